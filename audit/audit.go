@@ -0,0 +1,273 @@
+// Package audit records security-relevant events: who logged in, uploaded,
+// downloaded or deleted what, from where, and whether it worked. The log is
+// append-only; the table rejects updates and deletes. Every event carries
+// the hash of the one before it, so edits that bypass the table show up in
+// Verify.
+package audit
+
+import (
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"go-secure-file-management/db"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Actions, named <area>.<verb>.
+const (
+	ActionLogin        = "auth.login"
+	ActionRegister     = "auth.register"
+	ActionUpload       = "file.upload"
+	ActionUploadReject = "file.upload_rejected"
+	ActionDownload     = "file.download"
+	ActionDelete       = "file.delete"
+	ActionRename       = "file.rename"
+	ActionSettings     = "user.settings"
+	ActionAuditQuery   = "admin.audit_query"
+	ActionAuditExport  = "admin.audit_export"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	// OutcomeDenied is a refusal by a rule, e.g. the file policy or a scan
+	OutcomeDenied = "denied"
+)
+
+const (
+	DefaultLimit = 50
+	MaxLimit     = 500
+
+	timeLayout = "2006-01-02 15:04:05"
+)
+
+type Event struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Action    string    `json:"action"`
+	Outcome   string    `json:"outcome"`
+	ActorId   uint      `json:"actor_id,omitempty"` // 0 when not logged in
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	FileId    int       `json:"file_id,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	PrevHash  string    `json:"prev_hash"`
+	Hash      string    `json:"hash"`
+}
+
+// Filter selects events, newest first. Zero values don't filter.
+type Filter struct {
+	ActorId uint
+	Action  string
+	Outcome string
+	FileId  int
+	Since   time.Time
+	Until   time.Time
+	// Before is the id of the last event of the previous page
+	Before int64
+	Limit  int
+}
+
+type Logger struct {
+	DB *sql.DB
+	// Key signs checkpoints, see RunCheckpoints. Without it none are
+	// written.
+	Key ed25519.PrivateKey
+
+	dialect db.Dialect
+	mu      sync.Mutex
+	mirror  *os.File
+}
+
+func NewLogger(conn *sql.DB) *Logger {
+	return &Logger{DB: conn, dialect: db.DialectOf(conn)}
+}
+
+// MirrorTo additionally appends every event to path as a JSON line, e.g.
+// for shipping to a log collector.
+func (l *Logger) MirrorTo(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit mirror: %v", err)
+	}
+
+	l.mu.Lock()
+	l.mirror = f
+	l.mu.Unlock()
+	return nil
+}
+
+// Record stores an event, chained to the last one.
+func (l *Logger) Record(e Event) error {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	e.CreatedAt = e.CreatedAt.UTC().Truncate(time.Second)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.insert(&e); err != nil {
+		return fmt.Errorf("failed to record audit event: %v", err)
+	}
+
+	if l.mirror != nil {
+		line, _ := json.Marshal(e)
+		if _, err := l.mirror.Write(append(line, '\n')); err != nil {
+			log.Printf("Failed to mirror audit event %d: %v", e.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// chainLock serializes appending to the chain in the database, so replicas
+// sharing it can't both extend the same last event.
+const chainLock = "audit_chain"
+
+// insert assigns the event the id after the last one and chains it to that
+// event's hash.
+func (l *Logger) insert(e *Event) error {
+	tx, err := l.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := l.dialect.Lock(tx, chainLock); err != nil {
+		return err
+	}
+
+	var lastId int64
+	err = tx.QueryRow("SELECT id, hash FROM audit_log ORDER BY id DESC LIMIT 1").Scan(&lastId, &e.PrevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	e.ID = lastId + 1
+	e.Hash = e.ComputeHash()
+
+	_, err = tx.Exec(l.dialect.Rebind(`
+		INSERT INTO audit_log (id, created_at, action, outcome, actor_id, ip, user_agent, file_id, detail, prev_hash, hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		e.ID, e.CreatedAt.Format(timeLayout), e.Action, e.Outcome, e.ActorId, e.IP, e.UserAgent, e.FileId, e.Detail, e.PrevHash, e.Hash)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// FromRequest starts an event for the current request: the actor is the
+// logged in user, if any.
+func FromRequest(c *gin.Context, action, outcome string) Event {
+	return Event{
+		Action:    action,
+		Outcome:   outcome,
+		ActorId:   c.GetUint("userId"),
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	}
+}
+
+// Log records an event. An event that can't be recorded is written to the
+// server log in full, so it can be recovered, and the error is returned:
+// callers about to grant access should refuse instead, other callers may
+// carry on.
+func (l *Logger) Log(e Event) error {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	err := l.Record(e)
+	if err != nil {
+		line, _ := json.Marshal(e)
+		log.Printf("Audit event not recorded: %s: %v", line, err)
+	}
+	return err
+}
+
+// Request logs an event for the current request, see FromRequest and Log.
+func (l *Logger) Request(c *gin.Context, action, outcome string, fileId int, detail string) error {
+	e := FromRequest(c, action, outcome)
+	e.FileId = fileId
+	e.Detail = detail
+	return l.Log(e)
+}
+
+// Query returns the events matching f, newest first.
+func (l *Logger) Query(f Filter) ([]Event, error) {
+	var where []string
+	var args []interface{}
+
+	if f.ActorId != 0 {
+		where = append(where, "actor_id = ?")
+		args = append(args, f.ActorId)
+	}
+	if f.Action != "" {
+		where = append(where, "action = ?")
+		args = append(args, f.Action)
+	}
+	if f.Outcome != "" {
+		where = append(where, "outcome = ?")
+		args = append(args, f.Outcome)
+	}
+	if f.FileId != 0 {
+		where = append(where, "file_id = ?")
+		args = append(args, f.FileId)
+	}
+	if !f.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, f.Since.UTC().Format(timeLayout))
+	}
+	if !f.Until.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, f.Until.UTC().Format(timeLayout))
+	}
+	if f.Before != 0 {
+		where = append(where, "id < ?")
+		args = append(args, f.Before)
+	}
+
+	limit := f.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	limit = min(limit, MaxLimit)
+
+	query := "SELECT " + eventColumns + " FROM audit_log"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := l.DB.Query(l.dialect.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+const eventColumns = "id, created_at, action, outcome, actor_id, ip, user_agent, file_id, detail, prev_hash, hash"
+
+func scanEvent(rows *sql.Rows) (Event, error) {
+	var e Event
+	err := rows.Scan(&e.ID, &e.CreatedAt, &e.Action, &e.Outcome, &e.ActorId, &e.IP, &e.UserAgent, &e.FileId, &e.Detail, &e.PrevHash, &e.Hash)
+	return e, err
+}
@@ -0,0 +1,65 @@
+package audit_test
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"testing"
+
+	"go-secure-file-management/audit"
+	"go-secure-file-management/db/dbtest"
+)
+
+// Loggers with their own mutex stand in for replicas sharing the database.
+func TestRecordFromConcurrentReplicas(t *testing.T) {
+	dbtest.Run(t, dbtest.Migrated, func(t *testing.T, conn *sql.DB) {
+		const replicas, events = 4, 25
+
+		var wg sync.WaitGroup
+		errs := make(chan error, replicas*events)
+		for r := 0; r < replicas; r++ {
+			logger := audit.NewLogger(conn)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < events; i++ {
+					errs <- logger.Record(audit.Event{
+						Action:  audit.ActionDownload,
+						Outcome: audit.OutcomeSuccess,
+						ActorId: uint(r + 1),
+						Detail:  fmt.Sprintf("replica %d event %d", r, i),
+					})
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatalf("Record: %v", err)
+			}
+		}
+
+		report, err := audit.NewLogger(conn).Verify(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Events != replicas*events || report.LastEventId != replicas*events {
+			t.Errorf("chain has %d events ending at %d, want %d", report.Events, report.LastEventId, replicas*events)
+		}
+		if len(report.Findings) > 0 {
+			t.Errorf("chain of concurrent events doesn't verify: %+v", report.Findings)
+		}
+	})
+}
+
+func TestLogReturnsFailure(t *testing.T) {
+	dbtest.Run(t, dbtest.Migrated, func(t *testing.T, conn *sql.DB) {
+		logger := audit.NewLogger(conn)
+		conn.Close()
+
+		if err := logger.Log(audit.Event{Action: audit.ActionLogin, Outcome: audit.OutcomeSuccess}); err == nil {
+			t.Fatal("Log on a closed database returned no error")
+		}
+	})
+}
@@ -0,0 +1,227 @@
+package audit
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// DefaultCheckpointInterval is how often the head of the chain is signed.
+const DefaultCheckpointInterval = time.Hour
+
+// Checkpoint is a signed statement that the chain ended in Hash at EventId.
+// Rewriting the chain up to it would need the server key.
+type Checkpoint struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	EventId   int64     `json:"event_id"`
+	Hash      string    `json:"hash"`
+	PublicKey string    `json:"public_key"` // base64
+	Signature string    `json:"signature"`  // base64
+}
+
+// hashedEvent fixes the fields covered by an event's hash and their order.
+type hashedEvent struct {
+	ID        int64  `json:"id"`
+	CreatedAt string `json:"created_at"`
+	Action    string `json:"action"`
+	Outcome   string `json:"outcome"`
+	ActorId   uint   `json:"actor_id"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+	FileId    int    `json:"file_id"`
+	Detail    string `json:"detail"`
+}
+
+// ComputeHash returns the SHA-256 of the previous hash and the event's
+// fields, hex encoded. The id is included, so moving an event breaks the
+// chain as well.
+func (e Event) ComputeHash() string {
+	fields, _ := json.Marshal(hashedEvent{
+		ID:        e.ID,
+		CreatedAt: e.CreatedAt.UTC().Format(timeLayout),
+		Action:    e.Action,
+		Outcome:   e.Outcome,
+		ActorId:   e.ActorId,
+		IP:        e.IP,
+		UserAgent: e.UserAgent,
+		FileId:    e.FileId,
+		Detail:    e.Detail,
+	})
+
+	hasher := sha256.New()
+	hasher.Write([]byte(e.PrevHash))
+	hasher.Write([]byte{'\n'})
+	hasher.Write(fields)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func (c Checkpoint) message() []byte {
+	return []byte(fmt.Sprintf("audit-checkpoint\n%d\n%s\n%s", c.EventId, c.Hash, c.CreatedAt.UTC().Format(timeLayout)))
+}
+
+// ParseSigningKey decodes a base64 ed25519 seed, e.g. from
+// `openssl rand -base64 32`.
+func ParseSigningKey(encoded string) (ed25519.PrivateKey, error) {
+	seed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("signing key is not base64: %v", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("signing key must be %d bytes, got %d", ed25519.SeedSize, len(seed))
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ParsePublicKey decodes a base64 ed25519 public key.
+func ParsePublicKey(encoded string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("public key is not base64: %v", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key must be %d bytes, got %d", ed25519.PublicKeySize, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// RunCheckpoints signs the head of the chain every interval until ctx is
+// done.
+func (l *Logger) RunCheckpoints(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := l.Checkpoint(); err != nil {
+			log.Printf("Failed to write audit checkpoint: %v", err)
+		}
+	}
+}
+
+// Checkpoint signs the last event. It returns nil when there's no key or no
+// event since the last checkpoint.
+func (l *Logger) Checkpoint() (*Checkpoint, error) {
+	if l.Key == nil {
+		return nil, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var c Checkpoint
+	err := l.DB.QueryRow("SELECT id, hash FROM audit_log ORDER BY id DESC LIMIT 1").Scan(&c.EventId, &c.Hash)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var signed bool
+	err = l.DB.QueryRow(l.dialect.Rebind("SELECT EXISTS(SELECT 1 FROM audit_checkpoints WHERE event_id = ?)"), c.EventId).Scan(&signed)
+	if err != nil || signed {
+		return nil, err
+	}
+
+	c.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	c.PublicKey = base64.StdEncoding.EncodeToString(l.Key.Public().(ed25519.PublicKey))
+	c.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(l.Key, c.message()))
+
+	err = l.DB.QueryRow(l.dialect.Rebind(`
+		INSERT INTO audit_checkpoints (created_at, event_id, hash, public_key, signature)
+		VALUES (?, ?, ?, ?, ?) RETURNING id`),
+		c.CreatedAt.Format(timeLayout), c.EventId, c.Hash, c.PublicKey, c.Signature).Scan(&c.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Checkpoints returns all checkpoints, oldest first.
+func (l *Logger) Checkpoints() ([]Checkpoint, error) {
+	rows, err := l.DB.Query("SELECT id, created_at, event_id, hash, public_key, signature FROM audit_checkpoints ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var checkpoints []Checkpoint
+	for rows.Next() {
+		var c Checkpoint
+		if err := rows.Scan(&c.ID, &c.CreatedAt, &c.EventId, &c.Hash, &c.PublicKey, &c.Signature); err != nil {
+			return nil, err
+		}
+		checkpoints = append(checkpoints, c)
+	}
+	return checkpoints, rows.Err()
+}
+
+// ExportRecord is one line of an export: either an event or a checkpoint.
+type ExportRecord struct {
+	Event      *Event      `json:"event,omitempty"`
+	Checkpoint *Checkpoint `json:"checkpoint,omitempty"`
+}
+
+// Export writes the whole log as JSON lines, oldest first, each checkpoint
+// right after the event it signs. VerifyExport checks the result without
+// access to the database.
+func (l *Logger) Export(w io.Writer) error {
+	checkpoints, err := l.Checkpoints()
+	if err != nil {
+		return err
+	}
+	pending := map[int64][]Checkpoint{}
+	for _, c := range checkpoints {
+		pending[c.EventId] = append(pending[c.EventId], c)
+	}
+
+	rows, err := l.DB.Query("SELECT " + eventColumns + " FROM audit_log ORDER BY id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	encoder := json.NewEncoder(w)
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return err
+		}
+		if err := encoder.Encode(ExportRecord{Event: &e}); err != nil {
+			return err
+		}
+		for _, c := range pending[e.ID] {
+			if err := encoder.Encode(ExportRecord{Checkpoint: &c}); err != nil {
+				return err
+			}
+		}
+		delete(pending, e.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// checkpoints of events that are gone, left in so Verify reports them
+	for _, c := range checkpoints {
+		if _, ok := pending[c.EventId]; ok {
+			if err := encoder.Encode(ExportRecord{Checkpoint: &c}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// Kinds of verification findings.
+const (
+	FindingGap          = "gap"          // events are missing between two ids
+	FindingReordered    = "reordered"    // an event or checkpoint is out of order
+	FindingChainBroken  = "chain_broken" // prev_hash isn't the previous event's hash
+	FindingModified     = "modified"     // an event's fields don't match its hash
+	FindingTruncated    = "truncated"    // a checkpoint signs an event that's gone
+	FindingCheckpoint   = "checkpoint_mismatch"
+	FindingBadSignature = "bad_signature"
+	FindingUntrustedKey = "untrusted_key" // signed with a key other than the trusted one
+)
+
+type VerifyFinding struct {
+	Kind    string `json:"kind"`
+	EventId int64  `json:"event_id"`
+	Detail  string `json:"detail"`
+}
+
+type VerifyReport struct {
+	Events      int   `json:"events"`
+	Checkpoints int   `json:"checkpoints"`
+	LastEventId int64 `json:"last_event_id"`
+	// SignaturesTrusted is false when no public key was given; signatures
+	// are then only checked against the key stored with each checkpoint.
+	SignaturesTrusted bool            `json:"signatures_trusted"`
+	Findings          []VerifyFinding `json:"findings"`
+}
+
+// verifier walks the chain oldest first. Edits after the last checkpoint
+// can be hidden by rehashing every later event; checkpoints bound that to
+// the checkpoint interval.
+type verifier struct {
+	key      ed25519.PublicKey
+	report   VerifyReport
+	lastHash string
+	// checkpoints of events not seen yet
+	pending map[int64][]Checkpoint
+}
+
+func newVerifier(key ed25519.PublicKey) *verifier {
+	return &verifier{
+		key:     key,
+		report:  VerifyReport{SignaturesTrusted: key != nil, Findings: []VerifyFinding{}},
+		pending: map[int64][]Checkpoint{},
+	}
+}
+
+func (v *verifier) add(kind string, eventId int64, format string, args ...interface{}) {
+	v.report.Findings = append(v.report.Findings, VerifyFinding{Kind: kind, EventId: eventId, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (v *verifier) event(e Event) {
+	v.report.Events++
+	lastId := v.report.LastEventId
+
+	if e.ComputeHash() != e.Hash {
+		v.add(FindingModified, e.ID, "content doesn't match its hash")
+	}
+
+	switch {
+	case e.ID <= lastId:
+		// the chain goes on from the latest event
+		v.add(FindingReordered, e.ID, "event %d follows event %d", e.ID, lastId)
+		return
+	case e.ID == lastId+2:
+		v.add(FindingGap, e.ID, "event %d is missing", lastId+1)
+	case e.ID != lastId+1:
+		v.add(FindingGap, e.ID, "events %d to %d are missing", lastId+1, e.ID-1)
+	case e.PrevHash != v.lastHash:
+		v.add(FindingChainBroken, e.ID, "prev_hash doesn't match the hash of event %d", lastId)
+	}
+
+	v.report.LastEventId = e.ID
+	v.lastHash = e.Hash
+
+	for _, c := range v.pending[e.ID] {
+		v.check(c, e.Hash)
+	}
+	delete(v.pending, e.ID)
+}
+
+func (v *verifier) checkpoint(c Checkpoint) {
+	switch {
+	case c.EventId == v.report.LastEventId:
+		v.check(c, v.lastHash)
+	case c.EventId > v.report.LastEventId:
+		v.pending[c.EventId] = append(v.pending[c.EventId], c)
+	default:
+		v.report.Checkpoints++
+		v.add(FindingReordered, c.EventId, "checkpoint %d follows event %d", c.ID, v.report.LastEventId)
+	}
+}
+
+// check compares a checkpoint to the hash its event has now.
+func (v *verifier) check(c Checkpoint, hash string) {
+	v.report.Checkpoints++
+	if c.Hash != hash {
+		v.add(FindingCheckpoint, c.EventId, "checkpoint %d signed a different hash", c.ID)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(c.Signature)
+	if err != nil {
+		v.add(FindingBadSignature, c.EventId, "checkpoint %d: signature is not base64", c.ID)
+		return
+	}
+	key, err := ParsePublicKey(c.PublicKey)
+	if err != nil {
+		v.add(FindingBadSignature, c.EventId, "checkpoint %d: %v", c.ID, err)
+		return
+	}
+	if !ed25519.Verify(key, c.message(), signature) {
+		v.add(FindingBadSignature, c.EventId, "checkpoint %d: signature doesn't verify", c.ID)
+		return
+	}
+	if v.key != nil && !v.key.Equal(key) {
+		v.add(FindingUntrustedKey, c.EventId, "checkpoint %d was signed with key %s", c.ID, c.PublicKey)
+	}
+}
+
+func (v *verifier) finish() VerifyReport {
+	var eventIds []int64
+	for eventId := range v.pending {
+		eventIds = append(eventIds, eventId)
+	}
+	slices.Sort(eventIds)
+
+	for _, eventId := range eventIds {
+		for _, c := range v.pending[eventId] {
+			v.report.Checkpoints++
+			v.add(FindingTruncated, eventId, "checkpoint %d signs event %d, the log ends at %d", c.ID, eventId, v.report.LastEventId)
+		}
+	}
+	return v.report
+}
+
+// Verify checks the chain and the checkpoints in the database. With a nil
+// key, signatures aren't checked against a trusted key.
+func (l *Logger) Verify(key ed25519.PublicKey) (VerifyReport, error) {
+	v := newVerifier(key)
+
+	checkpoints, err := l.Checkpoints()
+	if err != nil {
+		return v.report, err
+	}
+	for _, c := range checkpoints {
+		v.pending[c.EventId] = append(v.pending[c.EventId], c)
+	}
+
+	rows, err := l.DB.Query("SELECT " + eventColumns + " FROM audit_log ORDER BY id")
+	if err != nil {
+		return v.report, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return v.report, err
+		}
+		v.event(e)
+	}
+	if err := rows.Err(); err != nil {
+		return v.report, err
+	}
+
+	return v.finish(), nil
+}
+
+// VerifyExport checks an export written by Export, in the order of its
+// lines.
+func VerifyExport(r io.Reader, key ed25519.PublicKey) (VerifyReport, error) {
+	v := newVerifier(key)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var record ExportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return v.report, fmt.Errorf("line %d: %v", line, err)
+		}
+		switch {
+		case record.Event != nil:
+			v.event(*record.Event)
+		case record.Checkpoint != nil:
+			v.checkpoint(*record.Checkpoint)
+		default:
+			return v.report, fmt.Errorf("line %d: neither an event nor a checkpoint", line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return v.report, err
+	}
+
+	return v.finish(), nil
+}
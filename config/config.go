@@ -0,0 +1,470 @@
+// Package config loads the server settings from a YAML file, overridden by
+// environment variables, and validates them before anything is started.
+// Settings tagged reload:"true" take effect on SIGHUP, see Watch; the others
+// need a restart.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go-secure-file-management/audit"
+	"go-secure-file-management/db"
+	"go-secure-file-management/janitor"
+	"go-secure-file-management/jobs"
+	"go-secure-file-management/policy"
+	"go-secure-file-management/ratelimit"
+	"go-secure-file-management/scanner"
+	"io"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultPath is read when CONFIG_PATH isn't set, if it exists.
+const DefaultPath = "config.yaml"
+
+// startDir is the directory the server was started in. Relative paths are
+// resolved against it, also after Storage.Dir was entered.
+var startDir, _ = os.Getwd()
+
+type Config struct {
+	Server    Server    `yaml:"server"`
+	Database  Database  `yaml:"database"`
+	Auth      Auth      `yaml:"auth"`
+	Storage   Storage   `yaml:"storage"`
+	Scanner   Scanner   `yaml:"scanner"`
+	Jobs      Jobs      `yaml:"jobs"`
+	Janitor   Janitor   `yaml:"janitor"`
+	Audit     Audit     `yaml:"audit"`
+	RateLimit RateLimit `yaml:"rate_limit"`
+	// FilePolicy is the path of the JSON file type policy, see package
+	// policy. The file is read again on reload.
+	FilePolicy string `yaml:"file_policy" env:"FILE_POLICY_PATH" reload:"true"`
+
+	// Path is the file the config was read from, "" without one
+	Path string `yaml:"-"`
+}
+
+type Server struct {
+	Port int `yaml:"port" env:"PORT"`
+	// ClientURL is the frontend's origin, the only one CORS allows
+	ClientURL string `yaml:"client_url" env:"CLIENT_URL"`
+
+	// ReadHeaderTimeout bounds reading the request headers, against
+	// clients that send them slowly to hold connections open
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"SERVER_READ_HEADER_TIMEOUT"`
+	// ReadTimeout and WriteTimeout bound reading a whole request and
+	// writing its response, except on transfer routes; 0 means none
+	ReadTimeout  time.Duration `yaml:"read_timeout" env:"SERVER_READ_TIMEOUT"`
+	WriteTimeout time.Duration `yaml:"write_timeout" env:"SERVER_WRITE_TIMEOUT"`
+	// TransferTimeout replaces them on the upload and download routes,
+	// which may take long, especially with bandwidth limits; 0 means none
+	TransferTimeout time.Duration `yaml:"transfer_timeout" env:"SERVER_TRANSFER_TIMEOUT"`
+	// IdleTimeout closes keep-alive connections without requests
+	IdleTimeout time.Duration `yaml:"idle_timeout" env:"SERVER_IDLE_TIMEOUT"`
+	// ShutdownTimeout is how long running requests and background work
+	// get to finish on SIGTERM
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SERVER_SHUTDOWN_TIMEOUT"`
+	MaxHeaderBytes  int           `yaml:"max_header_bytes" env:"SERVER_MAX_HEADER_BYTES"`
+	BodyLimits      BodyLimits    `yaml:"body_limits"`
+}
+
+// BodyLimits are request body limits in bytes; 0 means unlimited.
+type BodyLimits struct {
+	Default int64 `yaml:"default" env:"BODY_LIMIT_DEFAULT"`
+	// Chunk applies to /upload-chunk
+	Chunk int64 `yaml:"chunk" env:"BODY_LIMIT_CHUNK"`
+	// Tus applies to tus PATCH requests, which are bounded by the
+	// upload's length anyway
+	Tus int64 `yaml:"tus" env:"BODY_LIMIT_TUS"`
+}
+
+type Database struct {
+	// URL is a postgres:// URL or a SQLite file, see db.DialectFor
+	URL string `yaml:"url" env:"DATABASE_URL"`
+}
+
+type Auth struct {
+	JWTSecret string `yaml:"jwt_secret" env:"JWT_SECRET"`
+}
+
+type Storage struct {
+	// Dir holds uploads/, quarantine/ and the default SQLite file. The
+	// server changes into it on start.
+	Dir string `yaml:"dir" env:"STORAGE_DIR"`
+}
+
+type Scanner struct {
+	// Kind is "none", "clamd" or "fake", see scanner.New
+	Kind         string `yaml:"kind" env:"SCANNER"`
+	ClamdAddress string `yaml:"clamd_address" env:"CLAMD_ADDRESS"`
+}
+
+type Jobs struct {
+	Workers int `yaml:"workers" env:"JOB_WORKERS"`
+	// Lease is how soon the job of a worker that died is run again
+	Lease time.Duration `yaml:"lease" env:"JOB_LEASE"`
+}
+
+type Janitor struct {
+	Interval time.Duration `yaml:"interval" env:"JANITOR_INTERVAL"`
+	// SessionTTL is how long an upload session may sit idle
+	SessionTTL time.Duration `yaml:"session_ttl" env:"UPLOAD_SESSION_TTL"`
+	DryRun     bool          `yaml:"dry_run" env:"JANITOR_DRY_RUN"`
+}
+
+type Audit struct {
+	// LogPath mirrors the audit log to a JSON lines file
+	LogPath string `yaml:"log_path" env:"AUDIT_LOG_PATH"`
+	// SigningKey is a base64 ed25519 seed, checkpoints are off without it
+	SigningKey         string        `yaml:"signing_key" env:"AUDIT_SIGNING_KEY"`
+	CheckpointInterval time.Duration `yaml:"checkpoint_interval" env:"AUDIT_CHECKPOINT_INTERVAL"`
+}
+
+type RateLimit struct {
+	// RedisURL shares the buckets between replicas, they are kept in the
+	// process without it
+	RedisURL string `yaml:"redis_url" env:"RATE_LIMIT_REDIS_URL"`
+	// Limits maps the rate limited routes to their limit, see
+	// ratelimit.ParseLimit. RATE_LIMIT_<NAME> overrides them.
+	Limits map[string]string `yaml:"limits" reload:"true"`
+}
+
+// Default returns the settings used for whatever the file and environment
+// leave out.
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Port:              8080,
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       time.Minute,
+			WriteTimeout:      time.Minute,
+			TransferTimeout:   time.Hour,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   30 * time.Second,
+			MaxHeaderBytes:    64 << 10,
+			BodyLimits: BodyLimits{
+				Default: 1 << 20,
+				// a 64 MiB chunk and the multipart form around it
+				Chunk: 65 << 20,
+			},
+		},
+		Database: Database{
+			URL: db.DefaultDSN,
+		},
+		Storage: Storage{Dir: "."},
+		Scanner: Scanner{
+			Kind:         "none",
+			ClamdAddress: scanner.DefaultClamdAddress,
+		},
+		Jobs: Jobs{Workers: jobs.DefaultWorkers, Lease: jobs.DefaultLease},
+		Janitor: Janitor{
+			Interval:   janitor.DefaultInterval,
+			SessionTTL: janitor.DefaultTTL,
+		},
+		Audit: Audit{CheckpointInterval: audit.DefaultCheckpointInterval},
+		RateLimit: RateLimit{
+			Limits: map[string]string{
+				// per address, against password guessing
+				"auth": "10/1m",
+				// per user, every authenticated request
+				"api": "1200/1m,burst=200",
+				// per user, chunks and tus requests
+				"upload": "200/1m",
+			},
+		},
+	}
+}
+
+// PathFromEnv returns CONFIG_PATH, or DefaultPath when it exists, or "".
+func PathFromEnv() string {
+	if path := os.Getenv("CONFIG_PATH"); path != "" {
+		return path
+	}
+	if _, err := os.Stat(filepath.Join(startDir, DefaultPath)); err == nil {
+		return DefaultPath
+	}
+	return ""
+}
+
+// Load reads path over the defaults, applies the environment and validates
+// the result. Without a path only the environment is used.
+func Load(path string) (*Config, error) {
+	return load(path, true)
+}
+
+// LoadForCommand is Load for the CLI commands, which don't serve HTTP and
+// so don't need the server and auth settings.
+func LoadForCommand(path string) (*Config, error) {
+	return load(path, false)
+}
+
+func load(path string, server bool) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		path = resolve(path)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config: %v", err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		// a misspelled key would silently keep its default
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to parse config %s: %v", path, err)
+		}
+		cfg.Path = path
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	cfg.FilePolicy = resolve(cfg.FilePolicy)
+	cfg.Audit.LogPath = resolve(cfg.Audit.LogPath)
+	cfg.Storage.Dir = resolve(cfg.Storage.Dir)
+
+	if err := cfg.validate(server); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func resolve(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(startDir, path)
+}
+
+func (c *Config) applyEnv() error {
+	var errs []error
+	applyEnv(reflect.ValueOf(c).Elem(), &errs)
+
+	// older deployments enable clamd with a flag
+	if os.Getenv("SCANNER") == "" && os.Getenv("ENABLE_CLAMAV_SCAN") == "true" {
+		c.Scanner.Kind = "clamd"
+	}
+
+	limits := map[string]string{}
+	for name, limit := range c.RateLimit.Limits {
+		limits[name] = limit
+	}
+	for name := range Default().RateLimit.Limits {
+		if value := os.Getenv("RATE_LIMIT_" + strings.ToUpper(name)); value != "" {
+			limits[name] = value
+		}
+	}
+	c.RateLimit.Limits = limits
+
+	return errors.Join(errs...)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// applyEnv sets the fields tagged env:"NAME" from the environment. Unset and
+// empty variables keep the value.
+func applyEnv(v reflect.Value, errs *[]error) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			applyEnv(field, errs)
+			continue
+		}
+
+		name := v.Type().Field(i).Tag.Get("env")
+		value := os.Getenv(name)
+		if name == "" || value == "" {
+			continue
+		}
+
+		var err error
+		switch {
+		case field.Type() == durationType:
+			var d time.Duration
+			d, err = time.ParseDuration(value)
+			field.SetInt(int64(d))
+		case field.Kind() == reflect.Int, field.Kind() == reflect.Int64:
+			var n int64
+			n, err = strconv.ParseInt(value, 10, field.Type().Bits())
+			field.SetInt(n)
+		case field.Kind() == reflect.Bool:
+			var b bool
+			b, err = strconv.ParseBool(value)
+			field.SetBool(b)
+		case field.Kind() == reflect.String:
+			field.SetString(value)
+		}
+		if err != nil {
+			*errs = append(*errs, fmt.Errorf("%s: %q isn't a valid %s", name, value, field.Type()))
+		}
+	}
+}
+
+// Validate checks every setting and reports all problems at once.
+func (c *Config) Validate() error {
+	return c.validate(true)
+}
+
+func (c *Config) validate(server bool) error {
+	var errs []error
+	fail := func(key, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+
+	if server {
+		if c.Server.Port < 1 || c.Server.Port > 65535 {
+			fail("server.port", "must be between 1 and 65535, got %d", c.Server.Port)
+		}
+		if u, err := url.Parse(c.Server.ClientURL); c.Server.ClientURL == "" {
+			fail("server.client_url", "is required, set it or CLIENT_URL to the frontend's origin")
+		} else if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("server.client_url", "%q must be an http(s) origin like https://files.example.com", c.Server.ClientURL)
+		}
+
+		if c.Server.ReadHeaderTimeout <= 0 {
+			fail("server.read_header_timeout", "must be positive, got %s", c.Server.ReadHeaderTimeout)
+		}
+		if c.Server.ShutdownTimeout <= 0 {
+			fail("server.shutdown_timeout", "must be positive, got %s", c.Server.ShutdownTimeout)
+		}
+		timeouts := map[string]time.Duration{
+			"server.read_timeout":     c.Server.ReadTimeout,
+			"server.write_timeout":    c.Server.WriteTimeout,
+			"server.transfer_timeout": c.Server.TransferTimeout,
+			"server.idle_timeout":     c.Server.IdleTimeout,
+		}
+		for _, key := range slices.Sorted(maps.Keys(timeouts)) {
+			if timeouts[key] < 0 {
+				fail(key, "must not be negative, got %s", timeouts[key])
+			}
+		}
+		if c.Server.MaxHeaderBytes <= 0 {
+			fail("server.max_header_bytes", "must be positive, got %d", c.Server.MaxHeaderBytes)
+		}
+		limits := c.Server.BodyLimits
+		if limits.Default < 0 || limits.Chunk < 0 || limits.Tus < 0 {
+			fail("server.body_limits", "must not be negative")
+		}
+
+		if c.Auth.JWTSecret == "" {
+			fail("auth.jwt_secret", "is required, set it or JWT_SECRET, e.g. to the output of `openssl rand -base64 32`")
+		}
+	}
+
+	if c.Database.URL == "" {
+		fail("database.url", "must not be empty")
+	}
+
+	if info, err := os.Stat(c.Storage.Dir); err != nil {
+		fail("storage.dir", "%v", err)
+	} else if !info.IsDir() {
+		fail("storage.dir", "%s is not a directory", c.Storage.Dir)
+	}
+
+	switch c.Scanner.Kind {
+	case "none", "fake":
+	case "clamd":
+		if _, err := scanner.NewClamd(c.Scanner.ClamdAddress); err != nil {
+			fail("scanner.clamd_address", "%v", err)
+		}
+	default:
+		fail("scanner.kind", "must be none, clamd or fake, got %q", c.Scanner.Kind)
+	}
+
+	if c.Jobs.Workers < 1 {
+		fail("jobs.workers", "must be at least 1, got %d", c.Jobs.Workers)
+	}
+	// leases are stored in whole seconds and renewed every quarter
+	if c.Jobs.Lease < 10*time.Second {
+		fail("jobs.lease", "must be at least 10s, got %s", c.Jobs.Lease)
+	}
+	if c.Janitor.Interval <= 0 {
+		fail("janitor.interval", "must be positive, got %s", c.Janitor.Interval)
+	}
+	if c.Janitor.SessionTTL <= 0 {
+		fail("janitor.session_ttl", "must be positive, got %s", c.Janitor.SessionTTL)
+	}
+
+	if c.Audit.SigningKey != "" {
+		if _, err := audit.ParseSigningKey(c.Audit.SigningKey); err != nil {
+			fail("audit.signing_key", "%v", err)
+		}
+	}
+	if c.Audit.CheckpointInterval <= 0 {
+		fail("audit.checkpoint_interval", "must be positive, got %s", c.Audit.CheckpointInterval)
+	}
+
+	if c.RateLimit.RedisURL != "" {
+		if store, err := ratelimit.NewRedisStore(c.RateLimit.RedisURL); err != nil {
+			fail("rate_limit.redis_url", "%v", err)
+		} else {
+			store.Client.Close()
+		}
+	}
+	known := Default().RateLimit.Limits
+	names := make([]string, 0, len(c.RateLimit.Limits))
+	for name := range c.RateLimit.Limits {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if _, ok := known[name]; !ok {
+			fail("rate_limit.limits."+name, "unknown route, the rate limited ones are auth, api and upload")
+			continue
+		}
+		if _, err := ratelimit.ParseLimit(c.RateLimit.Limits[name]); err != nil {
+			fail("rate_limit.limits."+name, "%v", err)
+		}
+	}
+
+	if _, err := policy.Load(c.FilePolicy); err != nil {
+		fail("file_policy", "%v", err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// RateLimits parses the rate limits, which Validate has checked.
+func (c *Config) RateLimits() map[string]ratelimit.Limit {
+	limits := map[string]ratelimit.Limit{}
+	for name, spec := range c.RateLimit.Limits {
+		limits[name], _ = ratelimit.ParseLimit(spec)
+	}
+	return limits
+}
+
+// RestartRequired lists the settings that differ between c and next but
+// only take effect on restart.
+func (c *Config) RestartRequired(next *Config) []string {
+	var keys []string
+	diff(reflect.ValueOf(c).Elem(), reflect.ValueOf(next).Elem(), "", &keys)
+	return keys
+}
+
+func diff(a, b reflect.Value, prefix string, keys *[]string) {
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "-" || field.Tag.Get("reload") == "true" {
+			continue
+		}
+		if field.Type.Kind() == reflect.Struct && field.Type != durationType {
+			diff(a.Field(i), b.Field(i), prefix+name+".", keys)
+			continue
+		}
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			*keys = append(*keys, prefix+name)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// Watch loads the configuration again on SIGHUP until ctx is done, e.g.
+// after `kill -HUP <pid>`. A valid one is handed to apply, which takes over
+// the settings tagged reload:"true"; changes to the others are logged and
+// wait for a restart. An invalid one is logged and the running one kept.
+func Watch(ctx context.Context, running *Config, apply func(next *Config) error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+		}
+
+		next, err := Load(running.Path)
+		if err != nil {
+			log.Printf("Failed to reload config, keeping the running one: %v", err)
+			continue
+		}
+		if keys := running.RestartRequired(next); len(keys) > 0 {
+			log.Printf("Config changes to %s take effect on restart", strings.Join(keys, ", "))
+		}
+		if err := apply(next); err != nil {
+			log.Printf("Failed to apply reloaded config: %v", err)
+			continue
+		}
+		log.Println("Config reloaded")
+	}
+}
@@ -3,52 +3,114 @@ package db
 import (
 	"database/sql"
 	"log"
+	"net/url"
+	"strings"
 
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 )
 
-var DB *sql.DB
+// Init opens the database and brings its schema up to date.
+func Init(dataSourceName string) *sql.DB {
+	conn := Open(dataSourceName)
 
-func Init(dataSourceName string) {
-	var err error
-	DB, err = sql.Open("sqlite3", dataSourceName)
+	applied, err := MigrateUp(conn, 0)
+	if err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+	for _, m := range applied {
+		log.Printf("Applied migration %d_%s", m.Version, m.Name)
+	}
+	if err := InitSearchSchema(conn); err != nil {
+		log.Fatalf("Failed to initialize search schema: %v", err)
+	}
+	log.Println("Database schema initialized")
+
+	return conn
+}
+
+// Open connects without touching the schema, for the migrate command. The
+// dialect is picked by DialectFor.
+func Open(dataSourceName string) *sql.DB {
+	dialect := DialectFor(dataSourceName)
+	if dialect == Postgres {
+		dataSourceName = withUTC(dataSourceName)
+	}
+
+	conn, err := sql.Open(dialect.Driver, dataSourceName)
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
 
-	if err = DB.Ping(); err != nil {
+	if err = conn.Ping(); err != nil {
 		log.Fatalf("Failed to ping database: %v", err)
 	}
 
-	log.Println("Database connection established")
+	log.Printf("Database connection established (%s)", dialect.Name)
+	return conn
+}
 
-	initSchema()
+// withUTC sets the session time zone to UTC unless the DSN picks one, so
+// CURRENT_TIMESTAMP matches the UTC times the application writes.
+func withUTC(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return dsn
+	}
+	query := u.Query()
+	if query.Get("timezone") == "" {
+		query.Set("timezone", "UTC")
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
 }
 
-func initSchema() {
-	query := `
-		CREATE TABLE IF NOT EXISTS users (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			email TEXT,
-			password TEXT,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+// InitSearchSchema isn't a migration: which table the index uses depends on
+// how the sqlite3 driver was built. Postgres always uses the plain table.
+func InitSearchSchema(conn *sql.DB) error {
+	if DialectOf(conn) == Postgres {
+		return createSearchTable(conn)
+	}
+
+	_, err := conn.Exec(`
+		CREATE VIRTUAL TABLE IF NOT EXISTS files_fts USING fts5 (
+			filename,
+			tags,
+			content,
+			tokenize = 'unicode61 remove_diacritics 2'
 		);
+	`)
+	if err == nil {
+		return nil
+	}
+	if !strings.Contains(err.Error(), "no such module") {
+		return err
+	}
 
-		CREATE TABLE IF NOT EXISTS files (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id INTEGER,
-			path TEXT,
+	log.Println("WARNING: the sqlite3 driver was built without FTS5, search falls back to LIKE queries that scan the whole index. Build with `-tags sqlite_fts5`, e.g. `make build`.")
+	return createSearchTable(conn)
+}
+
+func createSearchTable(conn *sql.DB) error {
+	_, err := conn.Exec(`
+		CREATE TABLE IF NOT EXISTS files_search (
+			file_id INTEGER PRIMARY KEY,
 			filename TEXT,
-			size INTEGER,
-			mime_type TEXT,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+			tags TEXT,
+			content TEXT,
+			FOREIGN KEY (file_id) REFERENCES files (id) ON DELETE CASCADE
 		);
-	`
+	`)
+	return err
+}
 
-	_, err := DB.Exec(query)
-	if err != nil {
-		log.Fatalf("Failed to initialize schema: %v", err)
+// FullTextSearch reports whether the search index is an FTS5 table. The
+// sqlite3 driver only ships FTS5 when built with `-tags sqlite_fts5`;
+// otherwise the index falls back to a plain table queried with LIKE.
+func FullTextSearch(conn *sql.DB) bool {
+	if DialectOf(conn) != SQLite {
+		return false
 	}
-	log.Println("Database schema initialized")
+	_, err := conn.Exec("SELECT rowid FROM files_fts LIMIT 0")
+	return err == nil
 }
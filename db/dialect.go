@@ -0,0 +1,108 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// DefaultDSN is the SQLite file used when database.url isn't set.
+const DefaultDSN = "./my_db.db"
+
+// Dialect covers the SQL differences between the supported databases.
+// Queries are written with `?` placeholders and passed through Rebind.
+type Dialect struct {
+	// Name is also the directory of the dialect's migrations.
+	Name   string
+	Driver string
+}
+
+var (
+	SQLite   = Dialect{Name: "sqlite", Driver: "sqlite3"}
+	Postgres = Dialect{Name: "postgres", Driver: "postgres"}
+)
+
+// DialectFor picks the database by DSN: postgres:// and postgresql:// URLs
+// are Postgres, anything else is an SQLite file.
+func DialectFor(dsn string) Dialect {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return Postgres
+	}
+	return SQLite
+}
+
+// Rebind rewrites `?` placeholders to the dialect's, e.g. $1, $2 for
+// Postgres. Question marks inside quoted strings are left alone.
+func (d Dialect) Rebind(query string) string {
+	if d != Postgres {
+		return query
+	}
+
+	var b strings.Builder
+	b.Grow(len(query) + 16)
+	n := 0
+	var quote rune
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Like is the case-insensitive LIKE operator. SQLite's LIKE already
+// ignores ASCII case, Postgres needs ILIKE.
+func (d Dialect) Like() string {
+	if d == Postgres {
+		return "ILIKE"
+	}
+	return "LIKE"
+}
+
+// SkipLocked ends a SELECT of rows to claim. On Postgres it locks them and
+// skips rows another transaction is claiming, which would otherwise be
+// picked twice under READ COMMITTED. SQLite runs one writer at a time and
+// needs nothing.
+func (d Dialect) SkipLocked() string {
+	if d == Postgres {
+		return "FOR UPDATE SKIP LOCKED"
+	}
+	return ""
+}
+
+// DialectOf returns the dialect of an open database by its driver.
+func DialectOf(conn *sql.DB) Dialect {
+	if _, ok := conn.Driver().(*pq.Driver); ok {
+		return Postgres
+	}
+	return SQLite
+}
+
+// Lock takes the named lock until tx ends. It must come before anything
+// tx reads that the lock protects: the write makes SQLite take its write
+// lock and Postgres lock the row, so other transactions taking the lock
+// wait and then read what this one committed. Names are rows of the locks
+// table, added by migrations.
+func (d Dialect) Lock(tx *sql.Tx, name string) error {
+	result, err := tx.Exec(d.Rebind("UPDATE locks SET name = name WHERE name = ?"), name)
+	if err != nil {
+		return fmt.Errorf("failed to take lock %s: %v", name, err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("unknown lock %s", name)
+	}
+	return nil
+}
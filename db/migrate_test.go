@@ -0,0 +1,175 @@
+package db_test
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	"go-secure-file-management/db"
+	"go-secure-file-management/db/dbtest"
+)
+
+// baselineSchema is what db.initSchema created before migrations existed.
+const baselineSchema = `
+	CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		email TEXT,
+		password TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS files (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER,
+		path TEXT,
+		filename TEXT,
+		size INTEGER,
+		mime_type TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+	);
+`
+
+func TestMigrateUpAdoptsBaselineDatabase(t *testing.T) {
+	conn := dbtest.Empty(t, db.SQLite)
+	if _, err := conn.Exec(baselineSchema); err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, conn, "INSERT INTO users (email, password) VALUES ('a@b.co', 'x')")
+	mustExec(t, conn, "INSERT INTO files (user_id, path, filename, size, mime_type) VALUES (1, 'uploads/a', 'a.png', 10, 'image/png')")
+	mustExec(t, conn, "INSERT INTO files (user_id, path, filename, size, mime_type) VALUES (1, 'uploads/b', 'b.png', 32, 'image/png')")
+
+	applied, err := db.MigrateUp(conn, 0)
+	if err != nil {
+		t.Fatalf("MigrateUp on a baseline database: %v", err)
+	}
+	assertAllApplied(t, conn, applied)
+
+	var role string
+	var used int64
+	if err := conn.QueryRow("SELECT role, storage_used FROM users WHERE id = 1").Scan(&role, &used); err != nil {
+		t.Fatal(err)
+	}
+	if role != "user" || used != 42 {
+		t.Errorf("user after upgrade: role %q, storage_used %d; want \"user\", 42", role, used)
+	}
+
+	var status string
+	if err := conn.QueryRow("SELECT scan_status FROM files WHERE id = 1").Scan(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status != "pending" {
+		t.Errorf("scan_status after upgrade = %q, want pending", status)
+	}
+}
+
+func TestMigrateUpDownRoundTrip(t *testing.T) {
+	dbtest.Run(t, dbtest.Empty, func(t *testing.T, conn *sql.DB) {
+		applied, err := db.MigrateUp(conn, 0)
+		if err != nil {
+			t.Fatalf("MigrateUp: %v", err)
+		}
+		assertAllApplied(t, conn, applied)
+
+		if _, err := db.MigrateDown(conn, len(applied)); err != nil {
+			t.Fatalf("MigrateDown: %v", err)
+		}
+		statuses, err := db.MigrationStatuses(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range statuses {
+			if s.Applied {
+				t.Errorf("migration %d_%s still applied after rolling back everything", s.Version, s.Name)
+			}
+		}
+
+		if _, err := db.MigrateUp(conn, 0); err != nil {
+			t.Fatalf("MigrateUp after rolling back: %v", err)
+		}
+	})
+}
+
+func TestMigrateUpToTarget(t *testing.T) {
+	conn := dbtest.Empty(t, db.SQLite)
+
+	applied, err := db.MigrateUp(conn, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 3 || applied[2].Version != 3 {
+		t.Fatalf("MigrateUp(3) applied %v", versions(applied))
+	}
+
+	rest, err := db.MigrateUp(conn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) == 0 || rest[0].Version != 4 {
+		t.Fatalf("MigrateUp(0) after MigrateUp(3) applied %v", versions(rest))
+	}
+}
+
+func TestMigrateUpRefusesEditedMigration(t *testing.T) {
+	conn := dbtest.Empty(t, db.SQLite)
+	if _, err := db.MigrateUp(conn, 2); err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, conn, "UPDATE schema_migrations SET checksum = 'edited' WHERE version = 1")
+
+	if _, err := db.MigrateUp(conn, 0); !errors.Is(err, db.ErrChecksumMismatch) {
+		t.Fatalf("MigrateUp with an edited migration: err = %v, want ErrChecksumMismatch", err)
+	}
+	if _, err := db.MigrateDown(conn, 2); !errors.Is(err, db.ErrChecksumMismatch) {
+		t.Fatalf("MigrateDown over an edited migration: err = %v, want ErrChecksumMismatch", err)
+	}
+}
+
+func TestMigrationsMatchAcrossDialects(t *testing.T) {
+	sqlite, err := db.Migrations(db.SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	postgres, err := db.Migrations(db.Postgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sqlite) != len(postgres) {
+		t.Fatalf("sqlite has %d migrations, postgres %d", len(sqlite), len(postgres))
+	}
+	for i := range sqlite {
+		if sqlite[i].Version != postgres[i].Version || sqlite[i].Name != postgres[i].Name {
+			t.Errorf("migration %d: sqlite %d_%s, postgres %d_%s", i, sqlite[i].Version, sqlite[i].Name, postgres[i].Version, postgres[i].Name)
+		}
+		if sqlite[i].Down == "" || postgres[i].Down == "" {
+			t.Errorf("migration %d_%s has no down file", sqlite[i].Version, sqlite[i].Name)
+		}
+	}
+}
+
+func assertAllApplied(t *testing.T, conn *sql.DB, applied []db.Migration) {
+	t.Helper()
+
+	migrations, err := db.Migrations(db.DialectOf(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Fatalf("applied %v, want all %d migrations", versions(applied), len(migrations))
+	}
+}
+
+func versions(migrations []db.Migration) []int {
+	var v []int
+	for _, m := range migrations {
+		v = append(v, m.Version)
+	}
+	return v
+}
+
+func mustExec(t *testing.T, conn *sql.DB, query string) {
+	t.Helper()
+	if _, err := conn.Exec(query); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+}
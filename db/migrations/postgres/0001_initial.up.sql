@@ -0,0 +1,21 @@
+-- The Postgres version of sqlite/0001_initial.up.sql. Timestamps are UTC
+-- without time zone and whole seconds, like the text SQLite stores; keyset
+-- cursors compare against them at that precision.
+
+CREATE TABLE IF NOT EXISTS users (
+	id SERIAL PRIMARY KEY,
+	email TEXT,
+	password TEXT,
+	created_at TIMESTAMP DEFAULT LOCALTIMESTAMP(0)
+);
+
+CREATE TABLE IF NOT EXISTS files (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER,
+	path TEXT,
+	filename TEXT,
+	size BIGINT,
+	mime_type TEXT,
+	created_at TIMESTAMP DEFAULT LOCALTIMESTAMP(0),
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
@@ -0,0 +1,4 @@
+DROP INDEX idx_files_user_mime;
+DROP INDEX idx_files_user_size;
+DROP INDEX idx_files_user_filename;
+DROP INDEX idx_files_user_created;
@@ -0,0 +1,3 @@
+DROP INDEX idx_files_scan_status;
+ALTER TABLE files DROP COLUMN scan_signature;
+ALTER TABLE files DROP COLUMN scan_status;
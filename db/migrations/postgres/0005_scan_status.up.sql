@@ -0,0 +1,3 @@
+ALTER TABLE files ADD COLUMN scan_status TEXT NOT NULL DEFAULT 'pending';
+ALTER TABLE files ADD COLUMN scan_signature TEXT NOT NULL DEFAULT '';
+CREATE INDEX idx_files_scan_status ON files (scan_status);
@@ -0,0 +1,13 @@
+CREATE TABLE tus_uploads (
+	id TEXT PRIMARY KEY,
+	user_id INTEGER,
+	filename TEXT NOT NULL,
+	length BIGINT NOT NULL,
+	"offset" BIGINT NOT NULL DEFAULT 0,
+	metadata TEXT NOT NULL DEFAULT '',
+	job_id BIGINT,
+	expires_at TIMESTAMP NOT NULL,
+	created_at TIMESTAMP DEFAULT LOCALTIMESTAMP(0),
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX idx_tus_uploads_expires_at ON tus_uploads (expires_at);
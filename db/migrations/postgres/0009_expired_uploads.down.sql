@@ -0,0 +1,2 @@
+DROP INDEX idx_files_path;
+DROP TABLE expired_uploads;
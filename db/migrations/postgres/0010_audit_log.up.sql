@@ -0,0 +1,24 @@
+-- append-only: no foreign keys, deleting a user keeps their events
+CREATE TABLE audit_log (
+	id BIGSERIAL PRIMARY KEY,
+	created_at TIMESTAMP NOT NULL,
+	action TEXT NOT NULL,
+	outcome TEXT NOT NULL,
+	actor_id INTEGER NOT NULL DEFAULT 0,
+	ip TEXT NOT NULL DEFAULT '',
+	user_agent TEXT NOT NULL DEFAULT '',
+	file_id INTEGER NOT NULL DEFAULT 0,
+	detail TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX idx_audit_log_actor ON audit_log (actor_id, id);
+CREATE INDEX idx_audit_log_action ON audit_log (action, id);
+CREATE INDEX idx_audit_log_file ON audit_log (file_id, id);
+
+CREATE FUNCTION audit_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+	FOR EACH ROW EXECUTE FUNCTION audit_append_only();
@@ -0,0 +1,13 @@
+ALTER TABLE audit_log ADD COLUMN prev_hash TEXT NOT NULL DEFAULT '';
+ALTER TABLE audit_log ADD COLUMN hash TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE audit_checkpoints (
+	id SERIAL PRIMARY KEY,
+	created_at TIMESTAMP NOT NULL,
+	event_id BIGINT NOT NULL,
+	hash TEXT NOT NULL,
+	public_key TEXT NOT NULL,
+	signature TEXT NOT NULL
+);
+CREATE TRIGGER audit_checkpoints_append_only BEFORE UPDATE OR DELETE ON audit_checkpoints
+	FOR EACH ROW EXECUTE FUNCTION audit_append_only();
@@ -0,0 +1,6 @@
+-- One row per named lock, see Dialect.Lock. Updating a row serializes
+-- the transactions that take it, across every process using the database.
+CREATE TABLE locks (
+	name TEXT PRIMARY KEY
+);
+INSERT INTO locks (name) VALUES ('audit_chain');
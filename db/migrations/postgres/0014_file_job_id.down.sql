@@ -0,0 +1,2 @@
+DROP INDEX idx_files_job_id;
+ALTER TABLE files DROP COLUMN job_id;
@@ -0,0 +1,4 @@
+-- the upload job that stored the file; a retried job finds its file
+-- instead of storing it again
+ALTER TABLE files ADD COLUMN job_id BIGINT;
+CREATE UNIQUE INDEX idx_files_job_id ON files (job_id);
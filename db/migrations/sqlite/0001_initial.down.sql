@@ -0,0 +1,6 @@
+-- Drops the search index as well, it is created outside migrations.
+
+DROP TABLE IF EXISTS files_fts;
+DROP TABLE IF EXISTS files_search;
+DROP TABLE IF EXISTS files;
+DROP TABLE IF EXISTS users;
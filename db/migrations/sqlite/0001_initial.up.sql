@@ -0,0 +1,21 @@
+-- The schema before migrations existed, table for table. It keeps IF NOT
+-- EXISTS so those databases are adopted as version 1; everything added
+-- since goes into later migrations.
+
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	email TEXT,
+	password TEXT,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS files (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER,
+	path TEXT,
+	filename TEXT,
+	size INTEGER,
+	mime_type TEXT,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
@@ -0,0 +1,5 @@
+-- keyset pagination indexes, one per sortable column
+CREATE INDEX idx_files_user_created ON files (user_id, created_at, id);
+CREATE INDEX idx_files_user_filename ON files (user_id, filename, id);
+CREATE INDEX idx_files_user_size ON files (user_id, size, id);
+CREATE INDEX idx_files_user_mime ON files (user_id, mime_type);
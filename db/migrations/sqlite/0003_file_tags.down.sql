@@ -0,0 +1,2 @@
+DROP TABLE file_metadata;
+DROP TABLE file_tags;
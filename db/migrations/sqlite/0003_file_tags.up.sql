@@ -0,0 +1,16 @@
+CREATE TABLE file_tags (
+	file_id INTEGER,
+	tag TEXT,
+	PRIMARY KEY (file_id, tag),
+	FOREIGN KEY (file_id) REFERENCES files (id) ON DELETE CASCADE
+);
+CREATE INDEX idx_file_tags_tag ON file_tags (tag, file_id);
+
+CREATE TABLE file_metadata (
+	file_id INTEGER,
+	key TEXT,
+	value TEXT,
+	PRIMARY KEY (file_id, key),
+	FOREIGN KEY (file_id) REFERENCES files (id) ON DELETE CASCADE
+);
+CREATE INDEX idx_file_metadata_key ON file_metadata (key, value, file_id);
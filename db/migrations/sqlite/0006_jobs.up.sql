@@ -0,0 +1,19 @@
+CREATE TABLE jobs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER,
+	type TEXT NOT NULL,
+	payload TEXT NOT NULL,
+	state TEXT NOT NULL DEFAULT '',
+	status TEXT NOT NULL DEFAULT 'queued',
+	step TEXT NOT NULL DEFAULT '',
+	progress INTEGER NOT NULL DEFAULT 0,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	max_attempts INTEGER NOT NULL DEFAULT 5,
+	last_error TEXT NOT NULL DEFAULT '',
+	run_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	locked_until TIMESTAMP,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users (id)
+);
+CREATE INDEX idx_jobs_status_run_at ON jobs (status, run_at);
@@ -0,0 +1,3 @@
+ALTER TABLE files DROP COLUMN metadata_stripped;
+ALTER TABLE files DROP COLUMN original_sha256;
+ALTER TABLE users DROP COLUMN strip_metadata;
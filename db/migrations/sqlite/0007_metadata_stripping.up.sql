@@ -0,0 +1,4 @@
+-- NULL follows the policy
+ALTER TABLE users ADD COLUMN strip_metadata INTEGER;
+ALTER TABLE files ADD COLUMN original_sha256 TEXT NOT NULL DEFAULT '';
+ALTER TABLE files ADD COLUMN metadata_stripped INTEGER NOT NULL DEFAULT 0;
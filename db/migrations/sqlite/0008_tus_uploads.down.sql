@@ -0,0 +1 @@
+DROP TABLE tus_uploads;
@@ -0,0 +1,13 @@
+CREATE TABLE tus_uploads (
+	id TEXT PRIMARY KEY,
+	user_id INTEGER,
+	filename TEXT NOT NULL,
+	length INTEGER NOT NULL,
+	offset INTEGER NOT NULL DEFAULT 0,
+	metadata TEXT NOT NULL DEFAULT '',
+	job_id INTEGER,
+	expires_at TIMESTAMP NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX idx_tus_uploads_expires_at ON tus_uploads (expires_at);
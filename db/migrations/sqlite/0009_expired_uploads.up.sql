@@ -0,0 +1,12 @@
+CREATE TABLE expired_uploads (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER,
+	upload_id TEXT NOT NULL,
+	chunks INTEGER NOT NULL,
+	bytes INTEGER NOT NULL,
+	last_activity TIMESTAMP NOT NULL,
+	expired_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- the orphan sweep looks up stored files by path
+CREATE INDEX idx_files_path ON files (path);
@@ -0,0 +1,19 @@
+ALTER TABLE audit_log ADD COLUMN prev_hash TEXT NOT NULL DEFAULT '';
+ALTER TABLE audit_log ADD COLUMN hash TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE audit_checkpoints (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	created_at TIMESTAMP NOT NULL,
+	event_id INTEGER NOT NULL,
+	hash TEXT NOT NULL,
+	public_key TEXT NOT NULL,
+	signature TEXT NOT NULL
+);
+CREATE TRIGGER audit_checkpoints_no_update BEFORE UPDATE ON audit_checkpoints
+BEGIN
+	SELECT RAISE(ABORT, 'audit log is append-only');
+END;
+CREATE TRIGGER audit_checkpoints_no_delete BEFORE DELETE ON audit_checkpoints
+BEGIN
+	SELECT RAISE(ABORT, 'audit log is append-only');
+END;
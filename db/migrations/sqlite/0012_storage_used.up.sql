@@ -0,0 +1,4 @@
+-- bytes stored per user, kept up to date by the files repository
+ALTER TABLE users ADD COLUMN storage_used INTEGER NOT NULL DEFAULT 0;
+
+UPDATE users SET storage_used = (SELECT COALESCE(SUM(size), 0) FROM files WHERE files.user_id = users.id);
@@ -10,7 +10,7 @@ rm -rf $APP_NAME.gz
 
 # Build the Go binary
 echo "Building Golang app..."
-CGO_ENABLED=1 CC=x86_64-linux-musl-gcc GOOS=linux GOARCH=amd64 go build -o $APP_NAME
+CGO_ENABLED=1 CC=x86_64-linux-musl-gcc GOOS=linux GOARCH=amd64 go build -tags sqlite_fts5 -o $APP_NAME
 
 # Compress the binary
 gzip $APP_NAME
@@ -0,0 +1,76 @@
+package exif
+
+import (
+	"encoding/binary"
+)
+
+// Orientation values of TIFF tag 0x0112, see package thumbnail for their
+// meaning.
+const (
+	OrientationNormal = 1
+	OrientationMax    = 8
+
+	tagOrientation = 0x0112
+	typeShort      = 3
+)
+
+// Header starts the payload of a JPEG APP1 segment holding EXIF data.
+const Header = "Exif\x00\x00"
+
+// Orientation reads the orientation tag from IFD0 of a TIFF structure, the
+// body of an EXIF segment after Header. It returns OrientationNormal when
+// the tag is missing or invalid.
+func Orientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return OrientationNormal
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return OrientationNormal
+	}
+
+	offset := int64(order.Uint32(tiff[4:8]))
+	if offset+2 > int64(len(tiff)) {
+		return OrientationNormal
+	}
+	count := int64(order.Uint16(tiff[offset:]))
+
+	for i := int64(0); i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > int64(len(tiff)) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) != tagOrientation {
+			continue
+		}
+
+		value := int(order.Uint16(tiff[entry+8:]))
+		if value < OrientationNormal || value > OrientationMax {
+			return OrientationNormal
+		}
+		return value
+	}
+
+	return OrientationNormal
+}
+
+// OrientationOnly builds an EXIF segment payload (including Header) whose
+// only tag is the orientation, so a stripped photo still displays upright.
+func OrientationOnly(orientation int) []byte {
+	b := []byte(Header + "II*\x00")
+	b = binary.LittleEndian.AppendUint32(b, 8) // IFD0 right after the header
+	b = binary.LittleEndian.AppendUint16(b, 1) // one entry
+	b = binary.LittleEndian.AppendUint16(b, tagOrientation)
+	b = binary.LittleEndian.AppendUint16(b, typeShort)
+	b = binary.LittleEndian.AppendUint32(b, 1)
+	b = binary.LittleEndian.AppendUint16(b, uint16(orientation))
+	b = binary.LittleEndian.AppendUint16(b, 0) // value padding
+	b = binary.LittleEndian.AppendUint32(b, 0) // no next IFD
+	return b
+}
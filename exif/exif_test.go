@@ -0,0 +1,42 @@
+package exif_test
+
+import (
+	"testing"
+
+	"go-secure-file-management/exif"
+)
+
+func TestOrientation(t *testing.T) {
+	for orientation := exif.OrientationNormal; orientation <= exif.OrientationMax; orientation++ {
+		tiff := exif.OrientationOnly(orientation)[len(exif.Header):]
+		if got := exif.Orientation(tiff); got != orientation {
+			t.Errorf("round trip of %d: %d", orientation, got)
+		}
+	}
+
+	// big endian, with a make tag before the orientation
+	bigEndian := "MM\x00*\x00\x00\x00\x08" +
+		"\x00\x02" +
+		"\x01\x0f\x00\x02\x00\x00\x00\x04Cam\x00" +
+		"\x01\x12\x00\x03\x00\x00\x00\x01\x00\x03\x00\x00" +
+		"\x00\x00\x00\x00"
+	valid := exif.OrientationOnly(6)[len(exif.Header):]
+
+	for _, tc := range []struct {
+		name string
+		tiff string
+		want int
+	}{
+		{"big endian", bigEndian, 3},
+		{"empty", "", exif.OrientationNormal},
+		{"unknown byte order", "XX" + string(valid[2:]), exif.OrientationNormal},
+		{"IFD past the end", "II*\x00\xff\x00\x00\x00", exif.OrientationNormal},
+		{"truncated entry", string(valid[:15]), exif.OrientationNormal},
+		{"no orientation tag", bigEndian[:8] + "\x00\x01" + bigEndian[10:], exif.OrientationNormal},
+		{"invalid value", string(exif.OrientationOnly(9)[len(exif.Header):]), exif.OrientationNormal},
+	} {
+		if got := exif.Orientation([]byte(tc.tiff)); got != tc.want {
+			t.Errorf("%s: %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
@@ -87,7 +87,8 @@ function App() {
             signal,
           })
 
-          if (response.status === 201) {
+          // 202 means the last chunk arrived and the file is being processed
+          if (response.status === 201 || response.status === 202) {
             setUploadCount(prev => prev + 1)
             localUpdateCount++
           } else if (response.status === 422) {
@@ -128,7 +129,7 @@ function App() {
             body: data,
           })
 
-          if (response.status === 201) {
+          if (response.status === 201 || response.status === 202) {
             setIsSuccess(true)
             fetchData()
           } else if (response.status === 422) {
@@ -235,8 +236,14 @@ function App() {
   const fetchData = async () => {
     try {
       setIsFetching(true)
-      const response = await customFetch("/api/file")
-      if (response.status === 200) {
+      // the list is paged, follow the cursor to the last page
+      const files: FileList[] = []
+      let cursor = ""
+      do {
+        const params = new URLSearchParams({ limit: "100" })
+        if (cursor) params.set("cursor", cursor)
+        const response = await customFetch(`/api/file?${params}`)
+        if (response.status !== 200) return
         const parsedData = await response.json()
 
         const responseValidation = fileResponseSchema.safeParse(parsedData.data)
@@ -248,8 +255,11 @@ function App() {
           return
         }
 
-        setFileList(parsedData.data)
-      }
+        files.push(...parsedData.data)
+        cursor = parsedData.next_cursor
+      } while (cursor)
+
+      setFileList(files)
     } catch (error) {
       console.log("🚀 ~ fetchData ~ error:", error)
     } finally {
@@ -0,0 +1,332 @@
+// Package fsck checks that the files table and the stored files agree, and
+// optionally repairs what drifted apart.
+package fsck
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-secure-file-management/janitor"
+	"go-secure-file-management/models"
+	"go-secure-file-management/pipeline"
+	"go-secure-file-management/repositories"
+	"go-secure-file-management/scanner"
+	"go-secure-file-management/search"
+	"go-secure-file-management/thumbnail"
+	"go-secure-file-management/utils"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Kinds of findings.
+const (
+	MissingBlob  = "missing_blob"  // a row whose file is gone
+	OrphanBlob   = "orphan_blob"   // a stored file without a row
+	SizeMismatch = "size_mismatch" // the file's size differs from the row
+	HashMismatch = "hash_mismatch" // the file changed since it was uploaded
+	StaleTemp    = "stale_temp"    // chunks of an abandoned upload, or stray temp files
+)
+
+// Actions taken on findings.
+const (
+	ActionRowDeleted  = "row_deleted"
+	ActionSizeUpdated = "size_updated"
+	ActionQuarantined = "quarantined"
+	ActionDeleted     = "deleted"
+)
+
+// BlobAction decides what happens to orphaned and modified files.
+type BlobAction int
+
+const (
+	KeepBlobs BlobAction = iota
+	QuarantineBlobs
+	DeleteBlobs
+)
+
+type Options struct {
+	// Repair deletes rows of missing files, corrects sizes and removes
+	// stale temp chunks.
+	Repair bool
+	// Blobs is what happens to orphaned and modified files.
+	Blobs BlobAction
+	// Hash compares every file to the hash it was uploaded with, which
+	// reads all stored bytes.
+	Hash bool
+	// MinAge is how old orphaned files and temp chunks must be, so uploads
+	// in progress aren't reported.
+	MinAge time.Duration
+}
+
+type Finding struct {
+	Kind     string `json:"kind"`
+	Path     string `json:"path"`
+	FileId   int    `json:"file_id,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	Action   string `json:"action,omitempty"` // empty when left as it is
+	Error    string `json:"error,omitempty"`  // why the action failed
+}
+
+type Report struct {
+	CheckedAt time.Time `json:"checked_at"`
+	Files     int       `json:"files"` // rows checked
+	Findings  []Finding `json:"findings"`
+	// Unresolved counts findings no action was taken on
+	Unresolved int `json:"unresolved"`
+}
+
+type Checker struct {
+	Repo    repositories.FileStore
+	Indexer *search.Indexer
+	Janitor *janitor.Janitor
+}
+
+func New(repo repositories.FileStore, indexer *search.Indexer, uploadJanitor *janitor.Janitor) *Checker {
+	return &Checker{
+		Repo:    repo,
+		Indexer: indexer,
+		Janitor: uploadJanitor,
+	}
+}
+
+// Check compares every row with its file, looks for files without a row and
+// for stale temp chunks, applying opts to what it finds.
+func (c *Checker) Check(opts Options) (Report, error) {
+	report := Report{CheckedAt: time.Now().UTC(), Findings: []Finding{}}
+
+	files, err := c.Repo.GetAllFiles()
+	if err != nil {
+		return report, err
+	}
+	report.Files = len(files)
+
+	for _, file := range files {
+		if finding, ok := c.checkFile(file, opts); ok {
+			report.Findings = append(report.Findings, finding)
+		}
+	}
+
+	orphans, err := c.orphanBlobs(opts)
+	if err != nil {
+		return report, err
+	}
+	report.Findings = append(report.Findings, orphans...)
+
+	stale, err := c.staleTemp(opts)
+	if err != nil {
+		return report, err
+	}
+	report.Findings = append(report.Findings, stale...)
+
+	for _, finding := range report.Findings {
+		if finding.Action == "" || finding.Error != "" {
+			report.Unresolved++
+		}
+	}
+	return report, nil
+}
+
+// checkFile reports the first problem of a row, if any. Files still being
+// processed are skipped, the pipeline changes them.
+func (c *Checker) checkFile(file models.Files, opts Options) (Finding, bool) {
+	if file.ScanStatus == scanner.StatusPending {
+		return Finding{}, false
+	}
+	finding := Finding{Path: file.Path, FileId: file.ID}
+
+	info, err := os.Stat(file.Path)
+	if os.IsNotExist(err) {
+		finding.Kind = MissingBlob
+		if opts.Repair {
+			finding.resolve(ActionRowDeleted, c.deleteRow(file))
+		}
+		return finding, true
+	}
+	if err != nil {
+		finding.Kind = MissingBlob
+		finding.Error = err.Error()
+		return finding, true
+	}
+
+	// quarantined files are up for review as they are
+	if strings.HasPrefix(file.Path, filepath.Clean(utils.QuarantineDir)+string(filepath.Separator)) {
+		return Finding{}, false
+	}
+
+	// stripping metadata changes the content, the original hash no longer
+	// applies
+	if opts.Hash && file.OriginalSha256 != "" && !file.MetadataStripped {
+		sum, err := hashFile(file.Path)
+		if err != nil {
+			finding.Kind = HashMismatch
+			finding.Error = err.Error()
+			return finding, true
+		}
+		if sum != file.OriginalSha256 {
+			finding.Kind = HashMismatch
+			finding.Expected = file.OriginalSha256
+			finding.Actual = sum
+			c.handleModified(file, &finding, opts)
+			return finding, true
+		}
+	}
+
+	if info.Size() != int64(file.Size) {
+		finding.Kind = SizeMismatch
+		finding.Expected = fmt.Sprint(file.Size)
+		finding.Actual = fmt.Sprint(info.Size())
+		if opts.Repair {
+			finding.resolve(ActionSizeUpdated, c.Repo.SetSize(file.ID, info.Size()))
+		}
+		return finding, true
+	}
+
+	return Finding{}, false
+}
+
+// handleModified quarantines or deletes a file whose content changed. A
+// quarantined file keeps its row, marked as failed so it can't be
+// downloaded; a deleted one loses it.
+func (c *Checker) handleModified(file models.Files, finding *Finding, opts Options) {
+	switch opts.Blobs {
+	case QuarantineBlobs:
+		newPath, err := utils.QuarantineFile(file.Path, finding)
+		if err == nil {
+			thumbnail.Remove(file.Path)
+			err = c.Repo.SetScanResult(file.ID, scanner.StatusError, "fsck: "+HashMismatch, newPath)
+		}
+		finding.resolve(ActionQuarantined, err)
+	case DeleteBlobs:
+		err := os.Remove(file.Path)
+		if err == nil {
+			err = c.deleteRow(file)
+		}
+		finding.resolve(ActionDeleted, err)
+	}
+}
+
+func (c *Checker) deleteRow(file models.Files) error {
+	if err := c.Repo.DeleteFile(file.ID, uint(file.UserId)); err != nil {
+		return err
+	}
+	thumbnail.Remove(file.Path)
+	return c.Indexer.Remove(file.ID)
+}
+
+// orphanBlobs reports stored files and thumbnails no row points to.
+func (c *Checker) orphanBlobs(opts Options) ([]Finding, error) {
+	entries, err := os.ReadDir(janitor.UploadDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-opts.MinAge)
+	var findings []Finding
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		path := filepath.Join(janitor.UploadDir, entry.Name())
+		recordPath := path
+		if original, ok := thumbnail.Original(path); ok {
+			recordPath = original
+		}
+		exists, err := c.Repo.PathExists(recordPath)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			continue
+		}
+
+		finding := Finding{Kind: OrphanBlob, Path: path, Actual: fmt.Sprint(info.Size())}
+		switch opts.Blobs {
+		case QuarantineBlobs:
+			_, err := utils.QuarantineFile(path, finding)
+			finding.resolve(ActionQuarantined, err)
+		case DeleteBlobs:
+			finding.resolve(ActionDeleted, os.Remove(path))
+		}
+		findings = append(findings, finding)
+	}
+
+	return findings, nil
+}
+
+// staleTemp reports abandoned upload sessions through the janitor, which
+// removes and records them on repair.
+func (c *Checker) staleTemp(opts Options) ([]Finding, error) {
+	c.Janitor.TTL = opts.MinAge
+	c.Janitor.DryRun = !opts.Repair
+
+	report, err := c.Janitor.SweepTemp()
+	if err != nil {
+		return nil, err
+	}
+
+	var findings []Finding
+	for _, session := range report.ExpiredSessions {
+		findings = append(findings, Finding{
+			Kind:   StaleTemp,
+			Path:   pipeline.UploadDir(session.UserId, session.UploadId),
+			Actual: fmt.Sprint(session.Bytes),
+		})
+	}
+	for _, path := range report.OrphanTempFiles {
+		findings = append(findings, Finding{Kind: StaleTemp, Path: path})
+	}
+	if opts.Repair {
+		for i := range findings {
+			findings[i].Action = ActionDeleted
+		}
+	}
+
+	return findings, nil
+}
+
+func (f *Finding) resolve(action string, err error) {
+	f.Action = action
+	if err != nil {
+		f.Error = err.Error()
+	}
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// ParseBlobAction maps the CLI flags to a BlobAction.
+func ParseBlobAction(quarantine, delete bool) (BlobAction, error) {
+	switch {
+	case quarantine && delete:
+		return KeepBlobs, errors.New("-quarantine and -delete are mutually exclusive")
+	case quarantine:
+		return QuarantineBlobs, nil
+	case delete:
+		return DeleteBlobs, nil
+	}
+	return KeepBlobs, nil
+}
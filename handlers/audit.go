@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"fmt"
+	"go-secure-file-management/audit"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AuditHandler struct {
+	Log *audit.Logger
+}
+
+func NewAuditHandler(auditLog *audit.Logger) *AuditHandler {
+	return &AuditHandler{
+		Log: auditLog,
+	}
+}
+
+// ListEvents returns the audit log of every user to admins, newest first.
+// Looking at it is audited as well.
+func (h *AuditHandler) ListEvents(c *gin.Context) {
+	filter, err := parseAuditFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if value := c.Query("user_id"); value != "" {
+		userId, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user_id must be a positive integer"})
+			return
+		}
+		filter.ActorId = uint(userId)
+	}
+
+	if err := h.Log.Request(c, audit.ActionAuditQuery, audit.OutcomeSuccess, filter.FileId, c.Request.URL.RawQuery); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record audit query"})
+		return
+	}
+	h.respond(c, filter)
+}
+
+// Export streams the whole log with its checkpoints as JSON lines, see
+// audit.Logger.Export.
+func (h *AuditHandler) Export(c *gin.Context) {
+	if err := h.Log.Request(c, audit.ActionAuditExport, audit.OutcomeSuccess, 0, ""); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record audit export"})
+		return
+	}
+
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	c.Status(http.StatusOK)
+	if err := h.Log.Export(c.Writer); err != nil {
+		// the status is sent already, a truncated export fails verification
+		log.Printf("Failed to export audit log: %v", err)
+	}
+}
+
+// MyActivity returns the events the current user caused.
+func (h *AuditHandler) MyActivity(c *gin.Context) {
+	filter, err := parseAuditFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter.ActorId = c.GetUint("userId")
+
+	h.respond(c, filter)
+}
+
+func (h *AuditHandler) respond(c *gin.Context, filter audit.Filter) {
+	events, err := h.Log.Query(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = audit.DefaultLimit
+	}
+
+	// a full page may have more after it, starting before its oldest event
+	var nextBefore int64
+	if len(events) > 0 && len(events) == min(limit, audit.MaxLimit) {
+		nextBefore = events[len(events)-1].ID
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":        events,
+		"next_before": nextBefore,
+	})
+}
+
+// parseAuditFilter reads the `action`, `outcome`, `file_id`, `since`,
+// `until`, `before` and `limit` query params.
+func parseAuditFilter(c *gin.Context) (audit.Filter, error) {
+	filter := audit.Filter{
+		Action:  c.Query("action"),
+		Outcome: c.Query("outcome"),
+	}
+
+	intParams := []struct {
+		name string
+		dest func(int64)
+	}{
+		{"file_id", func(v int64) { filter.FileId = int(v) }},
+		{"before", func(v int64) { filter.Before = v }},
+		{"limit", func(v int64) { filter.Limit = int(v) }},
+	}
+	for _, p := range intParams {
+		value := c.Query(p.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			return filter, fmt.Errorf("%s must be a non-negative integer", p.name)
+		}
+		p.dest(parsed)
+	}
+
+	dateParams := []struct {
+		name     string
+		dest     *time.Time
+		endOfDay bool
+	}{
+		{"since", &filter.Since, false},
+		{"until", &filter.Until, true},
+	}
+	for _, p := range dateParams {
+		value := c.Query(p.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := parseDateParam(value, p.endOfDay)
+		if err != nil {
+			return filter, fmt.Errorf("%s must be an RFC 3339 timestamp or YYYY-MM-DD date", p.name)
+		}
+		*p.dest = parsed
+	}
+
+	return filter, nil
+}
@@ -0,0 +1,11 @@
+package handlers
+
+// HeldLocks is the number of uploads locked or waited for.
+func (h *FileHandler) HeldLocks() int {
+	return h.uploads.len()
+}
+
+// HeldLocks is the number of uploads locked or waited for.
+func (h *TusHandler) HeldLocks() int {
+	return h.locks.len()
+}
@@ -2,33 +2,85 @@ package handlers
 
 import (
 	"crypto/sha256"
-	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"go-secure-file-management/audit"
+	"go-secure-file-management/jobs"
+	"go-secure-file-management/models"
+	"go-secure-file-management/pipeline"
+	"go-secure-file-management/policy"
 	"go-secure-file-management/repositories"
+	"go-secure-file-management/scanner"
+	"go-secure-file-management/search"
+	"go-secure-file-management/throttle"
+	"go-secure-file-management/thumbnail"
 	"go-secure-file-management/utils"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
-	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// SearchIndex searches files and keeps the index up to date;
+// search.Indexer implements it.
+type SearchIndex interface {
+	Search(userId uint, opts search.Options) ([]search.Result, error)
+	Enqueue(fileId int)
+	Remove(fileId int) error
+}
+
+// JobQueue queues background jobs; jobs.Queue implements it.
+type JobQueue interface {
+	Enqueue(userId uint, jobType string, payload interface{}) (int64, error)
+}
+
+// AuditLog records audit events; audit.Logger implements it.
+type AuditLog interface {
+	Log(e audit.Event) error
+	Request(c *gin.Context, action, outcome string, fileId int, detail string) error
+}
+
+var (
+	_ SearchIndex = (*search.Indexer)(nil)
+	_ JobQueue    = (*jobs.Queue)(nil)
+	_ AuditLog    = (*audit.Logger)(nil)
+)
+
 type FileHandler struct {
-	Repo *repositories.FileRepository
+	Repo    repositories.FileStore
+	Indexer SearchIndex
+	Policy  *policy.Holder
+	Jobs    JobQueue
+	Audit   AuditLog
+	// shapes chunk uploads and downloads
+	Bandwidth *throttle.Shaper
+
+	// per upload directory, held while a chunk is added
+	uploads keyedMutex
 }
 
-func NewFileHandler(db *sql.DB) *FileHandler {
+func NewFileHandler(repo repositories.FileStore, indexer SearchIndex, filePolicy *policy.Holder, jobQueue JobQueue, auditLog AuditLog, bandwidth *throttle.Shaper) *FileHandler {
 	return &FileHandler{
-		Repo: repositories.NewFileRepository(db),
+		Repo:      repo,
+		Indexer:   indexer,
+		Policy:    filePolicy,
+		Jobs:      jobQueue,
+		Audit:     auditLog,
+		Bandwidth: bandwidth,
 	}
 }
 
+// MaxChunkSize bounds a single chunk; the frontend sends 500 KB chunks.
+const MaxChunkSize = 64 << 20
+
 type Metadata struct {
 	Order    int    `json:"order"`
 	FileId   string `json:"fileId"`
@@ -39,16 +91,26 @@ type Metadata struct {
 	CheckSum string `json:"checkSum"`
 }
 
+type RenameFileRequest struct {
+	Filename string `json:"filename" binding:"required,max=255"`
+}
+
 type GetFilesResponse struct {
-	ID        int    `json:"id"`
-	Filename  string `json:"filename"`
-	MimeType  string `json:"mime_type"`
-	Size      int    `json:"size"`
-	CreatedAt string `json:"created_at"`
+	ID         int    `json:"id"`
+	Filename   string `json:"filename"`
+	MimeType   string `json:"mime_type"`
+	Size       int    `json:"size"`
+	ScanStatus string `json:"scan_status"`
+	CreatedAt  string `json:"created_at"`
 }
 
+// CreateFile stores one chunk sent as multipart form: the chunk in `file`
+// and its Metadata as JSON in `metadata`.
 func (h *FileHandler) CreateFile(c *gin.Context) {
-	userId := c.GetUint("userId")
+	// the form is parsed from the body, it has to be throttled before
+	transfer := throttleUpload(c, h.Bandwidth, h.Policy.Current(), "")
+	defer transfer.Done()
+
 	file, err := c.FormFile("file")
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, errors.New(err.Error()))
@@ -70,129 +132,211 @@ func (h *FileHandler) CreateFile(c *gin.Context) {
 		return
 	}
 
-	expectedChecksum := metadata.CheckSum // handle checksum
-	hasher := sha256.New()
-	if _, err := io.Copy(hasher, openedFile); err != nil {
-		c.AbortWithError(http.StatusInternalServerError, errors.New("failed to read file content"))
+	h.storeChunk(c, metadata, openedFile, transfer)
+}
+
+// StreamChunk stores one chunk sent as the raw request body, with its
+// Metadata as JSON in the X-Upload-Metadata header. Unlike the multipart
+// form, the body is never buffered: it is hashed while being written.
+func (h *FileHandler) StreamChunk(c *gin.Context) {
+	var metadata Metadata
+	if err := json.Unmarshal([]byte(c.GetHeader("X-Upload-Metadata")), &metadata); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "X-Upload-Metadata must hold the chunk metadata as JSON"})
 		return
 	}
-	computedChecksum := hex.EncodeToString(hasher.Sum(nil))
 
-	if computedChecksum != expectedChecksum {
-		c.AbortWithError(http.StatusBadRequest, errors.New("invalid checksum value"))
+	chunkSize := int64(metadata.Limit - metadata.Offset)
+	if c.Request.ContentLength >= 0 && c.Request.ContentLength != chunkSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Content-Length doesn't match the chunk's offset and limit"})
 		return
 	}
+	transfer := throttleUpload(c, h.Bandwidth, h.Policy.Current(), metadata.FileName)
+	defer transfer.Done()
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, max(chunkSize, 0))
 
-	if err := c.SaveUploadedFile(file, fmt.Sprintf("./uploads/temp/%v_%v", metadata.Order, metadata.FileId)); err != nil {
-		c.AbortWithError(http.StatusInternalServerError, errors.New("failed to upload chunk file"))
+	h.storeChunk(c, metadata, c.Request.Body, transfer)
+}
+
+// storeChunk writes a chunk to the upload's directory, verifying its size
+// and checksum in the same pass. Chunks may arrive in any order and in
+// parallel; the chunk completing the file queues the upload pipeline, once.
+func (h *FileHandler) storeChunk(c *gin.Context, metadata Metadata, body io.Reader, transfer *throttle.Transfer) {
+	userId := c.GetUint("userId")
+
+	filename, err := utils.SanitizeFilename(metadata.FileName)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	metadata.FileName = filename
+	transfer.SetName(filename)
 
-	if metadata.FileSize == metadata.Limit {
-		chunks, err := filepath.Glob(filepath.Join("./uploads/temp", fmt.Sprintf("*_%s", metadata.FileId)))
-		if err != nil {
-			c.AbortWithError(http.StatusInternalServerError, errors.New("failed to finding chunk file"))
-			return
-		}
+	role := c.GetString("role")
+	if violation := h.Policy.Current().CheckDeclared(role, metadata.FileName, int64(metadata.FileSize)); violation != nil {
+		h.Audit.Request(c, audit.ActionUploadReject, audit.OutcomeDenied, 0, violation.Code+": "+metadata.FileName)
+		respondPolicyViolation(c, violation)
+		return
+	}
 
-		sort.Slice(chunks, func(i, j int) bool {
-			orderI, _ := strconv.Atoi(string(filepath.Base(chunks[i])[0]))
-			orderJ, _ := strconv.Atoi(string(filepath.Base(chunks[j])[0]))
+	if !pipeline.ValidUploadId(metadata.FileId) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": pipeline.ErrInvalidUploadId.Error()})
+		return
+	}
 
-			return orderI < orderJ
-		})
+	chunkSize := int64(metadata.Limit - metadata.Offset)
+	if metadata.Order < 0 || metadata.Offset < 0 || chunkSize <= 0 || chunkSize > MaxChunkSize || metadata.Limit > metadata.FileSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("chunks must be between 1 and %d bytes and lie within the file", MaxChunkSize)})
+		return
+	}
 
-		originalPath := filepath.Join("./uploads", metadata.FileName)
-		finalPath := utils.GetUniqueFilePath(originalPath)
+	dir := pipeline.UploadDir(userId, metadata.FileId)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, errors.New("failed to upload chunk file"))
+		return
+	}
 
-		finalFile, err := os.Create(finalPath)
-		if err != nil {
-			c.AbortWithError(http.StatusInternalServerError, errors.New("failed creating chunk file"))
+	tmp, err := os.CreateTemp(dir, ".chunk-*")
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, errors.New("failed to upload chunk file"))
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hasher := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tmp, hasher), io.LimitReader(body, chunkSize+1))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "chunk is larger than its offset and limit"})
 			return
 		}
-		defer finalFile.Close()
-
-		for _, chunk := range chunks {
-			chunkFile, err := os.Open(chunk)
-			if err != nil {
-				c.AbortWithError(http.StatusInternalServerError, errors.New(err.Error()))
-				return
-			}
-
-			_, err = io.Copy(finalFile, chunkFile)
-			chunkFile.Close()
-
-			if err != nil {
-				c.AbortWithError(http.StatusInternalServerError, errors.New(err.Error()))
-				return
-			}
-		}
+		c.AbortWithError(http.StatusInternalServerError, errors.New("failed to read file content"))
+		return
+	}
+	if written != chunkSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "chunk size doesn't match its offset and limit"})
+		return
+	}
 
-		for _, chunk := range chunks {
-			os.Remove(chunk)
-		}
+	expectedChecksum := metadata.CheckSum // handle checksum
+	computedChecksum := hex.EncodeToString(hasher.Sum(nil))
+	if computedChecksum != expectedChecksum {
+		c.AbortWithError(http.StatusBadRequest, errors.New("invalid checksum value"))
+		return
+	}
 
-		// virus scanning
-		if os.Getenv("ENABLE_CLAMAV_SCAN") == "true" {
-			isClean, err := utils.ScanFileWithClamav(finalPath)
-			if err != nil {
-				c.AbortWithError(http.StatusInternalServerError, errors.New("failed scanning file with clamav: "+err.Error()))
-				return
-			}
-
-			if !isClean {
-				if err := os.Remove(finalPath); err != nil {
-					c.AbortWithError(http.StatusInternalServerError, errors.New("failed to remove file from storage"))
-					return
-				}
-
-				c.AbortWithError(http.StatusConflict, errors.New("file is infected"))
-				return
-			}
-		}
+	if err := tmp.Close(); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, errors.New("failed to upload chunk file"))
+		return
+	}
 
-		finalFile, err = os.Open(finalPath)
-		if err != nil {
-			c.AbortWithError(http.StatusInternalServerError, errors.New("failed reopening final file: "+err.Error()))
-			return
-		}
-		defer finalFile.Close()
+	// the chunk is written, deciding whether it completes the upload has to
+	// happen one request at a time
+	unlock := h.uploads.Lock(dir)
+	defer unlock()
 
-		mimeValue, err := utils.GetMimeType(finalFile)
-		if err != nil {
-			c.AbortWithError(http.StatusInternalServerError, errors.New(err.Error()))
-			return
-		}
+	if _, err := os.Stat(filepath.Join(dir, pipeline.QueuedMarker)); err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "upload is already complete"})
+		return
+	}
 
-		// validate actual mimetype
-		isValidated := false
-		allowedTypes := []string{"image/png", "image/jpeg", "application/pdf"}
-		for _, allowed := range allowedTypes {
-			if mimeValue == allowed {
-				isValidated = true
-			}
-		}
+	fileSize, err := pipeline.PinSize(dir, int64(metadata.FileSize))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, errors.New("failed to upload chunk file"))
+		return
+	}
+	if fileSize != int64(metadata.FileSize) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("upload was started with a file size of %d bytes", fileSize)})
+		return
+	}
 
-		if !isValidated {
-			c.AbortWithError(http.StatusBadRequest, errors.New("invalid mimetype"))
-			return
-		}
+	chunks, err := pipeline.Chunks(dir)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, errors.New("failed to upload chunk file"))
+		return
+	}
+	if pipeline.Overlaps(chunks, int64(metadata.Offset), int64(metadata.Limit)) {
+		c.JSON(http.StatusConflict, gin.H{"error": "chunk overlaps another chunk of the upload"})
+		return
+	}
+	chunkPath := pipeline.ChunkPath(dir, int64(metadata.Offset), int64(metadata.Limit))
+	if err := os.Rename(tmp.Name(), chunkPath); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, errors.New("failed to upload chunk file"))
+		return
+	}
 
-		err = h.Repo.CreateFile(finalPath, userId, metadata.FileName, metadata.FileSize, mimeValue)
-		if err != nil {
-			c.AbortWithError(http.StatusInternalServerError, errors.New(err.Error()))
-			return
-		}
+	chunks, err = pipeline.Chunks(dir)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, errors.New("failed to upload chunk file"))
+		return
+	}
+	if !pipeline.Complete(chunks, int64(metadata.FileSize)) {
+		c.JSON(http.StatusCreated, gin.H{
+			"message": "Success Upload",
+		})
+		return
+	}
+
+	// the marker also keeps a second server process from queueing the
+	// upload again
+	marker, err := os.OpenFile(filepath.Join(dir, pipeline.QueuedMarker), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "upload is already complete"})
+		return
+	}
+	marker.Close()
+
+	// assembly, scanning and validation run in the background
+	jobId, err := h.Jobs.Enqueue(userId, pipeline.JobType, pipeline.Payload{
+		UploadId: metadata.FileId,
+		Filename: metadata.FileName,
+		Size:     metadata.FileSize,
+		Role:     role,
+	})
+	if err != nil {
+		os.Remove(marker.Name())
+		c.AbortWithError(http.StatusInternalServerError, errors.New(err.Error()))
+		return
+	}
+	h.Audit.Request(c, audit.ActionUpload, audit.OutcomeSuccess, 0, fmt.Sprintf("%s, job %d", metadata.FileName, jobId))
+	// lets the janitor tell a queued upload from an abandoned one
+	if err := os.WriteFile(marker.Name(), []byte(strconv.FormatInt(jobId, 10)), 0644); err != nil {
+		log.Printf("Failed to record job %d of upload %s: %v", jobId, dir, err)
+	}
 
-		println("Chunk upload complete, merging chunkable files...")
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":    "Upload complete, processing",
+		"job_id":     jobId,
+		"status_url": fmt.Sprintf("/api/jobs/%d", jobId),
+	})
+}
+
+// respondPolicyViolation rejects an upload with the machine-readable reason
+// in the `violation` field.
+func respondPolicyViolation(c *gin.Context, violation *policy.Violation) {
+	status := http.StatusUnsupportedMediaType
+	if violation.Code == policy.CodeSizeExceeded {
+		status = http.StatusRequestEntityTooLarge
 	}
 
-	c.SaveUploadedFile(file, "./uploads/temp/")
-	c.JSON(http.StatusCreated, gin.H{
-		"message": "Success Upload",
+	c.AbortWithStatusJSON(status, gin.H{
+		"error":     violation.Message,
+		"violation": violation,
 	})
 }
 
+// ownFile loads a file of the requesting user, responding 404 for files
+// that don't exist or belong to someone else.
+func (h *FileHandler) ownFile(c *gin.Context, fileId int) (models.Files, bool) {
+	file, err := h.Repo.GetFileById(fileId)
+	if err != nil || uint(file.UserId) != c.GetUint("userId") {
+		c.JSON(http.StatusNotFound, gin.H{"error": repositories.ErrFileNotFound.Error()})
+		return models.Files{}, false
+	}
+	return file, true
+}
+
 func (h *FileHandler) GetFileMetadata(c *gin.Context) {
 	fileId := c.Param("fileId")
 	if fileId == "" {
@@ -206,9 +350,20 @@ func (h *FileHandler) GetFileMetadata(c *gin.Context) {
 		return
 	}
 
-	file, err := h.Repo.GetFileById(parsedFileId)
+	file, ok := h.ownFile(c, parsedFileId)
+	if !ok {
+		return
+	}
+
+	file.Tags, err = h.Repo.GetTags(parsedFileId)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	file.Metadata, err = h.Repo.GetMetadata(parsedFileId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
@@ -220,27 +375,205 @@ func (h *FileHandler) GetFileMetadata(c *gin.Context) {
 func (h *FileHandler) GetFiles(c *gin.Context) {
 	userId := c.GetUint("userId")
 
-	files, err := h.Repo.GetFilesByUserId(userId)
+	opts, err := parseListFilesOptions(c)
 	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	page, err := h.Repo.ListFiles(userId, opts)
+	if err != nil {
+		if errors.Is(err, repositories.ErrInvalidCursor) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
 	response := make([]GetFilesResponse, 0)
-	for _, file := range files {
+	for _, file := range page.Files {
 		response = append(response, GetFilesResponse{
-			ID:        file.ID,
-			Filename:  file.Filename,
-			MimeType:  file.MimeType,
-			Size:      file.Size,
-			CreatedAt: file.CreatedAt,
+			ID:         file.ID,
+			Filename:   file.Filename,
+			MimeType:   file.MimeType,
+			Size:       file.Size,
+			ScanStatus: file.ScanStatus,
+			CreatedAt:  file.CreatedAt,
 		})
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"data": response,
+		"data":        response,
+		"total":       page.Total,
+		"next_cursor": page.NextCursor,
+	})
+}
+
+// parseListFilesOptions reads the paging, sorting and filter query params of GET /api/file.
+func parseListFilesOptions(c *gin.Context) (repositories.ListFilesOptions, error) {
+	opts := repositories.ListFilesOptions{
+		SortBy:   c.DefaultQuery("sort", "date"),
+		Order:    c.DefaultQuery("order", "desc"),
+		Cursor:   c.Query("cursor"),
+		MimeType: c.Query("mime_type"),
+		Query:    c.Query("q"),
+	}
+
+	switch opts.SortBy {
+	case "name", "size", "date":
+	default:
+		return opts, errors.New("sort must be one of name, size, date")
+	}
+
+	if opts.Order != "asc" && opts.Order != "desc" {
+		return opts, errors.New("order must be asc or desc")
+	}
+
+	intParams := []struct {
+		name string
+		dest *int
+	}{
+		{"limit", &opts.Limit},
+		{"min_size", &opts.MinSize},
+		{"max_size", &opts.MaxSize},
+	}
+	for _, p := range intParams {
+		value := c.Query(p.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return opts, fmt.Errorf("%s must be a non-negative integer", p.name)
+		}
+		*p.dest = parsed
+	}
+
+	tags, metadata, err := parseLabelFilters(c)
+	if err != nil {
+		return opts, err
+	}
+	opts.Tags = tags
+	opts.Metadata = metadata
+
+	if opts.MaxSize > 0 && opts.MinSize > opts.MaxSize {
+		return opts, errors.New("min_size must not be greater than max_size")
+	}
+
+	dateParams := []struct {
+		name     string
+		dest     *time.Time
+		endOfDay bool
+	}{
+		{"created_after", &opts.CreatedAfter, false},
+		{"created_before", &opts.CreatedBefore, true},
+	}
+	for _, p := range dateParams {
+		value := c.Query(p.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := parseDateParam(value, p.endOfDay)
+		if err != nil {
+			return opts, fmt.Errorf("%s must be an RFC 3339 timestamp or YYYY-MM-DD date", p.name)
+		}
+		*p.dest = parsed
+	}
+
+	return opts, nil
+}
+
+// parseDateParam reads an RFC 3339 timestamp or a YYYY-MM-DD date in UTC.
+// With endOfDay a date stands for its last second, so an inclusive upper
+// bound covers the whole day; stored times have whole seconds.
+func parseDateParam(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err == nil && endOfDay {
+		t = t.AddDate(0, 0, 1).Add(-time.Second)
+	}
+	return t, err
+}
+
+func (h *FileHandler) SearchFiles(c *gin.Context) {
+	userId := c.GetUint("userId")
+
+	limit := 0
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a non-negative integer"})
+			return
+		}
+		limit = parsed
+	}
+
+	tags, metadata, err := parseLabelFilters(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	results, err := h.Indexer.Search(userId, search.Options{
+		Query:    c.Query("q"),
+		Limit:    limit,
+		Tags:     tags,
+		Metadata: metadata,
+	})
+	if err != nil {
+		if errors.Is(err, search.ErrEmptyQuery) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": results,
 	})
 }
 
+func (h *FileHandler) RenameFile(c *gin.Context) {
+	userId := c.GetUint("userId")
+
+	parsedFileId, err := strconv.Atoi(c.Param("fileId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse file id"})
+		return
+	}
+
+	var req RenameFileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	filename, err := utils.SanitizeFilename(req.Filename)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.Repo.RenameFile(parsedFileId, userId, filename); err != nil {
+		h.Audit.Request(c, audit.ActionRename, audit.OutcomeFailure, parsedFileId, err.Error())
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	h.Audit.Request(c, audit.ActionRename, audit.OutcomeSuccess, parsedFileId, filename)
+
+	h.Indexer.Enqueue(parsedFileId)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Success rename file",
+	})
+}
+
+// DeleteFile removes a file of the user. The blob is only removed once the
+// record is gone, so a failed delete leaves the file intact.
 func (h *FileHandler) DeleteFile(c *gin.Context) {
 	userId := c.GetUint("userId")
 	fileId := c.Param("fileId")
@@ -255,24 +588,35 @@ func (h *FileHandler) DeleteFile(c *gin.Context) {
 		return
 	}
 
-	file, err := h.Repo.GetFileById(parsedFileId)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	file, ok := h.ownFile(c, parsedFileId)
+	if !ok {
+		h.Audit.Request(c, audit.ActionDelete, audit.OutcomeFailure, parsedFileId, repositories.ErrFileNotFound.Error())
 		return
 	}
 
-	filePath := "./" + file.Path
-
-	if err := os.Remove(filePath); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove file from storage"})
+	err = h.Repo.DeleteFile(parsedFileId, userId)
+	if errors.Is(err, repositories.ErrFileNotFound) {
+		// deleted by a concurrent request
+		h.Audit.Request(c, audit.ActionDelete, audit.OutcomeFailure, parsedFileId, err.Error())
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
-
-	err = h.Repo.DeleteFile(parsedFileId, userId)
 	if err != nil {
+		h.Audit.Request(c, audit.ActionDelete, audit.OutcomeFailure, parsedFileId, "failed to delete file record")
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete file"})
 		return
 	}
+	h.Audit.Request(c, audit.ActionDelete, audit.OutcomeSuccess, parsedFileId, file.Filename)
+
+	// the record is gone; a blob left behind is found by fsck
+	filePath := "./" + file.Path
+	if err := os.Remove(filePath); err != nil {
+		log.Printf("Failed to remove file %d from storage: %v", parsedFileId, err)
+	}
+	if err := h.Indexer.Remove(parsedFileId); err != nil {
+		log.Printf("Failed to remove file %d from search index: %v", parsedFileId, err)
+	}
+	thumbnail.Remove(filePath)
 
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Success delete file",
@@ -290,18 +634,125 @@ func (h *FileHandler) DownloadFile(c *gin.Context) {
 
 	file, err := h.Repo.GetFileById(parsedFileId)
 	if err != nil {
+		h.Audit.Request(c, audit.ActionDownload, audit.OutcomeFailure, parsedFileId, err.Error())
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	if file.ScanStatus != scanner.StatusClean {
+		h.Audit.Request(c, audit.ActionDownload, audit.OutcomeDenied, parsedFileId, "scan status "+file.ScanStatus)
+		c.JSON(http.StatusConflict, gin.H{
+			"error":       "File is not available for download until the malware scan marks it clean",
+			"scan_status": file.ScanStatus,
+		})
+		return
+	}
+
 	filePath := "./" + file.Path
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		h.Audit.Request(c, audit.ActionDownload, audit.OutcomeFailure, parsedFileId, "file missing from storage")
 		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
 		return
 	}
+	if err := h.Audit.Request(c, audit.ActionDownload, audit.OutcomeSuccess, parsedFileId, file.Filename); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record download"})
+		return
+	}
 
-	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, file.Filename))
+	c.Header("Content-Disposition", utils.ContentDisposition(file.Filename))
 	c.Header("Content-Type", "application/octet-stream")
 
+	userId := c.GetUint("userId")
+	rates := h.Policy.Current().BandwidthFor(c.GetString("role"), userId)
+	transfer := h.Bandwidth.Start(throttle.Download, userId, rates.Download, file.Filename)
+	defer transfer.Done()
+	c.Writer = &throttledResponseWriter{ResponseWriter: c.Writer, body: transfer.Writer(c.Request.Context(), c.Writer)}
+
 	c.File(filePath)
 }
+
+// throttleUpload shapes the request body to the upload bandwidth of the
+// user. The transfer must be ended with Done.
+func throttleUpload(c *gin.Context, bandwidth *throttle.Shaper, filePolicy *policy.Policy, name string) *throttle.Transfer {
+	userId := c.GetUint("userId")
+	rates := filePolicy.BandwidthFor(c.GetString("role"), userId)
+	transfer := bandwidth.Start(throttle.Upload, userId, rates.Upload, name)
+	c.Request.Body = struct {
+		io.Reader
+		io.Closer
+	}{transfer.Reader(c.Request.Context(), c.Request.Body), c.Request.Body}
+	return transfer
+}
+
+// throttledResponseWriter sends the response body through a throttled
+// writer.
+type throttledResponseWriter struct {
+	gin.ResponseWriter
+	body io.Writer
+}
+
+func (w *throttledResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeaderNow()
+	return w.body.Write(p)
+}
+
+func (w *throttledResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// GetThumbnail serves a preview of a file. Thumbnails are rendered by the
+// upload pipeline; missing ones, e.g. of files uploaded before, are rendered
+// on first request.
+func (h *FileHandler) GetThumbnail(c *gin.Context) {
+	fileId := c.Param("fileId")
+
+	parsedFileId, err := strconv.Atoi(fileId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse activity id"})
+		return
+	}
+
+	size := c.DefaultQuery("size", thumbnail.DefaultSize)
+	if _, ok := thumbnail.Sizes[size]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "size must be one of " + strings.Join(thumbnail.SizeNames(), ", ")})
+		return
+	}
+
+	file, err := h.Repo.GetFileById(parsedFileId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if file.ScanStatus != scanner.StatusClean {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":       "File is not available for download until the malware scan marks it clean",
+			"scan_status": file.ScanStatus,
+		})
+		return
+	}
+
+	if !thumbnail.Supported(file.MimeType) {
+		c.JSON(http.StatusNotFound, gin.H{"error": thumbnail.ErrUnsupported.Error()})
+		return
+	}
+
+	filePath := "./" + file.Path
+	thumbPath := thumbnail.Path(filePath, size)
+	if _, err := os.Stat(thumbPath); os.IsNotExist(err) {
+		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+		if err := thumbnail.Generate(filePath, file.MimeType); err != nil {
+			log.Printf("Failed to generate thumbnails of file %d: %v", file.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate thumbnail"})
+			return
+		}
+	}
+
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.Header("Content-Type", "image/jpeg")
+
+	c.File(thumbPath)
+}
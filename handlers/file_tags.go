@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"errors"
+	"go-secure-file-management/repositories"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type SetTagsRequest struct {
+	Tags []string `json:"tags" binding:"required"`
+}
+
+type SetMetadataRequest struct {
+	Metadata map[string]string `json:"metadata" binding:"required"`
+}
+
+func (h *FileHandler) SetTags(c *gin.Context) {
+	userId := c.GetUint("userId")
+
+	parsedFileId, err := strconv.Atoi(c.Param("fileId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse file id"})
+		return
+	}
+
+	var req SetTagsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tags, err := normalizeTags(req.Tags)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.Repo.SetTags(parsedFileId, userId, tags); err != nil {
+		respondLabelError(c, err)
+		return
+	}
+
+	h.Indexer.Enqueue(parsedFileId)
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": tags,
+	})
+}
+
+func (h *FileHandler) RemoveTag(c *gin.Context) {
+	userId := c.GetUint("userId")
+
+	parsedFileId, err := strconv.Atoi(c.Param("fileId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse file id"})
+		return
+	}
+
+	tag, err := repositories.NormalizeTag(c.Param("tag"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.Repo.RemoveTag(parsedFileId, userId, tag); err != nil {
+		respondLabelError(c, err)
+		return
+	}
+
+	h.Indexer.Enqueue(parsedFileId)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Success remove tag",
+	})
+}
+
+func (h *FileHandler) SetMetadata(c *gin.Context) {
+	userId := c.GetUint("userId")
+
+	parsedFileId, err := strconv.Atoi(c.Param("fileId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse file id"})
+		return
+	}
+
+	var req SetMetadataRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	metadata, err := normalizeMetadata(req.Metadata)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.Repo.SetMetadata(parsedFileId, userId, metadata); err != nil {
+		respondLabelError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Success update metadata",
+	})
+}
+
+func (h *FileHandler) RemoveMetadata(c *gin.Context) {
+	userId := c.GetUint("userId")
+
+	parsedFileId, err := strconv.Atoi(c.Param("fileId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to parse file id"})
+		return
+	}
+
+	key, err := repositories.NormalizeMetadataKey(c.Param("key"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.Repo.RemoveMetadata(parsedFileId, userId, key); err != nil {
+		respondLabelError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Success remove metadata",
+	})
+}
+
+// parseLabelFilters reads the `tag` (repeatable) and `meta[key]=value`
+// query params shared by listing and search.
+func parseLabelFilters(c *gin.Context) ([]string, map[string]string, error) {
+	tags, err := normalizeTags(c.QueryArray("tag"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	metadata, err := normalizeMetadata(c.QueryMap("meta"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tags, metadata, nil
+}
+
+func normalizeTags(raw []string) ([]string, error) {
+	if len(raw) > repositories.MaxTagsPerFile {
+		return nil, repositories.ErrTooManyTags
+	}
+
+	tags := make([]string, 0, len(raw))
+	seen := make(map[string]bool)
+	for _, tag := range raw {
+		normalized, err := repositories.NormalizeTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[normalized] {
+			seen[normalized] = true
+			tags = append(tags, normalized)
+		}
+	}
+
+	return tags, nil
+}
+
+func normalizeMetadata(raw map[string]string) (map[string]string, error) {
+	if len(raw) > repositories.MaxMetadataPerFile {
+		return nil, repositories.ErrTooManyMetadata
+	}
+
+	metadata := make(map[string]string, len(raw))
+	for key, value := range raw {
+		normalized, err := repositories.NormalizeMetadataKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := repositories.ValidateMetadataValue(value); err != nil {
+			return nil, err
+		}
+		metadata[normalized] = value
+	}
+
+	return metadata, nil
+}
+
+func respondLabelError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, repositories.ErrFileNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, repositories.ErrTooManyTags), errors.Is(err, repositories.ErrTooManyMetadata):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
@@ -0,0 +1,601 @@
+package handlers_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-secure-file-management/audit"
+	"go-secure-file-management/handlers"
+	"go-secure-file-management/models"
+	"go-secure-file-management/pipeline"
+	"go-secure-file-management/policy"
+	"go-secure-file-management/repositories"
+	"go-secure-file-management/scanner"
+	"go-secure-file-management/search"
+	"go-secure-file-management/throttle"
+
+	"github.com/gin-gonic/gin"
+)
+
+type fakeIndex struct {
+	mu      sync.Mutex
+	queued  []int
+	removed []int
+}
+
+func (i *fakeIndex) Search(userId uint, opts search.Options) ([]search.Result, error) {
+	return nil, nil
+}
+
+func (i *fakeIndex) Enqueue(fileId int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.queued = append(i.queued, fileId)
+}
+
+func (i *fakeIndex) Remove(fileId int) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.removed = append(i.removed, fileId)
+	return nil
+}
+
+type fakeQueue struct {
+	mu       sync.Mutex
+	payloads []pipeline.Payload
+}
+
+func (q *fakeQueue) Enqueue(userId uint, jobType string, payload interface{}) (int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.payloads = append(q.payloads, payload.(pipeline.Payload))
+	return int64(len(q.payloads)), nil
+}
+
+// fakeAudit records events as "action outcome"; with err set it fails
+// like an audit log whose database is gone.
+type fakeAudit struct {
+	mu     sync.Mutex
+	events []string
+	err    error
+}
+
+func (a *fakeAudit) Log(e audit.Event) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err != nil {
+		return a.err
+	}
+	a.events = append(a.events, e.Action+" "+e.Outcome)
+	return nil
+}
+
+func (a *fakeAudit) Request(c *gin.Context, action, outcome string, fileId int, detail string) error {
+	return a.Log(audit.Event{Action: action, Outcome: outcome})
+}
+
+func (a *fakeAudit) last() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.events) == 0 {
+		return ""
+	}
+	return a.events[len(a.events)-1]
+}
+
+type fileEnv struct {
+	repo    *repositories.MemoryFileStore
+	index   *fakeIndex
+	queue   *fakeQueue
+	audit   *fakeAudit
+	handler *handlers.FileHandler
+	stored  int64
+}
+
+// inTempDir runs the test in a temporary working directory, which holds
+// the upload directories.
+func inTempDir(t testing.TB) {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	if err := os.MkdirAll(pipeline.TempDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newFileEnv returns a FileHandler on the in-memory stores, working in a
+// temporary directory.
+func newFileEnv(t testing.TB) *fileEnv {
+	t.Helper()
+
+	inTempDir(t)
+	e := &fileEnv{
+		repo:  repositories.NewMemoryFileStore(),
+		index: &fakeIndex{},
+		queue: &fakeQueue{},
+		audit: &fakeAudit{},
+	}
+	e.handler = handlers.NewFileHandler(e.repo, e.index, policy.NewHolder(policy.Default()), e.queue, e.audit, throttle.New(0, 0))
+	return e
+}
+
+// router serves the file routes as userId.
+func (e *fileEnv) router(userId uint) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("userId", userId)
+		c.Set("role", "user")
+	})
+	r.GET("/api/file", e.handler.GetFiles)
+	r.POST("/api/file/upload-chunk", e.handler.CreateFile)
+	r.PUT("/api/file/upload-chunk", e.handler.StreamChunk)
+	r.GET("/api/file/metadata/:fileId", e.handler.GetFileMetadata)
+	r.GET("/api/file/download/:fileId", e.handler.DownloadFile)
+	r.PUT("/api/file/:fileId", e.handler.RenameFile)
+	r.DELETE("/api/file/:fileId", e.handler.DeleteFile)
+	return r
+}
+
+// store adds a file owned by userId with the given content and scan status.
+func (e *fileEnv) store(t *testing.T, userId uint, filename, content, scanStatus string) models.Files {
+	t.Helper()
+
+	e.stored++
+	path := filepath.Join("uploads", strconv.FormatInt(e.stored, 10))
+	id, err := e.repo.FinalizeFile(e.stored, models.Files{
+		UserId:     int(userId),
+		Path:       path,
+		Filename:   filename,
+		Size:       len(content),
+		MimeType:   "text/plain",
+		ScanStatus: scanStatus,
+	}, 0, func() error {
+		return os.WriteFile(path, []byte(content), 0o600)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := e.repo.GetFileById(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func serve(r http.Handler, method, target, body string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func chunkMetadata(t testing.TB, uploadId string, content []byte, offset, limit int) []byte {
+	t.Helper()
+
+	sum := sha256.Sum256(content[offset:limit])
+	metadata, err := json.Marshal(handlers.Metadata{
+		FileId:   uploadId,
+		Offset:   offset,
+		Limit:    limit,
+		FileSize: len(content),
+		FileName: "photo.png",
+		CheckSum: hex.EncodeToString(sum[:]),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metadata
+}
+
+// putChunk sends content[offset:limit] of an upload through StreamChunk.
+func putChunk(t *testing.T, r http.Handler, uploadId string, content []byte, offset, limit int) *httptest.ResponseRecorder {
+	t.Helper()
+
+	metadata := chunkMetadata(t, uploadId, content, offset, limit)
+	return serve(r, http.MethodPut, "/api/file/upload-chunk", string(content[offset:limit]), http.Header{
+		"X-Upload-Metadata": {string(metadata)},
+	})
+}
+
+func TestGetFilesListsOwnFiles(t *testing.T) {
+	e := newFileEnv(t)
+	own := e.store(t, 1, "mine.txt", "a", scanner.StatusClean)
+	e.store(t, 2, "theirs.txt", "b", scanner.StatusClean)
+
+	w := serve(e.router(1), http.MethodGet, "/api/file", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var body struct {
+		Data []handlers.GetFilesResponse `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Data) != 1 || body.Data[0].ID != own.ID {
+		t.Errorf("listed %+v, want only file %d", body.Data, own.ID)
+	}
+}
+
+func TestGetFilesPagesAndFiltersByDay(t *testing.T) {
+	e := newFileEnv(t)
+	for i := 0; i < 25; i++ {
+		e.store(t, 1, fmt.Sprintf("file%02d.txt", i), "a", scanner.StatusClean)
+	}
+	r := e.router(1)
+	today := time.Now().UTC().Format("2006-01-02")
+	yesterday := time.Now().UTC().AddDate(0, 0, -1).Format("2006-01-02")
+
+	list := func(query string) (int, int, string) {
+		t.Helper()
+		w := serve(r, http.MethodGet, "/api/file?"+query, "", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", query, w.Code, w.Body)
+		}
+		var body struct {
+			Data       []handlers.GetFilesResponse `json:"data"`
+			Total      int                         `json:"total"`
+			NextCursor string                      `json:"next_cursor"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		return len(body.Data), body.Total, body.NextCursor
+	}
+
+	if n, total, cursor := list(""); n != repositories.DefaultPageSize || total != 25 || cursor == "" {
+		t.Errorf("first page: %d of %d, cursor %q; want %d of 25 and a cursor", n, total, cursor, repositories.DefaultPageSize)
+	}
+	if n, _, cursor := list("limit=100"); n != 25 || cursor != "" {
+		t.Errorf("limit=100: %d files, cursor %q; want all 25 and no cursor", n, cursor)
+	}
+	// a date alone means the whole day
+	if _, total, _ := list("created_before=" + today); total != 25 {
+		t.Errorf("created_before=%s: %d files, want the 25 created today", today, total)
+	}
+	if _, total, _ := list("created_before=" + yesterday); total != 0 {
+		t.Errorf("created_before=%s: %d files, want none", yesterday, total)
+	}
+	if _, total, _ := list("created_after=" + today + "&created_before=" + today); total != 25 {
+		t.Errorf("created today: %d files, want 25", total)
+	}
+}
+
+func TestChunkUploadQueuesPipeline(t *testing.T) {
+	e := newFileEnv(t)
+	r := e.router(1)
+	content := []byte("hello, chunked world")
+
+	if w := putChunk(t, r, "upload-1", content, 0, 10); w.Code != http.StatusCreated {
+		t.Fatalf("first chunk: status %d: %s", w.Code, w.Body)
+	}
+	if len(e.queue.payloads) != 0 {
+		t.Fatalf("queued %+v before the upload was complete", e.queue.payloads)
+	}
+	if w := putChunk(t, r, "upload-1", content, 10, len(content)); w.Code != http.StatusAccepted {
+		t.Fatalf("last chunk: status %d: %s", w.Code, w.Body)
+	}
+
+	want := pipeline.Payload{UploadId: "upload-1", Filename: "photo.png", Size: len(content), Role: "user"}
+	if len(e.queue.payloads) != 1 || e.queue.payloads[0] != want {
+		t.Errorf("queued %+v, want %+v", e.queue.payloads, want)
+	}
+	if got := e.audit.last(); got != "file.upload success" {
+		t.Errorf("last audit event %q, want file.upload success", got)
+	}
+}
+
+// The first chunk fixes the size of the file; a later chunk can't complete
+// the upload early by declaring a smaller one, or extend it.
+func TestChunkWithOtherFileSizeIsRejected(t *testing.T) {
+	e := newFileEnv(t)
+	r := e.router(1)
+	content := []byte("hello, chunked world")
+
+	if w := putChunk(t, r, "upload-1", content, 0, 10); w.Code != http.StatusCreated {
+		t.Fatalf("first chunk: status %d: %s", w.Code, w.Body)
+	}
+	if w := putChunk(t, r, "upload-1", content[:15], 10, 15); w.Code != http.StatusConflict {
+		t.Errorf("chunk declaring a smaller file: status %d, want 409", w.Code)
+	}
+	if w := putChunk(t, r, "upload-1", append(content, " and more"...), 10, 20); w.Code != http.StatusConflict {
+		t.Errorf("chunk declaring a larger file: status %d, want 409", w.Code)
+	}
+	if len(e.queue.payloads) != 0 {
+		t.Fatalf("queued %+v", e.queue.payloads)
+	}
+
+	if w := putChunk(t, r, "upload-1", content, 10, len(content)); w.Code != http.StatusAccepted {
+		t.Fatalf("last chunk: status %d: %s", w.Code, w.Body)
+	}
+	if len(e.queue.payloads) != 1 || e.queue.payloads[0].Size != len(content) {
+		t.Errorf("queued %+v, want one upload of %d bytes", e.queue.payloads, len(content))
+	}
+}
+
+// Chunks sent all at once and in any order complete the upload once; run
+// with -race.
+func TestConcurrentChunksQueueOnce(t *testing.T) {
+	e := newFileEnv(t)
+	r := e.router(1)
+	const chunks, chunkSize = 100, 1000
+	content := make([]byte, chunks*chunkSize)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+
+	// the metadata is built up front, t may only fail the test from its
+	// own goroutine
+	metadata := make([][]byte, chunks)
+	for i := range metadata {
+		metadata[i] = chunkMetadata(t, "parallel", content, i*chunkSize, (i+1)*chunkSize)
+	}
+
+	var wg sync.WaitGroup
+	codes := make(chan int, chunks)
+	for i := chunks - 1; i >= 0; i-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := serve(r, http.MethodPut, "/api/file/upload-chunk", string(content[i*chunkSize:(i+1)*chunkSize]), http.Header{
+				"X-Upload-Metadata": {string(metadata[i])},
+			})
+			codes <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	count := map[int]int{}
+	for code := range codes {
+		count[code]++
+	}
+	if count[http.StatusAccepted] != 1 || count[http.StatusCreated] != chunks-1 {
+		t.Errorf("responses %v, want one 202 and %d 201", count, chunks-1)
+	}
+	if len(e.queue.payloads) != 1 {
+		t.Fatalf("queued %d jobs, want 1", len(e.queue.payloads))
+	}
+
+	stored, err := pipeline.Chunks(pipeline.UploadDir(1, "parallel"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pipeline.Complete(stored, int64(len(content))) || len(stored) != chunks {
+		t.Errorf("%d chunks stored, want all %d covering the file", len(stored), chunks)
+	}
+	if n := e.handler.HeldLocks(); n != 0 {
+		t.Errorf("%d upload locks left", n)
+	}
+}
+
+// Uploads that are abandoned or fail don't keep their lock.
+func TestAbandonedUploadsLeaveNoLocks(t *testing.T) {
+	e := newFileEnv(t)
+	r := e.router(1)
+	content := []byte("hello, chunked world")
+
+	for i := 0; i < 10; i++ {
+		uploadId := fmt.Sprintf("abandoned-%d", i)
+		if w := putChunk(t, r, uploadId, content, 0, 10); w.Code != http.StatusCreated {
+			t.Fatalf("chunk: status %d: %s", w.Code, w.Body)
+		}
+		if w := putChunk(t, r, uploadId, content, 5, 15); w.Code != http.StatusConflict {
+			t.Fatalf("overlapping chunk: status %d, want 409", w.Code)
+		}
+	}
+
+	if n := e.handler.HeldLocks(); n != 0 {
+		t.Errorf("%d upload locks left by abandoned uploads", n)
+	}
+}
+
+// Tags and metadata may name clients or confidentiality levels; other
+// users don't learn the file exists.
+func TestFileMetadataOnlyForOwner(t *testing.T) {
+	e := newFileEnv(t)
+	file := e.store(t, 1, "contract.pdf", "a", scanner.StatusClean)
+	if err := e.repo.SetTags(file.ID, 1, []string{"client-acme"}); err != nil {
+		t.Fatal(err)
+	}
+	target := "/api/file/metadata/" + strconv.Itoa(file.ID)
+
+	w := serve(e.router(1), http.MethodGet, target, "", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "client-acme") {
+		t.Errorf("owner: status %d: %s", w.Code, w.Body)
+	}
+
+	w = serve(e.router(2), http.MethodGet, target, "", nil)
+	if w.Code != http.StatusNotFound || strings.Contains(w.Body.String(), "client-acme") {
+		t.Errorf("another user: status %d: %s, want 404", w.Code, w.Body)
+	}
+	if w := serve(e.router(2), http.MethodGet, "/api/file/metadata/999", "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("missing file: status %d, want 404", w.Code)
+	}
+}
+
+func TestRenameFile(t *testing.T) {
+	e := newFileEnv(t)
+	file := e.store(t, 1, "old.txt", "a", scanner.StatusClean)
+	target := "/api/file/" + strconv.Itoa(file.ID)
+
+	w := serve(e.router(2), http.MethodPut, target, `{"filename": "stolen.txt"}`, nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("renaming another user's file: status %d, want 404", w.Code)
+	}
+
+	w = serve(e.router(1), http.MethodPut, target, `{"filename": "../new.txt"}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	renamed, err := e.repo.GetFileById(file.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renamed.Filename != "new.txt" {
+		t.Errorf("filename %q, want the sanitized new.txt", renamed.Filename)
+	}
+	if len(e.index.queued) != 1 || e.index.queued[0] != file.ID {
+		t.Errorf("reindexed %v, want [%d]", e.index.queued, file.ID)
+	}
+	if got := e.audit.last(); got != "file.rename success" {
+		t.Errorf("last audit event %q, want file.rename success", got)
+	}
+}
+
+func TestDeleteFileRemovesRecordAndFile(t *testing.T) {
+	e := newFileEnv(t)
+	file := e.store(t, 1, "gone.txt", "a", scanner.StatusClean)
+
+	w := serve(e.router(1), http.MethodDelete, "/api/file/"+strconv.Itoa(file.ID), "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if _, err := e.repo.GetFileById(file.ID); err == nil {
+		t.Error("record still there")
+	}
+	if _, err := os.Stat(file.Path); !os.IsNotExist(err) {
+		t.Errorf("stored file still there: %v", err)
+	}
+	if used := e.repo.StorageUsed(1); used != 0 {
+		t.Errorf("storage_used %d, want 0", used)
+	}
+	if len(e.index.removed) != 1 || e.index.removed[0] != file.ID {
+		t.Errorf("removed from the index %v, want [%d]", e.index.removed, file.ID)
+	}
+}
+
+func TestDeleteFileOfAnotherUser(t *testing.T) {
+	e := newFileEnv(t)
+	file := e.store(t, 1, "mine.txt", "a", scanner.StatusClean)
+
+	w := serve(e.router(2), http.MethodDelete, "/api/file/"+strconv.Itoa(file.ID), "", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status %d, want 404", w.Code)
+	}
+	if _, err := e.repo.GetFileById(file.ID); err != nil {
+		t.Errorf("record gone: %v", err)
+	}
+	if _, err := os.Stat(file.Path); err != nil {
+		t.Errorf("stored file gone: %v", err)
+	}
+	if got := e.audit.last(); got != "file.delete failure" {
+		t.Errorf("last audit event %q, want file.delete failure", got)
+	}
+}
+
+func TestDownloadRequiresCleanScan(t *testing.T) {
+	e := newFileEnv(t)
+	pending := e.store(t, 1, "pending.txt", "not yet", scanner.StatusPending)
+	clean := e.store(t, 1, "clean.txt", "all good", scanner.StatusClean)
+	r := e.router(1)
+
+	w := serve(r, http.MethodGet, "/api/file/download/"+strconv.Itoa(pending.ID), "", nil)
+	if w.Code != http.StatusConflict {
+		t.Errorf("pending file: status %d, want 409", w.Code)
+	}
+	if got := e.audit.last(); got != "file.download denied" {
+		t.Errorf("last audit event %q, want file.download denied", got)
+	}
+
+	w = serve(r, http.MethodGet, "/api/file/download/"+strconv.Itoa(clean.ID), "", nil)
+	if w.Code != http.StatusOK || w.Body.String() != "all good" {
+		t.Errorf("clean file: status %d with %q, want 200 with its content", w.Code, w.Body)
+	}
+	if got := e.audit.last(); got != "file.download success" {
+		t.Errorf("last audit event %q, want file.download success", got)
+	}
+}
+
+func TestDownloadRefusedWhenNotAudited(t *testing.T) {
+	e := newFileEnv(t)
+	file := e.store(t, 1, "secret.txt", "classified", scanner.StatusClean)
+	e.audit.err = errors.New("database is gone")
+
+	w := serve(e.router(1), http.MethodGet, "/api/file/download/"+strconv.Itoa(file.ID), "", nil)
+	if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "classified") {
+		t.Errorf("status %d with %q, want 500 without the content", w.Code, w.Body)
+	}
+}
+
+// The chunk upload benchmarks send the first 4 MB chunk of an 8 MB upload,
+// as a multipart form to CreateFile and as the raw body to StreamChunk.
+const benchChunkSize = 4 << 20
+
+func benchmarkChunk(b *testing.B, send func(r http.Handler, uploadId string, content []byte) *httptest.ResponseRecorder) {
+	e := newFileEnv(b)
+	r := e.router(1)
+	content := make([]byte, 2*benchChunkSize)
+	for i := range content {
+		content[i] = byte(i)
+	}
+
+	b.SetBytes(benchChunkSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		uploadId := "bench-" + strconv.Itoa(i)
+		if w := send(r, uploadId, content); w.Code != http.StatusCreated {
+			b.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+
+		b.StopTimer()
+		os.RemoveAll(pipeline.UploadDir(1, uploadId))
+		b.StartTimer()
+	}
+}
+
+func BenchmarkCreateFileMultipart(b *testing.B) {
+	benchmarkChunk(b, func(r http.Handler, uploadId string, content []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("metadata", string(chunkMetadata(b, uploadId, content, 0, benchChunkSize)))
+		part, err := form.CreateFormFile("file", "blob")
+		if err != nil {
+			b.Fatal(err)
+		}
+		part.Write(content[:benchChunkSize])
+		form.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/api/file/upload-chunk", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	})
+}
+
+func BenchmarkStreamChunk(b *testing.B) {
+	benchmarkChunk(b, func(r http.Handler, uploadId string, content []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/api/file/upload-chunk", bytes.NewReader(content[:benchChunkSize]))
+		req.Header.Set("X-Upload-Metadata", string(chunkMetadata(b, uploadId, content, 0, benchChunkSize)))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	})
+}
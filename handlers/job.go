@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"errors"
+	"go-secure-file-management/jobs"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type JobHandler struct {
+	Queue *jobs.Queue
+}
+
+func NewJobHandler(queue *jobs.Queue) *JobHandler {
+	return &JobHandler{
+		Queue: queue,
+	}
+}
+
+// GetJob reports the progress of a background job, e.g. the processing of
+// an upload. Jobs of other users are reported as not found.
+func (h *JobHandler) GetJob(c *gin.Context) {
+	userId := c.GetUint("userId")
+
+	jobId, err := strconv.ParseInt(c.Param("jobId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid job id"})
+		return
+	}
+
+	job, err := h.Queue.GetJob(jobId)
+	if errors.Is(err, jobs.ErrJobNotFound) || (err == nil && job.UserId != userId) {
+		c.JSON(http.StatusNotFound, gin.H{"error": jobs.ErrJobNotFound.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": job,
+	})
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import "sync"
+
+// keyedMutex hands out a mutex per key, e.g. per upload. An entry only
+// lives while its key is locked or waited for, so uploads that are
+// abandoned or fail don't leave one behind. The zero value is ready to use.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int // holders and waiters, guarded by keyedMutex.mu
+}
+
+// Lock blocks until key is free and returns the function releasing it.
+func (k *keyedMutex) Lock(key string) (unlock func()) {
+	l := k.acquire(key)
+	l.Lock()
+	return func() { k.release(key, l) }
+}
+
+// TryLock is Lock without waiting; ok is false if key is held.
+func (k *keyedMutex) TryLock(key string) (unlock func(), ok bool) {
+	l := k.acquire(key)
+	if !l.TryLock() {
+		k.forget(key, l)
+		return nil, false
+	}
+	return func() { k.release(key, l) }, true
+}
+
+func (k *keyedMutex) acquire(key string) *keyedLock {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedLock)
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	return l
+}
+
+// release unlocks before dropping the reference, so a waiter always finds
+// the mutex it waits on in the map.
+func (k *keyedMutex) release(key string, l *keyedLock) {
+	l.Unlock()
+	k.forget(key, l)
+}
+
+func (k *keyedMutex) forget(key string, l *keyedLock) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l.refs--
+	if l.refs == 0 {
+		delete(k.locks, key)
+	}
+}
+
+// len is the number of keys locked or waited for.
+func (k *keyedMutex) len() int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.locks)
+}
@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"go-secure-file-management/throttle"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type TransferHandler struct {
+	Bandwidth *throttle.Shaper
+}
+
+func NewTransferHandler(bandwidth *throttle.Shaper) *TransferHandler {
+	return &TransferHandler{
+		Bandwidth: bandwidth,
+	}
+}
+
+// ListTransfers reports the running uploads and downloads with their
+// current throughput.
+func (h *TransferHandler) ListTransfers(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"data": h.Bandwidth.Transfers(),
+	})
+}
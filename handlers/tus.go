@@ -0,0 +1,523 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-secure-file-management/audit"
+	"go-secure-file-management/models"
+	"go-secure-file-management/pipeline"
+	"go-secure-file-management/policy"
+	"go-secure-file-management/repositories"
+	"go-secure-file-management/throttle"
+	"go-secure-file-management/utils"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	TusVersion    = "1.0.0"
+	TusExtensions = "creation,termination,checksum,expiration"
+
+	// TusUploadExpiry is how long an upload is kept after its last PATCH.
+	TusUploadExpiry = 24 * time.Hour
+
+	// StatusChecksumMismatch is the tus checksum extension's response when
+	// the body doesn't match Upload-Checksum.
+	StatusChecksumMismatch = 460
+)
+
+// tusChecksums are the Upload-Checksum algorithms we accept; tus requires
+// sha1.
+var tusChecksums = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"md5":    md5.New,
+}
+
+// TusHandler implements the tus 1.0 resumable upload protocol
+// (https://tus.io/protocols/resumable-upload) on top of the upload pipeline.
+// Each upload is written to a single file in its upload directory, stored
+// like one chunk covering the whole file, so the pipeline assembles it as one.
+type TusHandler struct {
+	Repo   repositories.UploadSessionStore
+	Policy *policy.Holder
+	Jobs   JobQueue
+	Audit  AuditLog
+	// shapes PATCH bodies
+	Bandwidth *throttle.Shaper
+
+	// one PATCH or DELETE per upload at a time
+	locks keyedMutex
+}
+
+func NewTusHandler(repo repositories.UploadSessionStore, filePolicy *policy.Holder, jobQueue JobQueue, auditLog AuditLog, bandwidth *throttle.Shaper) *TusHandler {
+	return &TusHandler{
+		Repo:      repo,
+		Policy:    filePolicy,
+		Jobs:      jobQueue,
+		Audit:     auditLog,
+		Bandwidth: bandwidth,
+	}
+}
+
+// TusResumable adds the Tus-Resumable header to every response and rejects
+// requests for other protocol versions. OPTIONS is used for discovery and
+// doesn't have to send the header.
+func TusResumable() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Tus-Resumable", TusVersion)
+
+		if c.Request.Method != http.MethodOptions && c.GetHeader("Tus-Resumable") != TusVersion {
+			c.Header("Tus-Version", TusVersion)
+			c.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{"error": "unsupported tus version"})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func tusUploadId(id string) string {
+	return "tus-" + id
+}
+
+func tusUploadDir(upload models.TusUpload) string {
+	return pipeline.UploadDir(upload.UserId, tusUploadId(upload.ID))
+}
+
+func tusDataPath(upload models.TusUpload) string {
+	return pipeline.ChunkPath(tusUploadDir(upload), 0, upload.Length)
+}
+
+// Options advertises the protocol version and extensions.
+func (h *TusHandler) Options(c *gin.Context) {
+	c.Header("Tus-Version", TusVersion)
+	c.Header("Tus-Extension", TusExtensions)
+	c.Header("Tus-Checksum-Algorithm", "sha1,sha256,md5")
+	c.Status(http.StatusNoContent)
+}
+
+// CreateUpload creates an upload from Upload-Length and the filename in
+// Upload-Metadata. The declared name and size are checked against the
+// policy before any data is accepted.
+func (h *TusHandler) CreateUpload(c *gin.Context) {
+	userId := c.GetUint("userId")
+	role := c.GetString("role")
+
+	if c.GetHeader("Upload-Defer-Length") != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Defer-Length is not supported"})
+		return
+	}
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Length must be a positive integer"})
+		return
+	}
+
+	metadata, err := parseUploadMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+	if filename == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Metadata must contain the filename"})
+		return
+	}
+	filename, err = utils.SanitizeFilename(filename)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if violation := h.Policy.Current().CheckDeclared(role, filename, length); violation != nil {
+		h.Audit.Request(c, audit.ActionUploadReject, audit.OutcomeDenied, 0, violation.Code+": "+filename)
+		respondPolicyViolation(c, violation)
+		return
+	}
+
+	var random [16]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, errors.New("failed to create upload"))
+		return
+	}
+	upload := models.TusUpload{
+		ID:        hex.EncodeToString(random[:]),
+		UserId:    userId,
+		Filename:  filename,
+		Length:    length,
+		Metadata:  c.GetHeader("Upload-Metadata"),
+		ExpiresAt: time.Now().Add(TusUploadExpiry),
+	}
+
+	if err := os.MkdirAll(tusUploadDir(upload), 0755); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, errors.New("failed to create upload"))
+		return
+	}
+	data, err := os.OpenFile(tusDataPath(upload), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, errors.New("failed to create upload"))
+		return
+	}
+	data.Close()
+
+	if err := h.Repo.CreateUpload(upload); err != nil {
+		os.RemoveAll(tusUploadDir(upload))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Location", "/api/file/tus/"+upload.ID)
+	c.Header("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusCreated)
+}
+
+// parseUploadMetadata decodes the Upload-Metadata header: comma separated
+// pairs of a key and its base64 encoded value, the value being optional.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("invalid Upload-Metadata")
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %q", key)
+		}
+		metadata[key] = string(value)
+	}
+
+	return metadata, nil
+}
+
+// getUpload loads the upload named in the URL, responding 404 for unknown
+// uploads and 410 for expired ones.
+func (h *TusHandler) getUpload(c *gin.Context) (models.TusUpload, bool) {
+	upload, err := h.Repo.GetUpload(c.Param("uploadId"), c.GetUint("userId"))
+	if errors.Is(err, repositories.ErrUploadNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return upload, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return upload, false
+	}
+	if time.Now().After(upload.ExpiresAt) {
+		c.JSON(http.StatusGone, gin.H{"error": "upload expired"})
+		return upload, false
+	}
+
+	return upload, true
+}
+
+// GetUpload reports how much of an upload the server has, so the client
+// knows where to resume.
+func (h *TusHandler) GetUpload(c *gin.Context) {
+	upload, ok := h.getUpload(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.Metadata != "" {
+		c.Header("Upload-Metadata", upload.Metadata)
+	}
+	if upload.JobId == nil {
+		c.Header("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	c.Status(http.StatusOK)
+}
+
+// PatchUpload appends the body at Upload-Offset. With Upload-Checksum the
+// bytes are only kept if they match; without it, whatever arrived before
+// the connection dropped is kept so the client can resume from there. The
+// request completing the upload queues the upload pipeline.
+func (h *TusHandler) PatchUpload(c *gin.Context) {
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Offset must be a non-negative integer"})
+		return
+	}
+
+	var hasher hash.Hash
+	var expectedSum []byte
+	if header := c.GetHeader("Upload-Checksum"); header != "" {
+		algorithm, encoded, _ := strings.Cut(header, " ")
+		newHash, ok := tusChecksums[algorithm]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported checksum algorithm"})
+			return
+		}
+		expectedSum, err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid Upload-Checksum value"})
+			return
+		}
+		hasher = newHash()
+	}
+
+	unlock, ok := h.locks.TryLock(c.Param("uploadId"))
+	if !ok {
+		c.JSON(http.StatusLocked, gin.H{"error": "upload is being written by another request"})
+		return
+	}
+	defer unlock()
+
+	upload, ok := h.getUpload(c)
+	if !ok {
+		return
+	}
+	if offset != upload.Offset {
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload-Offset doesn't match the upload"})
+		return
+	}
+
+	remaining := upload.Length - upload.Offset
+	if c.Request.ContentLength > remaining {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "body exceeds Upload-Length"})
+		return
+	}
+	transfer := throttleUpload(c, h.Bandwidth, h.Policy.Current(), upload.Filename)
+	defer transfer.Done()
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, remaining)
+
+	data, err := os.OpenFile(tusDataPath(upload), os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		// the pipeline is done with the upload and removed its data
+		c.JSON(http.StatusNotFound, gin.H{"error": repositories.ErrUploadNotFound.Error()})
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, errors.New("failed to open upload"))
+		return
+	}
+	defer data.Close()
+
+	// drop bytes past the stored offset left over from a rejected request
+	if err := data.Truncate(offset); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, errors.New("failed to write upload"))
+		return
+	}
+	if _, err := data.Seek(offset, io.SeekStart); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, errors.New("failed to write upload"))
+		return
+	}
+
+	var w io.Writer = data
+	if hasher != nil {
+		w = io.MultiWriter(data, hasher)
+	}
+	written, copyErr := io.Copy(w, body)
+
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(copyErr, &maxBytesErr):
+		data.Truncate(offset)
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "body exceeds Upload-Length"})
+		return
+	case copyErr != nil && hasher != nil:
+		data.Truncate(offset)
+		c.AbortWithError(http.StatusInternalServerError, errors.New("failed to read upload body"))
+		return
+	case hasher != nil && !bytes.Equal(hasher.Sum(nil), expectedSum):
+		data.Truncate(offset)
+		c.JSON(StatusChecksumMismatch, gin.H{"error": "checksum mismatch"})
+		return
+	}
+
+	if err := data.Close(); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, errors.New("failed to write upload"))
+		return
+	}
+
+	upload.Offset = offset + written
+	upload.ExpiresAt = time.Now().Add(TusUploadExpiry)
+	if err := h.Repo.SetOffset(upload.ID, offset, upload.Offset, upload.ExpiresAt); err != nil {
+		if errors.Is(err, repositories.ErrOffsetConflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Upload-Offset doesn't match the upload"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if copyErr != nil {
+		// the client is likely gone, it resumes from the stored offset
+		c.AbortWithError(http.StatusInternalServerError, errors.New("failed to read upload body"))
+		return
+	}
+
+	// a completed upload whose job couldn't be queued or recorded is
+	// retried by an empty PATCH at the final offset
+	if upload.Offset == upload.Length && upload.JobId == nil {
+		jobId, err := h.queue(c, upload)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		if err := h.Repo.SetJobId(upload.ID, jobId); err != nil {
+			log.Printf("Failed to record job %d for tus upload %s: %v", jobId, upload.ID, err)
+			c.AbortWithError(http.StatusInternalServerError, errors.New("failed to record upload job"))
+			return
+		}
+		upload.JobId = &jobId
+	}
+
+	if upload.JobId != nil {
+		c.Header("X-Job-Status-Url", fmt.Sprintf("/api/jobs/%d", *upload.JobId))
+	} else {
+		c.Header("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
+	c.Header("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Status(http.StatusNoContent)
+}
+
+// queue queues the pipeline for a completed upload, once: like chunk
+// uploads, the job is recorded in the upload's QueuedMarker, so a retry
+// after the session couldn't be updated finds the job instead of queueing
+// a second one.
+func (h *TusHandler) queue(c *gin.Context, upload models.TusUpload) (int64, error) {
+	if jobId, ok := tusQueuedJob(upload); ok {
+		return jobId, nil
+	}
+
+	markerPath := filepath.Join(tusUploadDir(upload), pipeline.QueuedMarker)
+	marker, err := os.OpenFile(markerPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		// left by a request that failed before recording its job
+		return 0, fmt.Errorf("failed to queue upload: %v", err)
+	}
+	marker.Close()
+
+	jobId, err := h.Jobs.Enqueue(upload.UserId, pipeline.JobType, pipeline.Payload{
+		UploadId: tusUploadId(upload.ID),
+		Filename: upload.Filename,
+		Size:     int(upload.Length),
+		Role:     c.GetString("role"),
+	})
+	if err != nil {
+		os.Remove(markerPath)
+		return 0, err
+	}
+	h.Audit.Request(c, audit.ActionUpload, audit.OutcomeSuccess, 0, fmt.Sprintf("%s, job %d", upload.Filename, jobId))
+	if err := os.WriteFile(markerPath, []byte(strconv.FormatInt(jobId, 10)), 0644); err != nil {
+		log.Printf("Failed to record job %d of tus upload %s: %v", jobId, upload.ID, err)
+	}
+	return jobId, nil
+}
+
+// tusQueuedJob returns the job recorded in the upload's QueuedMarker.
+func tusQueuedJob(upload models.TusUpload) (int64, bool) {
+	marker, err := os.ReadFile(filepath.Join(tusUploadDir(upload), pipeline.QueuedMarker))
+	if err != nil {
+		return 0, false
+	}
+	jobId, err := strconv.ParseInt(string(marker), 10, 64)
+	return jobId, err == nil
+}
+
+// DeleteUpload terminates an upload and frees its data. Completed uploads
+// already belong to the pipeline, only their record is removed.
+func (h *TusHandler) DeleteUpload(c *gin.Context) {
+	unlock, ok := h.locks.TryLock(c.Param("uploadId"))
+	if !ok {
+		c.JSON(http.StatusLocked, gin.H{"error": "upload is being written by another request"})
+		return
+	}
+	defer unlock()
+
+	upload, ok := h.getUpload(c)
+	if !ok {
+		return
+	}
+
+	if err := h.remove(upload); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *TusHandler) remove(upload models.TusUpload) error {
+	if _, queued := tusQueuedJob(upload); upload.JobId == nil && !queued {
+		if err := os.RemoveAll(tusUploadDir(upload)); err != nil {
+			return fmt.Errorf("failed to remove upload data: %v", err)
+		}
+	}
+	return h.Repo.DeleteUpload(upload.ID)
+}
+
+// ExpireUploads removes the uploads whose expiration has passed, skipping
+// those being written to right now. It returns how many were removed.
+func (h *TusHandler) ExpireUploads() (int, error) {
+	uploads, err := h.Repo.GetExpiredUploads(time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, upload := range uploads {
+		unlock, ok := h.locks.TryLock(upload.ID)
+		if !ok {
+			continue
+		}
+		err := h.remove(upload)
+		unlock()
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// RunExpiry calls ExpireUploads every interval until ctx is done.
+func (h *TusHandler) RunExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		removed, err := h.ExpireUploads()
+		if err != nil {
+			log.Printf("Failed to expire tus uploads: %v", err)
+		}
+		if removed > 0 {
+			log.Printf("Expired %d tus uploads", removed)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package handlers_test
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"go-secure-file-management/handlers"
+	"go-secure-file-management/pipeline"
+	"go-secure-file-management/policy"
+	"go-secure-file-management/repositories"
+	"go-secure-file-management/throttle"
+
+	"github.com/gin-gonic/gin"
+)
+
+// failingSessions fails SetJobId while fail is set.
+type failingSessions struct {
+	*repositories.MemoryUploadSessionStore
+	fail atomic.Bool
+}
+
+func (s *failingSessions) SetJobId(id string, jobId int64) error {
+	if s.fail.Load() {
+		return errors.New("database is gone")
+	}
+	return s.MemoryUploadSessionStore.SetJobId(id, jobId)
+}
+
+type tusEnv struct {
+	sessions *failingSessions
+	queue    *fakeQueue
+	handler  *handlers.TusHandler
+	router   *gin.Engine
+}
+
+// newTusEnv returns a TusHandler on the in-memory store serving as user 1,
+// working in a temporary directory.
+func newTusEnv(t *testing.T) *tusEnv {
+	t.Helper()
+
+	inTempDir(t)
+	e := &tusEnv{
+		sessions: &failingSessions{MemoryUploadSessionStore: repositories.NewMemoryUploadSessionStore()},
+		queue:    &fakeQueue{},
+	}
+	e.handler = handlers.NewTusHandler(e.sessions, policy.NewHolder(policy.Default()), e.queue, &fakeAudit{}, throttle.New(0, 0))
+
+	gin.SetMode(gin.TestMode)
+	e.router = gin.New()
+	e.router.Use(func(c *gin.Context) {
+		c.Set("userId", uint(1))
+		c.Set("role", "user")
+	})
+	tus := e.router.Group("/api/file/tus", handlers.TusResumable())
+	tus.POST("", e.handler.CreateUpload)
+	tus.PATCH("/:uploadId", e.handler.PatchUpload)
+	tus.DELETE("/:uploadId", e.handler.DeleteUpload)
+	return e
+}
+
+// create starts an upload of length bytes and returns its id.
+func (e *tusEnv) create(t *testing.T, length int) string {
+	t.Helper()
+
+	w := serve(e.router, http.MethodPost, "/api/file/tus", "", http.Header{
+		"Tus-Resumable":   {handlers.TusVersion},
+		"Upload-Length":   {strconv.Itoa(length)},
+		"Upload-Metadata": {"filename " + base64.StdEncoding.EncodeToString([]byte("photo.png"))},
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	return strings.TrimPrefix(w.Header().Get("Location"), "/api/file/tus/")
+}
+
+func (e *tusEnv) patch(id string, offset int, body string) int {
+	return e.patchResponse(id, offset, body).Code
+}
+
+func (e *tusEnv) patchResponse(id string, offset int, body string) *httptest.ResponseRecorder {
+	return serve(e.router, http.MethodPatch, "/api/file/tus/"+id, body, http.Header{
+		"Tus-Resumable": {handlers.TusVersion},
+		"Content-Type":  {"application/offset+octet-stream"},
+		"Upload-Offset": {strconv.Itoa(offset)},
+	})
+}
+
+func (e *tusEnv) delete(id string) int {
+	return serve(e.router, http.MethodDelete, "/api/file/tus/"+id, "", http.Header{
+		"Tus-Resumable": {handlers.TusVersion},
+	}).Code
+}
+
+func TestTusUploadQueuesPipeline(t *testing.T) {
+	e := newTusEnv(t)
+	id := e.create(t, 11)
+
+	if code := e.patch(id, 0, "hello "); code != http.StatusNoContent {
+		t.Fatalf("first PATCH: status %d", code)
+	}
+	if code := e.patch(id, 0, "hello "); code != http.StatusConflict {
+		t.Errorf("PATCH at a stale offset: status %d, want 409", code)
+	}
+	if code := e.patch(id, 6, "world"); code != http.StatusNoContent {
+		t.Fatalf("last PATCH: status %d", code)
+	}
+
+	want := pipeline.Payload{UploadId: "tus-" + id, Filename: "photo.png", Size: 11, Role: "user"}
+	if len(e.queue.payloads) != 1 || e.queue.payloads[0] != want {
+		t.Errorf("queued %+v, want %+v", e.queue.payloads, want)
+	}
+	if n := e.handler.HeldLocks(); n != 0 {
+		t.Errorf("%d upload locks left", n)
+	}
+}
+
+// When the job can't be recorded in the session the PATCH fails; the
+// retry finds the queued job instead of queueing a second one.
+func TestTusRetryAfterFailedSetJobIdQueuesOnce(t *testing.T) {
+	e := newTusEnv(t)
+	id := e.create(t, 5)
+
+	e.sessions.fail.Store(true)
+	if code := e.patch(id, 0, "hello"); code != http.StatusInternalServerError {
+		t.Fatalf("PATCH with the session store failing: status %d, want 500", code)
+	}
+
+	e.sessions.fail.Store(false)
+	w := e.patchResponse(id, 5, "")
+	if w.Code != http.StatusNoContent || w.Header().Get("X-Job-Status-Url") != "/api/jobs/1" {
+		t.Fatalf("retry: status %d, job %q; want 204 with job 1", w.Code, w.Header().Get("X-Job-Status-Url"))
+	}
+	if len(e.queue.payloads) != 1 {
+		t.Errorf("queued %d jobs, want 1", len(e.queue.payloads))
+	}
+	upload, err := e.sessions.GetUpload(id, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload.JobId == nil || *upload.JobId != 1 {
+		t.Errorf("session job %v, want 1", upload.JobId)
+	}
+}
+
+// Once the pipeline removed the upload's data, a PATCH finds nothing to
+// write to.
+func TestTusPatchAfterPipelineIsNotFound(t *testing.T) {
+	e := newTusEnv(t)
+	id := e.create(t, 5)
+	if code := e.patch(id, 0, "hello"); code != http.StatusNoContent {
+		t.Fatalf("PATCH: status %d", code)
+	}
+
+	if err := os.RemoveAll(pipeline.UploadDir(1, "tus-"+id)); err != nil {
+		t.Fatal(err)
+	}
+	if code := e.patch(id, 5, ""); code != http.StatusNotFound {
+		t.Errorf("PATCH after the pipeline: status %d, want 404", code)
+	}
+}
+
+// PATCH and DELETE racing for the same uploads either win the lock or are
+// turned away, and leave no lock behind; run with -race.
+func TestTusConcurrentPatchAndDelete(t *testing.T) {
+	e := newTusEnv(t)
+	ids := make([]string, 20)
+	for i := range ids {
+		ids[i] = e.create(t, 5)
+	}
+
+	var wg sync.WaitGroup
+	codes := make(chan string, 3*len(ids))
+	for _, id := range ids {
+		for _, request := range []func() int{
+			func() int { return e.patch(id, 0, "hello") },
+			func() int { return e.delete(id) },
+			func() int { return e.delete(id) },
+		} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				codes <- fmt.Sprint(request())
+			}()
+		}
+	}
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		switch code {
+		case "204", "404", "423":
+		default:
+			t.Errorf("status %s, want 204, 404 or 423", code)
+		}
+	}
+	if n := e.handler.HeldLocks(); n != 0 {
+		t.Errorf("%d upload locks left", n)
+	}
+}
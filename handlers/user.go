@@ -1,10 +1,11 @@
 package handlers
 
 import (
-	"database/sql"
+	"go-secure-file-management/audit"
 	"go-secure-file-management/repositories"
 	"go-secure-file-management/utils"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/bcrypt"
@@ -16,12 +17,14 @@ type AuthRequest struct {
 }
 
 type UserHandler struct {
-	Repo *repositories.UserRepository
+	Repo  repositories.UserStore
+	Audit AuditLog
 }
 
-func NewUserHandler(db *sql.DB) *UserHandler {
+func NewUserHandler(users repositories.UserStore, auditLog AuditLog) *UserHandler {
 	return &UserHandler{
-		Repo: repositories.NewUserRepository(db),
+		Repo:  users,
+		Audit: auditLog,
 	}
 }
 
@@ -35,22 +38,31 @@ func (h *UserHandler) Login(c *gin.Context) {
 
 	user, err := h.Repo.FindUserByEmail(req.Email)
 	if err != nil {
+		h.Audit.Request(c, audit.ActionLogin, audit.OutcomeFailure, 0, "unknown email "+req.Email)
 		c.JSON(http.StatusNotFound, gin.H{"error": "Email not found"})
 		return
 	}
 
+	event := audit.FromRequest(c, audit.ActionLogin, audit.OutcomeFailure)
+	event.ActorId = uint(user.ID)
+
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password))
 	if err != nil {
+		event.Detail = "password mismatch"
+		h.Audit.Log(event)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Password mismatch"})
 		return
 	}
 
-	token, err := utils.GenerateJWT(uint(user.ID), user.Email)
+	token, err := utils.GenerateJWT(uint(user.ID), user.Email, user.Role)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	event.Outcome = audit.OutcomeSuccess
+	h.Audit.Log(event)
+
 	c.JSON(http.StatusOK, gin.H{
 		"email": user.Email,
 		"token": token,
@@ -79,7 +91,11 @@ func (h *UserHandler) Register(c *gin.Context) {
 			return
 		}
 
-		token, err := utils.GenerateJWT(uint(user.ID), user.Email)
+		event := audit.FromRequest(c, audit.ActionRegister, audit.OutcomeSuccess)
+		event.ActorId = uint(user.ID)
+		h.Audit.Log(event)
+
+		token, err := utils.GenerateJWT(uint(user.ID), user.Email, user.Role)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -90,7 +106,54 @@ func (h *UserHandler) Register(c *gin.Context) {
 			"token": token,
 		})
 	} else {
+		h.Audit.Request(c, audit.ActionRegister, audit.OutcomeFailure, 0, "email already exists: "+req.Email)
 		c.JSON(http.StatusConflict, gin.H{"error": "Email already exists"})
 		return
 	}
 }
+
+type UserSettingsRequest struct {
+	// null resets the setting to the policy default
+	StripMetadata *bool `json:"strip_metadata"`
+}
+
+func (h *UserHandler) GetSettings(c *gin.Context) {
+	userId := c.GetUint("userId")
+
+	stripMetadata, err := h.Repo.GetStripMetadata(userId)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": UserSettingsRequest{StripMetadata: stripMetadata},
+	})
+}
+
+// UpdateSettings changes the user's preferences. They apply to uploads
+// finished afterwards.
+func (h *UserHandler) UpdateSettings(c *gin.Context) {
+	userId := c.GetUint("userId")
+
+	var req UserSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.Repo.SetStripMetadata(userId, req.StripMetadata); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	setting := "default"
+	if req.StripMetadata != nil {
+		setting = strconv.FormatBool(*req.StripMetadata)
+	}
+	h.Audit.Request(c, audit.ActionSettings, audit.OutcomeSuccess, 0, "strip_metadata="+setting)
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": req,
+	})
+}
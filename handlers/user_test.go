@@ -0,0 +1,102 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"go-secure-file-management/handlers"
+	"go-secure-file-management/repositories"
+	"go-secure-file-management/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+func userRouter(h *handlers.UserHandler, userId uint) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("userId", userId) })
+	r.POST("/api/register", h.Register)
+	r.POST("/api/login", h.Login)
+	r.GET("/api/user/settings", h.GetSettings)
+	r.PUT("/api/user/settings", h.UpdateSettings)
+	return r
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	users := repositories.NewMemoryUserStore()
+	events := &fakeAudit{}
+	r := userRouter(handlers.NewUserHandler(users, events), 0)
+	credentials := `{"email": "a@b.co", "password": "correct horse"}`
+
+	if w := serve(r, http.MethodPost, "/api/register", credentials, nil); w.Code != http.StatusCreated {
+		t.Fatalf("register: status %d: %s", w.Code, w.Body)
+	}
+	if w := serve(r, http.MethodPost, "/api/register", credentials, nil); w.Code != http.StatusConflict {
+		t.Errorf("registering twice: status %d, want 409", w.Code)
+	}
+	if w := serve(r, http.MethodPost, "/api/login", `{"email": "a@b.co", "password": "wrong horse"}`, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("wrong password: status %d, want 400", w.Code)
+	}
+	if got := events.last(); got != "auth.login failure" {
+		t.Errorf("last audit event %q, want auth.login failure", got)
+	}
+
+	user, err := users.FindUserByEmail("a@b.co")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users.SetRole(uint(user.ID), "admin")
+
+	w := serve(r, http.MethodPost, "/api/login", credentials, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login: status %d: %s", w.Code, w.Body)
+	}
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := utils.ValidateJWT(body.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserID != uint(user.ID) || claims.Role != "admin" {
+		t.Errorf("token for user %d with role %q, want %d with admin", claims.UserID, claims.Role, user.ID)
+	}
+	if got := events.last(); got != "auth.login success" {
+		t.Errorf("last audit event %q, want auth.login success", got)
+	}
+}
+
+func TestUpdateSettings(t *testing.T) {
+	users := repositories.NewMemoryUserStore()
+	user, err := users.CreateUser("a@b.co", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := userRouter(handlers.NewUserHandler(users, &fakeAudit{}), uint(user.ID))
+
+	enabled := true
+	for _, want := range []*bool{&enabled, nil} {
+		setting, err := json.Marshal(handlers.UserSettingsRequest{StripMetadata: want})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w := serve(r, http.MethodPut, "/api/user/settings", string(setting), nil); w.Code != http.StatusOK {
+			t.Fatalf("PUT %s: status %d: %s", setting, w.Code, w.Body)
+		}
+
+		w := serve(r, http.MethodGet, "/api/user/settings", "", nil)
+		var body struct {
+			Data handlers.UserSettingsRequest `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if got := body.Data.StripMetadata; (got == nil) != (want == nil) || got != nil && *got != *want {
+			t.Errorf("after PUT %s: GET returned %s", setting, w.Body)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+// Package janitor removes what interrupted uploads leave behind: upload
+// sessions nobody finished, stray temp files, and stored files without a
+// record.
+//
+// There is no quota to release: uploads don't reserve any while their
+// chunks arrive, storage is only charged when the pipeline stores the file
+// (see repositories.FileStore.FinalizeFile), in the same transaction as its
+// record. An expired session was never charged.
+package janitor
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go-secure-file-management/db"
+	"go-secure-file-management/jobs"
+	"go-secure-file-management/pipeline"
+	"go-secure-file-management/repositories"
+	"go-secure-file-management/thumbnail"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultTTL is how long an upload session may sit idle.
+	DefaultTTL      = 24 * time.Hour
+	DefaultInterval = time.Hour
+
+	// UploadDir holds the stored files, see pipeline.TempDir for the chunks.
+	UploadDir = "./uploads"
+
+	timeLayout = "2006-01-02 15:04:05"
+)
+
+// Session is an upload directory that expired.
+type Session struct {
+	UserId       uint      `json:"user_id"`
+	UploadId     string    `json:"upload_id"`
+	Chunks       int       `json:"chunks"`
+	Bytes        int64     `json:"bytes"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+// Report lists what a sweep removed, or would remove on a dry run.
+type Report struct {
+	DryRun          bool      `json:"dry_run"`
+	ExpiredSessions []Session `json:"expired_sessions"`
+	// files in the temp directory that aren't part of an upload session
+	OrphanTempFiles []string `json:"orphan_temp_files"`
+	// stored files and thumbnails without a files row
+	OrphanFiles []string `json:"orphan_files"`
+	BytesFreed  int64    `json:"bytes_freed"`
+}
+
+type Janitor struct {
+	DB    *sql.DB
+	Files repositories.FileStore
+	Tus   repositories.UploadSessionStore
+	Jobs  *jobs.Queue
+
+	// TTL is the idle time after which sessions expire. Orphaned files
+	// have to be this old as well, so files of an upload being finalized
+	// right now are left alone.
+	TTL    time.Duration
+	DryRun bool
+
+	dialect db.Dialect
+}
+
+func New(conn *sql.DB, files repositories.FileStore, tus repositories.UploadSessionStore, jobQueue *jobs.Queue) *Janitor {
+	return &Janitor{
+		DB:      conn,
+		Files:   files,
+		Tus:     tus,
+		Jobs:    jobQueue,
+		TTL:     DefaultTTL,
+		dialect: db.DialectOf(conn),
+	}
+}
+
+// Run sweeps every interval until ctx is done.
+func (j *Janitor) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		report, err := j.Sweep()
+		if err != nil {
+			log.Printf("Janitor sweep failed: %v", err)
+		}
+		if n := len(report.ExpiredSessions) + len(report.OrphanTempFiles) + len(report.OrphanFiles); n > 0 {
+			verb := "Removed"
+			if report.DryRun {
+				verb = "Would remove"
+			}
+			log.Printf("%s %d expired upload sessions and %d orphaned files, %d bytes", verb,
+				len(report.ExpiredSessions), len(report.OrphanTempFiles)+len(report.OrphanFiles), report.BytesFreed)
+		}
+	}
+}
+
+// Sweep expires idle upload sessions and removes orphaned files. Expired
+// sessions are recorded in the expired_uploads table. On a dry run nothing
+// is removed or recorded, the report lists what would have been.
+func (j *Janitor) Sweep() (Report, error) {
+	report := Report{
+		DryRun:          j.DryRun,
+		ExpiredSessions: []Session{},
+		OrphanTempFiles: []string{},
+		OrphanFiles:     []string{},
+	}
+	cutoff := time.Now().Add(-j.TTL)
+
+	if err := j.sweepTemp(cutoff, &report); err != nil {
+		return report, err
+	}
+	if err := j.sweepFiles(cutoff, &report); err != nil {
+		return report, err
+	}
+
+	return report, nil
+}
+
+// SweepTemp is Sweep limited to the temp directory: expired sessions and
+// stray temp files. Stored files are left alone.
+func (j *Janitor) SweepTemp() (Report, error) {
+	report := Report{
+		DryRun:          j.DryRun,
+		ExpiredSessions: []Session{},
+		OrphanTempFiles: []string{},
+		OrphanFiles:     []string{},
+	}
+
+	err := j.sweepTemp(time.Now().Add(-j.TTL), &report)
+	return report, err
+}
+
+// sweepTemp walks pipeline.TempDir, laid out as <userId>/<uploadId>/chunks.
+func (j *Janitor) sweepTemp(cutoff time.Time, report *Report) error {
+	users, err := os.ReadDir(pipeline.TempDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, user := range users {
+		path := filepath.Join(pipeline.TempDir, user.Name())
+		userId, err := strconv.ParseUint(user.Name(), 10, 32)
+		if !user.IsDir() || err != nil {
+			// e.g. chunks stored before uploads were kept per user
+			j.removeOrphan(path, cutoff, &report.OrphanTempFiles, report)
+			continue
+		}
+
+		uploads, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, upload := range uploads {
+			uploadPath := filepath.Join(path, upload.Name())
+			if !upload.IsDir() {
+				j.removeOrphan(uploadPath, cutoff, &report.OrphanTempFiles, report)
+				continue
+			}
+			if err := j.expireSession(uint(userId), upload.Name(), cutoff, report); err != nil {
+				return err
+			}
+		}
+
+		if !j.DryRun {
+			// only succeeds once the user has no sessions left
+			os.Remove(path)
+		}
+	}
+
+	return nil
+}
+
+// expireSession removes an upload directory that saw no chunk for the TTL,
+// unless its upload is still being processed or it's a live tus upload,
+// which expires on its own schedule.
+func (j *Janitor) expireSession(userId uint, uploadId string, cutoff time.Time, report *Report) error {
+	dir := pipeline.UploadDir(userId, uploadId)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	session := Session{UserId: userId, UploadId: uploadId, LastActivity: info.ModTime()}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(session.LastActivity) {
+			session.LastActivity = info.ModTime()
+		}
+		if !strings.HasPrefix(entry.Name(), ".") {
+			session.Chunks++
+		}
+		session.Bytes += info.Size()
+	}
+	if session.LastActivity.After(cutoff) {
+		return nil
+	}
+
+	if id, ok := strings.CutPrefix(uploadId, "tus-"); ok {
+		exists, err := j.Tus.UploadExists(id)
+		if err != nil || exists {
+			return err
+		}
+	}
+	if j.processing(dir) {
+		return nil
+	}
+
+	report.ExpiredSessions = append(report.ExpiredSessions, session)
+	report.BytesFreed += session.Bytes
+	if j.DryRun {
+		return nil
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove upload session %s: %v", dir, err)
+	}
+	_, err = j.DB.Exec(j.dialect.Rebind("INSERT INTO expired_uploads (user_id, upload_id, chunks, bytes, last_activity) VALUES (?, ?, ?, ?, ?)"),
+		userId, uploadId, session.Chunks, session.Bytes, session.LastActivity.UTC().Format(timeLayout))
+	if err != nil {
+		return fmt.Errorf("failed to record expired upload: %v", err)
+	}
+
+	return nil
+}
+
+// processing reports whether the upload in dir was queued and its job
+// hasn't finished yet.
+func (j *Janitor) processing(dir string) bool {
+	marker, err := os.ReadFile(filepath.Join(dir, pipeline.QueuedMarker))
+	if err != nil {
+		return false
+	}
+	jobId, err := strconv.ParseInt(string(marker), 10, 64)
+	if err != nil {
+		return false
+	}
+
+	job, err := j.Jobs.GetJob(jobId)
+	if err != nil {
+		return false
+	}
+	return job.Status == jobs.StatusQueued || job.Status == jobs.StatusRunning
+}
+
+// sweepFiles removes stored files and thumbnails no record points to, e.g.
+// when creating the record failed after the upload was merged.
+func (j *Janitor) sweepFiles(cutoff time.Time, report *Report) error {
+	entries, err := os.ReadDir(UploadDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		// stored paths are relative and cleaned, e.g. uploads/report.pdf
+		path := filepath.Join(UploadDir, entry.Name())
+		recordPath := path
+		if original, ok := thumbnail.Original(path); ok {
+			recordPath = original
+		}
+
+		exists, err := j.Files.PathExists(recordPath)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			j.removeOrphan(path, cutoff, &report.OrphanFiles, report)
+		}
+	}
+
+	return nil
+}
+
+// removeOrphan removes path if it's older than cutoff and adds it to list.
+func (j *Janitor) removeOrphan(path string, cutoff time.Time, list *[]string, report *Report) {
+	info, err := os.Stat(path)
+	if err != nil || info.ModTime().After(cutoff) {
+		return
+	}
+
+	size := info.Size()
+	if info.IsDir() {
+		size = dirSize(path)
+	}
+	if !j.DryRun {
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("Failed to remove %s: %v", path, err)
+			return
+		}
+	}
+
+	*list = append(*list, path)
+	report.BytesFreed += size
+}
+
+func dirSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
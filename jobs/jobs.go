@@ -0,0 +1,453 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-secure-file-management/db"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Job states. Failed attempts go back to queued until MaxAttempts is
+// reached, then the job is dead-lettered. Permanent errors, e.g. a rejected
+// upload, fail the job without retrying.
+const (
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusDead      = "dead"
+)
+
+const (
+	DefaultMaxAttempts = 5
+	DefaultWorkers     = 2
+	// DefaultLease is how long a claimed job stays locked without a
+	// heartbeat, i.e. how soon the job of a killed worker is run again.
+	DefaultLease = 2 * time.Minute
+
+	pollInterval = time.Second
+	baseBackoff  = 2 * time.Second
+	maxBackoff   = 5 * time.Minute
+
+	timeLayout = "2006-01-02 15:04:05"
+)
+
+var ErrJobNotFound = errors.New("job not found")
+
+// ErrLeaseLost is returned by Checkpoint when the job was given to another
+// worker, e.g. because the heartbeat couldn't reach the database in time.
+var ErrLeaseLost = errors.New("job lease lost")
+
+// Handler runs a job. Handlers must be idempotent: a job whose worker died
+// mid-way is run again, so they should pick up from job.Step.
+type Handler func(ctx context.Context, job *Job) error
+
+type Job struct {
+	ID          int64           `json:"id"`
+	UserId      uint            `json:"user_id"`
+	Type        string          `json:"type"`
+	Status      string          `json:"status"`
+	Step        string          `json:"step"`     // last completed step
+	Progress    int             `json:"progress"` // percent
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	LastError   string          `json:"last_error"`
+	Payload     json.RawMessage `json:"-"`
+	State       json.RawMessage `json:"state"` // handler-defined, e.g. ids of created records
+	CreatedAt   string          `json:"created_at"`
+	UpdatedAt   string          `json:"updated_at"`
+
+	queue *Queue
+}
+
+// Decode unmarshals the payload the job was enqueued with.
+func (j *Job) Decode(v interface{}) error {
+	return json.Unmarshal(j.Payload, v)
+}
+
+// DecodeState unmarshals the state saved by a previous attempt, if any.
+func (j *Job) DecodeState(v interface{}) error {
+	if len(j.State) == 0 {
+		return nil
+	}
+	return json.Unmarshal(j.State, v)
+}
+
+// Checkpoint records a completed step with the handler state needed to
+// resume after it, and extends the job's lease.
+func (j *Job) Checkpoint(step string, progress int, state interface{}) error {
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	result, err := j.queue.DB.Exec(
+		j.queue.dialect.Rebind("UPDATE jobs SET step = ?, progress = ?, state = ?, locked_until = ?, updated_at = CURRENT_TIMESTAMP WHERE "+leased),
+		step, progress, string(raw), formatTime(time.Now().Add(j.queue.lease())), j.ID, StatusRunning, j.Attempts,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrLeaseLost
+	}
+
+	j.Step, j.Progress, j.State = step, progress, raw
+	return nil
+}
+
+// leased matches a job while the worker that claimed it holds the lease,
+// with the job's id, StatusRunning and the attempt it claimed as
+// arguments. Claiming counts an attempt, so a job taken over by another
+// worker no longer matches.
+const leased = "id = ? AND status = ? AND attempts = ?"
+
+// LastAttempt reports whether a failure now would dead-letter the job.
+func (j *Job) LastAttempt() bool {
+	return j.Attempts >= j.MaxAttempts
+}
+
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks an error as not worth retrying; the job fails right away.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// Queue is a durable job queue stored in the jobs table and worked off by
+// a pool of goroutines.
+type Queue struct {
+	DB      *sql.DB
+	Workers int
+	// Lease is how long a job stays claimed without a heartbeat; running
+	// jobs are extended every quarter of it.
+	Lease time.Duration
+
+	dialect  db.Dialect
+	mu       sync.RWMutex
+	handlers map[string]Handler
+	notify   chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewQueue(conn *sql.DB) *Queue {
+	return &Queue{
+		DB:       conn,
+		Workers:  DefaultWorkers,
+		Lease:    DefaultLease,
+		dialect:  db.DialectOf(conn),
+		handlers: make(map[string]Handler),
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+func (q *Queue) Register(jobType string, h Handler) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.handlers[jobType] = h
+}
+
+// Enqueue stores a job and wakes up an idle worker.
+func (q *Queue) Enqueue(userId uint, jobType string, payload interface{}) (int64, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int64
+	err = q.DB.QueryRow(
+		q.dialect.Rebind("INSERT INTO jobs (user_id, type, payload, max_attempts, run_at) VALUES (?, ?, ?, ?, ?) RETURNING id"),
+		userId, jobType, string(raw), DefaultMaxAttempts, formatTime(time.Now()),
+	).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to enqueue %s job: %v", jobType, err)
+	}
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+
+	return id, nil
+}
+
+func (q *Queue) GetJob(id int64) (Job, error) {
+	row := q.DB.QueryRow(q.dialect.Rebind(`
+		SELECT id, user_id, type, status, step, progress, attempts, max_attempts, last_error, payload, state, created_at, updated_at
+		FROM jobs WHERE id = ?`), id)
+
+	job, err := scanJob(row)
+	if err == sql.ErrNoRows {
+		return Job{}, ErrJobNotFound
+	}
+	job.queue = q
+	return job, err
+}
+
+// Start launches the workers. They stop picking up jobs when ctx is
+// cancelled; Wait blocks until running jobs have returned.
+func (q *Queue) Start(ctx context.Context) {
+	workers := q.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			q.work(ctx)
+		}()
+	}
+}
+
+func (q *Queue) Wait() {
+	q.wg.Wait()
+}
+
+func (q *Queue) lease() time.Duration {
+	if q.Lease <= 0 {
+		return DefaultLease
+	}
+	return q.Lease
+}
+
+func (q *Queue) work(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := q.releaseExpired(); err != nil {
+			log.Printf("Failed to release expired jobs: %v", err)
+		}
+
+		for ctx.Err() == nil {
+			job, err := q.claim()
+			if err != nil {
+				if err != sql.ErrNoRows {
+					log.Printf("Failed to claim job: %v", err)
+				}
+				break
+			}
+			q.run(ctx, job)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-q.notify:
+		}
+	}
+}
+
+// claim atomically moves the oldest due job to running. The status is
+// checked again by the UPDATE, so a job claimed by another worker in the
+// meantime is never claimed twice.
+func (q *Queue) claim() (*Job, error) {
+	now := time.Now()
+	row := q.DB.QueryRow(q.dialect.Rebind(`
+		UPDATE jobs
+		SET status = ?, attempts = attempts + 1, locked_until = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = (
+			SELECT id FROM jobs WHERE status = ? AND run_at <= ? ORDER BY run_at, id LIMIT 1 `+q.dialect.SkipLocked()+`
+		) AND status = ?
+		RETURNING id, user_id, type, status, step, progress, attempts, max_attempts, last_error, payload, state, created_at, updated_at`),
+		StatusRunning, formatTime(now.Add(q.lease())), StatusQueued, formatTime(now), StatusQueued,
+	)
+
+	job, err := scanJob(row)
+	if err != nil {
+		return nil, err
+	}
+	job.queue = q
+	return &job, nil
+}
+
+// releaseExpired requeues running jobs whose worker vanished, e.g. because
+// the process was killed.
+func (q *Queue) releaseExpired() error {
+	_, err := q.DB.Exec(
+		q.dialect.Rebind("UPDATE jobs SET status = ?, updated_at = CURRENT_TIMESTAMP WHERE status = ? AND locked_until < ?"),
+		StatusQueued, StatusRunning, formatTime(time.Now()),
+	)
+	return err
+}
+
+func (q *Queue) run(ctx context.Context, job *Job) {
+	q.mu.RLock()
+	handler, ok := q.handlers[job.Type]
+	q.mu.RUnlock()
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	lost := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if !q.heartbeat(jobCtx, job) {
+			close(lost)
+			cancel()
+		}
+	}()
+
+	var err error
+	if !ok {
+		err = Permanent(fmt.Errorf("no handler registered for job type %q", job.Type))
+	} else {
+		err = safeRun(jobCtx, handler, job)
+	}
+	cancel()
+	<-stopped
+
+	select {
+	case <-lost:
+		// whatever the outcome, the job belongs to another worker now
+		log.Printf("Job %d (%s) lost its lease, leaving it to the worker that took it over: %v", job.ID, job.Type, err)
+		return
+	default:
+	}
+
+	if err == nil {
+		q.finish(job, StatusSucceeded, "", time.Time{})
+		return
+	}
+
+	// interrupted by a shutdown, not the job's fault: it resumes from its
+	// last step on the next start without using up an attempt
+	if ctx.Err() != nil {
+		log.Printf("Job %d (%s) interrupted, requeued: %v", job.ID, job.Type, err)
+		q.requeue(job)
+		return
+	}
+
+	var permanent permanentError
+	if errors.As(err, &permanent) {
+		log.Printf("Job %d (%s) failed: %v", job.ID, job.Type, err)
+		q.finish(job, StatusFailed, err.Error(), time.Time{})
+		return
+	}
+
+	if job.LastAttempt() {
+		log.Printf("Job %d (%s) dead-lettered after %d attempts: %v", job.ID, job.Type, job.Attempts, err)
+		q.finish(job, StatusDead, err.Error(), time.Time{})
+		return
+	}
+
+	log.Printf("Job %d (%s) failed attempt %d, retrying: %v", job.ID, job.Type, job.Attempts, err)
+	q.finish(job, StatusQueued, err.Error(), time.Now().Add(backoff(job.Attempts)))
+}
+
+// heartbeat extends the lease of a running job until ctx is done, so steps
+// may take longer than the lease. It returns false when the lease was lost:
+// the job expired and was claimed again, and the handler has to stop.
+// Failing to reach the database only counts once the lease ran out.
+func (q *Queue) heartbeat(ctx context.Context, job *Job) bool {
+	lease := q.lease()
+	ticker := time.NewTicker(lease / 4)
+	defer ticker.Stop()
+
+	expires := time.Now().Add(lease)
+	for {
+		select {
+		case <-ctx.Done():
+			return true
+		case <-ticker.C:
+		}
+
+		next := time.Now().Add(lease)
+		result, err := q.DB.Exec(
+			q.dialect.Rebind("UPDATE jobs SET locked_until = ? WHERE "+leased),
+			formatTime(next), job.ID, StatusRunning, job.Attempts,
+		)
+		if err != nil {
+			log.Printf("Failed to extend the lease of job %d: %v", job.ID, err)
+			if time.Now().After(expires) {
+				return false
+			}
+			continue
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return false
+		}
+		expires = next
+	}
+}
+
+func safeRun(ctx context.Context, handler Handler, job *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return handler(ctx, job)
+}
+
+func (q *Queue) requeue(job *Job) {
+	_, err := q.DB.Exec(q.dialect.Rebind(`
+		UPDATE jobs SET status = ?, attempts = attempts - 1, locked_until = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE `+leased), StatusQueued, job.ID, StatusRunning, job.Attempts)
+	if err != nil {
+		log.Printf("Failed to requeue job %d: %v", job.ID, err)
+	}
+}
+
+func (q *Queue) finish(job *Job, status string, lastError string, runAt time.Time) {
+	query := "UPDATE jobs SET status = ?, last_error = ?, locked_until = NULL, updated_at = CURRENT_TIMESTAMP"
+	args := []interface{}{status, lastError}
+	if status == StatusSucceeded {
+		query += ", progress = 100"
+	}
+	if !runAt.IsZero() {
+		query += ", run_at = ?"
+		args = append(args, formatTime(runAt))
+	}
+	query += " WHERE " + leased
+	args = append(args, job.ID, StatusRunning, job.Attempts)
+
+	if _, err := q.DB.Exec(q.dialect.Rebind(query), args...); err != nil {
+		log.Printf("Failed to update job %d: %v", job.ID, err)
+	}
+}
+
+// backoff grows exponentially with the attempt number, with jitter so
+// retries of jobs that failed together don't line up.
+func backoff(attempt int) time.Duration {
+	d := baseBackoff << (attempt - 1)
+	if d <= 0 || d > maxBackoff {
+		d = maxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanJob(row rowScanner) (Job, error) {
+	var job Job
+	var payload, state string
+	err := row.Scan(&job.ID, &job.UserId, &job.Type, &job.Status, &job.Step, &job.Progress, &job.Attempts,
+		&job.MaxAttempts, &job.LastError, &payload, &state, &job.CreatedAt, &job.UpdatedAt)
+	if err != nil {
+		return Job{}, err
+	}
+
+	job.Payload = json.RawMessage(payload)
+	if state != "" {
+		job.State = json.RawMessage(state)
+	}
+	return job, nil
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(timeLayout)
+}
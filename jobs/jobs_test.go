@@ -0,0 +1,207 @@
+package jobs_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-secure-file-management/db"
+	"go-secure-file-management/db/dbtest"
+	"go-secure-file-management/jobs"
+)
+
+func newQueue(t *testing.T, conn *sql.DB, lease time.Duration) *jobs.Queue {
+	t.Helper()
+
+	if _, err := conn.Exec("INSERT INTO users (email, password) VALUES ('a@b.co', 'x')"); err != nil {
+		t.Fatal(err)
+	}
+	q := jobs.NewQueue(conn)
+	q.Workers = 2
+	q.Lease = lease
+	return q
+}
+
+func start(t *testing.T, q *jobs.Queue) {
+	ctx, cancel := context.WithCancel(context.Background())
+	q.Start(ctx)
+	t.Cleanup(func() {
+		cancel()
+		q.Wait()
+	})
+}
+
+func waitFor(t *testing.T, q *jobs.Queue, id int64, timeout time.Duration, done func(jobs.Job) bool) jobs.Job {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		job, err := q.GetJob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if done(job) {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %d still %s after %s", id, job.Status, timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func finished(job jobs.Job) bool {
+	return job.Status != jobs.StatusQueued && job.Status != jobs.StatusRunning
+}
+
+// A step running several leases long must not be handed to the other
+// worker: the heartbeat keeps the lease.
+func TestJobOutlastingLeaseRunsOnce(t *testing.T) {
+	dbtest.Run(t, dbtest.Migrated, func(t *testing.T, conn *sql.DB) {
+		q := newQueue(t, conn, 2*time.Second)
+		var runs atomic.Int32
+		q.Register("slow", func(ctx context.Context, job *jobs.Job) error {
+			runs.Add(1)
+			select {
+			case <-time.After(5 * time.Second):
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		start(t, q)
+
+		id, err := q.Enqueue(1, "slow", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		job := waitFor(t, q, id, 15*time.Second, finished)
+
+		if job.Status != jobs.StatusSucceeded || job.Attempts != 1 {
+			t.Errorf("job ended %s after %d attempts, want succeeded after 1", job.Status, job.Attempts)
+		}
+		if n := runs.Load(); n != 1 {
+			t.Errorf("handler ran %d times, want 1", n)
+		}
+	})
+}
+
+// A worker whose job was taken over stops it and leaves the row to the new
+// owner.
+func TestLostLeaseStopsJob(t *testing.T) {
+	dbtest.Run(t, dbtest.Migrated, func(t *testing.T, conn *sql.DB) {
+		q := newQueue(t, conn, 2*time.Second)
+		started := make(chan struct{})
+		checkpoint := make(chan error, 1)
+		q.Register("blocking", func(ctx context.Context, job *jobs.Job) error {
+			close(started)
+			<-ctx.Done()
+			checkpoint <- job.Checkpoint("after", 50, nil)
+			return ctx.Err()
+		})
+		start(t, q)
+
+		id, err := q.Enqueue(1, "blocking", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-started
+
+		// what claiming the expired job again looks like to the old worker
+		_, err = conn.Exec(db.DialectOf(conn).Rebind("UPDATE jobs SET attempts = attempts + 1 WHERE id = ?"), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case err := <-checkpoint:
+			if !errors.Is(err, jobs.ErrLeaseLost) {
+				t.Errorf("Checkpoint after losing the lease: err = %v, want ErrLeaseLost", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler wasn't stopped after losing the lease")
+		}
+
+		time.Sleep(200 * time.Millisecond)
+		job, err := q.GetJob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != jobs.StatusRunning || job.Attempts != 2 || job.Step != "" || job.LastError != "" {
+			t.Errorf("old worker touched the job: status %s, attempts %d, step %q, last_error %q", job.Status, job.Attempts, job.Step, job.LastError)
+		}
+	})
+}
+
+func TestPermanentErrorFailsWithoutRetry(t *testing.T) {
+	dbtest.Run(t, dbtest.Migrated, func(t *testing.T, conn *sql.DB) {
+		q := newQueue(t, conn, jobs.DefaultLease)
+		q.Register("reject", func(ctx context.Context, job *jobs.Job) error {
+			return jobs.Permanent(errors.New("rejected"))
+		})
+		start(t, q)
+
+		id, err := q.Enqueue(1, "reject", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		job := waitFor(t, q, id, 5*time.Second, finished)
+
+		if job.Status != jobs.StatusFailed || job.Attempts != 1 || job.LastError != "rejected" {
+			t.Errorf("job ended %s after %d attempts with %q, want failed after 1 with \"rejected\"", job.Status, job.Attempts, job.LastError)
+		}
+	})
+}
+
+// Replicas polling the same table claim every job once. Only Postgres runs
+// claims concurrently, SQLite takes one writer at a time.
+func TestConcurrentClaimsRunJobsOnce(t *testing.T) {
+	conn := dbtest.Migrated(t, db.Postgres)
+	const replicas, jobCount = 4, 40
+
+	var mu sync.Mutex
+	runs := map[int64]int{}
+	handler := func(ctx context.Context, job *jobs.Job) error {
+		mu.Lock()
+		runs[job.ID]++
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}
+
+	queues := []*jobs.Queue{newQueue(t, conn, jobs.DefaultLease)}
+	for len(queues) < replicas {
+		queues = append(queues, jobs.NewQueue(conn))
+	}
+	ids := make([]int64, jobCount)
+	for i := range ids {
+		id, err := queues[0].Enqueue(1, "count", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = id
+	}
+	for _, q := range queues {
+		q.Workers = 4
+		q.Register("count", handler)
+		start(t, q)
+	}
+
+	for _, id := range ids {
+		job := waitFor(t, queues[0], id, 30*time.Second, finished)
+		if job.Status != jobs.StatusSucceeded || job.Attempts != 1 {
+			t.Errorf("job %d ended %s after %d attempts, want succeeded after 1", id, job.Status, job.Attempts)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, id := range ids {
+		if runs[id] != 1 {
+			t.Errorf("job %d ran %d times, want 1", id, runs[id])
+		}
+	}
+}
@@ -1,10 +1,26 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"flag"
+	"go-secure-file-management/audit"
+	"go-secure-file-management/config"
 	"go-secure-file-management/db"
-	"go-secure-file-management/middleware"
+	"go-secure-file-management/fsck"
+	"go-secure-file-management/janitor"
+	"go-secure-file-management/jobs"
+	"go-secure-file-management/repositories"
 	"go-secure-file-management/routes"
+	"go-secure-file-management/search"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"fmt"
 
@@ -16,14 +32,293 @@ func main() {
 		log.Println("No .env file found")
 	}
 
-	go middleware.ResetRateLimit()
+	if len(os.Args) > 1 {
+		cfg := loadConfig(config.LoadForCommand)
+		switch os.Args[1] {
+		case "gc":
+			runGC(cfg, os.Args[2:])
+			return
+		case "fsck":
+			runFsck(cfg, os.Args[2:])
+			return
+		case "verify-audit":
+			runVerifyAudit(cfg, os.Args[2:])
+			return
+		case "export-audit":
+			runExportAudit(cfg, os.Args[2:])
+			return
+		case "migrate":
+			runMigrate(cfg, os.Args[2:])
+			return
+		default:
+			log.Fatalf("Unknown command %q, available: gc, fsck, verify-audit, export-audit, migrate", os.Args[1])
+		}
+	}
+
+	cfg := loadConfig(config.Load)
+
+	conn := db.Init(cfg.Database.URL)
+	defer conn.Close()
+
+	// background work stops only after the requests using it have drained
+	workers, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	r, waitWorkers := routes.SetupRouter(workers, conn, cfg)
 
-	db.Init("./my_db.db")
-	defer db.DB.Close()
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.Server.Port),
+		Handler:           r,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+		MaxHeaderBytes:    cfg.Server.MaxHeaderBytes,
+	}
 
-	r := routes.SetupRouter(db.DB)
-	r.Static("/uploads", "./uploads")
+	stop, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
 
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
 	fmt.Printf("Starting server...\n")
-	r.Run()
+
+	<-stop.Done()
+	// a second signal kills the process right away
+	cancel()
+	log.Printf("Shutting down, waiting up to %s for running requests", cfg.Server.ShutdownTimeout)
+	shutdown(server, stopWorkers, waitWorkers, cfg.Server.ShutdownTimeout)
+}
+
+// shutdown stops accepting connections, lets running requests finish, then
+// stops the background workers, all within timeout. Requests still running
+// after it are cut off.
+func shutdown(server *http.Server, stopWorkers context.CancelFunc, waitWorkers func(), timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Requests still running after %s, closing their connections: %v", timeout, err)
+		server.Close()
+	}
+
+	stopWorkers()
+	done := make(chan struct{})
+	go func() {
+		waitWorkers()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Println("Server stopped")
+	case <-ctx.Done():
+		log.Printf("Background workers still running after %s, exiting anyway", timeout)
+	}
+}
+
+// loadConfig reads the configuration named by CONFIG_PATH and changes into
+// its storage directory, or exits listing what is wrong with it.
+func loadConfig(load func(path string) (*config.Config, error)) *config.Config {
+	cfg, err := load(config.PathFromEnv())
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	if err := os.Chdir(cfg.Storage.Dir); err != nil {
+		log.Fatalf("Failed to enter storage directory: %v", err)
+	}
+	return cfg
+}
+
+// runGC sweeps abandoned uploads once and prints the report as JSON.
+func runGC(cfg *config.Config, args []string) {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "report what would be removed without removing it")
+	ttl := flags.Duration("ttl", cfg.Janitor.SessionTTL, "idle time after which upload sessions expire")
+	flags.Parse(args)
+
+	conn := db.Init(cfg.Database.URL)
+	defer conn.Close()
+
+	j := janitor.New(conn, repositories.NewFileRepository(conn), repositories.NewTusRepository(conn), jobs.NewQueue(conn))
+	j.TTL = *ttl
+	j.DryRun = *dryRun
+
+	report, err := j.Sweep()
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(out))
+	if err != nil {
+		log.Fatalf("Sweep failed: %v", err)
+	}
+}
+
+// runFsck checks the files table against the stored files and prints the
+// report as JSON. It exits with 1 when findings are left unresolved and 2
+// when the check itself failed, for cron alerting.
+func runFsck(cfg *config.Config, args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "delete rows of missing files, correct sizes and remove stale temp chunks")
+	quarantine := flags.Bool("quarantine", false, "move orphaned and modified files to the quarantine")
+	deleteBlobs := flags.Bool("delete", false, "delete orphaned and modified files")
+	hash := flags.Bool("hash", true, "compare files to their upload hash")
+	minAge := flags.Duration("min-age", time.Hour, "ignore orphaned files and temp chunks younger than this")
+	flags.Parse(args)
+
+	blobs, err := fsck.ParseBlobAction(*quarantine, *deleteBlobs)
+	if err != nil {
+		log.Println(err)
+		os.Exit(2)
+	}
+
+	conn := db.Init(cfg.Database.URL)
+	defer conn.Close()
+
+	fileRepo := repositories.NewFileRepository(conn)
+	j := janitor.New(conn, fileRepo, repositories.NewTusRepository(conn), jobs.NewQueue(conn))
+	checker := fsck.New(fileRepo, search.NewIndexer(conn), j)
+
+	report, err := checker.Check(fsck.Options{
+		Repair: *repair,
+		Blobs:  blobs,
+		Hash:   *hash,
+		MinAge: *minAge,
+	})
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(out))
+	if err != nil {
+		log.Printf("Check failed: %v", err)
+		os.Exit(2)
+	}
+	if report.Unresolved > 0 {
+		os.Exit(1)
+	}
+}
+
+// runVerifyAudit checks the audit log's hash chain and checkpoints, in the
+// database or in an export, and prints the report as JSON. Exit codes are
+// those of fsck.
+func runVerifyAudit(cfg *config.Config, args []string) {
+	flags := flag.NewFlagSet("verify-audit", flag.ExitOnError)
+	file := flags.String("file", "", "verify an export instead of the database")
+	publicKey := flags.String("public-key", "", "base64 public key checkpoints must be signed with, defaults to the one of audit.signing_key")
+	flags.Parse(args)
+
+	var key ed25519.PublicKey
+	var err error
+	switch {
+	case *publicKey != "":
+		key, err = audit.ParsePublicKey(*publicKey)
+	case cfg.Audit.SigningKey != "":
+		var private ed25519.PrivateKey
+		private, err = audit.ParseSigningKey(cfg.Audit.SigningKey)
+		if err == nil {
+			key = private.Public().(ed25519.PublicKey)
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		os.Exit(2)
+	}
+
+	var report audit.VerifyReport
+	if *file != "" {
+		f, openErr := os.Open(*file)
+		if openErr != nil {
+			log.Println(openErr)
+			os.Exit(2)
+		}
+		defer f.Close()
+		report, err = audit.VerifyExport(f, key)
+	} else {
+		conn := db.Init(cfg.Database.URL)
+		defer conn.Close()
+		report, err = audit.NewLogger(conn).Verify(key)
+	}
+
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(out))
+	if err != nil {
+		log.Printf("Verification failed: %v", err)
+		os.Exit(2)
+	}
+	if len(report.Findings) > 0 {
+		os.Exit(1)
+	}
+}
+
+// runExportAudit writes the audit log with its checkpoints as JSON lines,
+// for archiving outside the server.
+func runExportAudit(cfg *config.Config, args []string) {
+	flags := flag.NewFlagSet("export-audit", flag.ExitOnError)
+	output := flags.String("o", "", "file to write to instead of stdout")
+	flags.Parse(args)
+
+	out := os.Stdout
+	if *output != "" {
+		f, err := os.OpenFile(*output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+		if err != nil {
+			log.Fatalf("Failed to create export: %v", err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	conn := db.Init(cfg.Database.URL)
+	defer conn.Close()
+
+	if err := audit.NewLogger(conn).Export(out); err != nil {
+		log.Fatalf("Export failed: %v", err)
+	}
+}
+
+// runMigrate applies or rolls back schema migrations, or lists them. The
+// server applies pending ones on start, so `up` is only needed to migrate
+// ahead of a deploy.
+func runMigrate(cfg *config.Config, args []string) {
+	usage := "usage: migrate up [-to version] | down [-steps n] | status"
+	if len(args) == 0 {
+		log.Fatal(usage)
+	}
+
+	flags := flag.NewFlagSet("migrate "+args[0], flag.ExitOnError)
+	to := flags.Int("to", 0, "last version to apply, default all")
+	steps := flags.Int("steps", 1, "number of migrations to roll back")
+	flags.Parse(args[1:])
+
+	conn := db.Open(cfg.Database.URL)
+	defer conn.Close()
+
+	var migrations []db.Migration
+	var err error
+	switch args[0] {
+	case "up":
+		migrations, err = db.MigrateUp(conn, *to)
+		for _, m := range migrations {
+			fmt.Printf("Applied %d_%s\n", m.Version, m.Name)
+		}
+	case "down":
+		migrations, err = db.MigrateDown(conn, *steps)
+		for _, m := range migrations {
+			fmt.Printf("Rolled back %d_%s\n", m.Version, m.Name)
+		}
+	case "status":
+		statuses, statusErr := db.MigrationStatuses(conn)
+		out, _ := json.MarshalIndent(statuses, "", "  ")
+		fmt.Println(string(out))
+		if statusErr != nil {
+			log.Fatalf("Migration failed: %v", statusErr)
+		}
+		for _, status := range statuses {
+			if status.Modified || status.Missing {
+				os.Exit(1)
+			}
+		}
+	default:
+		log.Fatal(usage)
+	}
+
+	if err != nil {
+		log.Fatalf("Migration failed: %v", err)
+	}
 }
@@ -37,8 +37,22 @@ func JWTAuth() gin.HandlerFunc {
 
 			fmt.Printf("Fullpath %s", c.FullPath())
 
-			switch c.FullPath() {
-			case "/api/file/upload-chunk":
+			switch {
+			case c.FullPath() == "/api/file/upload-chunk" && c.Request.Method == http.MethodPut:
+				if contentType != "application/octet-stream" {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "Content-Type must be application/octet-stream for streamed uploads"})
+					c.Abort()
+					return
+				}
+			case c.FullPath() == "/api/file/tus":
+				// tus creation requests have no body
+			case c.FullPath() == "/api/file/tus/:uploadId":
+				if contentType != "application/offset+octet-stream" {
+					c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be application/offset+octet-stream"})
+					c.Abort()
+					return
+				}
+			case c.FullPath() == "/api/file/upload-chunk":
 				if !strings.HasPrefix(contentType, "multipart/form-data") {
 					c.JSON(http.StatusBadRequest, gin.H{"error": "Content-Type must be multipart/form-data for file uploads"})
 					c.Abort()
@@ -55,6 +69,7 @@ func JWTAuth() gin.HandlerFunc {
 
 		c.Set("claims", claims)
 		c.Set("userId", claims.UserID)
+		c.Set("role", claims.Role)
 		c.Next()
 	}
 }
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BodyLimits caps request bodies at limit bytes, or at the limit routes
+// sets for a route, keyed by method and path as registered, e.g.
+// "PUT /api/file/upload-chunk". 0 means unlimited. It has to run before
+// anything reads the body, so it is installed on the engine: route
+// middleware could only lower the limit.
+func BodyLimits(limit int64, routes map[string]int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		routeLimit := limit
+		if value, ok := routes[c.Request.Method+" "+c.FullPath()]; ok {
+			routeLimit = value
+		}
+		if routeLimit <= 0 {
+			c.Next()
+			return
+		}
+
+		if c.Request.ContentLength > routeLimit {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("request body exceeds %d bytes", routeLimit)})
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, routeLimit)
+
+		c.Next()
+	}
+}
+
+// Deadline replaces the server's read and write timeouts for routes whose
+// bodies may take long to transfer, e.g. uploads and downloads. 0 removes
+// them.
+func Deadline(timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var deadline time.Time
+		if timeout > 0 {
+			deadline = time.Now().Add(timeout)
+		}
+
+		controller := http.NewResponseController(c.Writer)
+		if err := controller.SetReadDeadline(deadline); err != nil {
+			log.Printf("Failed to set read deadline: %v", err)
+		}
+		if err := controller.SetWriteDeadline(deadline); err != nil {
+			log.Printf("Failed to set write deadline: %v", err)
+		}
+
+		c.Next()
+	}
+}
@@ -1,51 +1,78 @@
 package middleware
 
 import (
-	"errors"
+	"fmt"
+	"go-secure-file-management/ratelimit"
+	"log"
 	"net/http"
-	"sync"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-var (
-	rateLimitMap = make(map[string]int) // Store request count per IP
-	mu           sync.Mutex             // Prevent race conditions
-)
+// KeyFunc picks the bucket a request counts against.
+type KeyFunc func(c *gin.Context) string
 
-const (
-	limit     = 200             // Max requests per minute
-	resetTime = 1 * time.Minute // Reset period
-)
+// ByIP counts requests per client address.
+func ByIP(c *gin.Context) string {
+	return "ip:" + c.ClientIP()
+}
 
-func ResetRateLimit() {
-	for {
-		time.Sleep(resetTime)
-		mu.Lock()
-		rateLimitMap = make(map[string]int) // Reset all counts
-		mu.Unlock()
+// ByUser counts requests per user, and per address before JWTAuth has
+// identified one.
+func ByUser(c *gin.Context) string {
+	if userId := c.GetUint("userId"); userId != 0 {
+		return "user:" + strconv.FormatUint(uint64(userId), 10)
 	}
+	return ByIP(c)
 }
 
-func RateLimiter() gin.HandlerFunc {
+// RateLimiter limits a route to the limit called name per key, looked up
+// on every request so reloaded limits apply right away. name also keeps the
+// buckets of routes with different limits apart. Every response carries the
+// RateLimit-* headers, rejected ones Retry-After as well.
+func RateLimiter(limiter *ratelimit.Limiter, limits *ratelimit.Limits, name string, key KeyFunc) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		clientIP := c.ClientIP()
-
-		mu.Lock()
-		defer mu.Unlock()
-
-		// Check if IP exists, then increment count
-		if count, exists := rateLimitMap[clientIP]; exists {
-			if count >= limit {
-				c.AbortWithError(http.StatusTooManyRequests, errors.New("too many request"))
-				return
-			}
-			rateLimitMap[clientIP]++
-		} else {
-			rateLimitMap[clientIP] = 1
+		limit, ok := limits.Get(name)
+		if !ok {
+			c.Next()
+			return
+		}
+
+		result, err := limiter.Allow(c.Request.Context(), name+":"+key(c), limit)
+		if err != nil {
+			// an unreachable store shouldn't take the API down with it
+			log.Printf("Rate limiter %s failed, letting the request through: %v", name, err)
+			c.Next()
+			return
+		}
+
+		c.Header("RateLimit-Policy", policyHeader(limit))
+		c.Header("RateLimit-Limit", strconv.Itoa(result.Limit))
+		c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Header("RateLimit-Reset", seconds(result.ResetAfter))
+
+		if !result.Allowed {
+			c.Header("Retry-After", seconds(result.RetryAfter))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests, try again later"})
+			return
 		}
 
 		c.Next()
 	}
 }
+
+func policyHeader(limit ratelimit.Limit) string {
+	policy := fmt.Sprintf("%d;w=%d", limit.Rate, int(limit.Period.Seconds()))
+	if limit.Burst > 0 {
+		policy += ";burst=" + strconv.Itoa(limit.Burst)
+	}
+	return policy
+}
+
+// seconds rounds up, a client waiting for the rounded down value would
+// be rejected again.
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+}
@@ -1,11 +1,18 @@
 package models
 
 type Files struct {
-	ID        int    `json:"id"`
-	UserId    int    `json:"user_id"`
-	Path      string `json:"path"`
-	Filename  string `json:"filename"`
-	Size      int    `json:"size"`
-	MimeType  string `json:"mime_type"`
-	CreatedAt string `json:"created_at"`
+	ID            int    `json:"id"`
+	UserId        int    `json:"user_id"`
+	Path          string `json:"path"`
+	Filename      string `json:"filename"`
+	Size          int    `json:"size"`
+	MimeType      string `json:"mime_type"`
+	ScanStatus    string `json:"scan_status"`
+	ScanSignature string `json:"scan_signature"`
+	// hash of the file as uploaded, before metadata was stripped
+	OriginalSha256   string            `json:"original_sha256"`
+	MetadataStripped bool              `json:"metadata_stripped"`
+	CreatedAt        string            `json:"created_at"`
+	Tags             []string          `json:"tags"`
+	Metadata         map[string]string `json:"metadata"`
 }
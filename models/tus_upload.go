@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// TusUpload is a resumable upload created through the tus protocol.
+type TusUpload struct {
+	ID       string `json:"id"`
+	UserId   uint   `json:"user_id"`
+	Filename string `json:"filename"`
+	Length   int64  `json:"length"`
+	Offset   int64  `json:"offset"`
+	// Upload-Metadata header as sent by the client
+	Metadata string `json:"metadata"`
+	// processing job, set once all bytes have arrived
+	JobId     *int64    `json:"job_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt string    `json:"created_at"`
+}
@@ -1,9 +1,12 @@
 package models
 
 type User struct {
-	ID        int    `json:"id"`
-	Name      string `json:"name"`
-	Email     string `json:"email"`
-	Password  string `json:"password"`
-	CreatedAt string `json:"created_at"`
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+	// StripMetadata overrides the policy for the user's uploads; nil follows it
+	StripMetadata *bool  `json:"strip_metadata"`
+	CreatedAt     string `json:"created_at"`
 }
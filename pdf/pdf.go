@@ -0,0 +1,140 @@
+package pdf
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+)
+
+// maxDecodedStream caps how much a single stream may inflate to, so a
+// crafted document can't exhaust memory while being inspected.
+const maxDecodedStream = 16 << 20
+
+var ErrNotPDF = errors.New("not a pdf document")
+
+// Stream is a single `stream ... endstream` object body together with the
+// dictionary that precedes it.
+type Stream struct {
+	Dict []byte
+	Data []byte
+	// Decoded is false when the stream uses a filter we don't support, in
+	// which case Data holds the raw bytes.
+	Decoded bool
+
+	// offsets of the raw body within the document
+	start, end int
+}
+
+// IsPDF reports whether data starts with a PDF header.
+func IsPDF(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("%PDF-"))
+}
+
+// Streams walks every stream object of the document in file order.
+// It does not rely on the xref table, so it also works on damaged files.
+func Streams(data []byte) ([]Stream, error) {
+	if !IsPDF(data) {
+		return nil, ErrNotPDF
+	}
+
+	var streams []Stream
+	pos := 0
+	for {
+		idx := bytes.Index(data[pos:], []byte("stream"))
+		if idx < 0 {
+			break
+		}
+		start := pos + idx
+
+		// skip "endstream" and keywords that merely end with "stream"
+		if start > 0 && isRegular(data[start-1]) {
+			pos = start + len("stream")
+			continue
+		}
+
+		// the dictionary is everything between "obj" and "stream"; searching
+		// only since the previous stream keeps this linear
+		window := data[pos:start]
+		dictStart := bytes.LastIndex(window, []byte("obj"))
+		if dictStart >= 0 {
+			dictStart += len("obj")
+		} else if dictStart = bytes.Index(window, []byte("<<")); dictStart < 0 {
+			pos = start + len("stream")
+			continue
+		}
+		dict := window[dictStart:]
+
+		bodyStart := start + len("stream")
+		if bodyStart < len(data) && data[bodyStart] == '\r' {
+			bodyStart++
+		}
+		if bodyStart < len(data) && data[bodyStart] == '\n' {
+			bodyStart++
+		}
+
+		end := bytes.Index(data[bodyStart:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		raw := bytes.TrimRight(data[bodyStart:bodyStart+end], "\r\n")
+
+		stream := Stream{Dict: dict, Data: raw, start: bodyStart, end: bodyStart + end}
+		if !HasName(dict, "Filter") {
+			stream.Decoded = true
+		} else if HasName(dict, "FlateDecode") && !HasName(dict, "DecodeParms") {
+			if decoded, err := inflate(raw); err == nil {
+				stream.Data = decoded
+				stream.Decoded = true
+			}
+		}
+		streams = append(streams, stream)
+
+		pos = bodyStart + end + len("endstream")
+	}
+
+	return streams, nil
+}
+
+// HasName reports whether the name object /name appears in b as a whole
+// token, e.g. HasName(b, "JS") doesn't match /JSON.
+func HasName(b []byte, name string) bool {
+	needle := []byte("/" + name)
+	pos := 0
+	for {
+		idx := bytes.Index(b[pos:], needle)
+		if idx < 0 {
+			return false
+		}
+		end := pos + idx + len(needle)
+		if end >= len(b) || !isRegular(b[end]) {
+			return true
+		}
+		pos = end
+	}
+}
+
+func inflate(raw []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var out bytes.Buffer
+	if _, err := io.Copy(&out, io.LimitReader(r, maxDecodedStream)); err != nil && out.Len() == 0 {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// isRegular reports whether c is neither whitespace nor a delimiter
+// (PDF 32000-1, 7.2.2).
+func isRegular(c byte) bool {
+	switch c {
+	case 0, '\t', '\n', '\f', '\r', ' ',
+		'(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return false
+	}
+	return true
+}
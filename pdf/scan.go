@@ -0,0 +1,84 @@
+package pdf
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// Features are the risky capabilities a document makes use of.
+type Features struct {
+	JavaScript    bool // /JavaScript or /JS actions
+	EmbeddedFiles bool // /EmbeddedFile streams or /EmbeddedFiles name trees
+	Launch        bool // /Launch actions that start external programs
+	Encrypted     bool // /Encrypt dictionary in the trailer
+	HasEOF        bool // ends with an %%EOF marker
+}
+
+// Scan reports which risky features the document uses. Names are matched
+// after resolving #xx escapes (so /J#61vaScript is found) and inside
+// compressed object streams, the two usual ways of hiding them.
+func Scan(data []byte) (Features, error) {
+	streams, err := Streams(data)
+	if err != nil {
+		return Features{}, err
+	}
+
+	var f Features
+	tail := data[max(len(data)-1024, 0):]
+	f.HasEOF = bytes.Contains(tail, []byte("%%EOF"))
+
+	// object syntax outside of streams, so binary stream data can't
+	// produce false matches
+	var skeleton []byte
+	pos := 0
+	for _, s := range streams {
+		skeleton = append(skeleton, data[pos:s.start]...)
+		pos = s.end
+	}
+	skeleton = append(skeleton, data[pos:]...)
+
+	bodies := [][]byte{skeleton}
+	for _, s := range streams {
+		if s.Decoded && HasName(s.Dict, "ObjStm") {
+			bodies = append(bodies, s.Data)
+		}
+	}
+
+	for _, body := range bodies {
+		names := normalizeNames(body)
+		f.JavaScript = f.JavaScript || HasName(names, "JavaScript") || HasName(names, "JS")
+		f.EmbeddedFiles = f.EmbeddedFiles || HasName(names, "EmbeddedFile") || HasName(names, "EmbeddedFiles")
+		f.Launch = f.Launch || HasName(names, "Launch")
+		f.Encrypted = f.Encrypted || HasName(names, "Encrypt")
+	}
+
+	return f, nil
+}
+
+// normalizeNames resolves #xx escapes inside name objects. Stream bodies are
+// not touched because they aren't scanned as names anyway.
+func normalizeNames(b []byte) []byte {
+	if !bytes.Contains(b, []byte("#")) {
+		return b
+	}
+
+	out := make([]byte, 0, len(b))
+	inName := false
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		switch {
+		case c == '/':
+			inName = true
+		case !isRegular(c):
+			inName = false
+		case inName && c == '#' && i+2 < len(b):
+			if v, err := strconv.ParseUint(string(b[i+1:i+3]), 16, 8); err == nil {
+				out = append(out, byte(v))
+				i += 2
+				continue
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
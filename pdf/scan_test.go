@@ -0,0 +1,115 @@
+package pdf_test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+	"testing"
+
+	"go-secure-file-management/pdf"
+)
+
+// document builds a PDF from object bodies, numbered from 1. Offsets in the
+// xref table are not accurate, the scanner doesn't read it.
+func document(objects ...string) []byte {
+	var b strings.Builder
+	b.WriteString("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	for i, object := range objects {
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	fmt.Fprintf(&b, "xref\n0 %d\ntrailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n0\n%%%%EOF\n", len(objects)+1, len(objects)+1)
+	return []byte(b.String())
+}
+
+// stream returns a stream object holding data, deflated if compress is set.
+func stream(dict, data string, compress bool) string {
+	if compress {
+		var buf bytes.Buffer
+		w := zlib.NewWriter(&buf)
+		w.Write([]byte(data))
+		w.Close()
+		data = buf.String()
+		dict += " /Filter /FlateDecode"
+	}
+	return fmt.Sprintf("<< %s /Length %d >>\nstream\n%s\nendstream", dict, len(data), data)
+}
+
+const catalog = "<< /Type /Catalog /Pages 2 0 R >>"
+
+func TestScan(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want pdf.Features
+	}{
+		{"plain", document(catalog, "<< /Type /Pages /Kids [] /Count 0 >>"), pdf.Features{HasEOF: true}},
+		{"no EOF", bytes.TrimSuffix(document(catalog), []byte("%%EOF\n")), pdf.Features{}},
+		{
+			"JavaScript action",
+			document("<< /Type /Catalog /OpenAction 2 0 R >>", "<< /S /JavaScript /JS (app.alert(1)) >>"),
+			pdf.Features{JavaScript: true, HasEOF: true},
+		},
+		{
+			"escaped name",
+			document("<< /Type /Catalog /OpenAction 2 0 R >>", "<< /S /J#61vaScript /J#53 (app.alert(1)) >>"),
+			pdf.Features{JavaScript: true, HasEOF: true},
+		},
+		{
+			"escaped name in lower case hex",
+			document("<< /Type /Catalog /OpenAction << /S /#4a#61#76#61#53#63#72#69#70#74 >> >>"),
+			pdf.Features{JavaScript: true, HasEOF: true},
+		},
+		{
+			"JavaScript in an object stream",
+			document(catalog, stream("/Type /ObjStm /N 1 /First 4", "3 0 << /S /JavaScript /JS (app.alert(1)) >>", true)),
+			pdf.Features{JavaScript: true, HasEOF: true},
+		},
+		{
+			"escaped name in an object stream",
+			document(catalog, stream("/Type /ObjStm /N 1 /First 4", "3 0 << /Type /Action /S /J#61vaScript >>", true)),
+			pdf.Features{JavaScript: true, HasEOF: true},
+		},
+		{
+			"launch action in an object stream",
+			document(catalog, stream("/Type /ObjStm /N 1 /First 4", "3 0 << /S /Launch /F (cmd.exe) >>", false)),
+			pdf.Features{Launch: true, HasEOF: true},
+		},
+		{
+			// only object streams hold objects, other streams hold data
+			"name in a content stream",
+			document(catalog, stream("", "BT /JavaScript Tj ET", true)),
+			pdf.Features{HasEOF: true},
+		},
+		{
+			"similar names",
+			document("<< /Type /Catalog /JSON (x) /JavaScripts (y) /Launcher (z) >>"),
+			pdf.Features{HasEOF: true},
+		},
+		{
+			"embedded file",
+			document(catalog, "<< /EmbeddedFiles 3 0 R >>", stream("/Type /EmbeddedFile", "MZ", false)),
+			pdf.Features{EmbeddedFiles: true, HasEOF: true},
+		},
+		{
+			"encrypted",
+			append(document(catalog), "trailer\n<< /Encrypt 4 0 R >>\n%%EOF\n"...),
+			pdf.Features{Encrypted: true, HasEOF: true},
+		},
+	} {
+		got, err := pdf.Scan(tc.data)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestScanNotPDF(t *testing.T) {
+	if _, err := pdf.Scan([]byte("\x89PNG\r\n\x1a\n")); err != pdf.ErrNotPDF {
+		t.Errorf("err = %v, want %v", err, pdf.ErrNotPDF)
+	}
+}
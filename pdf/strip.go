@@ -0,0 +1,160 @@
+package pdf
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+)
+
+var (
+	infoRef      = regexp.MustCompile(`/Info\s+(\d+)\s+(\d+)\s+R`)
+	metadataType = regexp.MustCompile(`/Type\s*/Metadata\b`)
+)
+
+// StripInfo removes the document information dictionaries (author, title,
+// producer, dates, ...) of every revision, and uncompressed XMP metadata
+// streams. Their bytes are overwritten with spaces in place, so object
+// offsets and the xref table stay valid. It returns how many objects were
+// blanked, 0 if there was nothing to strip.
+//
+// Info dictionaries stored inside compressed object streams and compressed
+// XMP streams are left alone, since removing them means rewriting the file.
+func StripInfo(data []byte) (int, error) {
+	streams, err := Streams(data)
+	if err != nil {
+		return 0, err
+	}
+
+	// only look at object syntax, stream bodies could contain anything
+	var regions [][2]int
+	pos := 0
+	for _, s := range streams {
+		regions = append(regions, [2]int{pos, s.start})
+		pos = s.end
+	}
+	regions = append(regions, [2]int{pos, len(data)})
+
+	refs := make(map[string]bool)
+	for _, r := range regions {
+		for _, m := range infoRef.FindAllSubmatch(data[r[0]:r[1]], -1) {
+			refs[string(m[1])+" "+string(m[2])] = true
+		}
+	}
+
+	blanked := 0
+	for ref := range refs {
+		var num, gen int
+		fmt.Sscanf(ref, "%d %d", &num, &gen)
+		header := regexp.MustCompile(fmt.Sprintf(`(?:^|[^0-9])%d\s+%d\s+obj\b`, num, gen))
+
+		for _, r := range regions {
+			for _, loc := range header.FindAllIndex(data[r[0]:r[1]], -1) {
+				start := r[0] + loc[1]
+				for start < len(data) && isWhitespace(data[start]) {
+					start++
+				}
+				if !bytes.HasPrefix(data[start:], []byte("<<")) {
+					continue
+				}
+				end := dictEnd(data, start)
+				if end < 0 {
+					continue
+				}
+				if blank(data[start+2 : end-2]) {
+					blanked++
+				}
+			}
+		}
+	}
+
+	for _, s := range streams {
+		// other streams may reference metadata with a /Metadata key, only
+		// the metadata streams themselves are typed
+		if metadataType.Match(s.Dict) && !HasName(s.Dict, "Filter") {
+			if blank(data[s.start:s.end]) {
+				blanked++
+			}
+		}
+	}
+
+	return blanked, nil
+}
+
+// dictEnd returns the offset just past the ">>" closing the dictionary that
+// starts at data[start], or -1 if it isn't closed.
+func dictEnd(data []byte, start int) int {
+	depth := 0
+	for i := start; i < len(data); {
+		switch {
+		case bytes.HasPrefix(data[i:], []byte("<<")):
+			depth++
+			i += 2
+		case bytes.HasPrefix(data[i:], []byte(">>")):
+			depth--
+			i += 2
+			if depth == 0 {
+				return i
+			}
+		case data[i] == '<':
+			// hex string
+			end := bytes.IndexByte(data[i:], '>')
+			if end < 0 {
+				return -1
+			}
+			i += end + 1
+		case data[i] == '(':
+			i = stringEnd(data, i)
+			if i < 0 {
+				return -1
+			}
+		case data[i] == '%':
+			for i < len(data) && data[i] != '\r' && data[i] != '\n' {
+				i++
+			}
+		default:
+			i++
+		}
+	}
+	return -1
+}
+
+// stringEnd returns the offset past a literal string starting at data[start].
+// Literal strings may contain balanced parentheses and escapes.
+func stringEnd(data []byte, start int) int {
+	depth := 0
+	for i := start; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
+
+// blank overwrites b with spaces and reports whether it held anything but
+// whitespace, so stripping a stripped file is a no-op.
+func blank(b []byte) bool {
+	changed := false
+	for i := range b {
+		if !isWhitespace(b[i]) {
+			changed = true
+		}
+		b[i] = ' '
+	}
+	return changed
+}
+
+func isWhitespace(c byte) bool {
+	switch c {
+	case 0, '\t', '\n', '\f', '\r', ' ':
+		return true
+	}
+	return false
+}
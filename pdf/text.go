@@ -0,0 +1,257 @@
+package pdf
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// ExtractText returns the text shown by the content streams of the document.
+// It understands the text-showing operators (Tj, TJ, ' and ") of uncompressed
+// and Flate-compressed streams; text drawn with embedded CID fonts without a
+// usable encoding is skipped. maxLen bounds the size of the result.
+func ExtractText(data []byte, maxLen int) (string, error) {
+	streams, err := Streams(data)
+	if err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+	for _, s := range streams {
+		if !s.Decoded || !isContentStream(s.Dict) {
+			continue
+		}
+		extractFromContent(s.Data, &out)
+		if out.Len() >= maxLen {
+			break
+		}
+	}
+
+	text := strings.Join(strings.Fields(out.String()), " ")
+	if len(text) > maxLen {
+		text = text[:maxLen]
+		for !utf8.ValidString(text) {
+			text = text[:len(text)-1]
+		}
+	}
+	return text, nil
+}
+
+func isContentStream(dict []byte) bool {
+	for _, name := range []string{"Image", "XRef", "ObjStm", "Metadata", "EmbeddedFile", "Length1", "Length2", "Length3", "Type1C", "CIDFontType0C", "OpenType"} {
+		if HasName(dict, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// extractFromContent runs a tiny content stream interpreter that only keeps
+// track of operands and reacts to text operators.
+func extractFromContent(content []byte, out *strings.Builder) {
+	var operands []string
+	var arrayParts []string
+	inArray := false
+	inText := false
+
+	for i := 0; i < len(content); {
+		c := content[i]
+		switch {
+		case c == '%':
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+		case c == '(':
+			s, next := readLiteralString(content, i)
+			i = next
+			if inArray {
+				arrayParts = append(arrayParts, s)
+			} else {
+				operands = append(operands, s)
+			}
+		case c == '<' && i+1 < len(content) && content[i+1] != '<':
+			s, next := readHexString(content, i)
+			i = next
+			if inArray {
+				arrayParts = append(arrayParts, s)
+			} else {
+				operands = append(operands, s)
+			}
+		case c == '[':
+			inArray = true
+			arrayParts = arrayParts[:0]
+			i++
+		case c == ']':
+			inArray = false
+			operands = append(operands, strings.Join(arrayParts, ""))
+			i++
+		case isRegular(c) || c == '/':
+			start := i
+			i++
+			for i < len(content) && isRegular(content[i]) {
+				i++
+			}
+			token := string(content[start:i])
+
+			if inArray {
+				// large negative kerning inside TJ arrays is how most
+				// producers encode a word gap
+				if n, err := strconv.ParseFloat(token, 64); err == nil && n < -200 {
+					arrayParts = append(arrayParts, " ")
+				}
+				continue
+			}
+
+			switch token {
+			case "BT":
+				inText = true
+			case "ET":
+				inText = false
+				out.WriteString("\n")
+			case "Tj", "TJ":
+				if inText && len(operands) > 0 {
+					out.WriteString(operands[len(operands)-1])
+				}
+			case "'", "\"":
+				if inText && len(operands) > 0 {
+					out.WriteString("\n")
+					out.WriteString(operands[len(operands)-1])
+				}
+			case "T*", "Td", "TD":
+				if inText {
+					out.WriteString("\n")
+				}
+			case "BI":
+				// skip inline image data
+				if end := bytes.Index(content[i:], []byte("EI")); end >= 0 {
+					i += end + 2
+				}
+			}
+
+			if isOperator(token) {
+				operands = operands[:0]
+			} else {
+				operands = append(operands, "")
+			}
+		default:
+			i++
+		}
+	}
+}
+
+func isOperator(token string) bool {
+	if token == "" || token[0] == '/' {
+		return false
+	}
+	if _, err := strconv.ParseFloat(token, 64); err == nil {
+		return false
+	}
+	return token != "true" && token != "false" && token != "null"
+}
+
+func readLiteralString(b []byte, i int) (string, int) {
+	var buf []byte
+	depth := 0
+	i++ // opening paren
+	for i < len(b) {
+		c := b[i]
+		switch c {
+		case '\\':
+			i++
+			if i >= len(b) {
+				break
+			}
+			e := b[i]
+			switch e {
+			case 'n':
+				buf = append(buf, '\n')
+			case 'r':
+				buf = append(buf, '\r')
+			case 't':
+				buf = append(buf, '\t')
+			case 'b', 'f':
+			case '\r', '\n':
+				// line continuation
+			default:
+				if e >= '0' && e <= '7' {
+					n := 0
+					j := 0
+					for j < 3 && i < len(b) && b[i] >= '0' && b[i] <= '7' {
+						n = n*8 + int(b[i]-'0')
+						i++
+						j++
+					}
+					buf = append(buf, byte(n))
+					continue
+				}
+				buf = append(buf, e)
+			}
+		case '(':
+			depth++
+			buf = append(buf, c)
+		case ')':
+			if depth == 0 {
+				return decodeText(buf), i + 1
+			}
+			depth--
+			buf = append(buf, c)
+		default:
+			buf = append(buf, c)
+		}
+		i++
+	}
+	return decodeText(buf), i
+}
+
+func readHexString(b []byte, i int) (string, int) {
+	end := bytes.IndexByte(b[i:], '>')
+	if end < 0 {
+		return "", len(b)
+	}
+	digits := make([]byte, 0, end)
+	for _, c := range b[i+1 : i+end] {
+		if unicode.Is(unicode.ASCII_Hex_Digit, rune(c)) {
+			digits = append(digits, c)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	raw, err := hex.DecodeString(string(digits))
+	if err != nil {
+		return "", i + end + 1
+	}
+	return decodeText(raw), i + end + 1
+}
+
+// decodeText converts a PDF string to UTF-8. Strings with a UTF-16BE byte
+// order mark are decoded as such; everything else is treated as
+// PDFDocEncoding, which matches Latin-1 for printable characters. Strings
+// that are mostly unprintable (glyph ids of CID fonts) are dropped.
+func decodeText(raw []byte) string {
+	if len(raw) >= 2 && raw[0] == 0xfe && raw[1] == 0xff {
+		units := make([]uint16, 0, len(raw)/2)
+		for i := 2; i+1 < len(raw); i += 2 {
+			units = append(units, uint16(raw[i])<<8|uint16(raw[i+1]))
+		}
+		return string(utf16.Decode(units))
+	}
+
+	printable := 0
+	runes := make([]rune, 0, len(raw))
+	for _, c := range raw {
+		r := rune(c)
+		if unicode.IsPrint(r) || unicode.IsSpace(r) {
+			printable++
+		}
+		runes = append(runes, r)
+	}
+	if len(raw) > 0 && printable*2 < len(raw) {
+		return ""
+	}
+	return string(runes)
+}
@@ -0,0 +1,154 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TempDir holds the chunks of uploads that are still in flight, one
+// directory per user and upload: TempDir/<userId>/<uploadId>/<offset>_<limit>.
+// Chunks can arrive in any order and in parallel; files starting with a dot
+// are in-flight writes and markers, not chunks.
+const TempDir = "./uploads/temp"
+
+// QueuedMarker is created in an upload's directory when its job is queued,
+// so a complete upload is processed exactly once.
+const QueuedMarker = ".queued"
+
+// SizeMarker records the file size declared by the first chunk of an
+// upload. Later chunks have to declare the same size, or a chunk could
+// complete the upload early by announcing a smaller file.
+const SizeMarker = ".size"
+
+var ErrInvalidUploadId = errors.New("upload id may only contain letters, digits, '-' and '_'")
+
+var uploadIdPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Chunk is a stored part of an upload, covering bytes [Offset, Limit).
+type Chunk struct {
+	Path   string
+	Offset int64
+	Limit  int64
+}
+
+// ValidUploadId reports whether a client chosen upload id is safe to use
+// as a directory name.
+func ValidUploadId(uploadId string) bool {
+	return uploadIdPattern.MatchString(uploadId)
+}
+
+// UploadDir returns the directory holding the chunks of a user's upload.
+// Upload ids are chosen by clients, namespacing them by user keeps two
+// users picking the same id apart.
+func UploadDir(userId uint, uploadId string) string {
+	return filepath.Join(TempDir, strconv.FormatUint(uint64(userId), 10), uploadId)
+}
+
+// ChunkPath returns where the chunk covering [offset, limit) is stored.
+func ChunkPath(dir string, offset, limit int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%d_%d", offset, limit))
+}
+
+// Chunks lists the chunks stored in dir, ordered by offset.
+func Chunks(dir string) ([]Chunk, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var chunks []Chunk
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		offset, limit, ok := strings.Cut(name, "_")
+		if !ok {
+			continue
+		}
+		chunk := Chunk{Path: filepath.Join(dir, name)}
+		chunk.Offset, err = strconv.ParseInt(offset, 10, 64)
+		if err != nil {
+			continue
+		}
+		chunk.Limit, err = strconv.ParseInt(limit, 10, 64)
+		if err != nil || chunk.Limit <= chunk.Offset {
+			continue
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Offset < chunks[j].Offset
+	})
+	return chunks, nil
+}
+
+// PinSize records size as the file size of the upload in dir, unless a size
+// is recorded already, and returns the recorded size. Callers serialize
+// access to dir.
+func PinSize(dir string, size int64) (int64, error) {
+	path := filepath.Join(dir, SizeMarker)
+	marker, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err == nil {
+		_, err = marker.WriteString(strconv.FormatInt(size, 10))
+		if closeErr := marker.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(path)
+			return 0, err
+		}
+		return size, nil
+	}
+	if !os.IsExist(err) {
+		return 0, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pinned, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size marker in %s: %v", dir, err)
+	}
+	return pinned, nil
+}
+
+// Overlaps reports whether [offset, limit) overlaps one of the chunks. A
+// chunk with exactly that range doesn't count, resending a chunk replaces it.
+func Overlaps(chunks []Chunk, offset, limit int64) bool {
+	for _, chunk := range chunks {
+		if chunk.Offset == offset && chunk.Limit == limit {
+			continue
+		}
+		if offset < chunk.Limit && chunk.Offset < limit {
+			return true
+		}
+	}
+	return false
+}
+
+// Complete reports whether the chunks, ordered by offset, cover a file of
+// size bytes without gaps or overlaps.
+func Complete(chunks []Chunk, size int64) bool {
+	var next int64
+	for _, chunk := range chunks {
+		if chunk.Offset != next {
+			return false
+		}
+		next = chunk.Limit
+	}
+	return next == size
+}
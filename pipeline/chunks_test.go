@@ -0,0 +1,33 @@
+package pipeline_test
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"go-secure-file-management/pipeline"
+)
+
+// Upload ids and chunk ranges come from clients; whatever passes the checks
+// must stay inside the user's own part of the upload area.
+func FuzzUploadPaths(f *testing.F) {
+	for _, id := range []string{"upload-1", "../../main", "..", ".", "a/b", `a\b`, "", "x\x00y", "é"} {
+		f.Add(uint(1), id, int64(0), int64(10))
+	}
+	f.Fuzz(func(t *testing.T, userId uint, uploadId string, offset, limit int64) {
+		if !pipeline.ValidUploadId(uploadId) {
+			return
+		}
+
+		userDir := filepath.Join(pipeline.TempDir, strconv.FormatUint(uint64(userId), 10))
+		dir := pipeline.UploadDir(userId, uploadId)
+		if filepath.Dir(dir) != userDir || filepath.Base(dir) != uploadId {
+			t.Fatalf("upload %q of user %d is stored in %s, outside %s", uploadId, userId, dir, userDir)
+		}
+
+		chunk := pipeline.ChunkPath(dir, offset, limit)
+		if filepath.Dir(chunk) != dir {
+			t.Fatalf("chunk %d-%d of %s is stored at %s", offset, limit, dir, chunk)
+		}
+	})
+}
@@ -0,0 +1,473 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-secure-file-management/audit"
+	"go-secure-file-management/jobs"
+	"go-secure-file-management/models"
+	"go-secure-file-management/policy"
+	"go-secure-file-management/repositories"
+	"go-secure-file-management/sanitize"
+	"go-secure-file-management/scanner"
+	"go-secure-file-management/search"
+	"go-secure-file-management/thumbnail"
+	"go-secure-file-management/utils"
+	"go-secure-file-management/validate"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// JobType is the job enqueued when the last chunk of an upload arrived.
+const JobType = "upload"
+
+// Steps of the upload pipeline, in order. The job's step field holds the
+// last one that completed. Validation runs on the staging file so rejected
+// uploads are never stored or charged; the scan runs on the stored, still
+// pending file, and before sanitize so it sees the uploaded bytes.
+const (
+	StepAssemble  = "assemble"
+	StepValidate  = "validate"
+	StepFinalize  = "finalize"
+	StepScan      = "scan"
+	StepSanitize  = "sanitize"
+	StepIndex     = "index"
+	StepThumbnail = "thumbnail"
+)
+
+// stagingName is the assembled file in the upload's directory, where it is
+// checked before it is stored.
+const stagingName = ".assembled"
+
+// Payload describes an upload whose chunks are all stored.
+type Payload struct {
+	UploadId string `json:"upload_id"` // the client's fileId, see UploadDir
+	Filename string `json:"filename"`
+	Size     int    `json:"size"`
+	Role     string `json:"role"`
+}
+
+// State is carried between steps and attempts. It is exposed through the
+// jobs API, so it mustn't hold anything the owner shouldn't see.
+type State struct {
+	FileId     int    `json:"file_id,omitempty"`
+	MimeType   string `json:"mime_type,omitempty"`
+	Sha256     string `json:"sha256,omitempty"`
+	ScanStatus string `json:"scan_status,omitempty"`
+	// MetadataStripped is set when the sanitize step removed metadata
+	MetadataStripped bool              `json:"metadata_stripped,omitempty"`
+	Violation        *policy.Violation `json:"violation,omitempty"`
+
+	path string
+}
+
+type step struct {
+	name string
+	run  func(ctx context.Context, job *jobs.Job, payload Payload, state *State) error
+}
+
+type Pipeline struct {
+	Repo    repositories.FileStore
+	Users   repositories.UserStore
+	Policy  *policy.Holder
+	Scanner *scanner.Service
+	Indexer *search.Indexer
+	Audit   *audit.Logger
+
+	steps []step
+}
+
+func New(repo repositories.FileStore, users repositories.UserStore, filePolicy *policy.Holder, scanService *scanner.Service, indexer *search.Indexer, auditLog *audit.Logger) *Pipeline {
+	p := &Pipeline{
+		Repo:    repo,
+		Users:   users,
+		Policy:  filePolicy,
+		Scanner: scanService,
+		Indexer: indexer,
+		Audit:   auditLog,
+	}
+	p.steps = []step{
+		{StepAssemble, p.assemble},
+		{StepValidate, p.validate},
+		{StepFinalize, p.finalize},
+		{StepScan, p.scan},
+		{StepSanitize, p.sanitize},
+		{StepIndex, p.index},
+		{StepThumbnail, p.thumbnail},
+	}
+	return p
+}
+
+// Register installs the pipeline as the handler for upload jobs.
+func (p *Pipeline) Register(q *jobs.Queue) {
+	q.Register(JobType, p.Run)
+}
+
+// Run executes the steps after the last completed one, checkpointing after
+// each so a retried job doesn't repeat work.
+func (p *Pipeline) Run(ctx context.Context, job *jobs.Job) error {
+	var payload Payload
+	if err := job.Decode(&payload); err != nil {
+		return jobs.Permanent(fmt.Errorf("invalid upload payload: %v", err))
+	}
+
+	var state State
+	if err := job.DecodeState(&state); err != nil {
+		return jobs.Permanent(fmt.Errorf("invalid upload state: %v", err))
+	}
+	if state.FileId != 0 {
+		file, err := p.Repo.GetFileById(state.FileId)
+		if err != nil {
+			return jobs.Permanent(fmt.Errorf("file %d of upload is gone: %v", state.FileId, err))
+		}
+		state.path = file.Path
+	} else {
+		state.path = filepath.Join(UploadDir(job.UserId, payload.UploadId), stagingName)
+	}
+
+	next := 0
+	for i, s := range p.steps {
+		if s.name == job.Step {
+			next = i + 1
+		}
+	}
+
+	for i := next; i < len(p.steps); i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		s := p.steps[i]
+		if err := s.run(ctx, job, payload, &state); err != nil {
+			var violation *policy.Violation
+			if errors.As(err, &violation) {
+				state.Violation = violation
+				err = jobs.Permanent(err)
+				p.reject(job, payload, &state, violation.Code)
+			}
+
+			// keep what the step found out, e.g. the scan result, visible
+			if err := job.Checkpoint(job.Step, job.Progress, state); err != nil {
+				log.Printf("Failed to save state of job %d: %v", job.ID, err)
+			}
+			return fmt.Errorf("%s: %w", s.name, err)
+		}
+
+		if err := job.Checkpoint(s.name, (i+1)*100/len(p.steps), state); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// assemble merges the chunks into a staging file in the upload's directory
+// and checks its sniffed type against the policy. The chunks are kept until
+// the file is stored, so a failed attempt can start over.
+func (p *Pipeline) assemble(ctx context.Context, job *jobs.Job, payload Payload, state *State) error {
+	dir := UploadDir(job.UserId, payload.UploadId)
+	chunks, err := Chunks(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list chunk files: %v", err)
+	}
+	if len(chunks) == 0 {
+		return jobs.Permanent(errors.New("no chunks found for upload"))
+	}
+	if !Complete(chunks, int64(payload.Size)) {
+		return jobs.Permanent(errors.New("chunks don't cover the upload"))
+	}
+
+	// merge into a fixed staging name so a retry overwrites it
+	stagingPath := filepath.Join(dir, stagingName)
+	sha256sum, err := mergeChunks(stagingPath, chunks)
+	if err != nil {
+		os.Remove(stagingPath)
+		return err
+	}
+
+	stagingFile, err := os.Open(stagingPath)
+	if err != nil {
+		return fmt.Errorf("failed reopening assembled file: %v", err)
+	}
+	defer stagingFile.Close()
+
+	mimeValue, err := utils.GetMimeType(stagingFile)
+	if errors.Is(err, utils.ErrUnknownType) {
+		mimeValue = "application/octet-stream"
+	} else if err != nil {
+		return err
+	}
+
+	info, err := stagingFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	// validate actual mimetype and size
+	if violation := p.Policy.Current().CheckContent(payload.Role, payload.Filename, mimeValue, info.Size()); violation != nil {
+		removeUpload(dir)
+		return violation
+	}
+
+	state.MimeType = mimeValue
+	state.Sha256 = sha256sum
+	state.path = stagingPath
+	return nil
+}
+
+// finalize stores the file: the record is created and the owner's storage
+// charged in one transaction, which commits only once the file is in
+// place. Up to here everything lives in the upload's directory, so a failed
+// attempt leaves nothing behind but what a retry needs. The record stays
+// pending until the scan and sanitize steps passed, which blocks downloads.
+//
+// The record is keyed by the job. An attempt that committed but died before
+// its checkpoint left the file stored and the upload in place; the retry
+// finds the record and only finishes up.
+func (p *Pipeline) finalize(ctx context.Context, job *jobs.Job, payload Payload, state *State) error {
+	dir := UploadDir(job.UserId, payload.UploadId)
+	file, err := p.Repo.GetFileByJobId(job.ID)
+	if err == nil {
+		return p.finalized(job, dir, file.ID, file.Path, state)
+	}
+	if !errors.Is(err, repositories.ErrFileNotFound) {
+		return err
+	}
+
+	info, err := os.Stat(state.path)
+	if err != nil {
+		return jobs.Permanent(fmt.Errorf("assembled file is gone: %v", err))
+	}
+
+	storageName, err := utils.NewStorageName()
+	if err != nil {
+		return err
+	}
+	finalPath := filepath.Join("./uploads", storageName)
+	quota := p.Policy.Current().ForRole(payload.Role).Quota
+	published := false
+	fileId, err := p.Repo.FinalizeFile(job.ID, models.Files{
+		UserId:         int(job.UserId),
+		Path:           finalPath,
+		Filename:       payload.Filename,
+		Size:           int(info.Size()),
+		MimeType:       state.MimeType,
+		ScanStatus:     scanner.StatusPending,
+		OriginalSha256: state.Sha256,
+	}, quota, func() error {
+		// unlike a rename, a link never replaces an existing file
+		if err := os.Link(state.path, finalPath); err != nil {
+			return fmt.Errorf("failed to move assembled file: %v", err)
+		}
+		published = true
+		return nil
+	})
+	if err != nil {
+		if published {
+			// a commit that reports an error may still have gone through
+			file, lookupErr := p.Repo.GetFileByJobId(job.ID)
+			if lookupErr == nil {
+				return p.finalized(job, dir, file.ID, file.Path, state)
+			}
+			if errors.Is(lookupErr, repositories.ErrFileNotFound) {
+				os.Remove(finalPath)
+			}
+		}
+		if errors.Is(err, repositories.ErrQuotaExceeded) {
+			removeUpload(dir)
+			return &policy.Violation{
+				Code:    policy.CodeQuotaExceeded,
+				Message: fmt.Sprintf("the upload exceeds the storage quota of %d bytes", quota),
+				Limit:   quota,
+			}
+		}
+		return err
+	}
+
+	return p.finalized(job, dir, fileId, finalPath, state)
+}
+
+// finalized records the stored file in the state and removes the upload.
+func (p *Pipeline) finalized(job *jobs.Job, dir string, fileId int, path string, state *State) error {
+	state.FileId = fileId
+	state.ScanStatus = scanner.StatusPending
+	state.path = path
+
+	// the checkpoint has to be stored before the chunks go away
+	if err := job.Checkpoint(StepFinalize, job.Progress, state); err != nil {
+		return err
+	}
+	removeUpload(dir)
+	return nil
+}
+
+// mergeChunks concatenates the chunks into path and returns the SHA-256 of
+// the result, which is kept as the hash of the original upload.
+func mergeChunks(path string, chunks []Chunk) (string, error) {
+	finalFile, err := os.Create(path)
+	if err != nil {
+		return "", fmt.Errorf("failed creating assembled file: %v", err)
+	}
+	defer finalFile.Close()
+
+	hasher := sha256.New()
+	out := io.MultiWriter(finalFile, hasher)
+	for _, chunk := range chunks {
+		chunkFile, err := os.Open(chunk.Path)
+		if err != nil {
+			return "", err
+		}
+
+		_, err = io.Copy(out, chunkFile)
+		chunkFile.Close()
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), finalFile.Close()
+}
+
+// scan runs the malware scanner. Scanner errors are retried by the queue;
+// the file is only marked as failed once the job runs out of attempts.
+func (p *Pipeline) scan(ctx context.Context, job *jobs.Job, payload Payload, state *State) error {
+	if !p.Scanner.Enabled() {
+		return nil
+	}
+
+	file, err := p.Repo.GetFileById(state.FileId)
+	if err != nil {
+		return err
+	}
+
+	result, newPath, err := p.Scanner.ScanFile(ctx, file)
+	if err != nil {
+		if job.LastAttempt() {
+			p.Repo.SetScanResult(state.FileId, scanner.StatusError, "", "")
+			state.ScanStatus = scanner.StatusError
+		}
+		return err
+	}
+
+	if result.Infected {
+		state.ScanStatus = scanner.StatusInfected
+		if err := p.Repo.SetScanResult(state.FileId, scanner.StatusInfected, result.Signature, newPath); err != nil {
+			return err
+		}
+		if err := p.Indexer.Remove(state.FileId); err != nil {
+			log.Printf("Failed to remove infected file %d from the index: %v", state.FileId, err)
+		}
+		p.reject(job, payload, state, "infected "+result.Signature)
+		return jobs.Permanent(errors.New("file is infected"))
+	}
+
+	state.ScanStatus = scanner.StatusClean
+	return nil
+}
+
+// validate runs the structural checks on the staging file. A rejected file
+// is deleted or quarantined, its chunks are removed.
+func (p *Pipeline) validate(ctx context.Context, job *jobs.Job, payload Payload, state *State) error {
+	validation := p.Policy.Current().Validation
+	violation, err := validate.File(state.path, state.MimeType, validation)
+	if err != nil {
+		return fmt.Errorf("failed validating file: %v", err)
+	}
+
+	if violation != nil {
+		if validation.OnFailure == policy.OnFailureQuarantine {
+			quarantinePath, err := utils.QuarantineFile(state.path, map[string]interface{}{
+				"user_id":     job.UserId,
+				"filename":    payload.Filename,
+				"mime_type":   state.MimeType,
+				"violation":   violation,
+				"rejected_at": time.Now().UTC(),
+			})
+			if err != nil {
+				log.Printf("Failed to quarantine file %s: %v", state.path, err)
+			} else {
+				log.Printf("Quarantined upload of user %d to %s: %s", job.UserId, quarantinePath, violation.Code)
+			}
+		} else if err := os.Remove(state.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove rejected file %s: %v", state.path, err)
+		}
+		removeUpload(UploadDir(job.UserId, payload.UploadId))
+		return violation
+	}
+
+	return nil
+}
+
+// sanitize strips metadata when the policy or the user asks for it, then
+// publishes the file: it only becomes downloadable once it is in its final
+// form.
+func (p *Pipeline) sanitize(ctx context.Context, job *jobs.Job, payload Payload, state *State) error {
+	userSetting, err := p.Users.GetStripMetadata(job.UserId)
+	if err != nil {
+		return err
+	}
+
+	if p.Policy.Current().ShouldStripMetadata(payload.Role, userSetting) && sanitize.Supported(state.MimeType) {
+		stripped, err := sanitize.File(state.path, state.MimeType)
+		if err != nil {
+			return fmt.Errorf("failed stripping metadata: %v", err)
+		}
+		if stripped {
+			info, err := os.Stat(state.path)
+			if err != nil {
+				return err
+			}
+			if err := p.Repo.SetMetadataStripped(state.FileId, info.Size()); err != nil {
+				return err
+			}
+			state.MetadataStripped = true
+		}
+	}
+
+	if !p.Scanner.Enabled() {
+		state.ScanStatus = scanner.StatusClean
+	}
+	return p.Repo.SetScanResult(state.FileId, state.ScanStatus, "", "")
+}
+
+func (p *Pipeline) index(ctx context.Context, job *jobs.Job, payload Payload, state *State) error {
+	return p.Indexer.Index(state.FileId)
+}
+
+// thumbnail renders the previews. A failure doesn't fail the upload, the
+// thumbnail endpoint renders missing previews on demand.
+func (p *Pipeline) thumbnail(ctx context.Context, job *jobs.Job, payload Payload, state *State) error {
+	if !thumbnail.Supported(state.MimeType) {
+		return nil
+	}
+	if err := thumbnail.Generate(state.path, state.MimeType); err != nil {
+		log.Printf("Failed to generate thumbnails of file %d: %v", state.FileId, err)
+	}
+	return nil
+}
+
+// reject audits an upload the pipeline refused. The job has no request, the
+// actor is its owner.
+func (p *Pipeline) reject(job *jobs.Job, payload Payload, state *State, reason string) {
+	p.Audit.Log(audit.Event{
+		Action:  audit.ActionUploadReject,
+		Outcome: audit.OutcomeDenied,
+		ActorId: job.UserId,
+		FileId:  state.FileId,
+		Detail:  reason + ": " + payload.Filename,
+	})
+}
+
+// removeUpload removes an upload's directory with its chunks and markers.
+func removeUpload(dir string) {
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("Failed to remove %s: %v", dir, err)
+	}
+}
@@ -0,0 +1,457 @@
+package pipeline_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-secure-file-management/audit"
+	"go-secure-file-management/db"
+	"go-secure-file-management/db/dbtest"
+	"go-secure-file-management/jobs"
+	"go-secure-file-management/models"
+	"go-secure-file-management/pipeline"
+	"go-secure-file-management/policy"
+	"go-secure-file-management/repositories"
+	"go-secure-file-management/scanner"
+	"go-secure-file-management/search"
+	"go-secure-file-management/utils"
+)
+
+const userId = 1
+
+var errInjected = errors.New("injected failure")
+
+// finalizeFunc runs the real FinalizeFile with the given publish.
+type finalizeFunc func(publish func() error) (int, error)
+
+// faultyStore lets a test replace the next FinalizeFile with a fault.
+type faultyStore struct {
+	*repositories.FileRepository
+
+	mu    sync.Mutex
+	fault func(finalize finalizeFunc, file models.Files, publish func() error) (int, error)
+	// failing SetScanResult calls left
+	scanResultFaults int
+}
+
+func (s *faultyStore) SetScanResult(id int, status string, signature string, path string) error {
+	s.mu.Lock()
+	fail := s.scanResultFaults > 0
+	if fail {
+		s.scanResultFaults--
+	}
+	s.mu.Unlock()
+
+	if fail {
+		return errInjected
+	}
+	return s.FileRepository.SetScanResult(id, status, signature, path)
+}
+
+func (s *faultyStore) FinalizeFile(jobId int64, file models.Files, quota int64, publish func() error) (int, error) {
+	s.mu.Lock()
+	fault := s.fault
+	s.fault = nil
+	s.mu.Unlock()
+
+	finalize := func(publish func() error) (int, error) {
+		return s.FileRepository.FinalizeFile(jobId, file, quota, publish)
+	}
+	if fault == nil {
+		return finalize(publish)
+	}
+	return fault(finalize, file, publish)
+}
+
+func (s *faultyStore) inject(fault func(finalize finalizeFunc, file models.Files, publish func() error) (int, error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fault = fault
+}
+
+type env struct {
+	conn  *sql.DB
+	store *faultyStore
+	queue *jobs.Queue
+	rules *policy.Holder
+}
+
+func setup(t *testing.T, conn *sql.DB) *env {
+	t.Helper()
+
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	if err := os.MkdirAll(pipeline.TempDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := conn.Exec("INSERT INTO users (email, password) VALUES ('a@b.co', 'x')"); err != nil {
+		t.Fatal(err)
+	}
+
+	e := &env{
+		conn:  conn,
+		store: &faultyStore{FileRepository: repositories.NewFileRepository(conn)},
+		queue: jobs.NewQueue(conn),
+		rules: policy.NewHolder(policy.Default()),
+	}
+	// short enough for a test to wait out a lost lease
+	e.queue.Lease = 2 * time.Second
+	pipeline.New(e.store, repositories.NewUserRepository(conn), e.rules, scanner.NewService(scanner.Fake{}),
+		search.NewIndexer(conn), audit.NewLogger(conn)).Register(e.queue)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e.queue.Start(ctx)
+	t.Cleanup(func() {
+		cancel()
+		e.queue.Wait()
+	})
+	return e
+}
+
+// upload stores content as two chunks and queues its job.
+func (e *env) upload(t *testing.T, uploadId string, content []byte) int64 {
+	t.Helper()
+
+	dir := pipeline.UploadDir(userId, uploadId)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	half := int64(len(content) / 2)
+	for _, chunk := range [][2]int64{{0, half}, {half, int64(len(content))}} {
+		if err := os.WriteFile(pipeline.ChunkPath(dir, chunk[0], chunk[1]), content[chunk[0]:chunk[1]], 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	id, err := e.queue.Enqueue(userId, pipeline.JobType, pipeline.Payload{
+		UploadId: uploadId, Filename: "picture.png", Size: len(content), Role: "user",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func (e *env) wait(t *testing.T, id int64) jobs.Job {
+	t.Helper()
+
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		job, err := e.queue.GetJob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Status != jobs.StatusQueued && job.Status != jobs.StatusRunning {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %d still %s (step %q, last error %q)", id, job.Status, job.Step, job.LastError)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// stored returns the rows of the user's files and the files under
+// uploads/, thumbnails and the upload area left out.
+func (e *env) stored(t *testing.T) ([]models.Files, []string) {
+	t.Helper()
+
+	rows, err := e.store.GetFilesByUserId(userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir("uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blobs []string
+	for _, entry := range entries {
+		if !entry.IsDir() && !strings.Contains(entry.Name(), ".thumb_") {
+			blobs = append(blobs, filepath.Join("uploads", entry.Name()))
+		}
+	}
+	return rows, blobs
+}
+
+func (e *env) storageUsed(t *testing.T) int64 {
+	t.Helper()
+
+	var used int64
+	err := e.conn.QueryRow(db.DialectOf(e.conn).Rebind("SELECT storage_used FROM users WHERE id = ?"), userId).Scan(&used)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return used
+}
+
+func pngFile(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 64, 64))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withText adds a tEXt chunk holding text before the IEND chunk of a PNG.
+func withText(t *testing.T, image []byte, text string) []byte {
+	t.Helper()
+
+	iend := bytes.LastIndex(image, []byte("IEND")) - 4
+	if iend < 0 {
+		t.Fatal("no IEND chunk")
+	}
+	data := append([]byte("comment\x00"), text...)
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, "tEXt"...)
+	chunk = append(chunk, data...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	return append(append(append([]byte{}, image[:iend]...), chunk...), image[iend:]...)
+}
+
+// assertQuarantined checks an infected upload ended up as a row marked
+// infected whose file is in quarantine, with nothing left in uploads/.
+func (e *env) assertQuarantined(t *testing.T, id int64, uploadId string) {
+	t.Helper()
+
+	job := e.wait(t, id)
+	if job.Status != jobs.StatusFailed || job.Step != pipeline.StepFinalize {
+		t.Errorf("job %s after step %q, want failed after finalize", job.Status, job.Step)
+	}
+
+	rows, blobs := e.stored(t)
+	if len(rows) != 1 {
+		t.Fatalf("%d rows stored, want 1: %+v", len(rows), rows)
+	}
+	file := rows[0]
+	if file.ScanStatus != scanner.StatusInfected || file.ScanSignature != scanner.EICARSignature {
+		t.Errorf("scan %s with %q, want infected with %s", file.ScanStatus, file.ScanSignature, scanner.EICARSignature)
+	}
+	if filepath.Dir(file.Path) != filepath.Clean(utils.QuarantineDir) {
+		t.Errorf("file at %s, want it in quarantine", file.Path)
+	}
+	if _, err := os.Stat(file.Path); err != nil {
+		t.Errorf("quarantined file missing: %v", err)
+	}
+	if len(blobs) != 0 {
+		t.Errorf("files left in uploads: %v", blobs)
+	}
+	if _, err := os.Stat(pipeline.UploadDir(userId, uploadId)); !os.IsNotExist(err) {
+		t.Errorf("upload directory left behind: %v", err)
+	}
+}
+
+// assertStoredOnce checks the upload ended up as exactly one row, charged
+// once, whose file is the only one stored, and that the upload area is gone.
+func (e *env) assertStoredOnce(t *testing.T, id int64, uploadId string, size int) {
+	t.Helper()
+
+	job := e.wait(t, id)
+	if job.Status != jobs.StatusSucceeded {
+		t.Fatalf("job %s: %s", job.Status, job.LastError)
+	}
+
+	rows, blobs := e.stored(t)
+	if len(rows) != 1 {
+		t.Fatalf("%d rows stored, want 1: %+v", len(rows), rows)
+	}
+	if len(blobs) != 1 || blobs[0] != filepath.Clean(rows[0].Path) {
+		t.Errorf("stored files %v, want only the row's %s", blobs, rows[0].Path)
+	}
+	if rows[0].ScanStatus != scanner.StatusClean {
+		t.Errorf("scan_status %s, want clean", rows[0].ScanStatus)
+	}
+	if used := e.storageUsed(t); used != int64(size) {
+		t.Errorf("storage_used %d, want %d charged once", used, size)
+	}
+	if _, err := os.Stat(pipeline.UploadDir(userId, uploadId)); !os.IsNotExist(err) {
+		t.Errorf("upload directory left behind: %v", err)
+	}
+}
+
+// assertNothingStored checks a rejected upload left no row, charge, file or
+// chunks.
+func (e *env) assertNothingStored(t *testing.T, uploadId string) {
+	t.Helper()
+
+	rows, blobs := e.stored(t)
+	if len(rows) != 0 || len(blobs) != 0 {
+		t.Errorf("rejected upload left rows %+v and files %v", rows, blobs)
+	}
+	if used := e.storageUsed(t); used != 0 {
+		t.Errorf("storage_used %d after a rejected upload, want 0", used)
+	}
+	if _, err := os.Stat(pipeline.UploadDir(userId, uploadId)); !os.IsNotExist(err) {
+		t.Errorf("upload directory left behind: %v", err)
+	}
+}
+
+func TestUploadIsStored(t *testing.T) {
+	dbtest.Run(t, dbtest.Migrated, func(t *testing.T, conn *sql.DB) {
+		e := setup(t, conn)
+		content := pngFile(t)
+
+		id := e.upload(t, "clean", content)
+		e.assertStoredOnce(t, id, "clean", len(content))
+	})
+}
+
+// The worker loses its lease right after the commit, as if it had crashed
+// before its checkpoint: the next owner must find the row instead of storing
+// and charging again.
+func TestFinalizeRetriedAfterCommitIsNotRepeated(t *testing.T) {
+	dbtest.Run(t, dbtest.Migrated, func(t *testing.T, conn *sql.DB) {
+		e := setup(t, conn)
+		e.store.inject(func(finalize finalizeFunc, file models.Files, publish func() error) (int, error) {
+			id, err := finalize(publish)
+			if err != nil {
+				return 0, err
+			}
+			// what claiming the expired job again looks like to this worker
+			_, err = conn.Exec(db.DialectOf(conn).Rebind("UPDATE jobs SET attempts = attempts + 1 WHERE type = ?"), pipeline.JobType)
+			if err != nil {
+				t.Error(err)
+			}
+			return id, nil
+		})
+		content := pngFile(t)
+
+		id := e.upload(t, "crash", content)
+		e.assertStoredOnce(t, id, "crash", len(content))
+	})
+}
+
+// The commit reports an error although it went through: the published file
+// belongs to the row and has to stay.
+func TestFinalizeErrorAfterCommitKeepsFile(t *testing.T) {
+	dbtest.Run(t, dbtest.Migrated, func(t *testing.T, conn *sql.DB) {
+		e := setup(t, conn)
+		e.store.inject(func(finalize finalizeFunc, file models.Files, publish func() error) (int, error) {
+			if _, err := finalize(publish); err != nil {
+				return 0, err
+			}
+			return 0, errInjected
+		})
+		content := pngFile(t)
+
+		id := e.upload(t, "lost-reply", content)
+		e.assertStoredOnce(t, id, "lost-reply", len(content))
+	})
+}
+
+// The commit fails after the file was moved into place: the file is removed
+// again and the retry starts over from the staged upload.
+func TestFinalizeCommitFailureRemovesPublishedFile(t *testing.T) {
+	dbtest.Run(t, dbtest.Migrated, func(t *testing.T, conn *sql.DB) {
+		e := setup(t, conn)
+		var published string
+		e.store.inject(func(finalize finalizeFunc, file models.Files, publish func() error) (int, error) {
+			return finalize(func() error {
+				if err := publish(); err != nil {
+					return err
+				}
+				published = file.Path
+				return errInjected
+			})
+		})
+		content := pngFile(t)
+
+		id := e.upload(t, "rollback", content)
+		e.assertStoredOnce(t, id, "rollback", len(content))
+
+		if published == "" {
+			t.Fatal("the fault never ran")
+		}
+		if _, err := os.Stat(published); !os.IsNotExist(err) {
+			t.Errorf("file published by the failed commit is still there: %v", err)
+		}
+	})
+}
+
+func TestQuotaExceededStoresNothing(t *testing.T) {
+	dbtest.Run(t, dbtest.Migrated, func(t *testing.T, conn *sql.DB) {
+		e := setup(t, conn)
+		rules := policy.Default()
+		rules.Quota = 10
+		e.rules.Set(rules)
+
+		id := e.upload(t, "quota", pngFile(t))
+		job := e.wait(t, id)
+
+		if job.Status != jobs.StatusFailed || !strings.Contains(string(job.State), policy.CodeQuotaExceeded) {
+			t.Errorf("job %s with state %s, want failed with %s", job.Status, job.State, policy.CodeQuotaExceeded)
+		}
+		e.assertNothingStored(t, "quota")
+	})
+}
+
+func TestInvalidFileStoresNothing(t *testing.T) {
+	dbtest.Run(t, dbtest.Migrated, func(t *testing.T, conn *sql.DB) {
+		e := setup(t, conn)
+		content := pngFile(t)
+		// a PNG signature followed by garbage passes sniffing, not validation
+		broken := append(content[:16:16], bytes.Repeat([]byte{0xff}, 64)...)
+
+		id := e.upload(t, "broken", broken)
+		job := e.wait(t, id)
+
+		if job.Status != jobs.StatusFailed || job.Step != pipeline.StepAssemble {
+			t.Errorf("job %s after step %q, want failed after assemble", job.Status, job.Step)
+		}
+		e.assertNothingStored(t, "broken")
+	})
+}
+
+func TestInfectedUploadIsQuarantined(t *testing.T) {
+	dbtest.Run(t, dbtest.Migrated, func(t *testing.T, conn *sql.DB) {
+		e := setup(t, conn)
+
+		id := e.upload(t, "infected", withText(t, pngFile(t), scanner.EICAR))
+		e.assertQuarantined(t, id, "infected")
+	})
+}
+
+// Recording the quarantine fails after the file was moved: the retry finds
+// it in quarantine instead of failing on the path it was moved away from.
+func TestQuarantineRetriedAfterFailedUpdate(t *testing.T) {
+	dbtest.Run(t, dbtest.Migrated, func(t *testing.T, conn *sql.DB) {
+		e := setup(t, conn)
+		e.store.mu.Lock()
+		e.store.scanResultFaults = 1
+		e.store.mu.Unlock()
+
+		id := e.upload(t, "infected-retry", withText(t, pngFile(t), scanner.EICAR))
+		e.assertQuarantined(t, id, "infected-retry")
+
+		job, err := e.queue.GetJob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Attempts != 2 {
+			t.Errorf("%d attempts, want the failed one and its retry", job.Attempts)
+		}
+	})
+}
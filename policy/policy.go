@@ -0,0 +1,416 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// Violation codes returned to clients. They are part of the API, don't
+// rename them.
+const (
+	CodeExtensionNotAllowed = "extension_not_allowed"
+	CodeExtensionMismatch   = "extension_mismatch"
+	CodeTypeDenied          = "mime_type_denied"
+	CodeTypeNotAllowed      = "mime_type_not_allowed"
+	CodeSizeExceeded        = "size_exceeded"
+	CodeQuotaExceeded       = "quota_exceeded"
+
+	// content validation, see package validate
+	CodeInvalidContent    = "invalid_content"
+	CodeTrailingData      = "trailing_data"
+	CodeImageTooLarge     = "image_too_large"
+	CodePDFJavaScript     = "pdf_javascript"
+	CodePDFEmbeddedFile   = "pdf_embedded_file"
+	CodePDFLaunchAction   = "pdf_launch_action"
+	CodePDFEncrypted      = "pdf_encrypted"
+	CodeTooLargeToInspect = "too_large_to_inspect"
+)
+
+const (
+	OnFailureReject     = "reject"
+	OnFailureQuarantine = "quarantine"
+)
+
+// Rule is a set of type and size restrictions. MIME types may use a
+// wildcard subtype, e.g. "image/*".
+type Rule struct {
+	Allowed []string `json:"allowed"`
+	Denied  []string `json:"denied"`
+	// MaxSize maps MIME types (or "*" for the default) to a size limit in
+	// bytes; 0 means unlimited.
+	MaxSize map[string]int64 `json:"max_size"`
+	// StripMetadata removes EXIF/XMP/IPTC and PDF document info after
+	// validation. Users can override it for their own uploads.
+	StripMetadata *bool `json:"strip_metadata"`
+	// Quota limits the bytes a user can have stored in total; 0 means
+	// unlimited.
+	Quota int64 `json:"quota"`
+	// Bandwidth limits each user over all of their transfers.
+	Bandwidth Rates `json:"bandwidth"`
+}
+
+// Rates are transfer limits in bytes per second; 0 means unlimited.
+type Rates struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+// merge overrides the rates other sets.
+func (r Rates) merge(other Rates) Rates {
+	if other.Upload != 0 {
+		r.Upload = other.Upload
+	}
+	if other.Download != 0 {
+		r.Download = other.Download
+	}
+	return r
+}
+
+// Validation configures the structural checks run on assembled files.
+type Validation struct {
+	// OnFailure is "reject" (delete the file) or "quarantine" (keep it
+	// aside for review). Either way the upload fails.
+	OnFailure string `json:"on_failure"`
+
+	MaxWidth  int   `json:"max_width"`
+	MaxHeight int   `json:"max_height"`
+	MaxPixels int64 `json:"max_pixels"`
+
+	// PDFs larger than this are rejected instead of parsed
+	MaxPDFSize int64 `json:"max_pdf_size"`
+
+	// risky PDF features are rejected unless explicitly allowed
+	AllowPDFJavaScript    bool `json:"allow_pdf_javascript"`
+	AllowPDFEmbeddedFiles bool `json:"allow_pdf_embedded_files"`
+	AllowPDFEncryption    bool `json:"allow_pdf_encryption"`
+}
+
+// Policy is the base rule plus per-role overrides. An override replaces the
+// allowed list when it sets one, adds to the denied list and overrides
+// individual size limits, strip_metadata, the quota and bandwidth rates.
+type Policy struct {
+	Rule
+	Roles      map[string]Rule `json:"roles"`
+	Validation Validation      `json:"validation"`
+	// UserBandwidth overrides the bandwidth of single users by id, over
+	// their role's.
+	UserBandwidth map[uint]Rates `json:"user_bandwidth"`
+	// TotalBandwidth limits all transfers together.
+	TotalBandwidth Rates `json:"total_bandwidth"`
+}
+
+// Holder shares a policy that is replaced as a whole when the file is
+// reloaded. Read it once per decision with Current, so one upload isn't
+// checked against two versions.
+type Holder struct {
+	current atomic.Pointer[Policy]
+}
+
+func NewHolder(p *Policy) *Holder {
+	h := &Holder{}
+	h.current.Store(p)
+	return h
+}
+
+func (h *Holder) Current() *Policy {
+	return h.current.Load()
+}
+
+func (h *Holder) Set(p *Policy) {
+	h.current.Store(p)
+}
+
+// Violation is a machine-readable rejection reason.
+type Violation struct {
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	MimeType string `json:"mime_type,omitempty"`
+	Limit    int64  `json:"limit,omitempty"`
+}
+
+func (v *Violation) Error() string {
+	return v.Message
+}
+
+// Default mirrors the types the upload handler has always accepted.
+func Default() *Policy {
+	p := &Policy{
+		Rule: Rule{
+			Allowed: []string{"image/png", "image/jpeg", "application/pdf"},
+		},
+	}
+	p.Validation.setDefaults()
+	return p
+}
+
+func (v *Validation) setDefaults() {
+	if v.OnFailure == "" {
+		v.OnFailure = OnFailureReject
+	}
+	if v.MaxWidth == 0 {
+		v.MaxWidth = 16384
+	}
+	if v.MaxHeight == 0 {
+		v.MaxHeight = 16384
+	}
+	if v.MaxPixels == 0 {
+		// ~100 MB once decoded to RGBA
+		v.MaxPixels = 25_000_000
+	}
+	if v.MaxPDFSize == 0 {
+		v.MaxPDFSize = 256 << 20
+	}
+}
+
+// Load reads a JSON policy file. An empty path yields the default policy.
+func Load(path string) (*Policy, error) {
+	if path == "" {
+		return Default(), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file policy: %v", err)
+	}
+
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse file policy %s: %v", path, err)
+	}
+
+	p.Validation.setDefaults()
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("invalid file policy %s: %v", path, err)
+	}
+
+	return &p, nil
+}
+
+func (p *Policy) validate() error {
+	rules := map[string]Rule{"": p.Rule}
+	for role, rule := range p.Roles {
+		rules[role] = rule
+	}
+
+	for role, rule := range rules {
+		for _, pattern := range append(append([]string{}, rule.Allowed...), rule.Denied...) {
+			if !validPattern(pattern) {
+				return fmt.Errorf("role %q: %q is not a MIME type", role, pattern)
+			}
+		}
+		for pattern, limit := range rule.MaxSize {
+			if pattern != "*" && !validPattern(pattern) {
+				return fmt.Errorf("role %q: max_size key %q is not a MIME type", role, pattern)
+			}
+			if limit < 0 {
+				return fmt.Errorf("role %q: max_size of %q must not be negative", role, pattern)
+			}
+		}
+		if rule.Quota < 0 {
+			return fmt.Errorf("role %q: quota must not be negative", role)
+		}
+		if rule.Bandwidth.Upload < 0 || rule.Bandwidth.Download < 0 {
+			return fmt.Errorf("role %q: bandwidth must not be negative", role)
+		}
+	}
+	for userId, rates := range p.UserBandwidth {
+		if rates.Upload < 0 || rates.Download < 0 {
+			return fmt.Errorf("user %d: bandwidth must not be negative", userId)
+		}
+	}
+	if p.TotalBandwidth.Upload < 0 || p.TotalBandwidth.Download < 0 {
+		return fmt.Errorf("total_bandwidth must not be negative")
+	}
+
+	if p.Validation.OnFailure != OnFailureReject && p.Validation.OnFailure != OnFailureQuarantine {
+		return fmt.Errorf("validation.on_failure must be %q or %q", OnFailureReject, OnFailureQuarantine)
+	}
+	if p.Validation.MaxWidth < 0 || p.Validation.MaxHeight < 0 || p.Validation.MaxPixels < 0 || p.Validation.MaxPDFSize < 0 {
+		return fmt.Errorf("validation limits must not be negative")
+	}
+
+	if len(p.Allowed) == 0 {
+		return fmt.Errorf("allowed must list at least one MIME type")
+	}
+	return nil
+}
+
+// ForRole returns the effective rule for a role.
+func (p *Policy) ForRole(role string) Rule {
+	rule := Rule{
+		Allowed:       p.Allowed,
+		Denied:        p.Denied,
+		MaxSize:       make(map[string]int64),
+		StripMetadata: p.StripMetadata,
+		Quota:         p.Quota,
+		Bandwidth:     p.Bandwidth,
+	}
+	for pattern, limit := range p.MaxSize {
+		rule.MaxSize[pattern] = limit
+	}
+
+	override, ok := p.Roles[role]
+	if !ok {
+		return rule
+	}
+
+	if override.Allowed != nil {
+		rule.Allowed = override.Allowed
+	}
+	rule.Denied = append(append([]string{}, rule.Denied...), override.Denied...)
+	for pattern, limit := range override.MaxSize {
+		rule.MaxSize[pattern] = limit
+	}
+	if override.StripMetadata != nil {
+		rule.StripMetadata = override.StripMetadata
+	}
+	if override.Quota != 0 {
+		rule.Quota = override.Quota
+	}
+	rule.Bandwidth = rule.Bandwidth.merge(override.Bandwidth)
+	return rule
+}
+
+// BandwidthFor returns the transfer limits of a user.
+func (p *Policy) BandwidthFor(role string, userId uint) Rates {
+	return p.ForRole(role).Bandwidth.merge(p.UserBandwidth[userId])
+}
+
+// ShouldStripMetadata decides whether metadata is removed from uploads of a user.
+// The user's own setting, when set, wins over the role's.
+func (p *Policy) ShouldStripMetadata(role string, userSetting *bool) bool {
+	if userSetting != nil {
+		return *userSetting
+	}
+	rule := p.ForRole(role)
+	return rule.StripMetadata != nil && *rule.StripMetadata
+}
+
+// CheckDeclared validates what the client announces before any bytes are
+// stored: the type implied by the file extension and the total size.
+func (p *Policy) CheckDeclared(role, filename string, size int64) *Violation {
+	mimeType := TypeByExtension(filename)
+	if mimeType == "" {
+		return &Violation{
+			Code:    CodeExtensionNotAllowed,
+			Message: fmt.Sprintf("file extension %q is not allowed", filepath.Ext(filename)),
+		}
+	}
+
+	return p.ForRole(role).check(mimeType, size)
+}
+
+// CheckContent validates an assembled file against its sniffed type. The
+// extension of the declared name must agree with the content, so a .pdf
+// that is really a PNG is rejected even if both types are allowed.
+func (p *Policy) CheckContent(role, filename, sniffedType string, size int64) *Violation {
+	if v := p.ForRole(role).check(sniffedType, size); v != nil {
+		return v
+	}
+
+	declared := TypeByExtension(filename)
+	if declared != sniffedType {
+		return &Violation{
+			Code:     CodeExtensionMismatch,
+			Message:  fmt.Sprintf("file extension %q doesn't match its content type %s", filepath.Ext(filename), sniffedType),
+			MimeType: sniffedType,
+		}
+	}
+
+	return nil
+}
+
+func (r Rule) check(mimeType string, size int64) *Violation {
+	if matchAny(r.Denied, mimeType) {
+		return &Violation{
+			Code:     CodeTypeDenied,
+			Message:  fmt.Sprintf("file type %s is denied", mimeType),
+			MimeType: mimeType,
+		}
+	}
+
+	if !matchAny(r.Allowed, mimeType) {
+		return &Violation{
+			Code:     CodeTypeNotAllowed,
+			Message:  fmt.Sprintf("file type %s is not allowed", mimeType),
+			MimeType: mimeType,
+		}
+	}
+
+	if limit := r.maxSize(mimeType); limit > 0 && size > limit {
+		return &Violation{
+			Code:     CodeSizeExceeded,
+			Message:  fmt.Sprintf("file size %d exceeds the limit of %d bytes for %s", size, limit, mimeType),
+			MimeType: mimeType,
+			Limit:    limit,
+		}
+	}
+
+	return nil
+}
+
+// maxSize picks the most specific limit: exact type, then wildcard subtype,
+// then the "*" default.
+func (r Rule) maxSize(mimeType string) int64 {
+	if limit, ok := r.MaxSize[mimeType]; ok {
+		return limit
+	}
+	if major, _, ok := strings.Cut(mimeType, "/"); ok {
+		if limit, ok := r.MaxSize[major+"/*"]; ok {
+			return limit
+		}
+	}
+	return r.MaxSize["*"]
+}
+
+// extensionTypes pins the types of the extensions we care about, since
+// mime.TypeByExtension depends on the host's mime.types files.
+var extensionTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".jpe":  "image/jpeg",
+	".pdf":  "application/pdf",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+}
+
+// TypeByExtension returns the MIME type implied by the extension of
+// filename, or "" if it is unknown.
+func TypeByExtension(filename string) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if ext == "" {
+		return ""
+	}
+	if mimeType, ok := extensionTypes[ext]; ok {
+		return mimeType
+	}
+
+	mimeType, _, err := mime.ParseMediaType(mime.TypeByExtension(ext))
+	if err != nil {
+		return ""
+	}
+	return mimeType
+}
+
+func matchAny(patterns []string, mimeType string) bool {
+	for _, pattern := range patterns {
+		if pattern == mimeType {
+			return true
+		}
+		if major, ok := strings.CutSuffix(pattern, "/*"); ok && strings.HasPrefix(mimeType, major+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func validPattern(pattern string) bool {
+	major, minor, ok := strings.Cut(pattern, "/")
+	return ok && major != "" && minor != "" && !strings.ContainsAny(pattern, " ;")
+}
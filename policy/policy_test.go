@@ -0,0 +1,170 @@
+package policy_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-secure-file-management/policy"
+)
+
+func load(t *testing.T, config string) *policy.Policy {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := policy.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+const roles = `{
+	"allowed": ["image/*", "application/pdf"],
+	"denied": ["image/gif"],
+	"max_size": {"*": 1000, "image/*": 500, "image/png": 200},
+	"strip_metadata": true,
+	"quota": 10000,
+	"bandwidth": {"upload": 100, "download": 200},
+	"roles": {
+		"admin": {
+			"allowed": ["image/*", "application/pdf", "text/plain"],
+			"max_size": {"image/png": 0, "application/pdf": 5000},
+			"strip_metadata": false,
+			"quota": 50000,
+			"bandwidth": {"download": 900}
+		},
+		"guest": {
+			"denied": ["image/webp"],
+			"max_size": {"image/*": 50}
+		}
+	},
+	"user_bandwidth": {"7": {"upload": 1}}
+}`
+
+// A role's override wins over the base rule for what it sets and inherits
+// the rest; denied lists add up.
+func TestRoleOverridePrecedence(t *testing.T) {
+	p := load(t, roles)
+
+	for _, tc := range []struct {
+		role, filename string
+		size           int64
+		want           string
+	}{
+		// base rule, also for unknown roles
+		{"user", "a.png", 200, ""},
+		{"user", "a.png", 201, policy.CodeSizeExceeded},
+		{"user", "a.jpg", 500, ""},
+		{"user", "a.jpg", 501, policy.CodeSizeExceeded},
+		{"user", "a.pdf", 1001, policy.CodeSizeExceeded},
+		{"user", "a.gif", 1, policy.CodeTypeDenied},
+		{"user", "a.txt", 1, policy.CodeTypeNotAllowed},
+		{"nobody", "a.png", 201, policy.CodeSizeExceeded},
+		// the admin's allowed list replaces the base one, a 0 limit lifts it
+		{"admin", "a.txt", 1, ""},
+		{"admin", "a.png", 1 << 30, ""},
+		{"admin", "a.jpg", 501, policy.CodeSizeExceeded},
+		{"admin", "a.pdf", 5000, ""},
+		{"admin", "a.gif", 1, policy.CodeTypeDenied},
+		// the guest keeps the base allowed and denied lists
+		{"guest", "a.webp", 1, policy.CodeTypeDenied},
+		{"guest", "a.gif", 1, policy.CodeTypeDenied},
+		{"guest", "a.txt", 1, policy.CodeTypeNotAllowed},
+		// the most specific limit wins, even the base rule's
+		{"guest", "a.png", 200, ""},
+		{"guest", "a.png", 201, policy.CodeSizeExceeded},
+		{"guest", "a.jpg", 51, policy.CodeSizeExceeded},
+		{"guest", "a.pdf", 1000, ""},
+		{"guest", "a.nosuchext", 1, policy.CodeExtensionNotAllowed},
+	} {
+		var got string
+		if v := p.CheckDeclared(tc.role, tc.filename, tc.size); v != nil {
+			got = v.Code
+		}
+		if got != tc.want {
+			t.Errorf("%s uploading %s of %d bytes: %q, want %q", tc.role, tc.filename, tc.size, got, tc.want)
+		}
+	}
+
+	if q := p.ForRole("admin").Quota; q != 50000 {
+		t.Errorf("admin quota %d, want 50000", q)
+	}
+	if q := p.ForRole("guest").Quota; q != 10000 {
+		t.Errorf("guest quota %d, want the base 10000", q)
+	}
+
+	for _, tc := range []struct {
+		role   string
+		userId uint
+		want   policy.Rates
+	}{
+		{"user", 1, policy.Rates{Upload: 100, Download: 200}},
+		{"admin", 1, policy.Rates{Upload: 100, Download: 900}},
+		{"admin", 7, policy.Rates{Upload: 1, Download: 900}},
+	} {
+		if got := p.BandwidthFor(tc.role, tc.userId); got != tc.want {
+			t.Errorf("bandwidth of %s %d: %+v, want %+v", tc.role, tc.userId, got, tc.want)
+		}
+	}
+
+	// Overrides don't leak into the base rule.
+	if denied := p.ForRole("user").Denied; len(denied) != 1 {
+		t.Errorf("user denied %v after resolving the guest role", denied)
+	}
+}
+
+func TestShouldStripMetadata(t *testing.T) {
+	p := load(t, roles)
+	yes, no := true, false
+
+	for _, tc := range []struct {
+		role string
+		user *bool
+		want bool
+	}{
+		{"user", nil, true},
+		{"admin", nil, false},
+		{"guest", nil, true},
+		{"user", &no, false},
+		{"admin", &yes, true},
+	} {
+		if got := p.ShouldStripMetadata(tc.role, tc.user); got != tc.want {
+			t.Errorf("%s with setting %v: %v, want %v", tc.role, tc.user, got, tc.want)
+		}
+	}
+}
+
+func TestCheckContentExtensionMismatch(t *testing.T) {
+	p := policy.Default()
+
+	if v := p.CheckContent("user", "a.pdf", "image/png", 10); v == nil || v.Code != policy.CodeExtensionMismatch {
+		t.Errorf("PNG named .pdf: %+v, want %s", v, policy.CodeExtensionMismatch)
+	}
+	if v := p.CheckContent("user", "a.PNG", "image/png", 10); v != nil {
+		t.Errorf("PNG named .PNG: %+v", v)
+	}
+}
+
+func TestLoadRejectsInvalid(t *testing.T) {
+	for name, config := range map[string]string{
+		"no allowed types":  `{}`,
+		"bad pattern":       `{"allowed": ["image"]}`,
+		"bad role pattern":  `{"allowed": ["image/png"], "roles": {"admin": {"denied": ["image/png; q=1"]}}}`,
+		"negative size":     `{"allowed": ["image/png"], "max_size": {"*": -1}}`,
+		"negative quota":    `{"allowed": ["image/png"], "roles": {"admin": {"quota": -1}}}`,
+		"unknown failure":   `{"allowed": ["image/png"], "validation": {"on_failure": "ignore"}}`,
+		"negative transfer": `{"allowed": ["image/png"], "user_bandwidth": {"1": {"download": -1}}}`,
+	} {
+		path := filepath.Join(t.TempDir(), "policy.json")
+		if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := policy.Load(path); err == nil {
+			t.Errorf("%s: loaded %s", name, config)
+		}
+	}
+}
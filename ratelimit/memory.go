@@ -0,0 +1,62 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often expired keys are dropped from a MemoryStore.
+const sweepInterval = time.Minute
+
+type memoryEntry struct {
+	tat     int64
+	expires time.Time
+}
+
+// MemoryStore keeps the buckets in the process, for a single replica.
+type MemoryStore struct {
+	mu        sync.Mutex
+	entries   map[string]memoryEntry
+	lastSweep time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: map[string]memoryEntry{}, lastSweep: time.Now()}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.get(key, time.Now()), nil
+}
+
+func (s *MemoryStore) CompareAndSwap(ctx context.Context, key string, old, new int64, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.get(key, now) != old {
+		return false, nil
+	}
+	s.entries[key] = memoryEntry{tat: new, expires: now.Add(ttl)}
+
+	if now.Sub(s.lastSweep) > sweepInterval {
+		for key, entry := range s.entries {
+			if !now.Before(entry.expires) {
+				delete(s.entries, key)
+			}
+		}
+		s.lastSweep = now
+	}
+	return true, nil
+}
+
+func (s *MemoryStore) get(key string, now time.Time) int64 {
+	entry, ok := s.entries[key]
+	if !ok || !now.Before(entry.expires) {
+		return 0
+	}
+	return entry.tat
+}
@@ -0,0 +1,168 @@
+// Package ratelimit limits requests with GCRA, the generic cell rate
+// algorithm: a token bucket that only needs to store one timestamp per
+// key, the theoretical arrival time (TAT) of the next request. Stores share
+// it between replicas.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Limit allows Rate requests per Period, Burst of them at once.
+type Limit struct {
+	Rate   int
+	Period time.Duration
+	// Burst defaults to Rate
+	Burst int
+}
+
+// ParseLimit reads "<rate>/<period>" with an optional ",burst=<n>", e.g.
+// "200/1m" or "10/1s,burst=50". The period is a Go duration, a missing
+// number means 1: "60/m" is "60/1m".
+func ParseLimit(s string) (Limit, error) {
+	spec, burst, hasBurst := strings.Cut(strings.TrimSpace(s), ",")
+	rate, period, ok := strings.Cut(spec, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("rate limit %q isn't <rate>/<period>", s)
+	}
+
+	var limit Limit
+	var err error
+	if limit.Rate, err = strconv.Atoi(strings.TrimSpace(rate)); err != nil || limit.Rate <= 0 {
+		return Limit{}, fmt.Errorf("rate limit %q: rate must be a positive integer", s)
+	}
+	period = strings.TrimSpace(period)
+	if period != "" && (period[0] < '0' || period[0] > '9') {
+		period = "1" + period
+	}
+	if limit.Period, err = time.ParseDuration(period); err != nil || limit.Period <= 0 {
+		return Limit{}, fmt.Errorf("rate limit %q: period must be a positive duration", s)
+	}
+	if hasBurst {
+		value, ok := strings.CutPrefix(strings.TrimSpace(burst), "burst=")
+		if limit.Burst, err = strconv.Atoi(value); !ok || err != nil || limit.Burst <= 0 {
+			return Limit{}, fmt.Errorf("rate limit %q: burst must be burst=<positive integer>", s)
+		}
+	}
+	return limit, nil
+}
+
+func (l Limit) String() string {
+	return fmt.Sprintf("%d/%s,burst=%d", l.Rate, l.Period, l.burst())
+}
+
+func (l Limit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Rate
+}
+
+// interval is the time one request uses up.
+func (l Limit) interval() time.Duration {
+	return l.Period / time.Duration(l.Rate)
+}
+
+// Limits holds the named limits of the routes, replaced together when the
+// configuration is reloaded.
+type Limits struct {
+	current atomic.Pointer[map[string]Limit]
+}
+
+func NewLimits(limits map[string]Limit) *Limits {
+	l := &Limits{}
+	l.Set(limits)
+	return l
+}
+
+// Get returns the limit called name, ok is false if there is none.
+func (l *Limits) Get(name string) (Limit, bool) {
+	limit, ok := (*l.current.Load())[name]
+	return limit, ok
+}
+
+func (l *Limits) Set(limits map[string]Limit) {
+	l.current.Store(&limits)
+}
+
+// Result is the outcome of a request, with what the RateLimit headers
+// report.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// ResetAfter is when the bucket is full again
+	ResetAfter time.Duration
+	// RetryAfter is when the next request is allowed, 0 if it is now
+	RetryAfter time.Duration
+}
+
+// Store keeps the TAT of each key as Unix nanoseconds.
+type Store interface {
+	// Get returns the TAT of key, 0 when there is none.
+	Get(ctx context.Context, key string) (int64, error)
+	// CompareAndSwap sets key to new if it still holds old (0 meaning no
+	// value) and lets it expire after ttl.
+	CompareAndSwap(ctx context.Context, key string, old, new int64, ttl time.Duration) (bool, error)
+}
+
+// maxRetries bounds the compare-and-swap loop under contention for a key.
+// A key still contended after that is rejected: failing open would let a
+// flood of requests through.
+const maxRetries = 10
+
+type Limiter struct {
+	Store Store
+	// Prefix namespaces the keys, e.g. per deployment
+	Prefix string
+	now    func() time.Time
+}
+
+func New(store Store) *Limiter {
+	return &Limiter{Store: store, Prefix: "ratelimit:", now: time.Now}
+}
+
+// Allow takes one request from the bucket of key under limit.
+func (l *Limiter) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	key = l.Prefix + key
+	interval := limit.interval()
+	// how far the TAT may run ahead of now
+	tolerance := interval * time.Duration(limit.burst())
+
+	for range maxRetries {
+		now := l.now().UnixNano()
+		stored, err := l.Store.Get(ctx, key)
+		if err != nil {
+			return Result{}, err
+		}
+
+		tat := max(stored, now)
+		next := tat + int64(interval)
+		result := Result{Limit: limit.burst()}
+		if allowAt := next - int64(tolerance); now < allowAt {
+			result.RetryAfter = time.Duration(allowAt - now)
+			result.ResetAfter = time.Duration(tat - now)
+			return result, nil
+		}
+
+		swapped, err := l.Store.CompareAndSwap(ctx, key, stored, next, tolerance)
+		if err != nil {
+			return Result{}, err
+		}
+		if !swapped {
+			continue
+		}
+
+		result.Allowed = true
+		result.Remaining = int((int64(tolerance) - (next - now)) / int64(interval))
+		result.ResetAfter = time.Duration(next - now)
+		return result, nil
+	}
+
+	return Result{Limit: limit.burst(), ResetAfter: tolerance, RetryAfter: interval}, nil
+}
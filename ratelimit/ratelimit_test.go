@@ -0,0 +1,117 @@
+package ratelimit_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-secure-file-management/ratelimit"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// stores runs fn against the in-memory store and a Redis store backed by
+// miniredis.
+func stores(t *testing.T, fn func(t *testing.T, store ratelimit.Store)) {
+	t.Run("memory", func(t *testing.T) {
+		fn(t, ratelimit.NewMemoryStore())
+	})
+	t.Run("redis", func(t *testing.T) {
+		fn(t, newRedisStore(t, miniredis.RunT(t)))
+	})
+}
+
+func newRedisStore(t *testing.T, server *miniredis.Miniredis) *ratelimit.RedisStore {
+	t.Helper()
+
+	store, err := ratelimit.NewRedisStore("redis://" + server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestStoreCompareAndSwap(t *testing.T) {
+	stores(t, func(t *testing.T, store ratelimit.Store) {
+		ctx := context.Background()
+
+		if tat, err := store.Get(ctx, "k"); err != nil || tat != 0 {
+			t.Fatalf("Get of a missing key = %d, %v; want 0", tat, err)
+		}
+		if ok, err := store.CompareAndSwap(ctx, "k", 0, 100, time.Minute); err != nil || !ok {
+			t.Fatalf("swap on a missing key = %t, %v; want true", ok, err)
+		}
+		if ok, err := store.CompareAndSwap(ctx, "k", 0, 200, time.Minute); err != nil || ok {
+			t.Errorf("swap with a stale value = %t, %v; want false", ok, err)
+		}
+		if ok, err := store.CompareAndSwap(ctx, "k", 100, 300, time.Minute); err != nil || !ok {
+			t.Errorf("swap with the current value = %t, %v; want true", ok, err)
+		}
+		if tat, err := store.Get(ctx, "k"); err != nil || tat != 300 {
+			t.Errorf("Get = %d, %v; want 300", tat, err)
+		}
+	})
+}
+
+func TestAllowBurstThenReject(t *testing.T) {
+	stores(t, func(t *testing.T, store ratelimit.Store) {
+		limiter := ratelimit.New(store)
+		limit := ratelimit.Limit{Rate: 60, Period: time.Hour, Burst: 3}
+
+		for i := 0; i < 3; i++ {
+			result, err := limiter.Allow(context.Background(), "user:1", limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !result.Allowed || result.Remaining != 2-i || result.Limit != 3 {
+				t.Fatalf("request %d: %+v, want allowed with %d remaining", i+1, result, 2-i)
+			}
+		}
+
+		result, err := limiter.Allow(context.Background(), "user:1", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// one request frees up every minute
+		if result.Allowed || result.RetryAfter <= 0 || result.RetryAfter > time.Minute {
+			t.Errorf("request over the burst: %+v, want rejected, retry within a minute", result)
+		}
+
+		other, err := limiter.Allow(context.Background(), "user:2", limit)
+		if err != nil || !other.Allowed {
+			t.Errorf("another key: %+v, %v; want allowed", other, err)
+		}
+	})
+}
+
+// Requests racing for one bucket never get more than the burst through.
+func TestAllowConcurrentRequests(t *testing.T) {
+	stores(t, func(t *testing.T, store ratelimit.Store) {
+		limiter := ratelimit.New(store)
+		limit := ratelimit.Limit{Rate: 1, Period: time.Hour, Burst: 10}
+
+		var allowed atomic.Int32
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				result, err := limiter.Allow(context.Background(), "upload:1", limit)
+				if err != nil {
+					t.Error(err)
+				}
+				if result.Allowed {
+					allowed.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if n := allowed.Load(); n == 0 || n > 10 {
+			t.Errorf("%d of 50 concurrent requests allowed, want between 1 and the burst of 10", n)
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// compareAndSwap sets KEYS[1] to ARGV[2] for ARGV[3] ms if it holds ARGV[1],
+// "0" standing for a missing key.
+var compareAndSwap = redis.NewScript(`
+local current = redis.call('GET', KEYS[1]) or '0'
+if current ~= ARGV[1] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+return 1
+`)
+
+// RedisStore shares the buckets between replicas through a server speaking
+// the Redis protocol (Redis, Valkey, KeyDB, ...).
+type RedisStore struct {
+	Client redis.UniversalClient
+}
+
+// NewRedisStore connects to a redis:// or rediss:// URL, e.g.
+// redis://:password@localhost:6379/0.
+func NewRedisStore(url string) (*RedisStore, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisStore{Client: redis.NewClient(options)}, nil
+}
+
+// Close releases the connections.
+func (s *RedisStore) Close() error {
+	return s.Client.Close()
+}
+
+// Ping checks the connection.
+func (s *RedisStore) Ping(ctx context.Context) error {
+	return s.Client.Ping(ctx).Err()
+}
+
+func (s *RedisStore) Get(ctx context.Context, key string) (int64, error) {
+	tat, err := s.Client.Get(ctx, key).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return tat, err
+}
+
+func (s *RedisStore) CompareAndSwap(ctx context.Context, key string, old, new int64, ttl time.Duration) (bool, error) {
+	// rounded up, expiring early could let a request through
+	ttlMillis := (ttl + time.Millisecond - 1).Milliseconds()
+	swapped, err := compareAndSwap.Run(ctx, s.Client, []string{key},
+		strconv.FormatInt(old, 10), strconv.FormatInt(new, 10), ttlMillis).Int()
+	return swapped == 1, err
+}
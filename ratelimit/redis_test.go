@@ -0,0 +1,69 @@
+package ratelimit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go-secure-file-management/ratelimit"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// Replicas sharing the server share the buckets.
+func TestRedisStoreSharedBetweenReplicas(t *testing.T) {
+	server := miniredis.RunT(t)
+	replicas := []*ratelimit.Limiter{
+		ratelimit.New(newRedisStore(t, server)),
+		ratelimit.New(newRedisStore(t, server)),
+	}
+	limit := ratelimit.Limit{Rate: 2, Period: time.Hour}
+
+	var allowed int
+	for i := 0; i < 4; i++ {
+		result, err := replicas[i%2].Allow(context.Background(), "auth:10.0.0.1", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Allowed {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("%d of 4 requests allowed across replicas, want 2", allowed)
+	}
+}
+
+// Buckets expire once they're full again, so idle keys don't pile up.
+func TestRedisStoreExpiresBuckets(t *testing.T) {
+	server := miniredis.RunT(t)
+	limiter := ratelimit.New(newRedisStore(t, server))
+	limit := ratelimit.Limit{Rate: 10, Period: time.Minute}
+
+	if _, err := limiter.Allow(context.Background(), "api:1", limit); err != nil {
+		t.Fatal(err)
+	}
+
+	key := limiter.Prefix + "api:1"
+	if !server.Exists(key) {
+		t.Fatalf("no key %s, keys are %v", key, server.Keys())
+	}
+	if ttl := server.TTL(key); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("bucket expires after %s, want at most the period", ttl)
+	}
+
+	server.FastForward(time.Minute)
+	if server.Exists(key) {
+		t.Error("bucket still there after it filled up again")
+	}
+}
+
+func TestRedisStoreUnreachable(t *testing.T) {
+	server := miniredis.RunT(t)
+	store := newRedisStore(t, server)
+	server.Close()
+
+	if _, err := ratelimit.New(store).Allow(context.Background(), "api:1", ratelimit.Limit{Rate: 1, Period: time.Second}); err == nil {
+		t.Error("Allow with the server gone returned no error")
+	}
+}
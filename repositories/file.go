@@ -2,49 +2,291 @@ package repositories
 
 import (
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"go-secure-file-management/db"
 	"go-secure-file-management/models"
 	"log"
+	"strconv"
+	"strings"
+	"time"
 )
 
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+
+	sqliteTimeLayout = "2006-01-02 15:04:05"
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+)
+
+// sortColumns maps the public sort keys to the columns they order by.
+var sortColumns = map[string]string{
+	"name": "filename",
+	"size": "size",
+	"date": "created_at",
+}
+
+type ListFilesOptions struct {
+	SortBy        string // name, size or date
+	Order         string // asc or desc
+	Limit         int
+	Cursor        string
+	MimeType      string
+	MinSize       int
+	MaxSize       int
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	Query         string // filename substring
+	Tags          []string
+	Metadata      map[string]string
+}
+
+type FilePage struct {
+	Files      []models.Files
+	Total      int
+	NextCursor string
+}
+
+// cursor is the keyset position of the last row of a page: the value of the
+// sort column and the id used as tie-breaker.
+type cursor struct {
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+// fileColumns is the column list scanFile expects.
+const fileColumns = "id, user_id, path, filename, size, mime_type, scan_status, scan_signature, original_sha256, metadata_stripped, created_at"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanFile(row rowScanner) (models.Files, error) {
+	var file models.Files
+	err := row.Scan(&file.ID, &file.UserId, &file.Path, &file.Filename, &file.Size, &file.MimeType, &file.ScanStatus, &file.ScanSignature,
+		&file.OriginalSha256, &file.MetadataStripped, &file.CreatedAt)
+	return file, err
+}
+
 type FileRepository struct {
-	DB *sql.DB
+	DB      *sql.DB
+	dialect db.Dialect
 }
 
-func NewFileRepository(db *sql.DB) *FileRepository {
-	return &FileRepository{DB: db}
+func NewFileRepository(conn *sql.DB) *FileRepository {
+	return &FileRepository{DB: conn, dialect: db.DialectOf(conn)}
 }
 
-func (r *FileRepository) CreateFile(path string, userId uint, filename string, size int, mimeType string) error {
-	query := "INSERT INTO files (user_id, path, filename, size, mime_type) VALUES (?, ?, ?, ?, ?)"
-	_, err := db.DB.Exec(query, userId, path, filename, size, mimeType)
+// FinalizeFile stores the record of an assembled upload and adds its size
+// to the owner's storage_used in one transaction. publish moves the file
+// into place at file.Path; it runs before the commit, so nothing is stored
+// when it fails. With a quota above 0, a file that doesn't fit fails with
+// ErrQuotaExceeded. The record is keyed by the upload's job, see
+// GetFileByJobId; a job can store one file only.
+func (r *FileRepository) FinalizeFile(jobId int64, file models.Files, quota int64, publish func() error) (int, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := "INSERT INTO files (user_id, path, filename, size, mime_type, scan_status, original_sha256, job_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING id"
+
+	var id int
+	err = tx.QueryRow(r.dialect.Rebind(query), file.UserId, file.Path, file.Filename, file.Size, file.MimeType, file.ScanStatus, file.OriginalSha256, jobId).Scan(&id)
+	if err != nil {
+		log.Printf("Failed to create file: %v", err)
+		return 0, err
+	}
 
+	// the quota is only compared when there is one: in `? = 0` Postgres
+	// would type it as int4, which quotas above 2 GiB overflow
+	update := "UPDATE users SET storage_used = storage_used + ? WHERE id = ?"
+	args := []interface{}{file.Size, file.UserId}
+	if quota > 0 {
+		update += " AND storage_used + ? <= ?"
+		args = append(args, file.Size, quota)
+	}
+	result, err := tx.Exec(r.dialect.Rebind(update), args...)
 	if err != nil {
-		fmt.Printf("Failed to create file: %v", err)
+		return 0, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if affected == 0 {
+		return 0, ErrQuotaExceeded
+	}
+
+	if err := publish(); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func (r *FileRepository) RenameFile(id int, userId uint, filename string) error {
+	query := "UPDATE files SET filename = ? WHERE id = ? AND user_id = ?"
+	result, err := r.DB.Exec(r.dialect.Rebind(query), filename, id, userId)
+	if err != nil {
+		log.Printf("Failed to rename file: %v", err)
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return fmt.Errorf("No file found with ID: %d", id)
+	}
+
+	return nil
+}
+
+// SetMetadataStripped records that metadata was removed from the stored
+// file, which changed its size. The original hash is kept.
+func (r *FileRepository) SetMetadataStripped(id int, size int64) error {
+	err := r.resize(id, size, "metadata_stripped = 1, ")
+	if err != nil {
+		log.Printf("Failed to update stripped file: %v", err)
 	}
 
 	return err
 }
 
+// SetScanResult records the outcome of a malware scan. path is the
+// file's new location when it was moved, or "" to keep the current one.
+func (r *FileRepository) SetScanResult(id int, status string, signature string, path string) error {
+	query := "UPDATE files SET scan_status = ?, scan_signature = ?, path = COALESCE(NULLIF(?, ''), path) WHERE id = ?"
+	_, err := r.DB.Exec(r.dialect.Rebind(query), status, signature, path, id)
+	if err != nil {
+		log.Printf("Failed to update scan result: %v", err)
+	}
+
+	return err
+}
+
+// DeleteFile removes the record of a file of userId with its tags and
+// metadata, and frees its size. Files that don't exist or belong to someone
+// else fail with ErrFileNotFound.
 func (r *FileRepository) DeleteFile(id int, userId uint) error {
-	query := "DELETE FROM files WHERE id = ? AND user_id = ?"
-	_, err := db.DB.Exec(query, id, userId)
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
+	queries := []string{
+		"UPDATE users SET storage_used = storage_used - COALESCE((SELECT size FROM files WHERE files.id = ? AND files.user_id = users.id), 0) WHERE id = ?",
+		"DELETE FROM file_tags WHERE file_id IN (SELECT id FROM files WHERE id = ? AND user_id = ?)",
+		"DELETE FROM file_metadata WHERE file_id IN (SELECT id FROM files WHERE id = ? AND user_id = ?)",
+		"DELETE FROM files WHERE id = ? AND user_id = ?",
+	}
+	var result sql.Result
+	for _, query := range queries {
+		if result, err = tx.Exec(r.dialect.Rebind(query), id, userId); err != nil {
+			log.Printf("Failed to delete file: %v", err)
+			return err
+		}
+	}
+	affected, err := result.RowsAffected()
 	if err != nil {
-		log.Printf("Failed to delete file: %v", err)
+		return err
+	}
+	if affected == 0 {
+		return ErrFileNotFound
+	}
+
+	return tx.Commit()
+}
+
+// GetAllFiles returns the records of every user, for consistency checks.
+func (r *FileRepository) GetAllFiles() ([]models.Files, error) {
+	rows, err := r.DB.Query("SELECT " + fileColumns + " FROM files ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []models.Files
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	return files, rows.Err()
+}
+
+// SetSize corrects the recorded size of a file.
+func (r *FileRepository) SetSize(id int, size int64) error {
+	err := r.resize(id, size, "")
+	if err != nil {
+		log.Printf("Failed to update file size: %v", err)
 	}
 
 	return err
 }
 
-func (r *FileRepository) GetFileById(id int) (models.Files, error) {
-	query := "SELECT * FROM files WHERE id = ?"
-	var file models.Files
+// resize sets the size of a file, and whatever else set assigns, and moves
+// the difference to its owner's storage_used.
+func (r *FileRepository) resize(id int, size int64, set string) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	row := db.DB.QueryRow(query, id)
+	_, err = tx.Exec(r.dialect.Rebind(`
+		UPDATE users SET storage_used = storage_used + ? - (SELECT size FROM files WHERE id = ?)
+		WHERE id = (SELECT user_id FROM files WHERE id = ?)`), size, id, id)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(r.dialect.Rebind("UPDATE files SET "+set+"size = ? WHERE id = ?"), size, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
 
-	err := row.Scan(&file.ID, &file.UserId, &file.Path, &file.Filename, &file.Size, &file.MimeType, &file.CreatedAt)
+// PathExists reports whether a file record points to path.
+func (r *FileRepository) PathExists(path string) (bool, error) {
+	var exists bool
+	err := r.DB.QueryRow(r.dialect.Rebind("SELECT EXISTS (SELECT 1 FROM files WHERE path = ?)"), path).Scan(&exists)
+	return exists, err
+}
+
+// GetFileByJobId returns the file stored by an upload job, or
+// ErrFileNotFound.
+func (r *FileRepository) GetFileByJobId(jobId int64) (models.Files, error) {
+	query := "SELECT " + fileColumns + " FROM files WHERE job_id = ?"
+
+	file, err := scanFile(r.DB.QueryRow(r.dialect.Rebind(query), jobId))
+	if err == sql.ErrNoRows {
+		return models.Files{}, ErrFileNotFound
+	}
+	return file, err
+}
+
+func (r *FileRepository) GetFileById(id int) (models.Files, error) {
+	query := "SELECT " + fileColumns + " FROM files WHERE id = ?"
+
+	file, err := scanFile(r.DB.QueryRow(r.dialect.Rebind(query), id))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return models.Files{}, fmt.Errorf("No file found with ID: %d", id)
@@ -56,16 +298,16 @@ func (r *FileRepository) GetFileById(id int) (models.Files, error) {
 }
 
 func (r *FileRepository) GetFilesByUserId(userId uint) ([]models.Files, error) {
-	query := "SELECT * FROM files WHERE user_id = ? ORDER BY created_at DESC"
-	rows, err := db.DB.Query(query, userId)
+	query := "SELECT " + fileColumns + " FROM files WHERE user_id = ? ORDER BY created_at DESC"
+	rows, err := r.DB.Query(r.dialect.Rebind(query), userId)
 	if err != nil {
 		return nil, err
 	}
 
 	var files []models.Files
 	for rows.Next() {
-		var file models.Files
-		if err := rows.Scan(&file.ID, &file.UserId, &file.Path, &file.Filename, &file.Size, &file.MimeType, &file.CreatedAt); err != nil {
+		file, err := scanFile(rows)
+		if err != nil {
 			return nil, err
 		}
 		files = append(files, file)
@@ -74,3 +316,162 @@ func (r *FileRepository) GetFilesByUserId(userId uint) ([]models.Files, error) {
 	return files, nil
 
 }
+
+func (r *FileRepository) ListFiles(userId uint, opts ListFilesOptions) (FilePage, error) {
+	column, ok := sortColumns[opts.SortBy]
+	if !ok {
+		column = sortColumns["date"]
+		opts.SortBy = "date"
+	}
+
+	direction := "DESC"
+	if strings.EqualFold(opts.Order, "asc") {
+		direction = "ASC"
+	}
+
+	if opts.Limit <= 0 {
+		opts.Limit = DefaultPageSize
+	}
+	if opts.Limit > MaxPageSize {
+		opts.Limit = MaxPageSize
+	}
+
+	where := []string{"user_id = ?"}
+	args := []interface{}{userId}
+
+	if opts.MimeType != "" {
+		where = append(where, "mime_type = ?")
+		args = append(args, opts.MimeType)
+	}
+	if opts.MinSize > 0 {
+		where = append(where, "size >= ?")
+		args = append(args, opts.MinSize)
+	}
+	if opts.MaxSize > 0 {
+		where = append(where, "size <= ?")
+		args = append(args, opts.MaxSize)
+	}
+	if !opts.CreatedAfter.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, opts.CreatedAfter.UTC().Format(sqliteTimeLayout))
+	}
+	if !opts.CreatedBefore.IsZero() {
+		where = append(where, "created_at <= ?")
+		args = append(args, opts.CreatedBefore.UTC().Format(sqliteTimeLayout))
+	}
+	if opts.Query != "" {
+		where = append(where, `filename `+r.dialect.Like()+` ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(opts.Query)+"%")
+	}
+
+	labelWhere, labelArgs := LabelFilters("id", opts.Tags, opts.Metadata)
+	where = append(where, labelWhere...)
+	args = append(args, labelArgs...)
+
+	var page FilePage
+
+	countQuery := "SELECT COUNT(*) FROM files WHERE " + strings.Join(where, " AND ")
+	if err := r.DB.QueryRow(r.dialect.Rebind(countQuery), args...).Scan(&page.Total); err != nil {
+		return FilePage{}, err
+	}
+
+	if opts.Cursor != "" {
+		cur, err := decodeCursor(opts.Cursor)
+		if err != nil {
+			return FilePage{}, err
+		}
+
+		var value interface{} = cur.Value
+		if column == "size" {
+			size, err := strconv.Atoi(cur.Value)
+			if err != nil {
+				return FilePage{}, ErrInvalidCursor
+			}
+			value = size
+		}
+
+		operator := "<"
+		if direction == "ASC" {
+			operator = ">"
+		}
+		where = append(where, fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?))", column, operator))
+		args = append(args, value, value, cur.ID)
+	}
+
+	// fetch one extra row to know whether there is a next page
+	query := fmt.Sprintf(
+		"SELECT %s FROM files WHERE %s ORDER BY %s %s, id %s LIMIT ?",
+		fileColumns, strings.Join(where, " AND "), column, direction, direction,
+	)
+	args = append(args, opts.Limit+1)
+
+	rows, err := r.DB.Query(r.dialect.Rebind(query), args...)
+	if err != nil {
+		return FilePage{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return FilePage{}, err
+		}
+		page.Files = append(page.Files, file)
+	}
+	if err := rows.Err(); err != nil {
+		return FilePage{}, err
+	}
+
+	if len(page.Files) > opts.Limit {
+		page.Files = page.Files[:opts.Limit]
+		page.NextCursor = encodeCursor(cursorAfter(opts.SortBy, page.Files[len(page.Files)-1]))
+	}
+
+	return page, nil
+}
+
+// cursorAfter is the position of the last file of a page.
+func cursorAfter(sortBy string, last models.Files) cursor {
+	var value string
+	switch sortBy {
+	case "name":
+		value = last.Filename
+	case "size":
+		value = strconv.Itoa(last.Size)
+	default:
+		value = toSQLiteTime(last.CreatedAt)
+	}
+	return cursor{Value: value, ID: last.ID}
+}
+
+func encodeCursor(c cursor) string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	var c cursor
+	if err := json.Unmarshal(raw, &c); err != nil || c.ID <= 0 {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	return c, nil
+}
+
+// toSQLiteTime converts a scanned timestamp back to the text format SQLite
+// stores for CURRENT_TIMESTAMP, so it can be compared against the column.
+func toSQLiteTime(value string) string {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t.UTC().Format(sqliteTimeLayout)
+	}
+	return value
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
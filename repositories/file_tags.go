@@ -0,0 +1,228 @@
+package repositories
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	MaxTagsPerFile     = 20
+	MaxTagLength       = 32
+	MaxMetadataPerFile = 32
+	MaxMetadataKey     = 64
+	MaxMetadataValue   = 512
+)
+
+var (
+	ErrFileNotFound     = errors.New("file not found")
+	ErrTooManyTags      = fmt.Errorf("a file can have at most %d tags", MaxTagsPerFile)
+	ErrTooManyMetadata  = fmt.Errorf("a file can have at most %d metadata entries", MaxMetadataPerFile)
+	ErrInvalidTag       = fmt.Errorf("tags must be 1-%d characters of letters, digits, space, '-', '_', '.' or ':'", MaxTagLength)
+	ErrInvalidMetaKey   = fmt.Errorf("metadata keys must be 1-%d characters of lower-case letters, digits, '-', '_' or '.'", MaxMetadataKey)
+	ErrInvalidMetaValue = fmt.Errorf("metadata values must be at most %d characters without control characters", MaxMetadataValue)
+)
+
+// NormalizeTag trims and lower-cases a tag and checks it against the
+// allowed character set.
+func NormalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" || len([]rune(tag)) > MaxTagLength {
+		return "", ErrInvalidTag
+	}
+	for _, r := range tag {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(" -_.:", r) {
+			return "", ErrInvalidTag
+		}
+	}
+	return tag, nil
+}
+
+func NormalizeMetadataKey(key string) (string, error) {
+	key = strings.ToLower(strings.TrimSpace(key))
+	if key == "" || len(key) > MaxMetadataKey {
+		return "", ErrInvalidMetaKey
+	}
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z') && !(r >= '0' && r <= '9') && !strings.ContainsRune("-_.", r) {
+			return "", ErrInvalidMetaKey
+		}
+	}
+	return key, nil
+}
+
+func ValidateMetadataValue(value string) error {
+	if len([]rune(value)) > MaxMetadataValue {
+		return ErrInvalidMetaValue
+	}
+	for _, r := range value {
+		if unicode.IsControl(r) {
+			return ErrInvalidMetaValue
+		}
+	}
+	return nil
+}
+
+// SetTags replaces all tags of the file.
+func (r *FileRepository) SetTags(fileId int, userId uint, tags []string) error {
+	if len(tags) > MaxTagsPerFile {
+		return ErrTooManyTags
+	}
+
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := r.checkOwner(tx, fileId, userId); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(r.dialect.Rebind("DELETE FROM file_tags WHERE file_id = ?"), fileId); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if _, err := tx.Exec(r.dialect.Rebind("INSERT INTO file_tags (file_id, tag) VALUES (?, ?) ON CONFLICT DO NOTHING"), fileId, tag); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (r *FileRepository) RemoveTag(fileId int, userId uint, tag string) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := r.checkOwner(tx, fileId, userId); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(r.dialect.Rebind("DELETE FROM file_tags WHERE file_id = ? AND tag = ?"), fileId, tag); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *FileRepository) GetTags(fileId int) ([]string, error) {
+	rows, err := r.DB.Query(r.dialect.Rebind("SELECT tag FROM file_tags WHERE file_id = ? ORDER BY tag"), fileId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make([]string, 0)
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+// SetMetadata adds or overwrites the given keys, leaving other keys as they are.
+func (r *FileRepository) SetMetadata(fileId int, userId uint, metadata map[string]string) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := r.checkOwner(tx, fileId, userId); err != nil {
+		return err
+	}
+
+	for key, value := range metadata {
+		_, err := tx.Exec(r.dialect.Rebind(`
+			INSERT INTO file_metadata (file_id, key, value) VALUES (?, ?, ?)
+			ON CONFLICT (file_id, key) DO UPDATE SET value = excluded.value`),
+			fileId, key, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	var count int
+	if err := tx.QueryRow(r.dialect.Rebind("SELECT COUNT(*) FROM file_metadata WHERE file_id = ?"), fileId).Scan(&count); err != nil {
+		return err
+	}
+	if count > MaxMetadataPerFile {
+		return ErrTooManyMetadata
+	}
+
+	return tx.Commit()
+}
+
+func (r *FileRepository) RemoveMetadata(fileId int, userId uint, key string) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := r.checkOwner(tx, fileId, userId); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(r.dialect.Rebind("DELETE FROM file_metadata WHERE file_id = ? AND key = ?"), fileId, key); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *FileRepository) GetMetadata(fileId int) (map[string]string, error) {
+	rows, err := r.DB.Query(r.dialect.Rebind("SELECT key, value FROM file_metadata WHERE file_id = ?"), fileId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metadata := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		metadata[key] = value
+	}
+
+	return metadata, rows.Err()
+}
+
+func (r *FileRepository) checkOwner(tx *sql.Tx, fileId int, userId uint) error {
+	var exists int
+	err := tx.QueryRow(r.dialect.Rebind("SELECT 1 FROM files WHERE id = ? AND user_id = ?"), fileId, userId).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return ErrFileNotFound
+	}
+	return err
+}
+
+// LabelFilters returns the WHERE conditions restricting idColumn to files
+// carrying every tag and metadata pair.
+func LabelFilters(idColumn string, tags []string, metadata map[string]string) ([]string, []interface{}) {
+	var where []string
+	var args []interface{}
+
+	for _, tag := range tags {
+		where = append(where, idColumn+" IN (SELECT file_id FROM file_tags WHERE tag = ?)")
+		args = append(args, tag)
+	}
+	for key, value := range metadata {
+		where = append(where, idColumn+" IN (SELECT file_id FROM file_metadata WHERE key = ? AND value = ?)")
+		args = append(args, key, value)
+	}
+
+	return where, args
+}
@@ -0,0 +1,314 @@
+package repositories_test
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go-secure-file-management/db"
+	"go-secure-file-management/db/dbtest"
+	"go-secure-file-management/models"
+	"go-secure-file-management/repositories"
+)
+
+func addUser(t *testing.T, conn *sql.DB, email string) uint {
+	t.Helper()
+
+	user, err := repositories.NewUserRepository(conn).CreateUser(email, "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uint(user.ID)
+}
+
+// addFile stores a file through FinalizeFile, as the upload pipeline does.
+func addFile(t *testing.T, repo *repositories.FileRepository, jobId int64, file models.Files) int {
+	t.Helper()
+
+	id, err := repo.FinalizeFile(jobId, file, 0, func() error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func storageUsed(t *testing.T, conn *sql.DB, userId uint) int64 {
+	t.Helper()
+
+	var used int64
+	err := conn.QueryRow(db.DialectOf(conn).Rebind("SELECT storage_used FROM users WHERE id = ?"), userId).Scan(&used)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return used
+}
+
+func TestFinalizeFile(t *testing.T) {
+	dbtest.Run(t, dbtest.Migrated, func(t *testing.T, conn *sql.DB) {
+		repo := repositories.NewFileRepository(conn)
+		userId := addUser(t, conn, "a@b.co")
+
+		id := addFile(t, repo, 7, models.Files{
+			UserId: int(userId), Path: "uploads/a", Filename: "a.png", Size: 10, MimeType: "image/png",
+			ScanStatus: "pending", OriginalSha256: "abc",
+		})
+
+		file, err := repo.GetFileById(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file.ID != id || file.Filename != "a.png" || file.Size != 10 || file.ScanStatus != "pending" || file.OriginalSha256 != "abc" {
+			t.Errorf("stored %+v", file)
+		}
+		created, err := time.Parse(time.RFC3339Nano, file.CreatedAt)
+		if err != nil {
+			t.Fatalf("created_at %q: %v", file.CreatedAt, err)
+		}
+		// the column default is the current time in UTC, whole seconds
+		if age := time.Since(created); age < -time.Second || age > time.Minute || created.Nanosecond() != 0 {
+			t.Errorf("created_at %s isn't the current UTC time in seconds", file.CreatedAt)
+		}
+
+		byJob, err := repo.GetFileByJobId(7)
+		if err != nil || byJob.ID != id {
+			t.Errorf("GetFileByJobId(7) = %d, %v; want file %d", byJob.ID, err, id)
+		}
+		if _, err := repo.GetFileByJobId(8); !errors.Is(err, repositories.ErrFileNotFound) {
+			t.Errorf("GetFileByJobId of a job without file: err = %v, want ErrFileNotFound", err)
+		}
+		if _, err := repo.FinalizeFile(7, file, 0, func() error { return nil }); err == nil {
+			t.Error("a job stored a second file")
+		}
+		if used := storageUsed(t, conn, userId); used != 10 {
+			t.Errorf("storage_used %d, want 10", used)
+		}
+	})
+}
+
+func TestFinalizeFileRollsBack(t *testing.T) {
+	dbtest.Run(t, dbtest.Migrated, func(t *testing.T, conn *sql.DB) {
+		repo := repositories.NewFileRepository(conn)
+		userId := addUser(t, conn, "a@b.co")
+		file := models.Files{UserId: int(userId), Path: "uploads/a", Filename: "a.png", Size: 10, MimeType: "image/png", ScanStatus: "pending"}
+
+		published := false
+		_, err := repo.FinalizeFile(1, file, 5, func() error {
+			published = true
+			return nil
+		})
+		if !errors.Is(err, repositories.ErrQuotaExceeded) || published {
+			t.Errorf("over quota: err = %v, published %t; want ErrQuotaExceeded before publishing", err, published)
+		}
+
+		failed := errors.New("link failed")
+		if _, err := repo.FinalizeFile(2, file, 0, func() error { return failed }); !errors.Is(err, failed) {
+			t.Errorf("failed publish: err = %v, want %v", err, failed)
+		}
+
+		files, err := repo.GetFilesByUserId(userId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 0 {
+			t.Errorf("rolled back uploads left %+v", files)
+		}
+		if used := storageUsed(t, conn, userId); used != 0 {
+			t.Errorf("storage_used %d after rollbacks, want 0", used)
+		}
+	})
+}
+
+func TestDeleteFile(t *testing.T) {
+	dbtest.Run(t, dbtest.Migrated, func(t *testing.T, conn *sql.DB) {
+		repo := repositories.NewFileRepository(conn)
+		owner := addUser(t, conn, "a@b.co")
+		other := addUser(t, conn, "c@d.co")
+		id := addFile(t, repo, 1, models.Files{UserId: int(owner), Path: "uploads/a", Filename: "a.png", Size: 10, MimeType: "image/png"})
+		if err := repo.SetTags(id, owner, []string{"sale"}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := repo.DeleteFile(id, other); !errors.Is(err, repositories.ErrFileNotFound) {
+			t.Errorf("another user's file: err = %v, want ErrFileNotFound", err)
+		}
+		if tags, _ := repo.GetTags(id); len(tags) != 1 {
+			t.Errorf("tags %v after a refused delete, want [sale]", tags)
+		}
+		if used := storageUsed(t, conn, owner); used != 10 {
+			t.Errorf("storage_used %d after a refused delete, want 10", used)
+		}
+
+		if err := repo.DeleteFile(id, owner); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.GetFileById(id); err == nil {
+			t.Error("record still there")
+		}
+		if used := storageUsed(t, conn, owner); used != 0 {
+			t.Errorf("storage_used %d, want 0", used)
+		}
+		if err := repo.DeleteFile(id, owner); !errors.Is(err, repositories.ErrFileNotFound) {
+			t.Errorf("deleting twice: err = %v, want ErrFileNotFound", err)
+		}
+	})
+}
+
+// Quotas are int64: the example ones in the configuration are above what
+// fits into an int4.
+func TestFinalizeFileLargeQuota(t *testing.T) {
+	dbtest.Run(t, dbtest.Migrated, func(t *testing.T, conn *sql.DB) {
+		repo := repositories.NewFileRepository(conn)
+		dialect := db.DialectOf(conn)
+		userId := addUser(t, conn, "a@b.co")
+		const quota = 5 << 30
+		file := models.Files{UserId: int(userId), Path: "uploads/a", Filename: "a.png", Size: 10, MimeType: "image/png", ScanStatus: "pending"}
+
+		if _, err := conn.Exec(dialect.Rebind("UPDATE users SET storage_used = ? WHERE id = ?"), int64(3<<30), userId); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.FinalizeFile(1, file, quota, func() error { return nil }); err != nil {
+			t.Fatalf("file within the quota: %v", err)
+		}
+		if used := storageUsed(t, conn, userId); used != 3<<30+10 {
+			t.Errorf("storage_used %d, want %d", used, int64(3<<30+10))
+		}
+
+		if _, err := conn.Exec(dialect.Rebind("UPDATE users SET storage_used = ? WHERE id = ?"), int64(quota-5), userId); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.FinalizeFile(2, file, quota, func() error { return nil }); !errors.Is(err, repositories.ErrQuotaExceeded) {
+			t.Errorf("file over the quota: err = %v, want ErrQuotaExceeded", err)
+		}
+	})
+}
+
+// listAll pages through ListFiles and returns the filenames in order.
+func listAll(t *testing.T, repo *repositories.FileRepository, userId uint, opts repositories.ListFilesOptions) ([]string, int) {
+	t.Helper()
+
+	var names []string
+	total := -1
+	for page := 0; ; page++ {
+		result, err := repo.ListFiles(userId, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total >= 0 && result.Total != total {
+			t.Errorf("total changed from %d to %d while paging", total, result.Total)
+		}
+		total = result.Total
+		for _, file := range result.Files {
+			names = append(names, file.Filename)
+		}
+		if result.NextCursor == "" {
+			return names, total
+		}
+		if page > 10 {
+			t.Fatal("paging doesn't end")
+		}
+		opts.Cursor = result.NextCursor
+	}
+}
+
+func TestListFilesPages(t *testing.T) {
+	dbtest.Run(t, dbtest.Migrated, func(t *testing.T, conn *sql.DB) {
+		repo := repositories.NewFileRepository(conn)
+		dialect := db.DialectOf(conn)
+		userId := addUser(t, conn, "a@b.co")
+		other := addUser(t, conn, "c@d.co")
+
+		// c and d share a timestamp, the id breaks the tie
+		files := []struct {
+			name    string
+			size    int
+			created string
+		}{
+			{"c.png", 30, "2025-01-02 10:00:00"},
+			{"a.png", 50, "2025-01-01 10:00:00"},
+			{"e.png", 10, "2025-01-03 10:00:00"},
+			{"d.png", 20, "2025-01-02 10:00:00"},
+			{"b.png", 40, "2025-01-04 10:00:00"},
+		}
+		for i, f := range files {
+			id := addFile(t, repo, int64(i+1), models.Files{UserId: int(userId), Path: "uploads/" + f.name, Filename: f.name, Size: f.size, MimeType: "image/png"})
+			if _, err := conn.Exec(dialect.Rebind("UPDATE files SET created_at = ? WHERE id = ?"), f.created, id); err != nil {
+				t.Fatal(err)
+			}
+		}
+		addFile(t, repo, 99, models.Files{UserId: int(other), Path: "uploads/x", Filename: "x.png", Size: 1, MimeType: "image/png"})
+
+		for _, tc := range []struct {
+			sort, order string
+			want        string
+		}{
+			{"date", "desc", "[b.png e.png d.png c.png a.png]"},
+			{"date", "asc", "[a.png c.png d.png e.png b.png]"},
+			{"name", "asc", "[a.png b.png c.png d.png e.png]"},
+			{"size", "desc", "[a.png b.png c.png d.png e.png]"},
+		} {
+			names, total := listAll(t, repo, userId, repositories.ListFilesOptions{SortBy: tc.sort, Order: tc.order, Limit: 2})
+			if got := fmt.Sprint(names); got != tc.want || total != len(files) {
+				t.Errorf("by %s %s: %s of %d, want %s of %d", tc.sort, tc.order, got, total, tc.want, len(files))
+			}
+		}
+
+		if _, err := repo.ListFiles(userId, repositories.ListFilesOptions{Cursor: "garbage"}); !errors.Is(err, repositories.ErrInvalidCursor) {
+			t.Errorf("garbage cursor: err = %v, want ErrInvalidCursor", err)
+		}
+	})
+}
+
+func TestListFilesFilters(t *testing.T) {
+	dbtest.Run(t, dbtest.Migrated, func(t *testing.T, conn *sql.DB) {
+		repo := repositories.NewFileRepository(conn)
+		dialect := db.DialectOf(conn)
+		userId := addUser(t, conn, "a@b.co")
+
+		files := []struct {
+			name, mime, created string
+			size                int
+		}{
+			{"Report.pdf", "application/pdf", "2025-01-01 10:00:00", 100},
+			{"50% off.png", "image/png", "2025-01-02 10:00:00", 200},
+			{"500 off.png", "image/png", "2025-01-03 10:00:00", 300},
+		}
+		ids := map[string]int{}
+		for i, f := range files {
+			id := addFile(t, repo, int64(i+1), models.Files{UserId: int(userId), Path: fmt.Sprintf("uploads/%d", i), Filename: f.name, Size: f.size, MimeType: f.mime})
+			if _, err := conn.Exec(dialect.Rebind("UPDATE files SET created_at = ? WHERE id = ?"), f.created, id); err != nil {
+				t.Fatal(err)
+			}
+			ids[f.name] = id
+		}
+		if err := repo.SetTags(ids["500 off.png"], userId, []string{"sale"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.SetMetadata(ids["Report.pdf"], userId, map[string]string{"project": "apollo"}); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tc := range []struct {
+			name string
+			opts repositories.ListFilesOptions
+			want string
+		}{
+			{"case-insensitive name", repositories.ListFilesOptions{Query: "REPORT"}, "[Report.pdf]"},
+			{"literal percent", repositories.ListFilesOptions{Query: "50%"}, "[50% off.png]"},
+			{"mime type", repositories.ListFilesOptions{MimeType: "image/png"}, "[500 off.png 50% off.png]"},
+			{"size range", repositories.ListFilesOptions{MinSize: 150, MaxSize: 250}, "[50% off.png]"},
+			{"created range", repositories.ListFilesOptions{
+				CreatedAfter:  time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC),
+				CreatedBefore: time.Date(2025, 1, 2, 23, 59, 59, 0, time.UTC),
+			}, "[50% off.png]"},
+			{"tag", repositories.ListFilesOptions{Tags: []string{"sale"}}, "[500 off.png]"},
+			{"metadata", repositories.ListFilesOptions{Metadata: map[string]string{"project": "apollo"}}, "[Report.pdf]"},
+		} {
+			names, _ := listAll(t, repo, userId, tc.opts)
+			if got := fmt.Sprint(names); got != tc.want {
+				t.Errorf("%s: %s, want %s", tc.name, got, tc.want)
+			}
+		}
+	})
+}
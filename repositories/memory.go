@@ -0,0 +1,568 @@
+package repositories
+
+import (
+	"fmt"
+	"go-secure-file-management/models"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The in-memory stores keep everything in maps and behave like the SQL
+// repositories, errors included. They're meant for handler tests.
+
+func memoryNow() string {
+	return time.Now().UTC().Truncate(time.Second).Format(time.RFC3339)
+}
+
+type MemoryUserStore struct {
+	mu     sync.Mutex
+	users  []models.User
+	nextId int
+}
+
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{nextId: 1}
+}
+
+func (s *MemoryUserStore) CreateUser(email string, password string) (models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := models.User{ID: s.nextId, Email: email, Password: password, Role: "user", CreatedAt: memoryNow()}
+	s.nextId++
+	s.users = append(s.users, user)
+
+	user.Password = ""
+	user.CreatedAt = ""
+	return user, nil
+}
+
+func (s *MemoryUserStore) FindUserByEmail(email string) (models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, user := range s.users {
+		if user.Email == email {
+			return models.User{ID: user.ID, Email: user.Email, Password: user.Password, Role: user.Role}, nil
+		}
+	}
+	return models.User{}, fmt.Errorf("no user found with email: %s", email)
+}
+
+func (s *MemoryUserStore) GetStripMetadata(userId uint) (*bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := s.find(userId)
+	if user == nil {
+		return nil, fmt.Errorf("no user found with ID: %d", userId)
+	}
+	if user.StripMetadata == nil {
+		return nil, nil
+	}
+	value := *user.StripMetadata
+	return &value, nil
+}
+
+func (s *MemoryUserStore) SetStripMetadata(userId uint, value *bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user := s.find(userId); user != nil {
+		if value != nil {
+			v := *value
+			value = &v
+		}
+		user.StripMetadata = value
+	}
+	return nil
+}
+
+// SetRole changes a user's role, there's no API for it.
+func (s *MemoryUserStore) SetRole(userId uint, role string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user := s.find(userId); user != nil {
+		user.Role = role
+	}
+}
+
+func (s *MemoryUserStore) find(userId uint) *models.User {
+	for i := range s.users {
+		if s.users[i].ID == int(userId) {
+			return &s.users[i]
+		}
+	}
+	return nil
+}
+
+type memoryFile struct {
+	models.Files
+	jobId    int64
+	tags     map[string]bool
+	metadata map[string]string
+}
+
+type MemoryFileStore struct {
+	mu     sync.Mutex
+	files  map[int]*memoryFile
+	nextId int
+	// bytes stored per user
+	usage map[uint]int64
+}
+
+func NewMemoryFileStore() *MemoryFileStore {
+	return &MemoryFileStore{files: map[int]*memoryFile{}, nextId: 1, usage: map[uint]int64{}}
+}
+
+func (s *MemoryFileStore) FinalizeFile(jobId int64, file models.Files, quota int64, publish func() error) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, f := range s.files {
+		if f.jobId == jobId {
+			return 0, fmt.Errorf("job %d already stored file %d", jobId, f.ID)
+		}
+	}
+	userId := uint(file.UserId)
+	if quota > 0 && s.usage[userId]+int64(file.Size) > quota {
+		return 0, ErrQuotaExceeded
+	}
+	if err := publish(); err != nil {
+		return 0, err
+	}
+
+	file.ID = s.nextId
+	file.ScanSignature = ""
+	file.MetadataStripped = false
+	file.CreatedAt = memoryNow()
+	file.Tags = nil
+	file.Metadata = nil
+	s.nextId++
+	s.files[file.ID] = &memoryFile{Files: file, jobId: jobId, tags: map[string]bool{}, metadata: map[string]string{}}
+	s.usage[userId] += int64(file.Size)
+	return file.ID, nil
+}
+
+// StorageUsed returns the bytes stored by a user.
+func (s *MemoryFileStore) StorageUsed(userId uint) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.usage[userId]
+}
+
+func (s *MemoryFileStore) GetFileByJobId(jobId int64) (models.Files, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, f := range s.files {
+		if f.jobId == jobId {
+			return f.Files, nil
+		}
+	}
+	return models.Files{}, ErrFileNotFound
+}
+
+func (s *MemoryFileStore) GetFileById(id int) (models.Files, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, ok := s.files[id]
+	if !ok {
+		return models.Files{}, fmt.Errorf("No file found with ID: %d", id)
+	}
+	return file.Files, nil
+}
+
+func (s *MemoryFileStore) GetFilesByUserId(userId uint) ([]models.Files, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files := s.filter(func(f *memoryFile) bool { return f.UserId == int(userId) })
+	slices.SortFunc(files, func(a, b models.Files) int {
+		if c := strings.Compare(b.CreatedAt, a.CreatedAt); c != 0 {
+			return c
+		}
+		return b.ID - a.ID
+	})
+	return files, nil
+}
+
+func (s *MemoryFileStore) GetAllFiles() ([]models.Files, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files := s.filter(func(*memoryFile) bool { return true })
+	slices.SortFunc(files, func(a, b models.Files) int { return a.ID - b.ID })
+	return files, nil
+}
+
+func (s *MemoryFileStore) ListFiles(userId uint, opts ListFilesOptions) (FilePage, error) {
+	if _, ok := sortColumns[opts.SortBy]; !ok {
+		opts.SortBy = "date"
+	}
+	descending := !strings.EqualFold(opts.Order, "asc")
+
+	if opts.Limit <= 0 {
+		opts.Limit = DefaultPageSize
+	}
+	if opts.Limit > MaxPageSize {
+		opts.Limit = MaxPageSize
+	}
+
+	// compare orders two files the way the SQL ORDER BY does, ascending
+	compare := func(a, b cursor) int {
+		var c int
+		if opts.SortBy == "size" {
+			x, _ := strconv.Atoi(a.Value)
+			y, _ := strconv.Atoi(b.Value)
+			c = x - y
+		} else {
+			c = strings.Compare(a.Value, b.Value)
+		}
+		if c == 0 {
+			c = a.ID - b.ID
+		}
+		if descending {
+			c = -c
+		}
+		return c
+	}
+
+	var after *cursor
+	if opts.Cursor != "" {
+		cur, err := decodeCursor(opts.Cursor)
+		if err != nil {
+			return FilePage{}, err
+		}
+		if opts.SortBy == "size" {
+			if _, err := strconv.Atoi(cur.Value); err != nil {
+				return FilePage{}, ErrInvalidCursor
+			}
+		}
+		after = &cur
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	query := strings.ToLower(opts.Query)
+	files := s.filter(func(f *memoryFile) bool {
+		created := toSQLiteTime(f.CreatedAt)
+		switch {
+		case f.UserId != int(userId),
+			opts.MimeType != "" && f.MimeType != opts.MimeType,
+			opts.MinSize > 0 && f.Size < opts.MinSize,
+			opts.MaxSize > 0 && f.Size > opts.MaxSize,
+			!opts.CreatedAfter.IsZero() && created < opts.CreatedAfter.UTC().Format(sqliteTimeLayout),
+			!opts.CreatedBefore.IsZero() && created > opts.CreatedBefore.UTC().Format(sqliteTimeLayout),
+			query != "" && !strings.Contains(strings.ToLower(f.Filename), query):
+			return false
+		}
+		for _, tag := range opts.Tags {
+			if !f.tags[tag] {
+				return false
+			}
+		}
+		for key, value := range opts.Metadata {
+			if v, ok := f.metadata[key]; !ok || v != value {
+				return false
+			}
+		}
+		return true
+	})
+
+	page := FilePage{Total: len(files)}
+
+	slices.SortFunc(files, func(a, b models.Files) int {
+		return compare(cursorAfter(opts.SortBy, a), cursorAfter(opts.SortBy, b))
+	})
+	for _, file := range files {
+		if after != nil && compare(cursorAfter(opts.SortBy, file), *after) <= 0 {
+			continue
+		}
+		page.Files = append(page.Files, file)
+		if len(page.Files) > opts.Limit {
+			break
+		}
+	}
+
+	if len(page.Files) > opts.Limit {
+		page.Files = page.Files[:opts.Limit]
+		page.NextCursor = encodeCursor(cursorAfter(opts.SortBy, page.Files[len(page.Files)-1]))
+	}
+
+	return page, nil
+}
+
+func (s *MemoryFileStore) PathExists(path string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, file := range s.files {
+		if file.Path == path {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *MemoryFileStore) RenameFile(id int, userId uint, filename string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file := s.owned(id, userId)
+	if file == nil {
+		return fmt.Errorf("No file found with ID: %d", id)
+	}
+	file.Filename = filename
+	return nil
+}
+
+func (s *MemoryFileStore) DeleteFile(id int, userId uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file := s.owned(id, userId)
+	if file == nil {
+		return ErrFileNotFound
+	}
+	s.usage[userId] -= int64(file.Size)
+	delete(s.files, id)
+	return nil
+}
+
+func (s *MemoryFileStore) SetSize(id int, size int64) error {
+	return s.update(id, func(f *memoryFile) { s.resize(f, size) })
+}
+
+func (s *MemoryFileStore) SetMetadataStripped(id int, size int64) error {
+	return s.update(id, func(f *memoryFile) {
+		f.MetadataStripped = true
+		s.resize(f, size)
+	})
+}
+
+func (s *MemoryFileStore) SetScanResult(id int, status string, signature string, path string) error {
+	return s.update(id, func(f *memoryFile) {
+		f.ScanStatus = status
+		f.ScanSignature = signature
+		if path != "" {
+			f.Path = path
+		}
+	})
+}
+
+func (s *MemoryFileStore) SetTags(fileId int, userId uint, tags []string) error {
+	if len(tags) > MaxTagsPerFile {
+		return ErrTooManyTags
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file := s.owned(fileId, userId)
+	if file == nil {
+		return ErrFileNotFound
+	}
+	file.tags = map[string]bool{}
+	for _, tag := range tags {
+		file.tags[tag] = true
+	}
+	return nil
+}
+
+func (s *MemoryFileStore) RemoveTag(fileId int, userId uint, tag string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file := s.owned(fileId, userId)
+	if file == nil {
+		return ErrFileNotFound
+	}
+	delete(file.tags, tag)
+	return nil
+}
+
+func (s *MemoryFileStore) GetTags(fileId int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tags := make([]string, 0)
+	if file, ok := s.files[fileId]; ok {
+		tags = slices.Sorted(maps.Keys(file.tags))
+	}
+	return tags, nil
+}
+
+func (s *MemoryFileStore) SetMetadata(fileId int, userId uint, metadata map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file := s.owned(fileId, userId)
+	if file == nil {
+		return ErrFileNotFound
+	}
+
+	merged := maps.Clone(file.metadata)
+	maps.Copy(merged, metadata)
+	if len(merged) > MaxMetadataPerFile {
+		return ErrTooManyMetadata
+	}
+	file.metadata = merged
+	return nil
+}
+
+func (s *MemoryFileStore) RemoveMetadata(fileId int, userId uint, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file := s.owned(fileId, userId)
+	if file == nil {
+		return ErrFileNotFound
+	}
+	delete(file.metadata, key)
+	return nil
+}
+
+func (s *MemoryFileStore) GetMetadata(fileId int) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	metadata := make(map[string]string)
+	if file, ok := s.files[fileId]; ok {
+		maps.Copy(metadata, file.metadata)
+	}
+	return metadata, nil
+}
+
+// filter returns copies of the matching records, without tags and metadata
+// like the SQL queries.
+func (s *MemoryFileStore) filter(match func(*memoryFile) bool) []models.Files {
+	var files []models.Files
+	for _, file := range s.files {
+		if match(file) {
+			files = append(files, file.Files)
+		}
+	}
+	return files
+}
+
+func (s *MemoryFileStore) owned(id int, userId uint) *memoryFile {
+	if file, ok := s.files[id]; ok && file.UserId == int(userId) {
+		return file
+	}
+	return nil
+}
+
+func (s *MemoryFileStore) resize(file *memoryFile, size int64) {
+	s.usage[uint(file.UserId)] += size - int64(file.Size)
+	file.Size = int(size)
+}
+
+// update changes a file of any user; like an UPDATE matching no row, a
+// missing file isn't an error.
+func (s *MemoryFileStore) update(id int, change func(*memoryFile)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if file, ok := s.files[id]; ok {
+		change(file)
+	}
+	return nil
+}
+
+type MemoryUploadSessionStore struct {
+	mu      sync.Mutex
+	uploads map[string]models.TusUpload
+}
+
+func NewMemoryUploadSessionStore() *MemoryUploadSessionStore {
+	return &MemoryUploadSessionStore{uploads: map[string]models.TusUpload{}}
+}
+
+func (s *MemoryUploadSessionStore) CreateUpload(upload models.TusUpload) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.uploads[upload.ID]; ok {
+		return fmt.Errorf("failed to create upload: id %s is taken", upload.ID)
+	}
+	upload.Offset = 0
+	upload.JobId = nil
+	upload.ExpiresAt = upload.ExpiresAt.UTC().Truncate(time.Second)
+	upload.CreatedAt = memoryNow()
+	s.uploads[upload.ID] = upload
+	return nil
+}
+
+func (s *MemoryUploadSessionStore) GetUpload(id string, userId uint) (models.TusUpload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload, ok := s.uploads[id]
+	if !ok || upload.UserId != userId {
+		return models.TusUpload{}, ErrUploadNotFound
+	}
+	return upload, nil
+}
+
+func (s *MemoryUploadSessionStore) UploadExists(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.uploads[id]
+	return ok, nil
+}
+
+func (s *MemoryUploadSessionStore) SetOffset(id string, from, to int64, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload, ok := s.uploads[id]
+	if !ok || upload.Offset != from {
+		return ErrOffsetConflict
+	}
+	upload.Offset = to
+	upload.ExpiresAt = expiresAt.UTC().Truncate(time.Second)
+	s.uploads[id] = upload
+	return nil
+}
+
+func (s *MemoryUploadSessionStore) SetJobId(id string, jobId int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if upload, ok := s.uploads[id]; ok {
+		upload.JobId = &jobId
+		s.uploads[id] = upload
+	}
+	return nil
+}
+
+func (s *MemoryUploadSessionStore) DeleteUpload(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.uploads, id)
+	return nil
+}
+
+func (s *MemoryUploadSessionStore) GetExpiredUploads(now time.Time) ([]models.TusUpload, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var uploads []models.TusUpload
+	for _, upload := range s.uploads {
+		if upload.ExpiresAt.Before(now.UTC().Truncate(time.Second)) {
+			uploads = append(uploads, upload)
+		}
+	}
+	return uploads, nil
+}
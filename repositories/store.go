@@ -0,0 +1,60 @@
+package repositories
+
+import (
+	"go-secure-file-management/models"
+	"time"
+)
+
+// UserStore persists user accounts and their settings.
+type UserStore interface {
+	CreateUser(email string, password string) (models.User, error)
+	FindUserByEmail(email string) (models.User, error)
+	GetStripMetadata(userId uint) (*bool, error)
+	SetStripMetadata(userId uint, value *bool) error
+}
+
+// FileStore persists file records with their tags and metadata, and keeps
+// the storage used by each user. Methods taking a userId only touch files
+// of that user.
+type FileStore interface {
+	FinalizeFile(jobId int64, file models.Files, quota int64, publish func() error) (int, error)
+	GetFileByJobId(jobId int64) (models.Files, error)
+	GetFileById(id int) (models.Files, error)
+	GetFilesByUserId(userId uint) ([]models.Files, error)
+	GetAllFiles() ([]models.Files, error)
+	ListFiles(userId uint, opts ListFilesOptions) (FilePage, error)
+	PathExists(path string) (bool, error)
+	RenameFile(id int, userId uint, filename string) error
+	DeleteFile(id int, userId uint) error
+	SetSize(id int, size int64) error
+	SetMetadataStripped(id int, size int64) error
+	SetScanResult(id int, status string, signature string, path string) error
+
+	SetTags(fileId int, userId uint, tags []string) error
+	RemoveTag(fileId int, userId uint, tag string) error
+	GetTags(fileId int) ([]string, error)
+	SetMetadata(fileId int, userId uint, metadata map[string]string) error
+	RemoveMetadata(fileId int, userId uint, key string) error
+	GetMetadata(fileId int) (map[string]string, error)
+}
+
+// UploadSessionStore persists resumable (tus) upload sessions.
+type UploadSessionStore interface {
+	CreateUpload(upload models.TusUpload) error
+	GetUpload(id string, userId uint) (models.TusUpload, error)
+	UploadExists(id string) (bool, error)
+	SetOffset(id string, from, to int64, expiresAt time.Time) error
+	SetJobId(id string, jobId int64) error
+	DeleteUpload(id string) error
+	GetExpiredUploads(now time.Time) ([]models.TusUpload, error)
+}
+
+var (
+	_ UserStore          = (*UserRepository)(nil)
+	_ FileStore          = (*FileRepository)(nil)
+	_ UploadSessionStore = (*TusRepository)(nil)
+
+	_ UserStore          = (*MemoryUserStore)(nil)
+	_ FileStore          = (*MemoryFileStore)(nil)
+	_ UploadSessionStore = (*MemoryUploadSessionStore)(nil)
+)
@@ -0,0 +1,133 @@
+package repositories
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"go-secure-file-management/db"
+	"go-secure-file-management/models"
+	"time"
+)
+
+var (
+	ErrUploadNotFound = errors.New("upload not found")
+	// ErrOffsetConflict means the stored offset moved since it was read,
+	// another request wrote to the upload in the meantime.
+	ErrOffsetConflict = errors.New("upload offset changed")
+)
+
+// offset is a reserved word in Postgres
+const tusColumns = `id, user_id, filename, length, "offset", metadata, job_id, expires_at, created_at`
+
+type TusRepository struct {
+	DB      *sql.DB
+	dialect db.Dialect
+}
+
+func NewTusRepository(conn *sql.DB) *TusRepository {
+	return &TusRepository{DB: conn, dialect: db.DialectOf(conn)}
+}
+
+func scanUpload(row rowScanner) (models.TusUpload, error) {
+	var upload models.TusUpload
+	var jobId sql.NullInt64
+	err := row.Scan(&upload.ID, &upload.UserId, &upload.Filename, &upload.Length, &upload.Offset, &upload.Metadata, &jobId,
+		&upload.ExpiresAt, &upload.CreatedAt)
+	if jobId.Valid {
+		upload.JobId = &jobId.Int64
+	}
+	return upload, err
+}
+
+func (r *TusRepository) CreateUpload(upload models.TusUpload) error {
+	query := "INSERT INTO tus_uploads (id, user_id, filename, length, metadata, expires_at) VALUES (?, ?, ?, ?, ?, ?)"
+
+	_, err := r.DB.Exec(r.dialect.Rebind(query), upload.ID, upload.UserId, upload.Filename, upload.Length, upload.Metadata,
+		upload.ExpiresAt.UTC().Format(sqliteTimeLayout))
+	if err != nil {
+		return fmt.Errorf("failed to create upload: %v", err)
+	}
+
+	return nil
+}
+
+// GetUpload returns the user's upload, ErrUploadNotFound if it doesn't exist
+// or belongs to someone else.
+func (r *TusRepository) GetUpload(id string, userId uint) (models.TusUpload, error) {
+	row := r.DB.QueryRow(r.dialect.Rebind("SELECT "+tusColumns+" FROM tus_uploads WHERE id = ? AND user_id = ?"), id, userId)
+
+	upload, err := scanUpload(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return models.TusUpload{}, ErrUploadNotFound
+		}
+		return models.TusUpload{}, err
+	}
+
+	return upload, nil
+}
+
+// UploadExists reports whether an upload of any user has the given id.
+func (r *TusRepository) UploadExists(id string) (bool, error) {
+	var exists bool
+	err := r.DB.QueryRow(r.dialect.Rebind("SELECT EXISTS (SELECT 1 FROM tus_uploads WHERE id = ?)"), id).Scan(&exists)
+	return exists, err
+}
+
+// SetOffset moves the offset from `from` to `to` and pushes back the
+// expiration. It fails with ErrOffsetConflict if the offset isn't `from`.
+func (r *TusRepository) SetOffset(id string, from, to int64, expiresAt time.Time) error {
+	result, err := r.DB.Exec(r.dialect.Rebind(`UPDATE tus_uploads SET "offset" = ?, expires_at = ? WHERE id = ? AND "offset" = ?`),
+		to, expiresAt.UTC().Format(sqliteTimeLayout), id, from)
+	if err != nil {
+		return fmt.Errorf("failed to update upload offset: %v", err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrOffsetConflict
+	}
+
+	return nil
+}
+
+func (r *TusRepository) SetJobId(id string, jobId int64) error {
+	_, err := r.DB.Exec(r.dialect.Rebind("UPDATE tus_uploads SET job_id = ? WHERE id = ?"), jobId, id)
+	if err != nil {
+		return fmt.Errorf("failed to update upload: %v", err)
+	}
+
+	return nil
+}
+
+func (r *TusRepository) DeleteUpload(id string) error {
+	_, err := r.DB.Exec(r.dialect.Rebind("DELETE FROM tus_uploads WHERE id = ?"), id)
+	if err != nil {
+		return fmt.Errorf("failed to delete upload: %v", err)
+	}
+
+	return nil
+}
+
+// GetExpiredUploads returns the uploads whose expiration passed before now.
+func (r *TusRepository) GetExpiredUploads(now time.Time) ([]models.TusUpload, error) {
+	rows, err := r.DB.Query(r.dialect.Rebind("SELECT "+tusColumns+" FROM tus_uploads WHERE expires_at < ?"), now.UTC().Format(sqliteTimeLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uploads []models.TusUpload
+	for rows.Next() {
+		upload, err := scanUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+
+	return uploads, rows.Err()
+}
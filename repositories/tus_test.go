@@ -0,0 +1,67 @@
+package repositories_test
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"go-secure-file-management/db/dbtest"
+	"go-secure-file-management/models"
+	"go-secure-file-management/repositories"
+)
+
+func TestTusUploadLifecycle(t *testing.T) {
+	dbtest.Run(t, dbtest.Migrated, func(t *testing.T, conn *sql.DB) {
+		repo := repositories.NewTusRepository(conn)
+		userId := addUser(t, conn, "a@b.co")
+		now := time.Now().UTC().Truncate(time.Second)
+
+		err := repo.CreateUpload(models.TusUpload{ID: "up1", UserId: userId, Filename: "a.png", Length: 100, ExpiresAt: now.Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.GetUpload("up1", userId+1); !errors.Is(err, repositories.ErrUploadNotFound) {
+			t.Errorf("another user's upload: err = %v, want ErrUploadNotFound", err)
+		}
+		if exists, err := repo.UploadExists("up1"); err != nil || !exists {
+			t.Errorf("UploadExists = %t, %v", exists, err)
+		}
+
+		if err := repo.SetOffset("up1", 0, 60, now.Add(2*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.SetOffset("up1", 0, 40, now.Add(2*time.Hour)); !errors.Is(err, repositories.ErrOffsetConflict) {
+			t.Errorf("stale offset: err = %v, want ErrOffsetConflict", err)
+		}
+		if err := repo.SetJobId("up1", 12); err != nil {
+			t.Fatal(err)
+		}
+
+		upload, err := repo.GetUpload("up1", userId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if upload.Offset != 60 || upload.JobId == nil || *upload.JobId != 12 || !upload.ExpiresAt.Equal(now.Add(2*time.Hour)) {
+			t.Errorf("upload %+v, want offset 60, job 12 and the new expiry", upload)
+		}
+
+		expired, err := repo.GetExpiredUploads(now.Add(3 * time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(expired) != 1 || expired[0].ID != "up1" {
+			t.Errorf("expired %+v, want up1", expired)
+		}
+		if expired, _ := repo.GetExpiredUploads(now); len(expired) != 0 {
+			t.Errorf("expired before its time: %+v", expired)
+		}
+
+		if err := repo.DeleteUpload("up1"); err != nil {
+			t.Fatal(err)
+		}
+		if exists, _ := repo.UploadExists("up1"); exists {
+			t.Error("deleted upload still exists")
+		}
+	})
+}
@@ -8,18 +8,19 @@ import (
 )
 
 type UserRepository struct {
-	DB *sql.DB
+	DB      *sql.DB
+	dialect db.Dialect
 }
 
-func NewUserRepository(db *sql.DB) *UserRepository {
-	return &UserRepository{DB: db}
+func NewUserRepository(conn *sql.DB) *UserRepository {
+	return &UserRepository{DB: conn, dialect: db.DialectOf(conn)}
 }
 
 func (r *UserRepository) CreateUser(email string, password string) (models.User, error) {
-	query := "INSERT INTO users (email, password) VALUES (?, ?) RETURNING id, email"
+	query := "INSERT INTO users (email, password) VALUES (?, ?) RETURNING id, email, role"
 
 	var user models.User
-	err := db.DB.QueryRow(query, email, password).Scan(&user.ID, &user.Email)
+	err := r.DB.QueryRow(r.dialect.Rebind(query), email, password).Scan(&user.ID, &user.Email, &user.Role)
 	if err != nil {
 		return models.User{}, fmt.Errorf("failed to create user: %v", err)
 	}
@@ -27,13 +28,40 @@ func (r *UserRepository) CreateUser(email string, password string) (models.User,
 	return user, nil
 }
 
+// GetStripMetadata returns the user's metadata stripping setting, nil when
+// the user follows the policy.
+func (r *UserRepository) GetStripMetadata(userId uint) (*bool, error) {
+	var value sql.NullBool
+	err := r.DB.QueryRow(r.dialect.Rebind("SELECT strip_metadata FROM users WHERE id = ?"), userId).Scan(&value)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("no user found with ID: %d", userId)
+		}
+		return nil, err
+	}
+
+	if !value.Valid {
+		return nil, nil
+	}
+	return &value.Bool, nil
+}
+
+func (r *UserRepository) SetStripMetadata(userId uint, value *bool) error {
+	_, err := r.DB.Exec(r.dialect.Rebind("UPDATE users SET strip_metadata = ? WHERE id = ?"), value, userId)
+	if err != nil {
+		return fmt.Errorf("failed to update user settings: %v", err)
+	}
+
+	return nil
+}
+
 func (r *UserRepository) FindUserByEmail(email string) (models.User, error) {
-	query := "SELECT id, email, password FROM users WHERE email = ?"
+	query := "SELECT id, email, password, role FROM users WHERE email = ?"
 	var user models.User
 
-	row := db.DB.QueryRow(query, email)
+	row := r.DB.QueryRow(r.dialect.Rebind(query), email)
 
-	err := row.Scan(&user.ID, &user.Email, &user.Password)
+	err := row.Scan(&user.ID, &user.Email, &user.Password, &user.Role)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			fmt.Print("User not found")
@@ -0,0 +1,71 @@
+package repositories_test
+
+import (
+	"database/sql"
+	"testing"
+
+	"go-secure-file-management/db/dbtest"
+	"go-secure-file-management/repositories"
+)
+
+func TestCreateUser(t *testing.T) {
+	dbtest.Run(t, dbtest.Migrated, func(t *testing.T, conn *sql.DB) {
+		repo := repositories.NewUserRepository(conn)
+
+		first, err := repo.CreateUser("a@b.co", "hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := repo.CreateUser("c@d.co", "hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first.ID <= 0 || second.ID == first.ID || first.Email != "a@b.co" || first.Role != "user" {
+			t.Errorf("created %+v and %+v, want distinct ids, the email and role user", first, second)
+		}
+
+		found, err := repo.FindUserByEmail("a@b.co")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found.ID != first.ID || found.Password != "hash" {
+			t.Errorf("found %+v, want user %d", found, first.ID)
+		}
+	})
+}
+
+func TestStripMetadataSetting(t *testing.T) {
+	dbtest.Run(t, dbtest.Migrated, func(t *testing.T, conn *sql.DB) {
+		repo := repositories.NewUserRepository(conn)
+		user, err := repo.CreateUser("a@b.co", "hash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		userId := uint(user.ID)
+
+		enabled, disabled := true, false
+		for _, want := range []*bool{nil, &enabled, &disabled, nil} {
+			if err := repo.SetStripMetadata(userId, want); err != nil {
+				t.Fatal(err)
+			}
+			got, err := repo.GetStripMetadata(userId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == nil) != (want == nil) || got != nil && *got != *want {
+				t.Errorf("set %v, got %v", describe(want), describe(got))
+			}
+		}
+
+		if _, err := repo.GetStripMetadata(userId + 1); err == nil {
+			t.Error("GetStripMetadata of a missing user returned no error")
+		}
+	})
+}
+
+func describe(b *bool) interface{} {
+	if b == nil {
+		return nil
+	}
+	return *b
+}
@@ -1,48 +1,222 @@
 package routes
 
 import (
+	"context"
 	"database/sql"
+	"go-secure-file-management/audit"
+	"go-secure-file-management/config"
 	"go-secure-file-management/handlers"
+	"go-secure-file-management/janitor"
+	"go-secure-file-management/jobs"
 	"go-secure-file-management/middleware"
-	"os"
-
+	"go-secure-file-management/pipeline"
+	"go-secure-file-management/policy"
+	"go-secure-file-management/ratelimit"
+	"go-secure-file-management/repositories"
+	"go-secure-file-management/scanner"
+	"go-secure-file-management/search"
+	"go-secure-file-management/throttle"
+	"go-secure-file-management/utils"
+	"io"
+	"log"
+	"sync"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
 
-func SetupRouter(db *sql.DB) *gin.Engine {
-	clientUrl := os.Getenv("CLIENT_URL")
+// newRateLimiter shares the limits through Redis when url is set, otherwise
+// they are kept per process.
+func newRateLimiter(url string) *ratelimit.Limiter {
+	if url == "" {
+		return ratelimit.New(ratelimit.NewMemoryStore())
+	}
+
+	store, err := ratelimit.NewRedisStore(url)
+	if err != nil {
+		log.Fatalf("Failed to set up rate limit store: %v", err)
+	}
+	if err := store.Ping(context.Background()); err != nil {
+		log.Fatalf("Failed to connect to rate limit store: %v", err)
+	}
+	return ratelimit.New(store)
+}
+
+// SetupRouter builds the API from a validated configuration. The rate
+// limits and the file policy follow reloads of it, see config.Watch.
+// Background workers run until ctx is done; the returned function waits
+// for them to return.
+func SetupRouter(ctx context.Context, db *sql.DB, cfg *config.Config) (*gin.Engine, func()) {
+	utils.JWTSecret = []byte(cfg.Auth.JWTSecret)
+	clientUrl := cfg.Server.ClientURL
 	router := gin.Default()
 	jwtMiddleware := middleware.JWTAuth()
 
+	// tus clients send and read their state in headers
+	allowHeaders := []string{"Authorization", "Content-Type", "X-Upload-Metadata",
+		"Tus-Resumable", "Upload-Length", "Upload-Metadata", "Upload-Offset", "Upload-Checksum"}
+	exposeHeaders := []string{"Content-Length", "Content-Disposition", "Location", "X-Job-Status-Url",
+		"Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Checksum-Algorithm",
+		"Upload-Offset", "Upload-Length", "Upload-Metadata", "Upload-Expires",
+		"RateLimit-Policy", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After"}
+
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{clientUrl}, // Allow only frontend
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE"},
-		AllowHeaders:     []string{"Authorization", "Content-Type"},
-		ExposeHeaders:    []string{"Content-Length", "Content-Disposition"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD"},
+		AllowHeaders:     allowHeaders,
+		ExposeHeaders:    exposeHeaders,
 		AllowCredentials: true, // Allow cookies/auth
 		MaxAge:           12 * time.Hour,
 	}))
 	router.Use(middleware.CSPMiddleware())
 	router.Use(middleware.SecureHeadersMiddleware())
+	router.Use(middleware.BodyLimits(cfg.Server.BodyLimits.Default, map[string]int64{
+		"POST /api/file/upload-chunk":   cfg.Server.BodyLimits.Chunk,
+		"PUT /api/file/upload-chunk":    cfg.Server.BodyLimits.Chunk,
+		"PATCH /api/file/tus/:uploadId": cfg.Server.BodyLimits.Tus,
+	}))
+	// uploads and downloads may outlast the server's timeouts
+	transfer := middleware.Deadline(cfg.Server.TransferTimeout)
+
+	var workers sync.WaitGroup
+	background := func(run func()) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			run()
+		}()
+	}
+
+	indexer := search.NewIndexer(db)
+	background(func() { indexer.Run(ctx) })
+	if err := indexer.Backfill(); err != nil {
+		log.Printf("Failed to backfill search index: %v", err)
+	}
+
+	loadedPolicy, err := policy.Load(cfg.FilePolicy)
+	if err != nil {
+		log.Fatalf("Failed to load file policy: %v", err)
+	}
+	filePolicy := policy.NewHolder(loadedPolicy)
+
+	malwareScanner, err := scanner.New(cfg.Scanner.Kind, cfg.Scanner.ClamdAddress)
+	if err != nil {
+		log.Fatalf("Failed to set up malware scanner: %v", err)
+	}
 
-	fileHandler := handlers.NewFileHandler(db)
-	userHandler := handlers.NewUserHandler(db)
+	auditLog := audit.NewLogger(db)
+	if path := cfg.Audit.LogPath; path != "" {
+		if err := auditLog.MirrorTo(path); err != nil {
+			log.Fatalf("Failed to set up audit log: %v", err)
+		}
+	}
+	if encoded := cfg.Audit.SigningKey; encoded != "" {
+		key, err := audit.ParseSigningKey(encoded)
+		if err != nil {
+			log.Fatalf("Failed to load audit signing key: %v", err)
+		}
+		auditLog.Key = key
+		background(func() { auditLog.RunCheckpoints(ctx, cfg.Audit.CheckpointInterval) })
+	} else {
+		log.Println("AUDIT_SIGNING_KEY is not set, audit checkpoints are disabled")
+	}
+
+	fileRepo := repositories.NewFileRepository(db)
+	userRepo := repositories.NewUserRepository(db)
+	jobQueue := jobs.NewQueue(db)
+	jobQueue.Workers = cfg.Jobs.Workers
+	jobQueue.Lease = cfg.Jobs.Lease
+	pipeline.New(fileRepo, userRepo, filePolicy, scanner.NewService(malwareScanner), indexer, auditLog).Register(jobQueue)
+	jobQueue.Start(ctx)
+
+	bandwidth := throttle.New(loadedPolicy.TotalBandwidth.Upload, loadedPolicy.TotalBandwidth.Download)
+	fileHandler := handlers.NewFileHandler(fileRepo, indexer, filePolicy, jobQueue, auditLog, bandwidth)
+	jobHandler := handlers.NewJobHandler(jobQueue)
+	tusRepo := repositories.NewTusRepository(db)
+	tusHandler := handlers.NewTusHandler(tusRepo, filePolicy, jobQueue, auditLog, bandwidth)
+	background(func() { tusHandler.RunExpiry(ctx, time.Hour) })
+
+	uploadJanitor := janitor.New(db, fileRepo, tusRepo, jobQueue)
+	uploadJanitor.TTL = cfg.Janitor.SessionTTL
+	uploadJanitor.DryRun = cfg.Janitor.DryRun
+	background(func() { uploadJanitor.Run(ctx, cfg.Janitor.Interval) })
+	userHandler := handlers.NewUserHandler(userRepo, auditLog)
+	auditHandler := handlers.NewAuditHandler(auditLog)
+	transferHandler := handlers.NewTransferHandler(bandwidth)
+
+	limiter := newRateLimiter(cfg.RateLimit.RedisURL)
+	limits := ratelimit.NewLimits(cfg.RateLimits())
+	authLimit := middleware.RateLimiter(limiter, limits, "auth", middleware.ByIP)
+	apiLimit := middleware.RateLimiter(limiter, limits, "api", middleware.ByUser)
+	uploadLimit := middleware.RateLimiter(limiter, limits, "upload", middleware.ByUser)
+
+	background(func() {
+		config.Watch(ctx, cfg, func(next *config.Config) error {
+			reloaded, err := policy.Load(next.FilePolicy)
+			if err != nil {
+				return err
+			}
+			filePolicy.Set(reloaded)
+			bandwidth.SetGlobal(reloaded.TotalBandwidth.Upload, reloaded.TotalBandwidth.Download)
+			limits.Set(next.RateLimits())
+			return nil
+		})
+	})
 
 	apiGroup := router.Group("/api")
 
-	apiGroup.POST("/login", userHandler.Login)
-	apiGroup.POST("/register", userHandler.Register)
+	apiGroup.POST("/login", authLimit, userHandler.Login)
+	apiGroup.POST("/register", authLimit, userHandler.Register)
+
+	userRouter := apiGroup.Group("user")
+	userRouter.Use(jwtMiddleware, apiLimit)
+	userRouter.GET("/settings", userHandler.GetSettings)
+	userRouter.PUT("/settings", userHandler.UpdateSettings)
+	userRouter.GET("/activity", auditHandler.MyActivity)
 
 	fileRouter := apiGroup.Group("file")
-	fileRouter.Use(jwtMiddleware)
+	fileRouter.Use(jwtMiddleware, apiLimit)
 	fileRouter.GET("", fileHandler.GetFiles)
-	fileRouter.POST("/upload-chunk", middleware.RateLimiter(), fileHandler.CreateFile)
+	fileRouter.GET("/search", fileHandler.SearchFiles)
+	fileRouter.POST("/upload-chunk", transfer, uploadLimit, fileHandler.CreateFile)
+	fileRouter.PUT("/upload-chunk", transfer, uploadLimit, fileHandler.StreamChunk)
 	fileRouter.GET("/metadata/:fileId", fileHandler.GetFileMetadata)
-	fileRouter.GET("/download/:fileId", fileHandler.DownloadFile)
+	fileRouter.GET("/download/:fileId", transfer, fileHandler.DownloadFile)
+	fileRouter.GET("/:fileId/thumbnail", fileHandler.GetThumbnail)
+	fileRouter.PUT("/:fileId", fileHandler.RenameFile)
+	fileRouter.PUT("/:fileId/tags", fileHandler.SetTags)
+	fileRouter.DELETE("/:fileId/tags/:tag", fileHandler.RemoveTag)
+	fileRouter.PUT("/:fileId/metadata", fileHandler.SetMetadata)
+	fileRouter.DELETE("/:fileId/metadata/:key", fileHandler.RemoveMetadata)
 	fileRouter.DELETE("/:fileId", fileHandler.DeleteFile)
 
-	return router
+	// tus discovery works without a token, the upload itself doesn't
+	tusRouter := apiGroup.Group("file/tus")
+	tusRouter.Use(handlers.TusResumable())
+	tusRouter.OPTIONS("", tusHandler.Options)
+	tusRouter.POST("", jwtMiddleware, apiLimit, uploadLimit, tusHandler.CreateUpload)
+	tusRouter.HEAD("/:uploadId", jwtMiddleware, apiLimit, tusHandler.GetUpload)
+	tusRouter.PATCH("/:uploadId", transfer, jwtMiddleware, apiLimit, uploadLimit, tusHandler.PatchUpload)
+	tusRouter.DELETE("/:uploadId", jwtMiddleware, apiLimit, tusHandler.DeleteUpload)
+
+	jobRouter := apiGroup.Group("jobs")
+	jobRouter.Use(jwtMiddleware, apiLimit)
+	jobRouter.GET("/:jobId", jobHandler.GetJob)
+
+	adminRouter := apiGroup.Group("admin")
+	adminRouter.Use(jwtMiddleware, apiLimit, middleware.RequireRole("admin"))
+	adminRouter.GET("/audit", auditHandler.ListEvents)
+	adminRouter.GET("/audit/export", transfer, auditHandler.Export)
+	adminRouter.GET("/transfers", transferHandler.ListTransfers)
+
+	wait := func() {
+		jobQueue.Wait()
+		workers.Wait()
+		if store, ok := limiter.Store.(io.Closer); ok {
+			store.Close()
+		}
+	}
+
+	return router, wait
 }
@@ -0,0 +1,244 @@
+package sanitize
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go-secure-file-management/exif"
+	"go-secure-file-management/pdf"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var ErrMalformed = errors.New("malformed file")
+
+// maxHeaderSize bounds the JPEG segments buffered before the image data.
+const maxHeaderSize = 16 << 20
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// Supported reports whether metadata can be stripped from mimeType.
+func Supported(mimeType string) bool {
+	switch mimeType {
+	case "image/png", "image/jpeg", "application/pdf":
+		return true
+	}
+	return false
+}
+
+// File strips metadata from the file at path, replacing it. It reports
+// whether anything was removed; files without metadata are left untouched.
+func File(path, mimeType string) (bool, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".sanitize-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	var changed bool
+	switch mimeType {
+	case "image/jpeg":
+		changed, err = JPEG(in, tmp)
+	case "image/png":
+		changed, err = PNG(in, tmp)
+	case "application/pdf":
+		changed, err = PDF(in, tmp)
+	default:
+		return false, nil
+	}
+	if err != nil || !changed {
+		return false, err
+	}
+
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), path)
+}
+
+// JPEG copies a JPEG without EXIF, XMP, IPTC, comments and vendor segments.
+// JFIF, ICC profiles and the Adobe color transform are kept since they
+// affect how the image looks, and so is the EXIF orientation, rewritten as
+// the only tag of a fresh EXIF segment.
+func JPEG(r io.Reader, w io.Writer) (bool, error) {
+	br := bufio.NewReader(r)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return false, ErrMalformed
+	}
+
+	var jfif, kept bytes.Buffer
+	orientation := exif.OrientationNormal
+	changed := false
+
+	for {
+		b, err := br.ReadByte()
+		if err != nil || b != 0xFF {
+			return false, ErrMalformed
+		}
+		marker, err := br.ReadByte()
+		for err == nil && marker == 0xFF {
+			marker, err = br.ReadByte()
+		}
+		if err != nil {
+			return false, ErrMalformed
+		}
+		// the image data follows, there is no metadata past this point
+		if marker == 0xDA {
+			kept.Write([]byte{0xFF, marker})
+			break
+		}
+		if marker == 0xD9 || (marker >= 0xD0 && marker <= 0xD7) || marker == 0x01 {
+			// segments without a length
+			kept.Write([]byte{0xFF, marker})
+			continue
+		}
+
+		var length uint16
+		if err := binary.Read(br, binary.BigEndian, &length); err != nil || length < 2 {
+			return false, ErrMalformed
+		}
+		if jfif.Len()+kept.Len()+int(length) > maxHeaderSize {
+			return false, fmt.Errorf("jpeg header larger than %d bytes", maxHeaderSize)
+		}
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return false, ErrMalformed
+		}
+
+		stripped := false
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte(exif.Header)) {
+			orientation = exif.Orientation(segment[len(exif.Header):])
+			// our own orientation-only segment, re-added below
+			stripped = bytes.Equal(segment, exif.OrientationOnly(orientation))
+		}
+
+		switch {
+		case stripped:
+		case marker == 0xE0:
+			writeSegment(&jfif, marker, segment)
+		case marker == 0xE2 && bytes.HasPrefix(segment, []byte("ICC_PROFILE\x00")),
+			marker == 0xEE,
+			marker < 0xE0 || (marker > 0xEF && marker != 0xFE):
+			writeSegment(&kept, marker, segment)
+		default:
+			// APPn metadata and COM
+			changed = true
+		}
+	}
+
+	if !changed {
+		return false, nil
+	}
+
+	// JFIF has to come first, EXIF directly after it
+	header := append([]byte{0xFF, 0xD8}, jfif.Bytes()...)
+	if orientation != exif.OrientationNormal {
+		var app1 bytes.Buffer
+		writeSegment(&app1, 0xE1, exif.OrientationOnly(orientation))
+		header = append(header, app1.Bytes()...)
+	}
+	if _, err := w.Write(append(header, kept.Bytes()...)); err != nil {
+		return false, err
+	}
+
+	_, err := io.Copy(w, br)
+	return true, err
+}
+
+func writeSegment(buf *bytes.Buffer, marker byte, payload []byte) {
+	buf.Write([]byte{0xFF, marker})
+	binary.Write(buf, binary.BigEndian, uint16(len(payload)+2))
+	buf.Write(payload)
+}
+
+// metadataChunks are the PNG chunks that carry text, XMP (iTXt), EXIF and
+// the modification time.
+var metadataChunks = map[string]bool{
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"eXIf": true,
+	"tIME": true,
+}
+
+// PNG copies a PNG without its metadata chunks. The remaining chunks are
+// copied as they are, with their checksums.
+func PNG(r io.Reader, w io.Writer) (bool, error) {
+	br := bufio.NewReader(r)
+
+	signature := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(br, signature); err != nil || !bytes.Equal(signature, pngSignature) {
+		return false, ErrMalformed
+	}
+
+	if _, err := w.Write(signature); err != nil {
+		return false, err
+	}
+	changed := false
+
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			return false, ErrMalformed
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		chunkType := string(header[4:8])
+
+		// data plus CRC
+		if metadataChunks[chunkType] {
+			if _, err := io.CopyN(io.Discard, br, length+4); err != nil {
+				return false, ErrMalformed
+			}
+			changed = true
+			continue
+		}
+
+		if _, err := w.Write(header[:]); err != nil {
+			return false, err
+		}
+		if _, err := io.CopyN(w, br, length+4); err != nil {
+			return false, ErrMalformed
+		}
+
+		if chunkType == "IEND" {
+			return changed, nil
+		}
+	}
+}
+
+// PDF copies a PDF with its document information and uncompressed XMP
+// metadata blanked, see pdf.StripInfo.
+func PDF(r io.Reader, w io.Writer) (bool, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return false, err
+	}
+
+	stripped, err := pdf.StripInfo(data)
+	if err != nil || stripped == 0 {
+		return false, err
+	}
+
+	_, err = w.Write(data)
+	return true, err
+}
@@ -0,0 +1,234 @@
+package sanitize_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go-secure-file-management/exif"
+	"go-secure-file-management/pdf"
+	"go-secure-file-management/sanitize"
+)
+
+// secret is hidden in every kind of metadata and must not survive.
+const secret = "52.3740N 4.8897E Jane Doe"
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 30))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 30; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 6), uint8(y * 8), 200, 255})
+		}
+	}
+	return img
+}
+
+func segment(marker byte, payload string) []byte {
+	b := []byte{0xFF, marker}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)+2))
+	return append(b, payload...)
+}
+
+func chunk(chunkType, data string) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	b = append(b, chunkType+data...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE([]byte(chunkType+data)))
+}
+
+// jpegWithMetadata is an encoded JPEG with JFIF, EXIF (orientation 6 plus
+// more), XMP, an ICC profile and a comment after its SOI marker.
+func jpegWithMetadata(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	b := []byte{0xFF, 0xD8}
+	b = append(b, segment(0xE0, "JFIF\x00\x01\x02\x00\x00\x01\x00\x01\x00\x00")...)
+	b = append(b, segment(0xE1, string(exif.OrientationOnly(6))+"GPS "+secret)...)
+	b = append(b, segment(0xE1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>"+secret+"</x:xmpmeta>")...)
+	b = append(b, segment(0xE2, "ICC_PROFILE\x00\x01\x01profile")...)
+	b = append(b, segment(0xED, "Photoshop 3.0\x00"+secret)...)
+	b = append(b, segment(0xFE, secret)...)
+	return append(b, encoded[2:]...)
+}
+
+// pngWithMetadata is an encoded PNG with text, XMP, EXIF and time chunks
+// before its image data.
+func pngWithMetadata(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+	idat := bytes.Index(encoded, []byte("IDAT")) - 4
+
+	b := append([]byte{}, encoded[:idat]...)
+	b = append(b, chunk("tEXt", "Author\x00"+secret)...)
+	b = append(b, chunk("iTXt", "XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta>"+secret+"</x:xmpmeta>")...)
+	b = append(b, chunk("eXIf", "MM\x00*"+secret)...)
+	b = append(b, chunk("tIME", "\x07\xea\x0a\x13\x0c\x00\x00")...)
+	return append(b, encoded[idat:]...)
+}
+
+// strip runs f and checks that it stripped something, that the result
+// decodes to the same image as the input and that the secret is gone.
+func strip(t *testing.T, f func(io.Reader, io.Writer) (bool, error), input []byte) []byte {
+	t.Helper()
+
+	var out bytes.Buffer
+	changed, err := f(bytes.NewReader(input), &out)
+	if err != nil || !changed {
+		t.Fatalf("strip: changed %v, %v", changed, err)
+	}
+	stripped := out.Bytes()
+
+	if bytes.Contains(stripped, []byte(secret)) {
+		t.Error("metadata left after stripping")
+	}
+
+	want, wantFormat, err := image.Decode(bytes.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, format, err := image.Decode(bytes.NewReader(stripped))
+	if err != nil {
+		t.Fatalf("stripped image doesn't decode: %v", err)
+	}
+	if format != wantFormat || !reflect.DeepEqual(got, want) {
+		t.Errorf("stripped %s image differs from the original %s", format, wantFormat)
+	}
+
+	// stripping again finds nothing
+	out.Reset()
+	if changed, err := f(bytes.NewReader(stripped), &out); changed || err != nil {
+		t.Errorf("second strip: changed %v, %v", changed, err)
+	}
+	return stripped
+}
+
+func TestJPEG(t *testing.T) {
+	stripped := strip(t, sanitize.JPEG, jpegWithMetadata(t))
+
+	if !bytes.HasPrefix(stripped[2:], segment(0xE0, "JFIF\x00\x01\x02\x00\x00\x01\x00\x01\x00\x00")) {
+		t.Error("JFIF segment isn't first")
+	}
+	app1 := segment(0xE1, string(exif.OrientationOnly(6)))
+	if !bytes.Contains(stripped, app1) {
+		t.Error("orientation not kept")
+	}
+	if !bytes.Contains(stripped, segment(0xE2, "ICC_PROFILE\x00\x01\x01profile")) {
+		t.Error("ICC profile not kept")
+	}
+	if bytes.Contains(stripped, []byte("xmpmeta")) || bytes.Contains(stripped, []byte("Photoshop")) {
+		t.Error("XMP or IPTC segment left")
+	}
+}
+
+func TestPNG(t *testing.T) {
+	stripped := strip(t, sanitize.PNG, pngWithMetadata(t))
+
+	for _, chunkType := range []string{"tEXt", "iTXt", "eXIf", "tIME"} {
+		if bytes.Contains(stripped, []byte(chunkType)) {
+			t.Errorf("%s chunk left", chunkType)
+		}
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	for name, f := range map[string]func(io.Reader, io.Writer) (bool, error){
+		"JPEG": sanitize.JPEG,
+		"PNG":  sanitize.PNG,
+	} {
+		for _, input := range [][]byte{nil, []byte("GIF89a"), jpegWithMetadata(t)[:30], pngWithMetadata(t)[:60]} {
+			if _, err := f(bytes.NewReader(input), &bytes.Buffer{}); err != sanitize.ErrMalformed {
+				t.Errorf("%s of %q: %v, want %v", name, input, err, sanitize.ErrMalformed)
+			}
+		}
+	}
+}
+
+func TestPDF(t *testing.T) {
+	xmp := "<x:xmpmeta>" + secret + "</x:xmpmeta>"
+	input := "%PDF-1.7\n" +
+		"1 0 obj\n<< /Type /Catalog /Metadata 2 0 R >>\nendobj\n" +
+		fmt.Sprintf("2 0 obj\n<< /Type /Metadata /Subtype /XML /Length %d >>\nstream\n%s\nendstream\nendobj\n", len(xmp), xmp) +
+		"3 0 obj\n<< /Author (" + secret + ") /Title (a \\) (nested) title) /Producer <414243> >>\nendobj\n" +
+		"trailer\n<< /Root 1 0 R /Info 3 0 R >>\n%%EOF\n"
+
+	var out bytes.Buffer
+	changed, err := sanitize.PDF(strings.NewReader(input), &out)
+	if err != nil || !changed {
+		t.Fatalf("changed %v, %v", changed, err)
+	}
+	stripped := out.String()
+
+	if strings.Contains(stripped, secret) || strings.Contains(stripped, "title") || strings.Contains(stripped, "414243") {
+		t.Errorf("metadata left:\n%s", stripped)
+	}
+	// blanked in place, the xref offsets stay valid
+	if len(stripped) != len(input) {
+		t.Errorf("length %d, want %d", len(stripped), len(input))
+	}
+	for _, keep := range []string{"/Type /Catalog /Metadata 2 0 R", "3 0 obj\n<<", ">>\nendobj", "/Info 3 0 R", "%%EOF"} {
+		if !strings.Contains(stripped, keep) {
+			t.Errorf("%q removed", keep)
+		}
+	}
+	if _, err := pdf.Scan([]byte(stripped)); err != nil {
+		t.Errorf("stripped PDF doesn't parse: %v", err)
+	}
+
+	if changed, err := sanitize.PDF(strings.NewReader(stripped), &bytes.Buffer{}); changed || err != nil {
+		t.Errorf("second strip: changed %v, %v", changed, err)
+	}
+}
+
+// File replaces the file keeping its permissions, and leaves files without
+// metadata alone.
+func TestFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "photo")
+	if err := os.WriteFile(path, pngWithMetadata(t), 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	if changed, err := sanitize.File(path, "image/png"); !changed || err != nil {
+		t.Fatalf("changed %v, %v", changed, err)
+	}
+	if changed, err := sanitize.File(path, "image/png"); changed || err != nil {
+		t.Errorf("second strip: changed %v, %v", changed, err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o640 {
+		t.Errorf("mode %v, want 0640", info.Mode().Perm())
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("directory holds %v, %v; want only the file", entries, err)
+	}
+
+	if changed, err := sanitize.File(path, "image/gif"); changed || err != nil {
+		t.Errorf("unsupported type: changed %v, %v", changed, err)
+	}
+}
@@ -0,0 +1,158 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultClamdAddress = "unix:///var/run/clamav/clamd.ctl"
+
+	clamdChunkSize = 64 << 10
+	clamdTimeout   = 5 * time.Minute
+)
+
+// Clamd talks to a clamd daemon over its socket protocol, streaming file
+// contents with INSTREAM so clamd doesn't need access to our upload
+// directory.
+type Clamd struct {
+	Network string // "tcp" or "unix"
+	Address string
+	Timeout time.Duration
+}
+
+// NewClamd parses addresses of the form tcp://host:port, unix:///path or
+// plain host:port.
+func NewClamd(address string) (*Clamd, error) {
+	c := &Clamd{Network: "tcp", Address: address, Timeout: clamdTimeout}
+
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		c.Network = "unix"
+		c.Address = strings.TrimPrefix(address, "unix://")
+	case strings.HasPrefix(address, "tcp://"):
+		c.Address = strings.TrimPrefix(address, "tcp://")
+	}
+
+	if c.Address == "" {
+		return nil, fmt.Errorf("invalid clamd address %q", address)
+	}
+	return c, nil
+}
+
+func (c *Clamd) Ping(ctx context.Context) error {
+	reply, err := c.command(ctx, "zPING\x00", nil)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("unexpected clamd reply to PING: %q", reply)
+	}
+	return nil
+}
+
+func (c *Clamd) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	reply, err := c.command(ctx, "zINSTREAM\x00", r)
+	if err != nil {
+		return Result{}, err
+	}
+
+	// "stream: OK", "stream: <signature> FOUND" or "<message> ERROR"
+	status := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case status == "OK":
+		return Result{}, nil
+	case strings.HasSuffix(status, " FOUND"):
+		return Result{Infected: true, Signature: strings.TrimSuffix(status, " FOUND")}, nil
+	case strings.HasSuffix(status, " ERROR"):
+		return Result{}, fmt.Errorf("clamd: %s", strings.TrimSuffix(status, " ERROR"))
+	}
+
+	return Result{}, fmt.Errorf("unexpected clamd reply: %q", reply)
+}
+
+// command sends a null-terminated command, optionally followed by a stream
+// of length-prefixed chunks, and returns the null-terminated reply.
+func (c *Clamd) command(ctx context.Context, cmd string, stream io.Reader) (string, error) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = clamdTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to clamd: %v", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// unblock reads and writes when the caller gives up
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	if _, err := io.WriteString(conn, cmd); err != nil {
+		return "", err
+	}
+
+	if stream != nil {
+		if err := writeChunks(conn, stream); err != nil {
+			// clamd closes the connection when the stream exceeds its
+			// StreamMaxLength; the reason is in the reply
+			if reply, readErr := readReply(conn); readErr == nil {
+				return reply, nil
+			}
+			return "", err
+		}
+	}
+
+	return readReply(conn)
+}
+
+func writeChunks(w io.Writer, r io.Reader) error {
+	buf := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, werr := w.Write(size); werr != nil {
+				return werr
+			}
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// a zero-length chunk ends the stream
+	binary.BigEndian.PutUint32(size, 0)
+	_, err := w.Write(size)
+	return err
+}
+
+func readReply(r io.Reader) (string, error) {
+	reply, err := bufio.NewReader(r).ReadString(0)
+	if err != nil && !(errors.Is(err, io.EOF) && reply != "") {
+		return "", fmt.Errorf("failed to read clamd reply: %v", err)
+	}
+	return strings.TrimSpace(strings.TrimRight(reply, "\x00")), nil
+}
@@ -0,0 +1,182 @@
+package scanner_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"go-secure-file-management/scanner"
+)
+
+// fakeClamd answers PING and INSTREAM on a local listener like clamd does,
+// reporting streams containing EICAR as infected and streams longer than
+// maxStream as too large. It records what was streamed.
+type fakeClamd struct {
+	listener  net.Listener
+	maxStream int
+	received  chan []byte
+}
+
+func startClamd(t *testing.T, maxStream int) *fakeClamd {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &fakeClamd{listener: listener, maxStream: maxStream, received: make(chan []byte, 1)}
+	t.Cleanup(func() { listener.Close() })
+	go c.serve()
+	return c
+}
+
+func (c *fakeClamd) client(t *testing.T) *scanner.Clamd {
+	t.Helper()
+
+	clamd, err := scanner.NewClamd("tcp://" + c.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clamd.Timeout = 5 * time.Second
+	return clamd
+}
+
+func (c *fakeClamd) serve() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			return
+		}
+		go c.handle(conn)
+	}
+}
+
+func (c *fakeClamd) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	cmd, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+	switch cmd {
+	case "zPING\x00":
+		io.WriteString(conn, "PONG\x00")
+	case "zINSTREAM\x00":
+		var stream []byte
+		size := make([]byte, 4)
+		for {
+			if _, err := io.ReadFull(r, size); err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint32(size)
+			if n == 0 {
+				break
+			}
+			if len(stream)+int(n) > c.maxStream {
+				io.WriteString(conn, "INSTREAM size limit exceeded. ERROR\x00")
+				// closing with unread data would reset the connection and
+				// could drop the reply
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				io.Copy(io.Discard, r)
+				return
+			}
+			chunk := make([]byte, n)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return
+			}
+			stream = append(stream, chunk...)
+		}
+		c.received <- stream
+
+		if bytes.Contains(stream, []byte(scanner.EICAR)) {
+			io.WriteString(conn, "stream: "+scanner.EICARSignature+" FOUND\x00")
+		} else {
+			io.WriteString(conn, "stream: OK\x00")
+		}
+	default:
+		io.WriteString(conn, "UNKNOWN COMMAND\x00")
+	}
+}
+
+func TestNewClamdAddresses(t *testing.T) {
+	for _, tc := range []struct {
+		address, network, want string
+	}{
+		{"unix:///var/run/clamav/clamd.ctl", "unix", "/var/run/clamav/clamd.ctl"},
+		{"tcp://clamav:3310", "tcp", "clamav:3310"},
+		{"clamav:3310", "tcp", "clamav:3310"},
+	} {
+		c, err := scanner.NewClamd(tc.address)
+		if err != nil || c.Network != tc.network || c.Address != tc.want {
+			t.Errorf("NewClamd(%q) = %+v, %v; want %s %s", tc.address, c, err, tc.network, tc.want)
+		}
+	}
+	if _, err := scanner.NewClamd("tcp://"); err == nil {
+		t.Error("empty address accepted")
+	}
+}
+
+func TestClamdPing(t *testing.T) {
+	clamd := startClamd(t, 1<<20).client(t)
+	if err := clamd.Ping(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+// Streams are sent in chunks, which clamd gets back together unchanged.
+func TestClamdScanStreamsContent(t *testing.T) {
+	server := startClamd(t, 1<<20)
+	clamd := server.client(t)
+	content := bytes.Repeat([]byte("0123456789abcdef"), 20000) // several chunks
+
+	result, err := clamd.Scan(context.Background(), bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Infected {
+		t.Errorf("clean stream reported %+v", result)
+	}
+	if got := <-server.received; !bytes.Equal(got, content) {
+		t.Errorf("clamd received %d bytes, want the %d sent", len(got), len(content))
+	}
+}
+
+func TestClamdScanInfected(t *testing.T) {
+	clamd := startClamd(t, 1<<20).client(t)
+
+	result, err := clamd.Scan(context.Background(), strings.NewReader("x "+scanner.EICAR))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Infected || result.Signature != scanner.EICARSignature {
+		t.Errorf("result %+v, want infected with %s", result, scanner.EICARSignature)
+	}
+}
+
+// clamd cuts off streams over its StreamMaxLength; the reason is reported
+// instead of the broken connection.
+func TestClamdScanTooLarge(t *testing.T) {
+	clamd := startClamd(t, 1000).client(t)
+
+	_, err := clamd.Scan(context.Background(), bytes.NewReader(make([]byte, 1<<20)))
+	if err == nil || !strings.Contains(err.Error(), "size limit exceeded") {
+		t.Errorf("err = %v, want clamd's size limit error", err)
+	}
+}
+
+func TestClamdUnreachable(t *testing.T) {
+	server := startClamd(t, 1<<20)
+	clamd := server.client(t)
+	server.listener.Close()
+
+	if _, err := clamd.Scan(context.Background(), strings.NewReader("data")); err == nil {
+		t.Error("Scan without clamd returned no error")
+	}
+}
@@ -0,0 +1,49 @@
+package scanner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+)
+
+// EICAR is the industry-standard antivirus test string.
+const EICAR = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+const EICARSignature = "Eicar-Test-Signature"
+
+// Fake reports a stream as infected when it contains the EICAR test
+// string and clean otherwise. It lets tests and development setups
+// exercise the infected path without a clamd daemon.
+type Fake struct{}
+
+func (Fake) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	needle := []byte(EICAR)
+	buf := make([]byte, 32<<10)
+	// keep the tail of the previous read so a match across reads is found
+	var carry []byte
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return Result{}, err
+		}
+
+		n, err := r.Read(buf)
+		window := append(carry, buf[:n]...)
+		if bytes.Contains(window, needle) {
+			return Result{Infected: true, Signature: EICARSignature}, nil
+		}
+		if len(window) >= len(needle) {
+			carry = append([]byte{}, window[len(window)-len(needle)+1:]...)
+		} else {
+			carry = window
+		}
+
+		if errors.Is(err, io.EOF) {
+			return Result{}, nil
+		}
+		if err != nil {
+			return Result{}, err
+		}
+	}
+}
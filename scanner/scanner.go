@@ -0,0 +1,43 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// Scan states of a file. Only clean files can be downloaded.
+const (
+	StatusPending  = "pending"
+	StatusClean    = "clean"
+	StatusInfected = "infected"
+	StatusError    = "error"
+)
+
+type Result struct {
+	Infected  bool
+	Signature string // name of the detected malware, if any
+}
+
+// Scanner checks a stream for malware.
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (Result, error)
+}
+
+// New builds the scanner of kind "clamd", "fake" or "none", see
+// config.Scanner. A nil scanner means scanning is disabled.
+func New(kind, clamdAddress string) (Scanner, error) {
+	switch kind {
+	case "", "none":
+		return nil, nil
+	case "clamd":
+		if clamdAddress == "" {
+			clamdAddress = DefaultClamdAddress
+		}
+		return NewClamd(clamdAddress)
+	case "fake":
+		return Fake{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown scanner %q", kind)
+}
@@ -0,0 +1,105 @@
+package scanner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-secure-file-management/models"
+	"go-secure-file-management/utils"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Service scans stored files and moves infected ones to quarantine. It runs
+// as a step of the upload pipeline, which retries it when clamd is down.
+type Service struct {
+	Scanner Scanner
+}
+
+func NewService(s Scanner) *Service {
+	return &Service{Scanner: s}
+}
+
+// Enabled reports whether files need scanning at all. When it doesn't,
+// uploads are treated as clean.
+func (s *Service) Enabled() bool {
+	return s.Scanner != nil
+}
+
+// quarantineReport is written next to a quarantined file.
+type quarantineReport struct {
+	FileId     int       `json:"file_id"`
+	UserId     int       `json:"user_id"`
+	Filename   string    `json:"filename"`
+	Signature  string    `json:"signature"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+// ScanFile scans a file and returns its status. Infected files are moved to
+// quarantine; newPath is then their location, otherwise it is "". A file
+// an earlier attempt already quarantined is found there, so the step can be
+// retried when recording the new path failed.
+func (s *Service) ScanFile(ctx context.Context, file models.Files) (result Result, newPath string, err error) {
+	if !s.Enabled() {
+		return Result{}, "", nil
+	}
+
+	f, err := os.Open("./" + file.Path)
+	if os.IsNotExist(err) {
+		if result, newPath, ok := quarantined(file); ok {
+			return result, newPath, nil
+		}
+	}
+	if err != nil {
+		return Result{}, "", fmt.Errorf("failed to open file %d for scanning: %v", file.ID, err)
+	}
+	defer f.Close()
+
+	result, err = s.Scanner.Scan(ctx, f)
+	if err != nil {
+		return Result{}, "", fmt.Errorf("failed to scan file %d: %v", file.ID, err)
+	}
+	if !result.Infected {
+		return result, "", nil
+	}
+
+	log.Printf("File %d is infected with %s", file.ID, result.Signature)
+
+	newPath, err = utils.QuarantineFile("./"+file.Path, quarantineReport{
+		FileId:     file.ID,
+		UserId:     file.UserId,
+		Filename:   file.Filename,
+		Signature:  result.Signature,
+		DetectedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		// without a new path the file stays where it is, but downloads are
+		// blocked by its status
+		log.Printf("Failed to quarantine infected file %d: %v", file.ID, err)
+	}
+	return result, newPath, nil
+}
+
+// quarantined looks for the file in quarantine, by its storage name and the
+// file id in the report.
+func quarantined(file models.Files) (Result, string, bool) {
+	matches, err := filepath.Glob(filepath.Join(utils.QuarantineDir, "*_"+filepath.Base(file.Path)))
+	if err != nil {
+		return Result{}, "", false
+	}
+
+	for _, match := range matches {
+		data, err := os.ReadFile(match + ".json")
+		if err != nil {
+			continue
+		}
+		var report quarantineReport
+		if json.Unmarshal(data, &report) != nil || report.FileId != file.ID {
+			continue
+		}
+		return Result{Infected: true, Signature: report.Signature}, match, true
+	}
+	return Result{}, "", false
+}
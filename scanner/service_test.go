@@ -0,0 +1,100 @@
+package scanner_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go-secure-file-management/models"
+	"go-secure-file-management/scanner"
+	"go-secure-file-management/utils"
+)
+
+// storeFile writes content to uploads/ of a temporary working directory
+// and returns its record.
+func storeFile(t *testing.T, content string) models.Files {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	if err := os.Mkdir("uploads", 0o700); err != nil {
+		t.Fatal(err)
+	}
+	file := models.Files{ID: 7, UserId: 1, Path: "uploads/0123456789abcdef", Filename: "invoice.pdf"}
+	if err := os.WriteFile(file.Path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestScanFileClean(t *testing.T) {
+	file := storeFile(t, "just a document")
+
+	result, newPath, err := scanner.NewService(scanner.Fake{}).ScanFile(context.Background(), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Infected || newPath != "" {
+		t.Errorf("clean file: %+v moved to %q", result, newPath)
+	}
+	if _, err := os.Stat(file.Path); err != nil {
+		t.Errorf("clean file gone: %v", err)
+	}
+}
+
+func TestScanFileQuarantinesInfected(t *testing.T) {
+	file := storeFile(t, "prefix "+scanner.EICAR+" suffix")
+	service := scanner.NewService(scanner.Fake{})
+
+	result, newPath, err := service.ScanFile(context.Background(), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Infected || result.Signature != scanner.EICARSignature {
+		t.Fatalf("result %+v, want infected with %s", result, scanner.EICARSignature)
+	}
+	if filepath.Dir(newPath) != filepath.Clean(utils.QuarantineDir) {
+		t.Errorf("moved to %s, want a file in %s", newPath, utils.QuarantineDir)
+	}
+	if _, err := os.Stat(file.Path); !os.IsNotExist(err) {
+		t.Errorf("infected file still in uploads: %v", err)
+	}
+	report, err := os.ReadFile(newPath + ".json")
+	if err != nil || !strings.Contains(string(report), scanner.EICARSignature) {
+		t.Errorf("report %s, %v; want one naming the signature", report, err)
+	}
+
+	// a retry after the new path couldn't be recorded
+	again, againPath, err := service.ScanFile(context.Background(), file)
+	if err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if again != result || againPath != newPath {
+		t.Errorf("retry: %+v at %q, want %+v at %q", again, againPath, result, newPath)
+	}
+
+	// another file with the same storage name isn't taken for this one
+	other := file
+	other.ID = 8
+	if _, _, err := service.ScanFile(context.Background(), other); err == nil {
+		t.Error("a missing file of another record was found in quarantine")
+	}
+}
+
+// The EICAR string is found when it spans two reads.
+func TestFakeFindsEICARAcrossReads(t *testing.T) {
+	content := strings.Repeat("x", 32<<10-10) + scanner.EICAR
+	result, err := scanner.Fake{}.Scan(context.Background(), strings.NewReader(content))
+	if err != nil || !result.Infected {
+		t.Errorf("Scan = %+v, %v; want infected", result, err)
+	}
+}
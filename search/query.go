@@ -0,0 +1,257 @@
+package search
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"go-secure-file-management/repositories"
+	"html"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	DefaultLimit = 20
+	MaxLimit     = 50
+
+	maxTerms      = 10
+	snippetRadius = 80
+
+	// markers wrapped around matches by the index; converted to <mark> tags
+	// after the surrounding text has been HTML-escaped
+	markStart = "\x02"
+	markEnd   = "\x03"
+)
+
+var ErrEmptyQuery = errors.New("search query must contain at least one word")
+
+type Options struct {
+	Query    string
+	Limit    int
+	Tags     []string          // only files carrying all these tags
+	Metadata map[string]string // only files with these metadata values
+}
+
+type Result struct {
+	ID        int     `json:"id"`
+	Filename  string  `json:"filename"`
+	MimeType  string  `json:"mime_type"`
+	Size      int     `json:"size"`
+	CreatedAt string  `json:"created_at"`
+	Highlight string  `json:"highlight"` // filename with matches wrapped in <mark>
+	Snippet   string  `json:"snippet"`   // excerpt of the document text around a match
+	Score     float64 `json:"score"`     // higher is more relevant
+}
+
+// Search returns the files of userId that match every word of the query,
+// best matches first. Words are matched as prefixes.
+func (i *Indexer) Search(userId uint, opts Options) ([]Result, error) {
+	terms := Terms(opts.Query)
+	if len(terms) == 0 {
+		return nil, ErrEmptyQuery
+	}
+
+	if opts.Limit <= 0 {
+		opts.Limit = DefaultLimit
+	}
+	if opts.Limit > MaxLimit {
+		opts.Limit = MaxLimit
+	}
+
+	where := []string{"f.user_id = ?"}
+	args := []interface{}{userId}
+	labelWhere, labelArgs := repositories.LabelFilters("f.id", opts.Tags, opts.Metadata)
+	where = append(where, labelWhere...)
+	args = append(args, labelArgs...)
+
+	if i.fts {
+		return i.searchFTS(terms, where, args, opts.Limit)
+	}
+	return i.searchLike(terms, where, args, opts.Limit)
+}
+
+// Terms splits a user query into lower-cased words. Everything that isn't a
+// letter or digit is a separator, so FTS5 query syntax can't be injected.
+func Terms(q string) []string {
+	words := strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) > maxTerms {
+		words = words[:maxTerms]
+	}
+	return words
+}
+
+func (i *Indexer) searchFTS(terms []string, where []string, args []interface{}, limit int) ([]Result, error) {
+	match := make([]string, len(terms))
+	for n, term := range terms {
+		match[n] = `"` + term + `"*`
+	}
+
+	// column weights: filename, tags, content
+	query := `
+		SELECT f.id, f.filename, f.mime_type, f.size, f.created_at,
+			highlight(files_fts, 0, ?, ?),
+			snippet(files_fts, 2, ?, ?, '…', 16),
+			-bm25(files_fts, 10.0, 5.0, 1.0) AS score
+		FROM files_fts
+		JOIN files f ON f.id = files_fts.rowid
+		WHERE files_fts MATCH ? AND ` + strings.Join(where, " AND ") + `
+		ORDER BY score DESC
+		LIMIT ?`
+
+	params := []interface{}{markStart, markEnd, markStart, markEnd, strings.Join(match, " ")}
+	params = append(params, args...)
+	params = append(params, limit)
+
+	rows, err := i.DB.Query(i.dialect.Rebind(query), params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]Result, 0)
+	for rows.Next() {
+		var r Result
+		if err := rows.Scan(&r.ID, &r.Filename, &r.MimeType, &r.Size, &r.CreatedAt, &r.Highlight, &r.Snippet, &r.Score); err != nil {
+			return nil, err
+		}
+		r.Highlight = renderMarks(r.Highlight)
+		r.Snippet = renderMarks(r.Snippet)
+		results = append(results, r)
+	}
+
+	return results, rows.Err()
+}
+
+// searchLike is the fallback for drivers built without FTS5. Matching runs
+// in SQL, ranking and snippets are computed here.
+func (i *Indexer) searchLike(terms []string, where []string, args []interface{}, limit int) ([]Result, error) {
+	like := i.dialect.Like()
+	for _, term := range terms {
+		where = append(where, fmt.Sprintf(`(s.filename %[1]s ? ESCAPE '\' OR s.tags %[1]s ? ESCAPE '\' OR s.content %[1]s ? ESCAPE '\')`, like))
+		pattern := "%" + escapeLike(term) + "%"
+		args = append(args, pattern, pattern, pattern)
+	}
+
+	query := `
+		SELECT f.id, f.filename, f.mime_type, f.size, f.created_at, s.tags, s.content
+		FROM files_search s
+		JOIN files f ON f.id = s.file_id
+		WHERE ` + strings.Join(where, " AND ")
+
+	rows, err := i.DB.Query(i.dialect.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]Result, 0)
+	for rows.Next() {
+		var r Result
+		var tags, content sql.NullString
+		if err := rows.Scan(&r.ID, &r.Filename, &r.MimeType, &r.Size, &r.CreatedAt, &tags, &content); err != nil {
+			return nil, err
+		}
+
+		lowerName := strings.ToLower(r.Filename)
+		lowerTags := strings.ToLower(tags.String)
+		lowerContent := strings.ToLower(content.String)
+		for _, term := range terms {
+			r.Score += 10*float64(strings.Count(lowerName, term)) +
+				5*float64(strings.Count(lowerTags, term)) +
+				float64(strings.Count(lowerContent, term))
+		}
+
+		r.Highlight = renderMarks(markTerms(r.Filename, terms))
+		r.Snippet = renderMarks(markTerms(excerpt(content.String, terms), terms))
+		results = append(results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(results, func(a, b int) bool { return results[a].Score > results[b].Score })
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// excerpt cuts the text down to a window around the first matching term.
+func excerpt(text string, terms []string) string {
+	lower := strings.ToLower(text)
+	// ToLower can change byte lengths outside ASCII; fall back to the start
+	if len(lower) != len(text) {
+		lower = text
+	}
+
+	first := -1
+	for _, term := range terms {
+		if idx := strings.Index(lower, term); idx >= 0 && (first < 0 || idx < first) {
+			first = idx
+		}
+	}
+	if first < 0 {
+		return ""
+	}
+
+	start := max(first-snippetRadius, 0)
+	end := min(first+snippetRadius, len(text))
+	for start > 0 && !isRuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !isRuneStart(text[end]) {
+		end++
+	}
+
+	out := text[start:end]
+	if start > 0 {
+		out = "…" + out
+	}
+	if end < len(text) {
+		out += "…"
+	}
+	return out
+}
+
+func markTerms(text string, terms []string) string {
+	lower := strings.ToLower(text)
+	if len(lower) != len(text) {
+		return text
+	}
+
+	var b strings.Builder
+	for pos := 0; pos < len(text); {
+		matched := 0
+		for _, term := range terms {
+			if strings.HasPrefix(lower[pos:], term) && len(term) > matched {
+				matched = len(term)
+			}
+		}
+		if matched > 0 {
+			b.WriteString(markStart + text[pos:pos+matched] + markEnd)
+			pos += matched
+			continue
+		}
+		b.WriteByte(text[pos])
+		pos++
+	}
+	return b.String()
+}
+
+// renderMarks escapes indexed text for HTML and turns the match markers into
+// <mark> tags, so clients can render the result without further escaping.
+func renderMarks(s string) string {
+	s = html.EscapeString(s)
+	return strings.NewReplacer(markStart, "<mark>", markEnd, "</mark>").Replace(s)
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
@@ -0,0 +1,246 @@
+package search
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"go-secure-file-management/db"
+	"go-secure-file-management/pdf"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	maxContentLength = 1 << 20  // extracted text kept per file
+	maxExtractSize   = 64 << 20 // larger documents are indexed by name only
+	queueSize        = 256
+
+	// DefaultSweep is how often Run backfills files whose indexing was
+	// dropped because the queue was full.
+	DefaultSweep = 10 * time.Minute
+)
+
+// Indexer keeps the search index in sync with the files table. Indexing a
+// file reads it from disk, so it runs on a background worker fed by Enqueue.
+type Indexer struct {
+	DB *sql.DB
+	// Sweep is how often Run calls Backfill.
+	Sweep time.Duration
+
+	queue   chan int
+	dialect db.Dialect
+	// fts is set when the index is an FTS5 table, see db.FullTextSearch
+	fts bool
+}
+
+// NewIndexer expects the schema to be initialized, see db.Init.
+func NewIndexer(conn *sql.DB) *Indexer {
+	return &Indexer{
+		DB:      conn,
+		Sweep:   DefaultSweep,
+		queue:   make(chan int, queueSize),
+		dialect: db.DialectOf(conn),
+		fts:     db.FullTextSearch(conn),
+	}
+}
+
+// Run processes queued files until ctx is done, and backfills the index
+// every Sweep. Files still queued at the end are dropped: Backfill indexes
+// those that are missing from the index on the next start, updates of
+// indexed ones are lost.
+func (i *Indexer) Run(ctx context.Context) {
+	sweep := i.Sweep
+	if sweep <= 0 {
+		sweep = DefaultSweep
+	}
+	ticker := time.NewTicker(sweep)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := i.Backfill(); err != nil {
+				log.Printf("Failed to backfill search index: %v", err)
+			}
+		case fileId := <-i.queue:
+			if err := i.Index(fileId); err != nil {
+				log.Printf("Failed to index file %d: %v", fileId, err)
+			}
+		}
+	}
+}
+
+// Enqueue schedules a (re-)index of the file, e.g. after upload or rename.
+// It never blocks the request path: when the queue is full the file is
+// dropped, a new one is picked up by the next sweep, an update of an
+// indexed one is lost.
+func (i *Indexer) Enqueue(fileId int) {
+	if !i.enqueue(fileId) {
+		log.Printf("Search index queue full, dropped file %d", fileId)
+	}
+}
+
+func (i *Indexer) enqueue(fileId int) bool {
+	select {
+	case i.queue <- fileId:
+		return true
+	default:
+		return false
+	}
+}
+
+// Backfill queues every file that is missing from the index, so documents
+// uploaded before the index existed become searchable.
+func (i *Indexer) Backfill() error {
+	query := "SELECT id FROM files WHERE id NOT IN (SELECT file_id FROM files_search)"
+	if i.fts {
+		query = "SELECT id FROM files WHERE id NOT IN (SELECT rowid FROM files_fts)"
+	}
+
+	rows, err := i.DB.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// the rest is left for the next sweep
+	dropped := 0
+	for _, id := range ids {
+		if !i.enqueue(id) {
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		log.Printf("Search index queue full, %d of %d files left for the next backfill", dropped, len(ids))
+	}
+	return nil
+}
+
+// Index (re-)builds the index entry of a single file.
+func (i *Indexer) Index(fileId int) error {
+	var path, filename, mimeType, scanStatus string
+	err := i.DB.QueryRow(i.dialect.Rebind("SELECT path, filename, mime_type, scan_status FROM files WHERE id = ?"), fileId).
+		Scan(&path, &filename, &mimeType, &scanStatus)
+	if err == sql.ErrNoRows || scanStatus == "infected" {
+		// deleted before the worker got to it, or quarantined
+		return i.Remove(fileId)
+	}
+	if err != nil {
+		return err
+	}
+
+	// document text is only extracted once the malware scan passed; until
+	// then the file is findable by name and tags
+	content := ""
+	if mimeType == "application/pdf" && scanStatus == "clean" {
+		content, err = extractPDFText(path)
+		if err != nil {
+			log.Printf("Failed to extract text of file %d: %v", fileId, err)
+		}
+	}
+
+	tags, err := i.tags(fileId)
+	if err != nil {
+		return err
+	}
+
+	if i.fts {
+		tx, err := i.DB.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec(i.dialect.Rebind("DELETE FROM files_fts WHERE rowid = ?"), fileId); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(i.dialect.Rebind("INSERT INTO files_fts (rowid, filename, tags, content) VALUES (?, ?, ?, ?)"),
+			fileId, clean(filename), clean(tags), clean(content)); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	_, err = i.DB.Exec(i.dialect.Rebind(`
+		INSERT INTO files_search (file_id, filename, tags, content) VALUES (?, ?, ?, ?)
+		ON CONFLICT (file_id) DO UPDATE SET filename = excluded.filename, tags = excluded.tags, content = excluded.content`),
+		fileId, clean(filename), clean(tags), clean(content))
+	return err
+}
+
+func (i *Indexer) tags(fileId int) (string, error) {
+	rows, err := i.DB.Query(i.dialect.Rebind("SELECT tag FROM file_tags WHERE file_id = ? ORDER BY tag"), fileId)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return "", err
+		}
+		tags = append(tags, tag)
+	}
+
+	return strings.Join(tags, " "), rows.Err()
+}
+
+// Remove drops the file from the index.
+func (i *Indexer) Remove(fileId int) error {
+	query := "DELETE FROM files_search WHERE file_id = ?"
+	if i.fts {
+		query = "DELETE FROM files_fts WHERE rowid = ?"
+	}
+
+	_, err := i.DB.Exec(i.dialect.Rebind(query), fileId)
+	return err
+}
+
+func extractPDFText(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxExtractSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxExtractSize {
+		return "", fmt.Errorf("document larger than %d bytes", maxExtractSize)
+	}
+
+	return pdf.ExtractText(data, maxContentLength)
+}
+
+// clean strips control characters, which are also what the highlighter uses
+// as match markers.
+func clean(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, s)
+}
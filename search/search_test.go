@@ -0,0 +1,67 @@
+package search_test
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"go-secure-file-management/db"
+	"go-secure-file-management/db/dbtest"
+	"go-secure-file-management/models"
+	"go-secure-file-management/repositories"
+	"go-secure-file-management/search"
+)
+
+// A full queue drops files instead of parking a goroutine per file; the
+// sweep indexes them later.
+func TestEnqueueDropsWhenQueueFull(t *testing.T) {
+	conn := dbtest.Migrated(t, db.SQLite)
+	user, err := repositories.NewUserRepository(conn).CreateUser("a@b.co", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileId, err := repositories.NewFileRepository(conn).FinalizeFile(1, models.Files{
+		UserId: user.ID, Path: "uploads/a", Filename: "quarterly report.png", Size: 1, MimeType: "image/png", ScanStatus: "clean",
+	}, 0, func() error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indexer := search.NewIndexer(conn)
+	indexer.Sweep = 50 * time.Millisecond
+
+	goroutines := runtime.NumGoroutine()
+	// files that don't exist, indexing them is a no-op
+	for id := fileId + 1; id <= fileId+300; id++ {
+		indexer.Enqueue(id)
+	}
+	indexer.Enqueue(fileId)
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("%d goroutines after overfilling the queue, %d before", n, goroutines)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		indexer.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		results, err := indexer.Search(uint(user.ID), search.Options{Query: "quarterly"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) == 1 && results[0].ID == fileId {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dropped file not indexed by the sweep, search returned %+v", results)
+		}
+	}
+}
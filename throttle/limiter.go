@@ -0,0 +1,107 @@
+// Package throttle shapes the byte rate of uploads and downloads. Each
+// transfer is limited by the bucket of its user and by a global bucket per
+// direction. Transfers take bytes from the buckets a quantum at a time and
+// buckets hand them out in the order they were asked for, so concurrent
+// transfers sharing a bucket get equal shares of it.
+package throttle
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// burst is how far ahead of its rate a bucket lets a transfer run, e.g.
+	// after being idle.
+	burst = 250 * time.Millisecond
+
+	minQuantum = 1 << 10
+	maxQuantum = 64 << 10
+)
+
+// Limiter is a token bucket over bytes. The zero value is unlimited.
+type Limiter struct {
+	mu sync.Mutex
+	// bytes per second, 0 means unlimited
+	rate int64
+	// when the bytes handed out so far are paid for at rate
+	paidUntil time.Time
+}
+
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter{rate: rate}
+}
+
+func (l *Limiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.rate
+}
+
+// SetRate changes the rate, for transfers already running as well.
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate = rate
+}
+
+// reserve takes n bytes and returns how long to wait before using them.
+func (l *Limiter) reserve(n int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return 0
+	}
+	if l.paidUntil.Before(now) {
+		l.paidUntil = now
+	}
+	l.paidUntil = l.paidUntil.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	return max(l.paidUntil.Sub(now)-burst, 0)
+}
+
+// idle reports whether the limiter has nothing to pay off, so dropping it
+// wouldn't let anyone run ahead.
+func (l *Limiter) idle(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return !l.paidUntil.After(now)
+}
+
+// quantum is how many bytes a transfer takes at a time: small enough that a
+// slow bucket is shared evenly, large enough to keep the overhead low.
+func quantum(limiters ...*Limiter) int {
+	q := maxQuantum
+	for _, l := range limiters {
+		if rate := l.Rate(); rate > 0 {
+			q = min(q, int(max(rate/20, minQuantum)))
+		}
+	}
+	return q
+}
+
+// wait takes n bytes from every limiter and sleeps until all of them can
+// hand them out.
+func wait(ctx context.Context, n int, limiters ...*Limiter) error {
+	now := time.Now()
+	var delay time.Duration
+	for _, l := range limiters {
+		delay = max(delay, l.reserve(n, now))
+	}
+	if delay == 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,280 @@
+package throttle
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Direction string
+
+const (
+	Upload   Direction = "upload"
+	Download Direction = "download"
+)
+
+// sampleInterval and samples set the window the throughput of a transfer
+// is measured over.
+const (
+	sampleInterval = time.Second
+	samples        = 5
+)
+
+type userKey struct {
+	direction Direction
+	userId    uint
+}
+
+// Shaper keeps the buckets and the transfers running through them.
+type Shaper struct {
+	mu        sync.Mutex
+	global    map[Direction]*Limiter
+	users     map[userKey]*Limiter
+	transfers map[int64]*Transfer
+	lastId    int64
+}
+
+// New limits all uploads and all downloads together to the given bytes per
+// second, 0 meaning unlimited.
+func New(upload, download int64) *Shaper {
+	return &Shaper{
+		global: map[Direction]*Limiter{
+			Upload:   NewLimiter(upload),
+			Download: NewLimiter(download),
+		},
+		users:     map[userKey]*Limiter{},
+		transfers: map[int64]*Transfer{},
+	}
+}
+
+// SetGlobal changes the global limits.
+func (s *Shaper) SetGlobal(upload, download int64) {
+	s.global[Upload].SetRate(upload)
+	s.global[Download].SetRate(download)
+}
+
+// Start registers a transfer of a user limited to userRate bytes per second
+// over all of the user's transfers in that direction. Done must be called
+// when it ends.
+func (s *Shaper) Start(direction Direction, userId uint, userRate int64, name string) *Transfer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	// buckets of users without transfers are only kept while they have
+	// bytes to pay off
+	for key, l := range s.users {
+		if s.active(key) == 0 && l.idle(now) {
+			delete(s.users, key)
+		}
+	}
+
+	key := userKey{direction, userId}
+	user, ok := s.users[key]
+	if !ok {
+		user = NewLimiter(userRate)
+		s.users[key] = user
+	} else {
+		// the user's limit may have changed since
+		user.SetRate(userRate)
+	}
+
+	s.lastId++
+	t := &Transfer{
+		shaper:    s,
+		limiters:  []*Limiter{user, s.global[direction]},
+		id:        s.lastId,
+		direction: direction,
+		userId:    userId,
+		name:      name,
+		startedAt: now,
+	}
+	t.samples = append(t.samples, sample{now, 0})
+	s.transfers[t.id] = t
+	return t
+}
+
+func (s *Shaper) active(key userKey) int {
+	n := 0
+	for _, t := range s.transfers {
+		if t.direction == key.direction && t.userId == key.userId {
+			n++
+		}
+	}
+	return n
+}
+
+// Stats describes a running transfer.
+type Stats struct {
+	ID        int64     `json:"id"`
+	Direction Direction `json:"direction"`
+	UserId    uint      `json:"user_id"`
+	Name      string    `json:"name"`
+	StartedAt time.Time `json:"started_at"`
+	Bytes     int64     `json:"bytes"`
+	// BytesPerSecond is the throughput over the last few seconds
+	BytesPerSecond int64 `json:"bytes_per_second"`
+	// UserLimit and GlobalLimit are in bytes per second, 0 is unlimited
+	UserLimit   int64 `json:"user_limit"`
+	GlobalLimit int64 `json:"global_limit"`
+}
+
+// Transfers returns the running transfers, oldest first.
+func (s *Shaper) Transfers() []Stats {
+	s.mu.Lock()
+	transfers := make([]*Transfer, 0, len(s.transfers))
+	for _, t := range s.transfers {
+		transfers = append(transfers, t)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(transfers, func(i, j int) bool { return transfers[i].id < transfers[j].id })
+
+	now := time.Now()
+	stats := make([]Stats, 0, len(transfers))
+	for _, t := range transfers {
+		stats = append(stats, Stats{
+			ID:             t.id,
+			Direction:      t.direction,
+			UserId:         t.userId,
+			Name:           t.Name(),
+			StartedAt:      t.startedAt,
+			Bytes:          t.bytes.Load(),
+			BytesPerSecond: t.throughput(now),
+			UserLimit:      t.limiters[0].Rate(),
+			GlobalLimit:    t.limiters[1].Rate(),
+		})
+	}
+	return stats
+}
+
+type sample struct {
+	at    time.Time
+	bytes int64
+}
+
+// Transfer is one upload or download, see Shaper.Start.
+type Transfer struct {
+	shaper    *Shaper
+	limiters  []*Limiter
+	id        int64
+	direction Direction
+	userId    uint
+	startedAt time.Time
+	bytes     atomic.Int64
+
+	mu      sync.Mutex
+	name    string
+	samples []sample
+}
+
+func (t *Transfer) Name() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.name
+}
+
+// SetName names the transfer for Stats, when the file is only known after
+// it started.
+func (t *Transfer) SetName(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.name = name
+}
+
+// Done unregisters the transfer.
+func (t *Transfer) Done() {
+	t.shaper.mu.Lock()
+	defer t.shaper.mu.Unlock()
+
+	delete(t.shaper.transfers, t.id)
+}
+
+func (t *Transfer) record(n int) {
+	total := t.bytes.Add(int64(n))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(t.samples[len(t.samples)-1].at) >= sampleInterval {
+		t.samples = append(t.samples, sample{now, total})
+		if len(t.samples) > samples {
+			t.samples = t.samples[1:]
+		}
+	}
+}
+
+func (t *Transfer) throughput(now time.Time) int64 {
+	t.mu.Lock()
+	first := t.samples[0]
+	t.mu.Unlock()
+
+	elapsed := now.Sub(first.at)
+	if elapsed <= 0 {
+		return 0
+	}
+	return int64(float64(t.bytes.Load()-first.bytes) / elapsed.Seconds())
+}
+
+// Reader limits reads from r. It stops with ctx's error when ctx is done.
+func (t *Transfer) Reader(ctx context.Context, r io.Reader) io.Reader {
+	return &reader{ctx: ctx, r: r, t: t}
+}
+
+// Writer limits writes to w. It stops with ctx's error when ctx is done.
+func (t *Transfer) Writer(ctx context.Context, w io.Writer) io.Writer {
+	return &writer{ctx: ctx, w: w, t: t}
+}
+
+type reader struct {
+	ctx context.Context
+	r   io.Reader
+	t   *Transfer
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if q := quantum(r.t.limiters...); len(p) > q {
+		p = p[:q]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.t.record(n)
+		// paid after the fact, the bytes are only known once read
+		if waitErr := wait(r.ctx, n, r.t.limiters...); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+type writer struct {
+	ctx context.Context
+	w   io.Writer
+	t   *Transfer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if q := quantum(w.t.limiters...); len(chunk) > q {
+			chunk = chunk[:q]
+		}
+		if err := wait(w.ctx, len(chunk), w.t.limiters...); err != nil {
+			return written, err
+		}
+		n, err := w.w.Write(chunk)
+		written += n
+		w.t.record(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
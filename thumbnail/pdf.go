@@ -0,0 +1,131 @@
+package thumbnail
+
+import (
+	"go-secure-file-management/pdf"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	// A4 proportions at the largest thumbnail size
+	pageWidth  = 512
+	pageHeight = 724
+	pageMargin = 24
+
+	maxPDFSize    = 64 << 20
+	maxPreviewLen = 8 << 10
+)
+
+var (
+	pageBorder = color.Gray{Y: 0xC8}
+	textColor  = color.Gray{Y: 0x40}
+	badgeColor = color.RGBA{R: 0xD3, G: 0x2F, B: 0x2F, A: 0xFF}
+)
+
+// renderPDF draws a placeholder page: there is no pure-Go PDF rasterizer,
+// so the preview shows the beginning of the extracted text instead of the
+// real first page, with a PDF badge. Documents without extractable text get
+// an empty page.
+func renderPDF(f *os.File) (image.Image, error) {
+	data, err := io.ReadAll(io.LimitReader(f, maxPDFSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if !pdf.IsPDF(data) {
+		return nil, pdf.ErrNotPDF
+	}
+
+	text := ""
+	if len(data) <= maxPDFSize {
+		// the text is a nicety, a document we can't read still gets a page
+		text, _ = pdf.ExtractText(data, maxPreviewLen)
+	}
+
+	page := image.NewRGBA(image.Rect(0, 0, pageWidth, pageHeight))
+	draw.Draw(page, page.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	drawBorder(page, pageBorder)
+
+	face := basicfont.Face7x13
+	d := &font.Drawer{Dst: page, Src: image.NewUniform(textColor), Face: face}
+	lineHeight := face.Metrics().Height.Ceil()
+	maxChars := (pageWidth - 2*pageMargin) / face.Advance
+	y := pageMargin + lineHeight
+
+	for _, line := range wrap(text, maxChars) {
+		if y > pageHeight-pageMargin-2*lineHeight {
+			break
+		}
+		d.Dot = fixed.P(pageMargin, y)
+		d.DrawString(line)
+		y += lineHeight
+	}
+
+	// badge in the bottom right corner
+	badge := image.Rect(pageWidth-pageMargin-48, pageHeight-pageMargin-24, pageWidth-pageMargin, pageHeight-pageMargin)
+	draw.Draw(page, badge, image.NewUniform(badgeColor), image.Point{}, draw.Src)
+	d.Src = image.NewUniform(color.White)
+	d.Dot = fixed.P(badge.Min.X+(badge.Dx()-3*face.Advance)/2, badge.Max.Y-7)
+	d.DrawString("PDF")
+
+	return page, nil
+}
+
+func drawBorder(img *image.RGBA, c color.Color) {
+	b := img.Bounds()
+	for x := b.Min.X; x < b.Max.X; x++ {
+		img.Set(x, b.Min.Y, c)
+		img.Set(x, b.Max.Y-1, c)
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		img.Set(b.Min.X, y, c)
+		img.Set(b.Max.X-1, y, c)
+	}
+}
+
+// wrap breaks text into lines of at most width characters. The bitmap font
+// only covers Latin-1, other characters are replaced.
+func wrap(text string, width int) []string {
+	var lines []string
+	var line strings.Builder
+
+	for _, word := range strings.Fields(text) {
+		word = strings.Map(func(r rune) rune {
+			if r > 0xFF {
+				return '?'
+			}
+			return r
+		}, word)
+
+		for len([]rune(word)) > width {
+			runes := []rune(word)
+			if line.Len() > 0 {
+				lines = append(lines, line.String())
+				line.Reset()
+			}
+			lines = append(lines, string(runes[:width]))
+			word = string(runes[width:])
+		}
+
+		if line.Len() > 0 && len([]rune(line.String()))+1+len([]rune(word)) > width {
+			lines = append(lines, line.String())
+			line.Reset()
+		}
+		if line.Len() > 0 {
+			line.WriteByte(' ')
+		}
+		line.WriteString(word)
+	}
+	if line.Len() > 0 {
+		lines = append(lines, line.String())
+	}
+
+	return lines
+}
@@ -0,0 +1,175 @@
+package thumbnail
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// Sizes maps the size names accepted by the API to the length of the longer
+// edge in pixels. Images are never scaled up.
+var Sizes = map[string]int{
+	"small":  128,
+	"medium": 256,
+	"large":  512,
+}
+
+const DefaultSize = "medium"
+
+// SizeNames lists the size names from smallest to largest.
+func SizeNames() []string {
+	names := make([]string, 0, len(Sizes))
+	for name := range Sizes {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return Sizes[names[i]] < Sizes[names[j]] })
+	return names
+}
+
+const (
+	jpegQuality = 80
+
+	// images are fully decoded to scale them; larger sources are refused
+	// (uploads have been checked against the policy's limit by then)
+	maxSourcePixels = 50_000_000
+)
+
+var ErrUnsupported = errors.New("no thumbnail available for this file type")
+
+// Supported reports whether thumbnails can be generated for mimeType.
+func Supported(mimeType string) bool {
+	switch mimeType {
+	case "image/png", "image/jpeg", "application/pdf":
+		return true
+	}
+	return false
+}
+
+// Path returns where the thumbnail of the given size is stored, next to
+// the original.
+func Path(original, size string) string {
+	return original + ".thumb_" + size + ".jpg"
+}
+
+// Original returns the file a thumbnail path belongs to, and false if path
+// isn't a thumbnail.
+func Original(path string) (string, bool) {
+	for size := range Sizes {
+		if original, ok := strings.CutSuffix(path, ".thumb_"+size+".jpg"); ok {
+			return original, true
+		}
+	}
+	return "", false
+}
+
+// Generate renders the thumbnails of every size for the file at path,
+// replacing existing ones.
+func Generate(path, mimeType string) error {
+	src, orientation, err := load(path, mimeType)
+	if err != nil {
+		return err
+	}
+
+	for size, edge := range Sizes {
+		// rotating after scaling is much cheaper than rotating the source
+		if err := writeJPEG(Path(path, size), orient(fit(src, edge), orientation)); err != nil {
+			return fmt.Errorf("failed to write %s thumbnail: %v", size, err)
+		}
+	}
+	return nil
+}
+
+// Remove deletes the thumbnails of the file at path, if there are any.
+func Remove(path string) {
+	for size := range Sizes {
+		os.Remove(Path(path, size))
+	}
+}
+
+// load decodes the source image together with its EXIF orientation.
+func load(path, mimeType string) (image.Image, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	switch mimeType {
+	case "image/png":
+		img, err := decode(f, png.DecodeConfig, png.Decode)
+		return img, orientationNormal, err
+	case "image/jpeg":
+		orientation := readOrientation(f)
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, 0, err
+		}
+		img, err := decode(f, jpeg.DecodeConfig, jpeg.Decode)
+		return img, orientation, err
+	case "application/pdf":
+		img, err := renderPDF(f)
+		return img, orientationNormal, err
+	}
+
+	return nil, 0, ErrUnsupported
+}
+
+func decode(f *os.File, decodeConfig func(io.Reader) (image.Config, error), decodeImage func(io.Reader) (image.Image, error)) (image.Image, error) {
+	cfg, err := decodeConfig(f)
+	if err != nil {
+		return nil, err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxSourcePixels {
+		return nil, fmt.Errorf("image of %dx%d pixels is too large for a thumbnail", cfg.Width, cfg.Height)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return decodeImage(f)
+}
+
+// fit scales src down so its longer edge is at most edge pixels. The result
+// is flattened onto white since JPEG has no transparency.
+func fit(src image.Image, edge int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if longer := max(w, h); longer > edge {
+		w = max(w*edge/longer, 1)
+		h = max(h*edge/longer, 1)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.BiLinear.Scale(dst, dst.Bounds(), src, b, draw.Over, nil)
+	return dst
+}
+
+// writeJPEG writes through a temporary file so a half-written thumbnail is
+// never served.
+func writeJPEG(path string, img image.Image) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".thumb-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := jpeg.Encode(tmp, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// MaxFilenameLength is the limit of display names in bytes, that of most
+// file systems.
+const MaxFilenameLength = 255
+
+var ErrInvalidFilename = errors.New("filename is empty or only made of characters that aren't allowed")
+
+// reservedNames can't be used as file names on Windows, with any extension.
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizeFilename turns a client supplied name into a display name: the
+// last path element, NFC normalized, without control and bidi override
+// characters, with characters Windows doesn't allow replaced by '_', and
+// at most MaxFilenameLength bytes with the extension kept. Display names
+// are never used as storage paths, this only keeps them harmless when
+// shown or saved by a client.
+func SanitizeFilename(name string) (string, error) {
+	name = strings.ToValidUTF8(name, "_")
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r), unicode.Is(unicode.Bidi_Control, r), r == '\uFEFF':
+			return -1
+		case strings.ContainsRune(`<>:"|?*`, r):
+			return '_'
+		case unicode.IsSpace(r):
+			return ' '
+		}
+		return r
+	}, name)
+	// after the removal, which can bring a letter and its accent together
+	name = norm.NFC.String(name)
+
+	// Windows drops trailing dots and spaces
+	name = strings.TrimRight(strings.TrimSpace(name), ". ")
+	if name == "" || strings.Trim(name, ".") == "" {
+		return "", ErrInvalidFilename
+	}
+
+	stem, _, _ := strings.Cut(name, ".")
+	if reservedNames[strings.ToUpper(strings.TrimSpace(stem))] {
+		name = "_" + name
+	}
+
+	return truncateFilename(name, MaxFilenameLength), nil
+}
+
+// truncateFilename shortens the part before the extension to fit limit
+// bytes, without splitting a character.
+func truncateFilename(name string, limit int) string {
+	if len(name) <= limit {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	if len(ext) > limit/2 {
+		ext = ""
+	}
+	stem := name[:len(name)-len(ext)]
+	cut := limit - len(ext)
+	for cut > 0 && !utf8.RuneStart(stem[cut]) {
+		cut--
+	}
+	return strings.TrimRight(stem[:cut], ". ") + ext
+}
+
+// ContentDisposition builds an attachment header for name as RFC 6266
+// describes: an ASCII-only filename for old clients, and the exact name
+// as RFC 5987 encoded filename*.
+func ContentDisposition(name string) string {
+	var fallback strings.Builder
+	for _, r := range name {
+		if r < 0x20 || r >= 0x7f || r == '"' || r == '\\' || r == '%' {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(r)
+		}
+	}
+
+	var encoded strings.Builder
+	for _, b := range []byte(name) {
+		if b < 0x80 && (isAlphaNum(b) || strings.IndexByte("!#$&+-.^_`|~", b) >= 0) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, fallback.String(), encoded.String())
+}
+
+func isAlphaNum(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9'
+}
+
+// NewStorageName returns a random name for a stored file. Nothing of the
+// client's name goes into it, so it can't escape the upload directory or
+// collide with another file.
+func NewStorageName() (string, error) {
+	var random [16]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random[:]), nil
+}
@@ -0,0 +1,109 @@
+package utils_test
+
+import (
+	"mime"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+
+	"go-secure-file-management/utils"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var filenameSeeds = []string{
+	"report.pdf",
+	"../../main.go",
+	`..\..\windows\system32\cmd.exe`,
+	"/etc/passwd",
+	"CON.txt",
+	"lpt1",
+	"invoice\u202efdp.exe",
+	"été.png",
+	"tab\there\nnewline.txt",
+	"a<b>c:d\"e|f?g*.txt",
+	"...",
+	"trailing. . .",
+	"\xff\xfe.txt",
+	strings.Repeat("日本語", 100) + ".jpeg",
+	strings.Repeat("x", 300),
+}
+
+func FuzzSanitizeFilename(f *testing.F) {
+	for _, seed := range filenameSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		clean, err := utils.SanitizeFilename(name)
+		if err != nil {
+			return
+		}
+
+		if !utf8.ValidString(clean) || !norm.NFC.IsNormalString(clean) {
+			t.Errorf("%q: %q isn't NFC normalized UTF-8", name, clean)
+		}
+		if clean == "" || len(clean) > utils.MaxFilenameLength {
+			t.Errorf("%q: %q is empty or longer than %d bytes", name, clean, utils.MaxFilenameLength)
+		}
+		if strings.ContainsAny(clean, `/\<>:"|?*`) || filepath.Base(clean) != clean || strings.Trim(clean, ".") == "" {
+			t.Errorf("%q: %q is a path or has characters Windows doesn't allow", name, clean)
+		}
+		for _, r := range clean {
+			if unicode.IsControl(r) || unicode.Is(unicode.Bidi_Control, r) || r == '\uFEFF' {
+				t.Errorf("%q: %q contains %U", name, clean, r)
+			}
+		}
+		if strings.HasSuffix(clean, ".") || strings.HasSuffix(clean, " ") || strings.HasPrefix(clean, " ") {
+			t.Errorf("%q: %q starts or ends with a space or dot", name, clean)
+		}
+
+		again, err := utils.SanitizeFilename(clean)
+		if err != nil || again != clean {
+			t.Errorf("%q: sanitizing %q again gives %q, %v", name, clean, again, err)
+		}
+	})
+}
+
+func FuzzContentDisposition(f *testing.F) {
+	for _, seed := range filenameSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, name string) {
+		clean, err := utils.SanitizeFilename(name)
+		if err != nil {
+			return
+		}
+
+		header := utils.ContentDisposition(clean)
+		for i := 0; i < len(header); i++ {
+			if header[i] < 0x20 || header[i] >= 0x7f {
+				t.Fatalf("%q: header %q isn't printable ASCII", clean, header)
+			}
+		}
+
+		disposition, params, err := mime.ParseMediaType(header)
+		if err != nil {
+			t.Fatalf("%q: header %q doesn't parse: %v", clean, header, err)
+		}
+		// mime decodes filename* into filename
+		if disposition != "attachment" || params["filename"] != clean {
+			t.Errorf("%q: header %q parses as %s with filename %q", clean, header, disposition, params["filename"])
+		}
+	})
+}
+
+func TestNewStorageName(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		name, err := utils.NewStorageName()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(name) != 32 || strings.Trim(name, "0123456789abcdef") != "" || seen[name] {
+			t.Fatalf("storage name %q isn't 32 fresh hex digits", name)
+		}
+		seen[name] = true
+	}
+}
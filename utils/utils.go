@@ -1,12 +1,12 @@
 package utils
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"time"
 
@@ -14,18 +14,25 @@ import (
 	"github.com/h2non/filetype"
 )
 
+const DefaultRole = "user"
+
 type Claims struct {
 	UserID uint   `json:"user_id"`
 	Email  string `json:"email"`
+	Role   string `json:"role"`
 	jwt.RegisteredClaims
 }
 
-var JWTSecret = []byte(os.Getenv("JWT_SECRET")) // need to update
+var ErrUnknownType = errors.New("unknown type")
+
+// JWTSecret signs the tokens, set from the config by routes.SetupRouter.
+var JWTSecret []byte
 
-func GenerateJWT(userId uint, email string) (string, error) {
+func GenerateJWT(userId uint, email string, role string) (string, error) {
 	claims := Claims{
 		UserID: userId,
 		Email:  email,
+		Role:   role,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)), // Token expiration
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -53,6 +60,11 @@ func ValidateJWT(tokenString string) (*Claims, error) {
 		return nil, errors.New("invalid token")
 	}
 
+	// tokens issued before roles existed
+	if claims.Role == "" {
+		claims.Role = DefaultRole
+	}
+
 	return claims, nil
 }
 
@@ -67,40 +79,32 @@ func GetMimeType(file multipart.File) (string, error) {
 	// Detect the file type
 	kind, _ := filetype.Match(header)
 	if kind == filetype.Unknown {
-		return "", fmt.Errorf("unknown type")
+		return "", ErrUnknownType
 	}
 
 	return kind.MIME.Value, nil
 }
 
-func ScanFileWithClamav(filePath string) (bool, error) {
-	absolutePath, err := filepath.Abs(filePath)
-	if err != nil {
-		fmt.Println("Error getting absolute path:", err)
-		return false, err
-	}
+// QuarantineDir is outside ./uploads, which is served statically.
+const QuarantineDir = "./quarantine"
 
-	cmd := exec.Command("clamdscan", "--no-summary", filePath)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return false, err
+// QuarantineFile moves a rejected file out of the upload area into
+// QuarantineDir and writes report next to it as JSON, for later review.
+// It returns the new path.
+func QuarantineFile(path string, report interface{}) (string, error) {
+	if err := os.MkdirAll(QuarantineDir, 0o700); err != nil {
+		return "", err
 	}
 
-	if string(output) == "" || string(output) == fmt.Sprintf("%s: OK\n", absolutePath) {
-		return true, nil // clean
-	} else {
-		return false, nil // infected
+	target := filepath.Join(QuarantineDir, fmt.Sprintf("%d_%s", time.Now().UnixNano(), filepath.Base(path)))
+	if err := os.Rename(path, target); err != nil {
+		return "", err
 	}
-}
-
-func GetUniqueFilePath(basePath string) string {
-	ext := filepath.Ext(basePath)
-	name := basePath[:len(basePath)-len(ext)]
 
-	if _, err := os.Stat(basePath); os.IsNotExist(err) {
-		return basePath // return original path
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return target, err
 	}
 
-	timestampedPath := fmt.Sprintf("%s_%d%s", name, time.Now().Unix(), ext)
-	return timestampedPath
+	return target, os.WriteFile(target+".json", data, 0o600)
 }
@@ -0,0 +1,217 @@
+package validate
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go-secure-file-management/policy"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// PNG walks the chunk structure (checking CRCs and that nothing follows
+// IEND), checks the dimensions from IHDR against the limits and only then
+// fully decodes the image, so a small file can't expand into gigabytes.
+func PNG(f *os.File, rules policy.Validation) (*policy.Violation, error) {
+	if v, err := walkPNG(f); v != nil || err != nil {
+		return v, err
+	}
+
+	return decodeImage(f, "image/png", rules, png.DecodeConfig, png.Decode)
+}
+
+func walkPNG(f *os.File) (*policy.Violation, error) {
+	r := bufio.NewReader(f)
+
+	signature := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, signature); err != nil || !bytes.Equal(signature, pngSignature) {
+		return invalid("image/png", "missing PNG signature"), nil
+	}
+
+	header := make([]byte, 8)
+	for first := true; ; first = false {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return invalid("image/png", "truncated PNG: no IEND chunk"), nil
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		chunkType := string(header[4:8])
+
+		if first && chunkType != "IHDR" {
+			return invalid("image/png", "PNG doesn't start with IHDR"), nil
+		}
+		if length > 1<<31-1 {
+			return invalid("image/png", "invalid PNG chunk length"), nil
+		}
+
+		crc := crc32.NewIEEE()
+		crc.Write(header[4:8])
+		if _, err := io.CopyN(crc, r, int64(length)); err != nil {
+			return invalid("image/png", fmt.Sprintf("truncated PNG chunk %q", chunkType)), nil
+		}
+
+		sum := make([]byte, 4)
+		if _, err := io.ReadFull(r, sum); err != nil {
+			return invalid("image/png", fmt.Sprintf("truncated PNG chunk %q", chunkType)), nil
+		}
+		if binary.BigEndian.Uint32(sum) != crc.Sum32() {
+			return invalid("image/png", fmt.Sprintf("bad CRC in PNG chunk %q", chunkType)), nil
+		}
+
+		if chunkType == "IEND" {
+			break
+		}
+	}
+
+	return checkTrailingData(r, "image/png")
+}
+
+// JPEG walks the marker segments up to EOI, checks that nothing but padding
+// follows, then checks the dimensions and fully decodes the image.
+func JPEG(f *os.File, rules policy.Validation) (*policy.Violation, error) {
+	if v, err := walkJPEG(f); v != nil || err != nil {
+		return v, err
+	}
+
+	return decodeImage(f, "image/jpeg", rules, jpeg.DecodeConfig, jpeg.Decode)
+}
+
+func walkJPEG(f *os.File) (*policy.Violation, error) {
+	r := bufio.NewReader(f)
+
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(r, soi); err != nil || soi[0] != 0xFF || soi[1] != 0xD8 {
+		return invalid("image/jpeg", "missing JPEG start of image marker"), nil
+	}
+
+	truncated := invalid("image/jpeg", "truncated JPEG: no end of image marker")
+	// set when scanning entropy-coded data already consumed the 0xFF of
+	// the next marker
+	markerStarted := false
+	for {
+		if !markerStarted {
+			b, err := r.ReadByte()
+			if err != nil {
+				return truncated, nil
+			}
+			if b != 0xFF {
+				return invalid("image/jpeg", "invalid JPEG marker"), nil
+			}
+		}
+		markerStarted = false
+
+		marker, err := r.ReadByte()
+		for err == nil && marker == 0xFF { // fill bytes
+			marker, err = r.ReadByte()
+		}
+		if err != nil {
+			return truncated, nil
+		}
+
+		switch {
+		case marker == 0xD9: // EOI
+			return checkTrailingData(r, "image/jpeg")
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7): // no payload
+			continue
+		}
+
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil || length < 2 {
+			return truncated, nil
+		}
+		if _, err := r.Discard(int(length) - 2); err != nil {
+			return truncated, nil
+		}
+
+		if marker == 0xDA { // SOS: skip entropy-coded data up to the next real marker
+			for {
+				b, err := r.ReadByte()
+				if err != nil {
+					return truncated, nil
+				}
+				if b != 0xFF {
+					continue
+				}
+				next, err := r.Peek(1)
+				if err != nil {
+					return truncated, nil
+				}
+				if next[0] == 0x00 || (next[0] >= 0xD0 && next[0] <= 0xD7) {
+					r.ReadByte()
+					continue
+				}
+				if next[0] == 0xFF {
+					continue
+				}
+				markerStarted = true
+				break
+			}
+		}
+	}
+}
+
+func decodeImage(
+	f *os.File,
+	mimeType string,
+	rules policy.Validation,
+	decodeConfig func(io.Reader) (image.Config, error),
+	decode func(io.Reader) (image.Image, error),
+) (*policy.Violation, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	config, err := decodeConfig(bufio.NewReader(f))
+	if err != nil {
+		return invalid(mimeType, "failed to read image header: "+err.Error()), nil
+	}
+
+	pixels := int64(config.Width) * int64(config.Height)
+	if config.Width > rules.MaxWidth || config.Height > rules.MaxHeight || pixels > rules.MaxPixels {
+		return &policy.Violation{
+			Code:     policy.CodeImageTooLarge,
+			Message:  fmt.Sprintf("image of %dx%d pixels exceeds the limits (%dx%d, %d pixels)", config.Width, config.Height, rules.MaxWidth, rules.MaxHeight, rules.MaxPixels),
+			MimeType: mimeType,
+			Limit:    rules.MaxPixels,
+		}, nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := decode(bufio.NewReader(f)); err != nil {
+		return invalid(mimeType, "failed to decode image: "+err.Error()), nil
+	}
+
+	return nil, nil
+}
+
+// checkTrailingData rejects anything other than zero or whitespace padding
+// after the end marker. Some encoders pad, but real data after the image is
+// how polyglot files smuggle a second format.
+func checkTrailingData(r *bufio.Reader, mimeType string) (*policy.Violation, error) {
+	for {
+		b, err := r.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch b {
+		case 0x00, ' ', '\t', '\r', '\n':
+			continue
+		}
+		return &policy.Violation{
+			Code:     policy.CodeTrailingData,
+			Message:  "file contains data after the end of the image",
+			MimeType: mimeType,
+		}, nil
+	}
+}
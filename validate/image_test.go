@@ -0,0 +1,155 @@
+package validate_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go-secure-file-management/policy"
+	"go-secure-file-management/validate"
+)
+
+// check writes content to a file and validates it as mimeType, returning
+// the violation's code and message.
+func check(t *testing.T, content []byte, mimeType string, rules policy.Validation) (string, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	v, err := validate.File(path, mimeType, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v == nil {
+		return "", ""
+	}
+	return v.Code, v.Message
+}
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 48; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 5), 128, 255})
+		}
+	}
+	return img
+}
+
+func encodePNG(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeJPEG(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// edit returns a copy of b changed by f.
+func edit(b []byte, f func([]byte) []byte) []byte {
+	return f(append([]byte{}, b...))
+}
+
+// appended returns a copy of b followed by suffix.
+func appended(b []byte, suffix string) []byte {
+	return append(append([]byte{}, b...), suffix...)
+}
+
+type imageCase struct {
+	name    string
+	content []byte
+	code    string
+	message string // part of the message, if it matters
+}
+
+func runImageCases(t *testing.T, mimeType string, cases []imageCase) {
+	t.Helper()
+
+	for _, tc := range cases {
+		code, message := check(t, tc.content, mimeType, policy.Default().Validation)
+		if code != tc.code || !strings.Contains(message, tc.message) {
+			t.Errorf("%s: %q (%s), want %q (%s)", tc.name, code, message, tc.code, tc.message)
+		}
+	}
+}
+
+func TestPNG(t *testing.T) {
+	valid := encodePNG(t)
+	// signature, IHDR length and type, 13 bytes of IHDR data, then its CRC
+	ihdrCRC := 8 + 8 + 13
+
+	runImageCases(t, "image/png", []imageCase{
+		{"valid", valid, "", ""},
+		{"padded", appended(valid, "\r\n\x00\x00"), "", ""},
+		{"empty", nil, policy.CodeInvalidContent, "signature"},
+		{"not a PNG", encodeJPEG(t), policy.CodeInvalidContent, "signature"},
+		{"truncated in a chunk", valid[:len(valid)/2], policy.CodeInvalidContent, "truncated"},
+		{"truncated before IEND", valid[:len(valid)-12], policy.CodeInvalidContent, "no IEND"},
+		{"bad CRC", edit(valid, func(b []byte) []byte { b[ihdrCRC] ^= 0xFF; return b }), policy.CodeInvalidContent, `bad CRC in PNG chunk "IHDR"`},
+		{"bad CRC of image data", edit(valid, func(b []byte) []byte { b[bytes.Index(b, []byte("IDAT"))+6] ^= 0xFF; return b }), policy.CodeInvalidContent, `"IDAT"`},
+		{"huge chunk length", edit(valid, func(b []byte) []byte { copy(b[8:12], "\xff\xff\xff\xff"); return b }), policy.CodeInvalidContent, "length"},
+		{"trailing data", appended(valid, "PK\x03\x04"), policy.CodeTrailingData, ""},
+		{"trailing data after padding", appended(valid, "\n\n<?php"), policy.CodeTrailingData, ""},
+	})
+}
+
+func TestJPEG(t *testing.T) {
+	valid := encodeJPEG(t)
+
+	runImageCases(t, "image/jpeg", []imageCase{
+		{"valid", valid, "", ""},
+		{"padded", appended(valid, " \x00\n"), "", ""},
+		{"empty", nil, policy.CodeInvalidContent, "start of image"},
+		{"not a JPEG", encodePNG(t), policy.CodeInvalidContent, "start of image"},
+		{"truncated in the header", valid[:100], policy.CodeInvalidContent, "truncated"},
+		{"truncated in the image data", valid[:len(valid)-100], policy.CodeInvalidContent, "truncated"},
+		{"truncated before EOI", valid[:len(valid)-2], policy.CodeInvalidContent, "truncated"},
+		// JPEG has no checksums; a corrupt segment length runs past the end
+		{"bad segment length", edit(valid, func(b []byte) []byte { copy(b[4:6], "\xff\xf0"); return b }), policy.CodeInvalidContent, ""},
+		{"garbage between segments", edit(valid, func(b []byte) []byte { b[2] = 0x00; return b }), policy.CodeInvalidContent, "marker"},
+		{"trailing data", appended(valid, "%PDF-1.7"), policy.CodeTrailingData, ""},
+		{"second image appended", appended(valid, string(valid)), policy.CodeTrailingData, ""},
+	})
+}
+
+func TestImageDimensionLimits(t *testing.T) {
+	rules := policy.Default().Validation
+
+	for _, tc := range []struct {
+		name   string
+		change func(*policy.Validation)
+		code   string
+	}{
+		{"within the limits", func(*policy.Validation) {}, ""},
+		{"too wide", func(r *policy.Validation) { r.MaxWidth = 63 }, policy.CodeImageTooLarge},
+		{"too high", func(r *policy.Validation) { r.MaxHeight = 47 }, policy.CodeImageTooLarge},
+		{"too many pixels", func(r *policy.Validation) { r.MaxPixels = 64*48 - 1 }, policy.CodeImageTooLarge},
+	} {
+		r := rules
+		tc.change(&r)
+		for mimeType, content := range map[string][]byte{"image/png": encodePNG(t), "image/jpeg": encodeJPEG(t)} {
+			if code, message := check(t, content, mimeType, r); code != tc.code {
+				t.Errorf("%s %s: %q (%s), want %q", mimeType, tc.name, code, message, tc.code)
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package validate
+
+import (
+	"fmt"
+	"go-secure-file-management/pdf"
+	"go-secure-file-management/policy"
+	"io"
+	"os"
+)
+
+// PDF parses the document and flags active content: JavaScript, embedded
+// files, launch actions and encryption (which would hide the rest from us).
+func PDF(f *os.File, rules policy.Validation) (*policy.Violation, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > rules.MaxPDFSize {
+		return &policy.Violation{
+			Code:     policy.CodeTooLargeToInspect,
+			Message:  fmt.Sprintf("PDF larger than %d bytes can't be inspected", rules.MaxPDFSize),
+			MimeType: "application/pdf",
+			Limit:    rules.MaxPDFSize,
+		}, nil
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	features, err := pdf.Scan(data)
+	if err != nil {
+		return invalid("application/pdf", err.Error()), nil
+	}
+
+	violation := func(code, message string) *policy.Violation {
+		return &policy.Violation{Code: code, Message: message, MimeType: "application/pdf"}
+	}
+
+	switch {
+	case !features.HasEOF:
+		return invalid("application/pdf", "truncated PDF: no %%EOF marker"), nil
+	case features.Launch:
+		return violation(policy.CodePDFLaunchAction, "PDF contains a launch action"), nil
+	case features.JavaScript && !rules.AllowPDFJavaScript:
+		return violation(policy.CodePDFJavaScript, "PDF contains JavaScript"), nil
+	case features.EmbeddedFiles && !rules.AllowPDFEmbeddedFiles:
+		return violation(policy.CodePDFEmbeddedFile, "PDF contains embedded files"), nil
+	case features.Encrypted && !rules.AllowPDFEncryption:
+		return violation(policy.CodePDFEncrypted, "PDF is encrypted"), nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,45 @@
+package validate_test
+
+import (
+	"testing"
+
+	"go-secure-file-management/policy"
+)
+
+const (
+	plainPDF      = "%PDF-1.7\n1 0 obj\n<< /Type /Catalog >>\nendobj\ntrailer\n<< /Root 1 0 R >>\n%%EOF\n"
+	javaScriptPDF = "%PDF-1.7\n1 0 obj\n<< /Type /Catalog /OpenAction << /S /J#61vaScript /JS (app.alert(1)) >> >>\nendobj\n%%EOF\n"
+	launchPDF     = "%PDF-1.7\n1 0 obj\n<< /OpenAction << /S /Launch /JS (x) >> >>\nendobj\n%%EOF\n"
+	embeddedPDF   = "%PDF-1.7\n1 0 obj\n<< /Names << /EmbeddedFiles 2 0 R >> >>\nendobj\n%%EOF\n"
+	encryptedPDF  = "%PDF-1.7\n1 0 obj\n<< >>\nendobj\ntrailer\n<< /Encrypt 2 0 R >>\n%%EOF\n"
+)
+
+func TestPDF(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		change  func(*policy.Validation)
+		code    string
+	}{
+		{"plain", plainPDF, nil, ""},
+		{"not a PDF", "GIF89a", nil, policy.CodeInvalidContent},
+		{"truncated", plainPDF[:40], nil, policy.CodeInvalidContent},
+		{"JavaScript", javaScriptPDF, nil, policy.CodePDFJavaScript},
+		{"JavaScript allowed", javaScriptPDF, func(r *policy.Validation) { r.AllowPDFJavaScript = true }, ""},
+		// launch actions are never allowed, and reported over JavaScript
+		{"launch", launchPDF, func(r *policy.Validation) { r.AllowPDFJavaScript = true }, policy.CodePDFLaunchAction},
+		{"embedded file", embeddedPDF, nil, policy.CodePDFEmbeddedFile},
+		{"embedded file allowed", embeddedPDF, func(r *policy.Validation) { r.AllowPDFEmbeddedFiles = true }, ""},
+		{"encrypted", encryptedPDF, nil, policy.CodePDFEncrypted},
+		{"encryption allowed", encryptedPDF, func(r *policy.Validation) { r.AllowPDFEncryption = true }, ""},
+		{"too large to inspect", plainPDF, func(r *policy.Validation) { r.MaxPDFSize = 10 }, policy.CodeTooLargeToInspect},
+	} {
+		rules := policy.Default().Validation
+		if tc.change != nil {
+			tc.change(&rules)
+		}
+		if code, message := check(t, []byte(tc.content), "application/pdf", rules); code != tc.code {
+			t.Errorf("%s: %q (%s), want %q", tc.name, code, message, tc.code)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package validate
+
+import (
+	"go-secure-file-management/policy"
+	"os"
+)
+
+// File runs the structural validator for mimeType on the file at path. It
+// returns a violation when the content is malformed or uses features the
+// policy forbids, and an error only when the file can't be read. Types
+// without a validator pass.
+func File(path, mimeType string, rules policy.Validation) (*policy.Violation, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch mimeType {
+	case "image/png":
+		return PNG(f, rules)
+	case "image/jpeg":
+		return JPEG(f, rules)
+	case "application/pdf":
+		return PDF(f, rules)
+	}
+
+	return nil, nil
+}
+
+func invalid(mimeType, message string) *policy.Violation {
+	return &policy.Violation{
+		Code:     policy.CodeInvalidContent,
+		Message:  message,
+		MimeType: mimeType,
+	}
+}